@@ -0,0 +1,456 @@
+// Package agent runs builds assigned by a container-factory server, so a hierarchy can be built across several hosts
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+const (
+	// Time between attempts to reach the server after a failure
+	retryInterval = 5 * time.Second
+	// Time given to the server to requeue the tasks of a stopping agent
+	deregisterTimeout = 10 * time.Second
+
+	errorCodeAgentNotFound = "agent_not_found"
+)
+
+// errUnknownAgent is returned when the server no longer knows the agent, i.e. after it was considered gone or the server restarted
+var errUnknownAgent = errors.New("Server does not know this agent")
+
+var logger = logrus.New()
+
+// Options configures an agent
+type Options struct {
+	ServerURL string
+	Token     string
+	Name      string
+	// Platform the agent builds for, i.e. linux/amd64
+	Platform string
+	// Number of tasks run at once
+	Capacity int
+	// Directory build sources are unpacked in
+	WorkDirectory string
+	Version       string
+}
+
+type buildAgent struct {
+	options Options
+	client  *http.Client
+	sources *sourceCache
+
+	mutex sync.Mutex
+	id    string
+	// Interval between heartbeats requested by the server
+	heartbeatInterval time.Duration
+	// Cancels each running task, by task ID
+	running map[string]context.CancelFunc
+}
+
+// SetLogger allows overriding the default logger
+func SetLogger(l *logrus.Logger) {
+	logger = l
+}
+
+// Run registers with the server and runs the tasks it assigns until ctx is cancelled
+// Running tasks are cancelled on return and the server reassigns them to other agents
+func Run(ctx context.Context, options Options) error {
+	if options.ServerURL == "" {
+		return errors.New("Server URL is required")
+	}
+	if options.Capacity < 1 {
+		return errors.New("Capacity must be at least 1")
+	}
+	a := &buildAgent{
+		options: options,
+		// No timeout; polls, source downloads and log streams are bounded by the server
+		client:  &http.Client{},
+		sources: newSourceCache(options.WorkDirectory),
+		running: map[string]context.CancelFunc{},
+	}
+	a.options.ServerURL = strings.TrimRight(options.ServerURL, "/")
+	defer a.sources.clear()
+
+	if err := a.register(ctx, ""); err != nil {
+		// Interrupted before the server could be reached
+		return nil
+	}
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		a.sendHeartbeats(ctx)
+	}()
+	for i := 0; i < options.Capacity; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			a.runTasks(ctx)
+		}()
+	}
+	waitGroup.Wait()
+
+	a.deregister()
+	return nil
+}
+
+// register announces the agent to the server, retrying until it succeeds or ctx is cancelled
+// previousID is the ID the caller found to be unknown; registration is skipped if another goroutine already replaced it
+func (a *buildAgent) register(ctx context.Context, previousID string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.id != previousID {
+		return nil
+	}
+	// The server has reassigned anything running under the previous ID
+	for _, cancel := range a.running {
+		cancel()
+	}
+
+	for {
+		var response struct {
+			Agent struct {
+				ID string `json:"id"`
+			} `json:"agent"`
+			HeartbeatInterval string `json:"heartbeat_interval"`
+		}
+		err := a.do(ctx, "POST", "/api/v1/agents", Registration{
+			Name:     a.options.Name,
+			Platform: a.options.Platform,
+			Capacity: a.options.Capacity,
+			Version:  a.options.Version,
+		}, &response)
+		if err == nil {
+			a.id = response.Agent.ID
+			if a.heartbeatInterval, err = time.ParseDuration(response.HeartbeatInterval); err != nil || a.heartbeatInterval <= 0 {
+				a.heartbeatInterval = 10 * time.Second
+			}
+			logger.WithFields(logrus.Fields{
+				"agent_id": a.id,
+				"name":     a.options.Name,
+				"platform": a.options.Platform,
+				"capacity": a.options.Capacity,
+			}).Info("Registered with server")
+			return nil
+		}
+		logger.WithFields(logrus.Fields{
+			"server": a.options.ServerURL,
+			"error":  err,
+		}).Warn("Failed to register with server")
+		if !sleep(ctx, retryInterval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// deregister tells the server the agent is stopping so its tasks are reassigned immediately
+func (a *buildAgent) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer cancel()
+	if err := a.do(ctx, "DELETE", "/api/v1/agents/"+a.getID(), nil, nil); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to deregister from server")
+		return
+	}
+	logger.Info("Deregistered from server")
+}
+
+func (a *buildAgent) getID() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.id
+}
+
+// sendHeartbeats reports the running tasks to the server and stops the ones it no longer wants
+func (a *buildAgent) sendHeartbeats(ctx context.Context) {
+	for {
+		a.mutex.Lock()
+		id := a.id
+		interval := a.heartbeatInterval
+		heartbeat := Heartbeat{
+			Running: []string{},
+		}
+		for taskID := range a.running {
+			heartbeat.Running = append(heartbeat.Running, taskID)
+		}
+		a.mutex.Unlock()
+		if !sleep(ctx, interval) {
+			return
+		}
+
+		var response HeartbeatResponse
+		err := a.do(ctx, "POST", "/api/v1/agents/"+id+"/heartbeat", heartbeat, &response)
+		if err == errUnknownAgent {
+			logger.Warn("Server no longer knows this agent; registering again")
+			a.register(ctx, id)
+			continue
+		} else if err != nil {
+			if ctx.Err() == nil {
+				logger.WithFields(logrus.Fields{
+					"error": err,
+				}).Warn("Failed to send heartbeat")
+			}
+			continue
+		}
+		a.mutex.Lock()
+		for _, taskID := range response.Cancel {
+			if cancel, running := a.running[taskID]; running {
+				logger.WithFields(logrus.Fields{
+					"task_id": taskID,
+				}).Warn("Server cancelled task")
+				cancel()
+			}
+		}
+		a.mutex.Unlock()
+	}
+}
+
+// runTasks polls the server for a task and runs it, one at a time
+func (a *buildAgent) runTasks(ctx context.Context) {
+	for ctx.Err() == nil {
+		id := a.getID()
+		task, err := a.poll(ctx, id)
+		if err == errUnknownAgent {
+			a.register(ctx, id)
+			continue
+		} else if err != nil {
+			if ctx.Err() == nil {
+				logger.WithFields(logrus.Fields{
+					"error": err,
+				}).Warn("Failed to poll for tasks")
+				sleep(ctx, retryInterval)
+			}
+			continue
+		}
+		if task != nil {
+			a.runTask(ctx, id, *task)
+		}
+	}
+}
+
+// poll waits for the server to assign a task; returns nil if none was assigned before the server ended the poll
+func (a *buildAgent) poll(ctx context.Context, id string) (*Task, error) {
+	response, err := a.send(ctx, "POST", "/api/v1/agents/"+id+"/poll", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == 204 {
+		return nil, nil
+	} else if response.StatusCode >= 300 {
+		return nil, getResponseError(response.StatusCode, contents)
+	}
+	var body struct {
+		Task Task `json:"task"`
+	}
+	if err := json.Unmarshal(contents, &body); err != nil {
+		return nil, err
+	}
+	return &body.Task, nil
+}
+
+// runTask builds the task, streaming its log to the server, then reports the result
+func (a *buildAgent) runTask(ctx context.Context, id string, task Task) {
+	taskCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	a.mutex.Lock()
+	a.running[task.ID] = cancel
+	a.mutex.Unlock()
+	defer func() {
+		a.mutex.Lock()
+		delete(a.running, task.ID)
+		a.mutex.Unlock()
+	}()
+
+	log := logger.WithFields(logrus.Fields{
+		"task_id": task.ID,
+		"job_id":  task.JobID,
+		"type":    task.Type,
+		"image":   task.Image,
+		"tag":     task.Tag,
+		"attempt": task.Attempt,
+	})
+	log.Info("Task started")
+
+	taskPath := "/api/v1/agents/" + id + "/tasks/" + task.ID
+	logReader, logWriter := io.Pipe()
+	logStreamed := make(chan struct{})
+	go func() {
+		defer close(logStreamed)
+		response, err := a.send(taskCtx, "POST", taskPath+"/logs", logReader, "text/plain")
+		if err == nil {
+			response.Body.Close()
+		}
+		// Keep the build from blocking on its log if the stream failed
+		io.Copy(ioutil.Discard, logReader)
+	}()
+	result := a.build(taskCtx, id, task, logWriter)
+	logWriter.Close()
+	<-logStreamed
+
+	if ctx.Err() != nil {
+		// The server reassigns the task once the agent deregisters
+		log.Warn("Task interrupted")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"status": result.Status,
+	}).Info("Task finished")
+	if err := a.do(ctx, "POST", taskPath+"/result", result, nil); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to report task result")
+	}
+}
+
+// build runs the task with the local docker daemon, writing its log to w
+func (a *buildAgent) build(ctx context.Context, id string, task Task, w io.Writer) TaskResult {
+	inventory, release, err := a.sources.get(ctx, task.JobID, func(ctx context.Context, directory string) error {
+		return a.fetchSource(ctx, "/api/v1/agents/"+id+"/tasks/"+task.ID+"/source", directory)
+	})
+	if err != nil {
+		return TaskResult{
+			Status: TaskStatusFailed,
+			Error:  "Could not fetch the build source: " + err.Error(),
+		}
+	}
+	defer release()
+
+	var image *dockerbuild.ImageResult
+	ctx = dockerbuild.WithInventory(ctx, inventory)
+	ctx = dockerbuild.WithLogOutput(ctx, w)
+	// Parents are often built by other agents, so local copies may be stale
+	ctx = dockerbuild.WithPullParentImages(ctx)
+	if task.PullBaseImages {
+		ctx = dockerbuild.WithPullBaseImages(ctx)
+	}
+	if len(task.BuildArgs) > 0 {
+		ctx = dockerbuild.WithBuildArgs(ctx, task.BuildArgs)
+	}
+	ctx = dockerbuild.WithImageResultHandler(ctx, func(result dockerbuild.ImageResult) {
+		image = &result
+	})
+
+	switch task.Type {
+	case TaskTypeBaseImage:
+		err = dockerbuild.BuildBaseImage(ctx, task.RegistryBasePath, task.Tag, task.Image, task.ForceRebuild, true)
+	case TaskTypeDeployment:
+		err = dockerbuild.BuildDeployment(ctx, task.RegistryBasePath, task.Image, task.Tag, task.DeploymentTag, true)
+	default:
+		err = errors.New("Unsupported task type: " + task.Type)
+	}
+
+	result := TaskResult{
+		Status: TaskStatusSucceeded,
+		Image:  image,
+	}
+	if err != nil {
+		result.Status = TaskStatusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// fetchSource downloads the build source of a task and unpacks it into directory
+func (a *buildAgent) fetchSource(ctx context.Context, path string, directory string) error {
+	response, err := a.send(ctx, "GET", path, nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		contents, _ := ioutil.ReadAll(response.Body)
+		return getResponseError(response.StatusCode, contents)
+	}
+	return extractSourceArchive(response.Body, directory)
+}
+
+// do sends body as JSON and decodes the JSON response into result
+func (a *buildAgent) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var requestBody io.Reader
+	contentType := ""
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(encoded)
+		contentType = "application/json"
+	}
+	response, err := a.send(ctx, method, path, requestBody, contentType)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= 300 {
+		return getResponseError(response.StatusCode, contents)
+	}
+	if result == nil || len(contents) == 0 {
+		return nil
+	}
+	return json.Unmarshal(contents, result)
+}
+
+func (a *buildAgent) send(ctx context.Context, method string, path string, body io.Reader, contentType string) (*http.Response, error) {
+	request, err := http.NewRequest(method, a.options.ServerURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if a.options.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+a.options.Token)
+	}
+	return a.client.Do(request)
+}
+
+func getResponseError(status int, contents []byte) error {
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(contents, &body); err != nil || body.Error.Message == "" {
+		return errors.New("Server responded with status " + strconv.Itoa(status))
+	}
+	if body.Error.Code == errorCodeAgentNotFound {
+		return errUnknownAgent
+	}
+	return errors.New(body.Error.Message)
+}
+
+// sleep waits for d; returns false if ctx is cancelled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
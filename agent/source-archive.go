@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteSourceArchive writes the build assets in directory to w as a gzipped tarball
+// Temporary build directories and git metadata are left out
+func WriteSourceArchive(w io.Writer, directory string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == directory {
+			return nil
+		}
+		if info.Name() == ".git" || info.Name() == ".container-factory-locks" || strings.HasPrefix(info.Name(), ".tmp-") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relativePath, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relativePath)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractSourceArchive unpacks an archive written by WriteSourceArchive into directory
+// Entries are never written outside directory: paths and symlink targets leaving it are rejected, as are entries below or replacing a symlink
+func extractSourceArchive(r io.Reader, directory string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(header.Name)
+		if !isWithinDirectory(name) || filepath.Clean(name) == "." {
+			return errors.New("Build source archive contains an invalid path: " + header.Name)
+		}
+		if err := checkNoSymlinks(directory, filepath.Clean(name)); err != nil {
+			return err
+		}
+		path := filepath.Join(directory, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			target := filepath.FromSlash(header.Linkname)
+			if filepath.IsAbs(target) || !isWithinDirectory(filepath.Join(filepath.Dir(name), target)) {
+				return errors.New("Build source archive contains a symlink leaving the build source: " + header.Name + " -> " + header.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// isWithinDirectory reports whether a relative path stays inside the directory it is relative to
+func isWithinDirectory(name string) bool {
+	name = filepath.Clean(name)
+	return !filepath.IsAbs(name) && name != ".." && !strings.HasPrefix(name, ".."+string(filepath.Separator))
+}
+
+// checkNoSymlinks returns an error if name or any of its parents is a symlink in directory, which writing name would follow
+func checkNoSymlinks(directory string, name string) error {
+	path := directory
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("Build source archive writes through a symlink: " + filepath.ToSlash(name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveEntry is a file, directory or symlink written into a test archive
+type archiveEntry struct {
+	name     string
+	typeflag byte
+	contents string
+	linkname string
+}
+
+func writeTestArchive(t *testing.T, entries []archiveEntry) *bytes.Buffer {
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		header := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.contents)),
+		}
+		if e.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if e.typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.contents)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestSourceArchiveRoundTrip(t *testing.T) {
+	source := t.TempDir()
+	files := map[string]string{
+		"dockerfiles/base":                    "FROM alpine:3\n",
+		"dockerfiles/nested/tools":            "FROM {{ local }}/base\n",
+		"deployments/app":                     "FROM {{ local }}/tools\n",
+		".git/HEAD":                           "ref: refs/heads/main\n",
+		".container-factory-locks/base.lock":  "{}",
+		"dockerfiles/.tmp-123/Dockerfile":     "FROM alpine:3\n",
+		"dockerfiles/nested/.tmp-456/context": "",
+	}
+	for name, contents := range files {
+		path := filepath.Join(source, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../dockerfiles/base", filepath.Join(source, "deployments", "base-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteSourceArchive(&buffer, source); err != nil {
+		t.Fatal(err)
+	}
+	destination := t.TempDir()
+	if err := extractSourceArchive(&buffer, destination); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"dockerfiles/base", "dockerfiles/nested/tools", "deployments/app"} {
+		contents, err := ioutil.ReadFile(filepath.Join(destination, name))
+		if err != nil {
+			t.Errorf("%s was not extracted: %v", name, err)
+		} else if string(contents) != files[name] {
+			t.Errorf("%s = %q, want %q", name, contents, files[name])
+		}
+	}
+	for _, name := range []string{".git", ".container-factory-locks", "dockerfiles/.tmp-123", "dockerfiles/nested/.tmp-456"} {
+		if _, err := os.Lstat(filepath.Join(destination, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was archived", name)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(destination, "deployments", "base-link")); err != nil || link != "../dockerfiles/base" {
+		t.Errorf("deployments/base-link = %q, %v; want a symlink to ../dockerfiles/base", link, err)
+	}
+}
+
+func TestExtractSourceArchiveStaysInDirectory(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		wantErr bool
+	}{
+		{"relative symlink inside", []archiveEntry{
+			{name: "dockerfiles/base", typeflag: tar.TypeReg, contents: "FROM alpine:3\n"},
+			{name: "deployments/base", typeflag: tar.TypeSymlink, linkname: "../dockerfiles/base"},
+		}, false},
+		{"parent path", []archiveEntry{{name: "../evil", typeflag: tar.TypeReg, contents: "x"}}, true},
+		{"parent path in the middle", []archiveEntry{{name: "dockerfiles/../../evil", typeflag: tar.TypeReg, contents: "x"}}, true},
+		{"absolute path", []archiveEntry{{name: "/evil", typeflag: tar.TypeReg, contents: "x"}}, true},
+		{"absolute symlink", []archiveEntry{{name: "dockerfiles", typeflag: tar.TypeSymlink, linkname: "/tmp"}}, true},
+		{"symlink to a parent", []archiveEntry{{name: "dockerfiles", typeflag: tar.TypeSymlink, linkname: ".."}}, true},
+		{"nested symlink leaving the directory", []archiveEntry{{name: "a/b/link", typeflag: tar.TypeSymlink, linkname: "../../../evil"}}, true},
+		{"file through a symlinked directory", []archiveEntry{
+			{name: "dockerfiles", typeflag: tar.TypeDir},
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "dockerfiles"},
+			{name: "link/evil", typeflag: tar.TypeReg, contents: "x"},
+		}, true},
+		{"file replacing a symlink", []archiveEntry{
+			{name: "dockerfiles/base", typeflag: tar.TypeReg, contents: "FROM alpine:3\n"},
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "dockerfiles/base"},
+			{name: "link", typeflag: tar.TypeReg, contents: "x"},
+		}, true},
+	}
+	for _, test := range tests {
+		parent := t.TempDir()
+		directory := filepath.Join(parent, "source")
+		if err := os.Mkdir(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := extractSourceArchive(writeTestArchive(t, test.entries), directory)
+		if test.wantErr && err == nil {
+			t.Errorf("%s: extractSourceArchive did not return an error", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: extractSourceArchive: %v", test.name, err)
+		}
+		if _, err := os.Lstat(filepath.Join(parent, "evil")); !os.IsNotExist(err) {
+			t.Errorf("%s: extractSourceArchive wrote outside the directory", test.name)
+		}
+		if contents, err := ioutil.ReadFile(filepath.Join(directory, "dockerfiles", "base")); err == nil && string(contents) != "FROM alpine:3\n" {
+			t.Errorf("%s: extractSourceArchive overwrote dockerfiles/base through a symlink", test.name)
+		}
+	}
+}
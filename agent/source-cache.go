@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// Unused build sources beyond this count are deleted, oldest first
+const maxCachedSources = 4
+
+// cachedSource is the build assets of a job unpacked on the agent
+type cachedSource struct {
+	directory string
+	// Closed once the source is unpacked or failed to
+	ready     chan struct{}
+	inventory *dockerbuild.Inventory
+	err       error
+	// Number of running tasks using the source
+	users int
+}
+
+// sourceCache keeps the build sources of recent jobs so the tasks of a job only download them once
+type sourceCache struct {
+	directory string
+	mutex     sync.Mutex
+	sources   map[string]*cachedSource
+	// Job IDs, least recently used first
+	order []string
+}
+
+func newSourceCache(directory string) *sourceCache {
+	return &sourceCache{
+		directory: directory,
+		sources:   map[string]*cachedSource{},
+	}
+}
+
+// get returns the inventory of the source for jobID, calling fetch to unpack it into a new directory if it is not cached
+// release must be called once the task no longer needs the source
+func (sc *sourceCache) get(ctx context.Context, jobID string, fetch func(ctx context.Context, directory string) error) (*dockerbuild.Inventory, func(), error) {
+	sc.mutex.Lock()
+	source, exists := sc.sources[jobID]
+	if !exists {
+		source = &cachedSource{
+			ready: make(chan struct{}),
+		}
+		sc.sources[jobID] = source
+	}
+	source.users++
+	sc.touch(jobID)
+	sc.mutex.Unlock()
+
+	release := func() {
+		sc.mutex.Lock()
+		defer sc.mutex.Unlock()
+		source.users--
+		sc.evict()
+	}
+
+	if !exists {
+		source.directory, source.err = ioutil.TempDir(sc.directory, "source-")
+		if source.err == nil {
+			if source.err = fetch(ctx, source.directory); source.err == nil {
+				source.inventory, source.err = dockerbuild.LoadInventory(source.directory)
+			}
+		}
+		if source.err != nil {
+			// Leave the next task of the job to try again
+			sc.mutex.Lock()
+			delete(sc.sources, jobID)
+			sc.remove(jobID)
+			sc.mutex.Unlock()
+			if source.directory != "" {
+				os.RemoveAll(source.directory)
+			}
+		}
+		close(source.ready)
+	}
+
+	select {
+	case <-source.ready:
+	case <-ctx.Done():
+		release()
+		return nil, nil, ctx.Err()
+	}
+	if source.err != nil {
+		release()
+		return nil, nil, source.err
+	}
+	return source.inventory, release, nil
+}
+
+// touch marks a source as most recently used; the caller must hold the lock
+func (sc *sourceCache) touch(jobID string) {
+	sc.remove(jobID)
+	sc.order = append(sc.order, jobID)
+}
+
+// remove drops a job from the usage order; the caller must hold the lock
+func (sc *sourceCache) remove(jobID string) {
+	for i, id := range sc.order {
+		if id == jobID {
+			sc.order = append(sc.order[:i], sc.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// evict deletes the least recently used sources no task is using; the caller must hold the lock
+func (sc *sourceCache) evict() {
+	excess := len(sc.order) - maxCachedSources
+	retained := []string{}
+	for _, id := range sc.order {
+		source := sc.sources[id]
+		if excess > 0 && source.users == 0 {
+			delete(sc.sources, id)
+			os.RemoveAll(source.directory)
+			excess--
+			continue
+		}
+		retained = append(retained, id)
+	}
+	sc.order = retained
+}
+
+// clear deletes every cached source
+func (sc *sourceCache) clear() {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	for id, source := range sc.sources {
+		if source.directory != "" {
+			os.RemoveAll(source.directory)
+		}
+		delete(sc.sources, id)
+	}
+	sc.order = nil
+}
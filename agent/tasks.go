@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// Task types
+const (
+	TaskTypeBaseImage  = "base-image"
+	TaskTypeDeployment = "deployment"
+)
+
+// Task statuses reported by agents
+const (
+	TaskStatusSucceeded = "succeeded"
+	TaskStatusFailed    = "failed"
+)
+
+// Registration describes an agent to the server
+type Registration struct {
+	Name string `json:"name"`
+	// Platform the agent builds for, i.e. linux/amd64
+	Platform string `json:"platform"`
+	// Number of tasks the agent runs at once
+	Capacity int    `json:"capacity"`
+	Version  string `json:"version,omitempty"`
+}
+
+// Task is a single image or deployment build assigned to an agent
+type Task struct {
+	ID string `json:"id"`
+	// Tasks of the same job share a build source
+	JobID string `json:"job_id"`
+	Type  string `json:"type"`
+	// Base image or deployment name
+	Image            string `json:"image"`
+	Tag              string `json:"tag"`
+	DeploymentTag    string `json:"deployment_tag,omitempty"`
+	RegistryBasePath string `json:"registry_base_path"`
+	ForceRebuild     bool   `json:"force_rebuild,omitempty"`
+	// Pull the external image a root image is built FROM instead of using a cached copy
+	PullBaseImages bool `json:"pull_base_images,omitempty"`
+	// Passed to docker build as --build-arg
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+	// Number of agents the task has been assigned to, including this one
+	Attempt int `json:"attempt"`
+}
+
+// TaskResult is the outcome of a task reported by an agent
+type TaskResult struct {
+	Status string                   `json:"status"`
+	Image  *dockerbuild.ImageResult `json:"image,omitempty"`
+	Error  string                   `json:"error,omitempty"`
+}
+
+// Heartbeat tells the server an agent is alive and which tasks it is running
+type Heartbeat struct {
+	Running []string `json:"running"`
+}
+
+// HeartbeatResponse lists running tasks the agent should stop, i.e. because their job was cancelled
+type HeartbeatResponse struct {
+	Cancel []string `json:"cancel"`
+}
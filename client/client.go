@@ -0,0 +1,357 @@
+// Package client calls the v2 web API of a container-factory server; the API is described by the OpenAPI document the server publishes at /api/openapi.json
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Job statuses
+const (
+	JobStatusPendingApproval = "pending_approval"
+	JobStatusQueued          = "queued"
+	JobStatusRunning         = "running"
+	JobStatusSucceeded       = "succeeded"
+	JobStatusFailed          = "failed"
+	JobStatusCancelled       = "cancelled"
+	JobStatusRejected        = "rejected"
+)
+
+// Error is an error response from the server
+type Error struct {
+	StatusCode int
+	// Machine readable error code, i.e. validation_failed; empty when the server did not send an error body
+	Code    string
+	Message string
+	// Problems with individual request fields, keyed by field name
+	Fields map[string]string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "Server responded with status " + strconv.Itoa(e.StatusCode)
+	}
+	message := e.Message
+	for field, problem := range e.Fields {
+		message += "; " + field + ": " + problem
+	}
+	return message
+}
+
+// ImageResult is the outcome of building a single image in a job
+type ImageResult struct {
+	Name       string `json:"image_name"`
+	Reference  string `json:"reference"`
+	Status     string `json:"status"`
+	FailedStep string `json:"failed_step,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Approval is the approval a job building a protected tag waits for
+type Approval struct {
+	Tag string `json:"tag"`
+	// Protected tag pattern matching Tag; empty when the job uses a protected profile
+	Pattern string `json:"pattern"`
+	// Protected profile the job builds with
+	Profile   string     `json:"profile,omitempty"`
+	Status    string     `json:"status"`
+	DecidedBy string     `json:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+}
+
+// Job is a build running or run by the server
+type Job struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Status     string            `json:"status"`
+	CreatedBy  string            `json:"created_by"`
+	Parameters map[string]string `json:"parameters"`
+	Images     []ImageResult     `json:"images,omitempty"`
+	// Set for jobs building a protected tag
+	Approval   *Approval  `json:"approval,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Finished reports whether the job has stopped running
+func (j Job) Finished() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed || j.Status == JobStatusCancelled || j.Status == JobStatusRejected
+}
+
+// BaseImage is a buildable base image and the images built from it
+type BaseImage struct {
+	Name     string         `json:"image_name"`
+	Children []BaseImage    `json:"children"`
+	Metadata *ImageMetadata `json:"metadata,omitempty"`
+}
+
+// ImageMetadata holds the settings of a base image read from its sidecar file
+type ImageMetadata struct {
+	Description string            `json:"description,omitempty"`
+	Owners      []string          `json:"owners,omitempty"`
+	BuildArgs   map[string]string `json:"build_args,omitempty"`
+	// Build args also passed to every descendant of the image
+	PropagateBuildArgs []string          `json:"propagate_build_args,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	ExtraTags          []string          `json:"extra_tags,omitempty"`
+	Platforms          []string          `json:"platforms,omitempty"`
+	Timeout            string            `json:"timeout,omitempty"`
+	CachePolicy        string            `json:"cache_policy,omitempty"`
+	Disabled           bool              `json:"disabled,omitempty"`
+}
+
+// OrphanedImage is a base image whose parent does not exist
+type OrphanedImage struct {
+	Name       string `json:"image_name"`
+	ParentName string `json:"parent_image_name"`
+}
+
+// BaseImageHierarchy is the base image inventory of the server
+type BaseImageHierarchy struct {
+	BuildableImages []BaseImage     `json:"buildable_images"`
+	OrphanedImages  []OrphanedImage `json:"orphaned_images"`
+}
+
+// BaseImagesBuildRequest starts a build of base images
+type BaseImagesBuildRequest struct {
+	Tag          string `json:"tag"`
+	ForceRebuild bool   `json:"force_rebuild,omitempty"`
+	// Builds only these images and their descendants; every base image is built when empty
+	Images []string `json:"images,omitempty"`
+	// Branch, tag or commit to build from a git workspace
+	Ref string `json:"ref,omitempty"`
+	// Profile of the workspace configuration to build with; its tag template is used when Tag is empty
+	Profile string `json:"profile,omitempty"`
+	// Passed to every image as --build-arg, taking precedence over the build args of the profile
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+}
+
+// DeploymentBuildRequest starts a build of a deployment
+type DeploymentBuildRequest struct {
+	Name          string            `json:"name"`
+	Tag           string            `json:"tag"`
+	DeploymentTag string            `json:"deployment_tag,omitempty"`
+	Ref           string            `json:"ref,omitempty"`
+	Profile       string            `json:"profile,omitempty"`
+	BuildArgs     map[string]string `json:"build_args,omitempty"`
+}
+
+// Identity is the caller a token authenticates as
+type Identity struct {
+	Caller                string   `json:"caller"`
+	Scopes                []string `json:"scopes"`
+	AuthenticationEnabled bool     `json:"authentication_enabled"`
+}
+
+// Client calls a container-factory server
+type Client struct {
+	BaseURL string
+	Token   string
+	// No timeout is set by default; log streams last as long as the job
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, i.e. https://builds.example.com; token may be empty when authentication is disabled
+func New(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{},
+	}
+}
+
+// ListBaseImages returns the base image hierarchy of the server
+func (c *Client) ListBaseImages(ctx context.Context) (BaseImageHierarchy, error) {
+	var hierarchy BaseImageHierarchy
+	err := c.do(ctx, "GET", "/base-images", nil, &hierarchy)
+	return hierarchy, err
+}
+
+// ListDeployments returns the names of the deployments of the server
+func (c *Client) ListDeployments(ctx context.Context) ([]string, error) {
+	var response struct {
+		Deployments []string `json:"deployments"`
+	}
+	err := c.do(ctx, "GET", "/deployments", nil, &response)
+	return response.Deployments, err
+}
+
+// BuildBaseImages starts a job building base images
+func (c *Client) BuildBaseImages(ctx context.Context, request BaseImagesBuildRequest) (Job, error) {
+	return c.startJob(ctx, "/base-images/builds", request)
+}
+
+// BuildDeployment starts a job building a deployment
+func (c *Client) BuildDeployment(ctx context.Context, request DeploymentBuildRequest) (Job, error) {
+	return c.startJob(ctx, "/deployments/builds", request)
+}
+
+func (c *Client) startJob(ctx context.Context, path string, request interface{}) (Job, error) {
+	var response struct {
+		Job Job `json:"job"`
+	}
+	err := c.do(ctx, "POST", path, request, &response)
+	return response.Job, err
+}
+
+// ListJobs returns the recent jobs of the server, newest first
+func (c *Client) ListJobs(ctx context.Context) ([]Job, error) {
+	var response struct {
+		Jobs []Job `json:"jobs"`
+	}
+	err := c.do(ctx, "GET", "/jobs", nil, &response)
+	return response.Jobs, err
+}
+
+// GetJob returns a job
+func (c *Client) GetJob(ctx context.Context, id string) (Job, error) {
+	var response struct {
+		Job Job `json:"job"`
+	}
+	err := c.do(ctx, "GET", "/jobs/"+url.PathEscape(id), nil, &response)
+	return response.Job, err
+}
+
+// ApproveJob approves a job waiting for approval to build a protected tag; the comment is optional
+func (c *Client) ApproveJob(ctx context.Context, id string, comment string) (Job, error) {
+	return c.decideJob(ctx, id, "/approve", comment)
+}
+
+// RejectJob rejects a job waiting for approval to build a protected tag; the comment is optional
+func (c *Client) RejectJob(ctx context.Context, id string, comment string) (Job, error) {
+	return c.decideJob(ctx, id, "/reject", comment)
+}
+
+func (c *Client) decideJob(ctx context.Context, id string, action string, comment string) (Job, error) {
+	var response struct {
+		Job Job `json:"job"`
+	}
+	err := c.do(ctx, "POST", "/jobs/"+url.PathEscape(id)+action, map[string]string{"comment": comment}, &response)
+	return response.Job, err
+}
+
+// StreamJobLogs returns the output of a job; with follow, the stream stays open until the job finishes
+// The caller must close the stream
+func (c *Client) StreamJobLogs(ctx context.Context, id string, follow bool) (io.ReadCloser, error) {
+	path := "/jobs/" + url.PathEscape(id) + "/logs"
+	if follow {
+		path += "?follow=true"
+	}
+	response, err := c.send(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		contents, _ := ioutil.ReadAll(response.Body)
+		return nil, getError(response.StatusCode, contents)
+	}
+	return response.Body, nil
+}
+
+// WaitForJob copies the output of a job to w until it finishes and returns the finished job
+func (c *Client) WaitForJob(ctx context.Context, id string, w io.Writer) (Job, error) {
+	logs, err := c.StreamJobLogs(ctx, id, true)
+	if err != nil {
+		return Job{}, err
+	}
+	_, err = io.Copy(w, logs)
+	logs.Close()
+	if ctx.Err() != nil {
+		return Job{}, ctx.Err()
+	} else if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(ctx, id)
+}
+
+// WhoAmI returns the caller the token authenticates as and its scopes
+func (c *Client) WhoAmI(ctx context.Context) (Identity, error) {
+	var identity Identity
+	err := c.do(ctx, "GET", "/whoami", nil, &identity)
+	return identity, err
+}
+
+// do sends a request to the v2 API and decodes the JSON response into result
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	response, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= 300 {
+		return getError(response.StatusCode, contents)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(contents, result)
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var requestBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		requestBody = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, c.BaseURL+"/api/v2"+path, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(request)
+}
+
+func getError(status int, contents []byte) error {
+	var body struct {
+		Error struct {
+			Code    string            `json:"code"`
+			Message string            `json:"message"`
+			Fields  map[string]string `json:"fields"`
+		} `json:"error"`
+	}
+	e := &Error{
+		StatusCode: status,
+	}
+	if err := json.Unmarshal(contents, &body); err == nil {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+		e.Fields = body.Error.Fields
+	}
+	return e
+}
+
+// IsNotFound reports whether err is a 404 response from the server
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == 404
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/agent"
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// agentCmd runs builds assigned by a server
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run image builds assigned by a container-factory server",
+	Long:  `Requires --server and a token with the agent scope.  The agent registers with the server, receives single image and deployment builds over long polling and runs them with the local docker daemon.  Build assets are downloaded from the server, so -d and -p are ignored.  On SIGINT or SIGTERM, running builds are stopped and the server reassigns them to other agents.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !isRemote() {
+			exitWithError(errors.New("The agent command requires --server"))
+		}
+		if commandLineFlags.agentName == "" {
+			commandLineFlags.agentName, _ = os.Hostname()
+		}
+		if err := os.MkdirAll(commandLineFlags.agentWorkDirectory, 0755); err != nil {
+			exitWithError(err)
+		}
+		dockerbuild.SetLogger(logger)
+		dockerbuild.SetVerbosity(uint8(commandLineFlags.verbosity))
+		agent.SetLogger(logger)
+		if err := agent.Run(newInterruptibleContext(), agent.Options{
+			ServerURL:     commandLineFlags.server,
+			Token:         commandLineFlags.serverToken,
+			Name:          commandLineFlags.agentName,
+			Platform:      commandLineFlags.agentPlatform,
+			Capacity:      commandLineFlags.agentCapacity,
+			WorkDirectory: commandLineFlags.agentWorkDirectory,
+			Version:       Version,
+		}); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(agentCmd)
+	agentCmd.Flags().StringVarP(&commandLineFlags.agentName, "name", "", "", "Name the agent registers as; defaults to the hostname")
+	agentCmd.Flags().IntVarP(&commandLineFlags.agentCapacity, "capacity", "c", 1, "Number of builds run at once")
+	agentCmd.Flags().StringVarP(&commandLineFlags.agentPlatform, "platform", "", runtime.GOOS+"/"+runtime.GOARCH, "Platform advertised to the server")
+	agentCmd.Flags().StringVarP(&commandLineFlags.agentWorkDirectory, "work-directory", "", filepath.Join(os.TempDir(), "container-factory-agent"), "Directory build assets are downloaded to")
+}
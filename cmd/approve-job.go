@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/client"
+)
+
+// approveJobCmd approves a job waiting to build a protected tag
+var approveJobCmd = &cobra.Command{
+	Use:   "approve-job <job-id>",
+	Short: "Approve a job waiting to build a protected tag on a container-factory server",
+	Long:  `Requires --server and a token with the approve:builds scope.  Jobs must be approved by a different caller than the one that started them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		decideRemoteJob(args, true)
+	},
+}
+
+// decideRemoteJob approves or rejects a job and prints it
+func decideRemoteJob(args []string, approve bool) {
+	if !isRemote() {
+		exitWithError(errors.New("Approving and rejecting jobs requires --server"))
+	}
+	if len(args) != 1 {
+		exitWithError(errors.New("Exactly one job ID is required"))
+	}
+	id := args[0]
+	ctx := newInterruptibleContext()
+	c := newRemoteClient()
+	var job client.Job
+	var err error
+	if approve {
+		job, err = c.ApproveJob(ctx, id, commandLineFlags.approvalComment)
+	} else {
+		job, err = c.RejectJob(ctx, id, commandLineFlags.approvalComment)
+	}
+	if err != nil {
+		exitWithError(err)
+	}
+	printJobs([]client.Job{job})
+}
+
+func init() {
+	RootCmd.AddCommand(approveJobCmd)
+	approveJobCmd.Flags().StringVarP(&commandLineFlags.approvalComment, "comment", "m", "", "Comment recorded with the approval")
+	approveJobCmd.Flags().StringVarP(&commandLineFlags.outputFormat, "output-format", "o", "", "Specify output format.  Available options are stdout (default), json, and yaml")
+}
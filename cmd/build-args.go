@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/utilities/filesystem"
+)
+
+// getCommandLineBuildArgs returns the build args of --build-arg-file overridden by those of --build-arg
+func getCommandLineBuildArgs() (map[string]string, error) {
+	fileArgs := map[string]string{}
+	if commandLineFlags.buildArgFile != "" {
+		filename, err := filesystem.BuildAbsolutePathFromHome(commandLineFlags.buildArgFile)
+		if err != nil {
+			return nil, err
+		}
+		if fileArgs, err = dockerbuild.ReadBuildArgsFile(filename); err != nil {
+			return nil, err
+		}
+	}
+	flagArgs, err := dockerbuild.ParseBuildArgs(commandLineFlags.buildArgs)
+	if err != nil {
+		return nil, err
+	}
+	return dockerbuild.MergeBuildArgs(fileArgs, flagArgs), nil
+}
+
+// addBuildArgFlags adds the flags giving build args to a build command
+func addBuildArgFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVarP(&commandLineFlags.buildArgs, "build-arg", "", []string{}, "Build arg passed to docker build as NAME=VALUE; may be repeated, or given one per line in the environment variable")
+	cmd.Flags().StringVarP(&commandLineFlags.buildArgFile, "build-arg-file", "", "", "File of build args with a NAME=VALUE pair per line")
+}
@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"go.mikenewswanger.com/container-factory/client"
 	"go.mikenewswanger.com/container-factory/dockerbuild"
 )
 
@@ -12,21 +14,59 @@ var buildBaseImagesCmd = &cobra.Command{
 	Short: "Build All Docker Images",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
+		if isRemote() {
+			buildBaseImagesRemote(cmd)
+			return
+		}
 		dockerbuild.SetLogger(logger)
 		dockerbuild.SetVerbosity(uint8(commandLineFlags.verbosity))
+		ctx := applyProjectConfig(cmd)
 		dockerbuild.SetDockerBaseDirectory(commandLineFlags.dockerBaseDirectory)
-		dockerbuild.BuildBaseImages(
+		if err := dockerbuild.BuildBaseImages(
+			ctx,
 			commandLineFlags.dockerRegistryBasePath,
 			commandLineFlags.imageTag,
 			commandLineFlags.forceRebuild,
 			!commandLineFlags.localOnly,
-		)
+		); err != nil {
+			exitWithError(err)
+		}
 	},
 }
 
+// buildBaseImagesRemote starts the build on the server and follows its log
+func buildBaseImagesRemote(cmd *cobra.Command) {
+	if err := checkRemoteBuildFlags(cmd); err != nil {
+		exitWithError(err)
+	}
+	buildArgs, err := getCommandLineBuildArgs()
+	if err != nil {
+		exitWithError(err)
+	}
+	ctx := newInterruptibleContext()
+	c := newRemoteClient()
+	job, err := c.BuildBaseImages(ctx, client.BaseImagesBuildRequest{
+		Tag:          commandLineFlags.imageTag,
+		ForceRebuild: commandLineFlags.forceRebuild,
+		Profile:      commandLineFlags.profile,
+		BuildArgs:    buildArgs,
+	})
+	if err != nil {
+		exitWithError(err)
+	}
+	logger.WithFields(logrus.Fields{
+		"job_id": job.ID,
+	}).Info("Job started on server")
+	if err := followRemoteJob(ctx, c, job.ID); err != nil {
+		exitWithError(err)
+	}
+}
+
 func init() {
 	RootCmd.AddCommand(buildBaseImagesCmd)
 	buildBaseImagesCmd.Flags().BoolVarP(&commandLineFlags.forceRebuild, "force-rebuild", "f", false, "Force rebuild on all images")
 	buildBaseImagesCmd.Flags().BoolVarP(&commandLineFlags.localOnly, "local-only", "l", false, "Skip push build images to upstream repository step")
 	buildBaseImagesCmd.Flags().StringVarP(&commandLineFlags.imageTag, "image-tag", "t", "", "Tag for docker images")
+	addProjectConfigFlags(buildBaseImagesCmd)
+	addBuildArgFlags(buildBaseImagesCmd)
 }
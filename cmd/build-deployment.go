@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"go.mikenewswanger.com/container-factory/client"
 	"go.mikenewswanger.com/container-factory/dockerbuild"
 )
 
@@ -12,22 +14,61 @@ var buildDeploymentCmd = &cobra.Command{
 	Short: "Build a single Docker deployment image",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
+		if isRemote() {
+			buildDeploymentRemote(cmd, args[0])
+			return
+		}
 		dockerbuild.SetLogger(logger)
 		dockerbuild.SetVerbosity(uint8(commandLineFlags.verbosity))
+		ctx := applyProjectConfig(cmd)
 		dockerbuild.SetDockerBaseDirectory(commandLineFlags.dockerBaseDirectory)
-		dockerbuild.BuildDeployment(
+		if err := dockerbuild.BuildDeployment(
+			ctx,
 			commandLineFlags.dockerRegistryBasePath,
 			args[0],
 			commandLineFlags.imageTag,
 			commandLineFlags.deploymentImageTag,
 			!commandLineFlags.localOnly,
-		)
+		); err != nil {
+			exitWithError(err)
+		}
 	},
 }
 
+// buildDeploymentRemote starts the build on the server and follows its log
+func buildDeploymentRemote(cmd *cobra.Command, name string) {
+	if err := checkRemoteBuildFlags(cmd); err != nil {
+		exitWithError(err)
+	}
+	buildArgs, err := getCommandLineBuildArgs()
+	if err != nil {
+		exitWithError(err)
+	}
+	ctx := newInterruptibleContext()
+	c := newRemoteClient()
+	job, err := c.BuildDeployment(ctx, client.DeploymentBuildRequest{
+		Name:          name,
+		Tag:           commandLineFlags.imageTag,
+		DeploymentTag: commandLineFlags.deploymentImageTag,
+		Profile:       commandLineFlags.profile,
+		BuildArgs:     buildArgs,
+	})
+	if err != nil {
+		exitWithError(err)
+	}
+	logger.WithFields(logrus.Fields{
+		"job_id": job.ID,
+	}).Info("Job started on server")
+	if err := followRemoteJob(ctx, c, job.ID); err != nil {
+		exitWithError(err)
+	}
+}
+
 func init() {
 	RootCmd.AddCommand(buildDeploymentCmd)
 	buildDeploymentCmd.Flags().BoolVarP(&commandLineFlags.localOnly, "local-only", "l", false, "Skip push build images to upstream repository step")
 	buildDeploymentCmd.Flags().StringVarP(&commandLineFlags.deploymentImageTag, "deployment-image-tag", "", "", "Tag for docker deployment")
 	buildDeploymentCmd.Flags().StringVarP(&commandLineFlags.imageTag, "base-image-tag", "t", "", "Tag for docker images during deployment build process")
+	addProjectConfigFlags(buildDeploymentCmd)
+	addBuildArgFlags(buildDeploymentCmd)
 }
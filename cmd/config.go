@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// configCmd groups the commands inspecting the workspace configuration
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the workspace configuration",
+	Long:  ``,
+}
+
+// configShowCmd prints the effective workspace configuration
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the effective workspace configuration and where each setting comes from",
+	Long:  `Settings are taken from flags, then CONTAINER_FACTORY_* environment variables, then the profile selected with --profile, then ` + dockerbuild.ProjectConfigFilename + ` in the docker base directory, then defaults.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		effective, err := resolveProjectConfig(cmd)
+		if err != nil {
+			exitWithError(err)
+		}
+		settings := map[string]interface{}{
+			"registry_base_path": effective.Config.RegistryBasePath,
+			"tag_strategy":       effective.Config.TagStrategy,
+			"builder":            effective.Config.Builder,
+			"concurrency":        effective.Config.Concurrency,
+			"ignore":             effective.Config.Ignore,
+			"deployment_prefix":  effective.Config.DeploymentPrefix,
+			"build_args":         formatBuildArgs(effective.Config.BuildArgs),
+		}
+		profiles := []string{}
+		for name := range effective.Config.Profiles {
+			profiles = append(profiles, name)
+		}
+		sort.Strings(profiles)
+		settings["profiles"] = profiles
+		keys := []string{}
+		for _, s := range projectSettings {
+			keys = append(keys, s.key)
+		}
+		keys = append(keys, "profiles")
+		effective.Sources["profiles"] = settingSourceFile
+		if effective.Profile != "" {
+			for key, value := range map[string]interface{}{
+				"profile":            effective.Profile,
+				"tag_template":       effective.ProfileConfig.TagTemplate,
+				"push":               effective.ProfileConfig.ShouldPush(),
+				"protected":          effective.ProfileConfig.Protected,
+				"profile_build_args": formatBuildArgs(effective.ProfileConfig.BuildArgs),
+			} {
+				settings[key] = value
+				effective.Sources[key] = settingSourceProfile
+			}
+			keys = append(keys, "profile", "tag_template", "push", "protected", "profile_build_args")
+		}
+
+		switch commandLineFlags.outputFormat {
+		case "json", "yaml":
+			output := map[string]interface{}{
+				"file":     effective.File,
+				"settings": settings,
+				"sources":  effective.Sources,
+			}
+			var contents []byte
+			if commandLineFlags.outputFormat == "json" {
+				contents, err = json.Marshal(output)
+				contents = append(contents, '\n')
+			} else {
+				contents, err = yaml.Marshal(output)
+			}
+			if err != nil {
+				exitWithError(err)
+			}
+			fmt.Print(string(contents))
+		default:
+			if effective.File != "" {
+				fmt.Println("File: " + effective.File)
+			} else {
+				fmt.Println("File: none")
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+			for _, key := range keys {
+				value := ""
+				switch v := settings[key].(type) {
+				case string:
+					value = v
+				case int:
+					value = strconv.Itoa(v)
+				case bool:
+					value = strconv.FormatBool(v)
+				case []string:
+					value = strings.Join(v, ", ")
+				}
+				fmt.Fprintln(w, key+"\t"+value+"\t"+effective.Sources[key])
+			}
+			w.Flush()
+		}
+	},
+}
+
+// formatBuildArgs lists build args as NAME=VALUE, sorted by name
+func formatBuildArgs(args map[string]string) []string {
+	l := []string{}
+	for name, value := range args {
+		l = append(l, name+"="+value)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+	addProjectConfigFlags(configShowCmd)
+	configShowCmd.Flags().StringVarP(&commandLineFlags.outputFormat, "output-format", "o", "", "Specify output format.  Available options are stdout (default), json, and yaml")
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Prefix of the environment variables that set flags
+const environmentVariablePrefix = "CONTAINER_FACTORY_"
+
+// Flags of the running command that were set from environment variables, by flag name
+var flagsFromEnvironment = map[string]string{}
+
+// Flags of the running command given on the command line whose environment variable was also set to another value
+var flagsOverridingEnvironment = []string{}
+
+// getFlagEnvironmentVariable returns the environment variable setting a flag, i.e. CONTAINER_FACTORY_IMAGE_TAG for --image-tag
+func getFlagEnvironmentVariable(name string) string {
+	return environmentVariablePrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// addEnvironmentVariableUsage names the environment variable of every flag of cmd and its subcommands in their help
+func addEnvironmentVariableUsage(cmd *cobra.Command) {
+	addUsage := func(f *pflag.Flag) {
+		if f.Name == "help" || strings.Contains(f.Usage, "$"+getFlagEnvironmentVariable(f.Name)) {
+			return
+		}
+		f.Usage += " [$" + getFlagEnvironmentVariable(f.Name) + "]"
+	}
+	cmd.PersistentFlags().VisitAll(addUsage)
+	cmd.LocalNonPersistentFlags().VisitAll(addUsage)
+	for _, c := range cmd.Commands() {
+		addEnvironmentVariableUsage(c)
+	}
+}
+
+// getEnvironmentValues splits the value of an environment variable into the values given to its flag
+// Flags that may be repeated, such as --build-arg, take one value per line
+func getEnvironmentValues(f *pflag.Flag, value string) []string {
+	if f.Value.Type() != "stringArray" {
+		return []string{value}
+	}
+	values := []string{}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			values = append(values, line)
+		}
+	}
+	return values
+}
+
+// applyEnvironmentVariables sets each flag of cmd not given on the command line from its environment variable
+// Flags given on the command line take precedence over environment variables
+func applyEnvironmentVariables(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Name == "help" {
+			return
+		}
+		variable := getFlagEnvironmentVariable(f.Name)
+		value := os.Getenv(variable)
+		if value == "" {
+			return
+		}
+		values := getEnvironmentValues(f, value)
+		if f.Changed {
+			if !hasFlagValues(cmd.Flags(), f, values) {
+				flagsOverridingEnvironment = append(flagsOverridingEnvironment, f.Name)
+			}
+			return
+		}
+		for _, v := range values {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = errors.New("Invalid value for $" + variable + ": " + setErr.Error())
+				return
+			}
+		}
+		flagsFromEnvironment[f.Name] = variable
+	})
+	return err
+}
+
+// hasFlagValues reports whether a flag given on the command line has the values its environment variable would give it
+func hasFlagValues(flags *pflag.FlagSet, f *pflag.Flag, values []string) bool {
+	switch f.Value.Type() {
+	case "stringArray":
+		current, _ := flags.GetStringArray(f.Name)
+		return reflect.DeepEqual(current, values)
+	case "stringSlice":
+		return f.Value.String() == "["+values[0]+"]"
+	}
+	return f.Value.String() == values[0]
+}
+
+// warnAboutOverriddenEnvironment names each environment variable replaced by a flag on the command line
+// Written at every verbosity since a variable set by CI is easy to lose track of
+func warnAboutOverriddenEnvironment(w io.Writer) {
+	for _, name := range flagsOverridingEnvironment {
+		fmt.Fprintln(w, "Warning: "+describeFlag(name)+" overrides $"+getFlagEnvironmentVariable(name))
+	}
+}
+
+// describeFlag names a flag in an error, along with the environment variable that set it
+func describeFlag(name string) string {
+	if variable, set := flagsFromEnvironment[name]; set {
+		return "--" + name + " (set by $" + variable + ")"
+	}
+	return "--" + name
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// testEnvironmentFlags holds the values of the flags of newTestEnvironmentCommand
+type testEnvironmentFlags struct {
+	imageTag  string
+	localOnly bool
+	buildArgs []string
+	scopes    []string
+	builder   string
+}
+
+// newTestEnvironmentCommand returns a build command with flags like those of the real commands, parsing args and applying the environment
+func newTestEnvironmentCommand(t *testing.T, args []string) (*cobra.Command, *testEnvironmentFlags, error) {
+	flagsFromEnvironment = map[string]string{}
+	flagsOverridingEnvironment = []string{}
+	t.Cleanup(func() {
+		flagsFromEnvironment = map[string]string{}
+		flagsOverridingEnvironment = []string{}
+	})
+
+	values := &testEnvironmentFlags{}
+	cmd := &cobra.Command{Use: "build"}
+	cmd.Flags().StringVarP(&values.imageTag, "image-tag", "t", "", "")
+	cmd.Flags().BoolVarP(&values.localOnly, "local-only", "l", false, "")
+	cmd.Flags().StringArrayVarP(&values.buildArgs, "build-arg", "", []string{}, "")
+	cmd.Flags().StringSliceVarP(&values.scopes, "scope", "s", []string{"read"}, "")
+	cmd.Flags().StringVarP(&values.builder, "builder", "", "", "")
+	cmd.Flags().StringVarP(&commandLineFlags.server, "server", "", "", "")
+	t.Cleanup(func() { commandLineFlags.server = "" })
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, values, applyEnvironmentVariables(cmd)
+}
+
+func TestApplyEnvironmentVariables(t *testing.T) {
+	tests := []struct {
+		name            string
+		environment     map[string]string
+		args            []string
+		want            testEnvironmentFlags
+		wantFromEnv     []string
+		wantOverridden  []string
+		wantErrContains string
+	}{
+		{"defaults", nil, nil, testEnvironmentFlags{buildArgs: []string{}, scopes: []string{"read"}}, nil, nil, ""},
+		{"environment", map[string]string{"CONTAINER_FACTORY_IMAGE_TAG": "v1", "CONTAINER_FACTORY_LOCAL_ONLY": "true"}, nil,
+			testEnvironmentFlags{imageTag: "v1", localOnly: true, buildArgs: []string{}, scopes: []string{"read"}}, []string{"image-tag", "local-only"}, nil, ""},
+		{"flag takes precedence", map[string]string{"CONTAINER_FACTORY_IMAGE_TAG": "v1"}, []string{"-t", "v2"},
+			testEnvironmentFlags{imageTag: "v2", buildArgs: []string{}, scopes: []string{"read"}}, nil, []string{"image-tag"}, ""},
+		{"same value is not overridden", map[string]string{"CONTAINER_FACTORY_IMAGE_TAG": "v1"}, []string{"-t", "v1"},
+			testEnvironmentFlags{imageTag: "v1", buildArgs: []string{}, scopes: []string{"read"}}, nil, nil, ""},
+		{"repeated flag takes one value per line", map[string]string{"CONTAINER_FACTORY_BUILD_ARG": "A=1\nB=x,y\r\n\nC=\n"}, nil,
+			testEnvironmentFlags{buildArgs: []string{"A=1", "B=x,y", "C="}, scopes: []string{"read"}}, []string{"build-arg"}, nil, ""},
+		{"repeated flag replaces every line", map[string]string{"CONTAINER_FACTORY_BUILD_ARG": "A=1\nB=2"}, []string{"--build-arg", "A=3"},
+			testEnvironmentFlags{buildArgs: []string{"A=3"}, scopes: []string{"read"}}, nil, []string{"build-arg"}, ""},
+		{"repeated flag with the same values", map[string]string{"CONTAINER_FACTORY_BUILD_ARG": "A=1\nB=2"}, []string{"--build-arg", "A=1", "--build-arg", "B=2"},
+			testEnvironmentFlags{buildArgs: []string{"A=1", "B=2"}, scopes: []string{"read"}}, nil, nil, ""},
+		{"comma separated list", map[string]string{"CONTAINER_FACTORY_SCOPE": "read,build:base"}, nil,
+			testEnvironmentFlags{buildArgs: []string{}, scopes: []string{"read", "build:base"}}, []string{"scope"}, nil, ""},
+		{"comma separated list with the same values", map[string]string{"CONTAINER_FACTORY_SCOPE": "read,build:base"}, []string{"-s", "read,build:base"},
+			testEnvironmentFlags{buildArgs: []string{}, scopes: []string{"read", "build:base"}}, nil, nil, ""},
+		{"invalid value", map[string]string{"CONTAINER_FACTORY_LOCAL_ONLY": "maybe"}, nil,
+			testEnvironmentFlags{}, nil, nil, "Invalid value for $CONTAINER_FACTORY_LOCAL_ONLY"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.environment {
+				t.Setenv(name, value)
+			}
+			_, values, err := newTestEnvironmentCommand(t, test.args)
+			if test.wantErrContains != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErrContains) {
+					t.Errorf("applyEnvironmentVariables() = %v, want an error containing %q", err, test.wantErrContains)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*values, test.want) {
+				t.Errorf("flags = %+v, want %+v", *values, test.want)
+			}
+			for _, name := range test.wantFromEnv {
+				if flagsFromEnvironment[name] != getFlagEnvironmentVariable(name) {
+					t.Errorf("--%s is not recorded as set from the environment: %v", name, flagsFromEnvironment)
+				}
+			}
+			if len(flagsFromEnvironment) != len(test.wantFromEnv) {
+				t.Errorf("flags set from the environment = %v, want %v", flagsFromEnvironment, test.wantFromEnv)
+			}
+			if !reflect.DeepEqual(flagsOverridingEnvironment, append([]string{}, test.wantOverridden...)) {
+				t.Errorf("flags overriding the environment = %v, want %v", flagsOverridingEnvironment, test.wantOverridden)
+			}
+		})
+	}
+}
+
+func TestWarnAboutOverriddenEnvironment(t *testing.T) {
+	t.Setenv("CONTAINER_FACTORY_IMAGE_TAG", "v1")
+	if _, _, err := newTestEnvironmentCommand(t, []string{"-t", "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	warnAboutOverriddenEnvironment(&output)
+	if want := "Warning: --image-tag overrides $CONTAINER_FACTORY_IMAGE_TAG\n"; output.String() != want {
+		t.Errorf("warnings = %q, want %q", output.String(), want)
+	}
+}
+
+func TestCheckRemoteBuildFlags(t *testing.T) {
+	tests := []struct {
+		name        string
+		environment map[string]string
+		args        []string
+		want        string
+	}{
+		{"server only", nil, []string{"--server", "https://builds.test"}, ""},
+		{"local-only false", map[string]string{"CONTAINER_FACTORY_LOCAL_ONLY": "false"}, []string{"--server", "https://builds.test"}, ""},
+		{"local-only flag", nil, []string{"--server", "https://builds.test", "-l"},
+			"--local-only cannot be used with --server; the server always pushes the images it builds"},
+		{"local-only from the environment", map[string]string{"CONTAINER_FACTORY_LOCAL_ONLY": "true"}, []string{"--server", "https://builds.test"},
+			"--local-only (set by $CONTAINER_FACTORY_LOCAL_ONLY) cannot be used with --server; the server always pushes the images it builds"},
+		{"both from the environment", map[string]string{"CONTAINER_FACTORY_BUILDER": "buildx", "CONTAINER_FACTORY_SERVER": "https://builds.test"}, nil,
+			"--builder (set by $CONTAINER_FACTORY_BUILDER) cannot be used with --server (set by $CONTAINER_FACTORY_SERVER); the server uses the builder of its workspace configuration"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.environment {
+				t.Setenv(name, value)
+			}
+			cmd, _, err := newTestEnvironmentCommand(t, test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkRemoteBuildFlags(cmd)
+			if (test.want == "" && err != nil) || (test.want != "" && (err == nil || err.Error() != test.want)) {
+				t.Errorf("checkRemoteBuildFlags() = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
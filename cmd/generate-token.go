@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/fatih/color"
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/webserver"
+)
+
+// generateTokenCmd represents the generate-token command
+var generateTokenCmd = &cobra.Command{
+	Use:   "generate-token",
+	Short: "Generate an API token for the web service",
+	Long: `Generates a random API token and prints an entry for the serve --auth-tokens-file.
+Only the hash is stored in the tokens file; the token is shown once and should be handed to the caller.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		token, entry := generateToken(commandLineFlags.tokenName, commandLineFlags.tokenScopes)
+		color.White("Token: " + token)
+		color.White("")
+		color.White(entry)
+	},
+}
+
+// generateToken returns a random token and the entry for it in the tokens file
+func generateToken(name string, scopes []string) (string, string) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logger.Fatal(err)
+	}
+	token := hex.EncodeToString(b)
+
+	entry, err := yaml.Marshal(map[string]interface{}{
+		"tokens": []map[string]interface{}{
+			{
+				"name":         name,
+				"token_sha256": webserver.HashAPIToken(token),
+				"scopes":       scopes,
+			},
+		},
+	})
+	if err != nil {
+		panic("Failed to marshal yaml")
+	}
+	return token, string(entry)
+}
+
+func init() {
+	RootCmd.AddCommand(generateTokenCmd)
+
+	generateTokenCmd.Flags().StringVarP(&commandLineFlags.tokenName, "name", "n", "default", "Caller identity recorded for requests using this token")
+	generateTokenCmd.Flags().StringSliceVarP(&commandLineFlags.tokenScopes, "scope", "s", []string{"read"}, "Scopes granted to the token: read, build:base, build:deployment, manage:schedules, approve:builds, read:audit, agent or *")
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+
+	"go.mikenewswanger.com/container-factory/webserver"
+)
+
+func TestGenerateToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+	}{
+		{"default", []string{"read"}},
+		{"ci", []string{"read", "build:base", "build:deployment"}},
+		{"admin", []string{"*"}},
+	}
+	for _, test := range tests {
+		token, entry := generateToken(test.name, test.scopes)
+		var tokens struct {
+			Tokens []struct {
+				Name        string   `json:"name"`
+				TokenSHA256 string   `json:"token_sha256"`
+				Scopes      []string `json:"scopes"`
+			} `json:"tokens"`
+		}
+		if err := yaml.Unmarshal([]byte(entry), &tokens); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(token) != 64 || len(tokens.Tokens) != 1 {
+			t.Fatalf("%s: generated token %q with entry %s", test.name, token, entry)
+		}
+		got := tokens.Tokens[0]
+		if got.Name != test.name || got.TokenSHA256 != webserver.HashAPIToken(token) || !reflect.DeepEqual(got.Scopes, test.scopes) {
+			t.Errorf("%s: entry is %+v for token %s", test.name, got, token)
+		}
+	}
+	first, _ := generateToken("default", nil)
+	second, _ := generateToken("default", nil)
+	if first == second {
+		t.Error("The same token was generated twice")
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/client"
+)
+
+// jobsCmd lists the jobs of a server, or shows and follows a single job
+var jobsCmd = &cobra.Command{
+	Use:   "jobs [job-id]",
+	Short: "List jobs on a container-factory server, or show a single job",
+	Long:  `Requires --server.  With --follow, the log of the job is streamed until it finishes and the exit status reflects the outcome of the job.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !isRemote() {
+			exitWithError(errors.New("The jobs command requires --server"))
+		}
+		ctx := newInterruptibleContext()
+		c := newRemoteClient()
+
+		if len(args) == 0 {
+			jobs, err := c.ListJobs(ctx)
+			if err != nil {
+				exitWithError(err)
+			}
+			printJobs(jobs)
+			return
+		}
+
+		if commandLineFlags.followJob {
+			if err := followRemoteJob(ctx, c, args[0]); err != nil {
+				exitWithError(err)
+			}
+			return
+		}
+		job, err := c.GetJob(ctx, args[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		printJobs([]client.Job{job})
+	},
+}
+
+func printJobs(jobs []client.Job) {
+	switch commandLineFlags.outputFormat {
+	case "json":
+		output, err := json.Marshal(jobs)
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(string(output))
+	case "yaml":
+		output, err := yaml.Marshal(jobs)
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Print(string(output))
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTYPE\tSTATUS\tCREATED BY\tCREATED\tPARAMETERS")
+		for _, j := range jobs {
+			parameters := []string{}
+			for name, value := range j.Parameters {
+				parameters = append(parameters, name+"="+value)
+			}
+			sort.Strings(parameters)
+			fmt.Fprintln(w, strings.Join([]string{j.ID, j.Type, j.Status, j.CreatedBy, j.CreatedAt.Local().Format(time.RFC3339), strings.Join(parameters, " ")}, "\t"))
+		}
+		w.Flush()
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(jobsCmd)
+	jobsCmd.Flags().BoolVarP(&commandLineFlags.followJob, "follow", "f", false, "Stream the log of the job until it finishes")
+	jobsCmd.Flags().StringVarP(&commandLineFlags.outputFormat, "output-format", "o", "", "Specify output format.  Available options are stdout (default), json, and yaml")
+}
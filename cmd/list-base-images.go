@@ -16,11 +16,20 @@ var listBaseImagesCmd = &cobra.Command{
 	Short: "List Dockerfile Heirarchy",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		dockerbuild.SetLogger(logger)
-		dockerbuild.SetVerbosity(uint8(commandLineFlags.verbosity))
-		dockerbuild.SetDockerBaseDirectory(commandLineFlags.dockerBaseDirectory)
-
-		buildableImages, orphanImages := dockerbuild.GetBaseImageHeirarchy()
+		var buildableImages []dockerbuild.DockerBuildableImage
+		var orphanImages []dockerbuild.DockerOrphanedImage
+		if isRemote() {
+			hierarchy, err := newRemoteClient().ListBaseImages(newInterruptibleContext())
+			if err != nil {
+				exitWithError(err)
+			}
+			buildableImages, orphanImages = getRemoteBuildableImages(hierarchy.BuildableImages), getRemoteOrphanedImages(hierarchy.OrphanedImages)
+		} else {
+			dockerbuild.SetLogger(logger)
+			dockerbuild.SetVerbosity(uint8(commandLineFlags.verbosity))
+			dockerbuild.SetDockerBaseDirectory(commandLineFlags.dockerBaseDirectory)
+			buildableImages, orphanImages = dockerbuild.GetBaseImageHeirarchy()
+		}
 
 		switch commandLineFlags.outputFormat {
 		case "json":
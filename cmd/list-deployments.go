@@ -14,10 +14,18 @@ var listDeploymentsCmd = &cobra.Command{
 	Short: "List Configured Deployments",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		dockerbuild.SetLogger(logger)
-		dockerbuild.SetVerbosity(uint8(commandLineFlags.verbosity))
-		dockerbuild.SetDockerBaseDirectory(commandLineFlags.dockerBaseDirectory)
-		deployments := dockerbuild.GetDeployments()
+		var deployments []string
+		if isRemote() {
+			var err error
+			if deployments, err = newRemoteClient().ListDeployments(newInterruptibleContext()); err != nil {
+				exitWithError(err)
+			}
+		} else {
+			dockerbuild.SetLogger(logger)
+			dockerbuild.SetVerbosity(uint8(commandLineFlags.verbosity))
+			dockerbuild.SetDockerBaseDirectory(commandLineFlags.dockerBaseDirectory)
+			deployments = dockerbuild.GetDeployments()
+		}
 		sort.Strings(deployments)
 		for _, d := range deployments {
 			println(d)
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/utilities/filesystem"
+)
+
+// Where an effective workspace setting came from, in order of precedence
+const (
+	settingSourceFlag    = "flag"
+	settingSourceEnv     = "env"
+	settingSourceProfile = "profile"
+	settingSourceFile    = "file"
+	settingSourceDefault = "default"
+)
+
+// projectSetting maps a key of container-factory.yaml to the flag overriding it, which is also set by its environment variable
+type projectSetting struct {
+	key string
+	// Empty for settings that only come from the file
+	flag string
+}
+
+// Order settings are shown in by config show
+var projectSettings = []projectSetting{
+	{key: "registry_base_path", flag: "registry-base-path"},
+	{key: "tag_strategy", flag: "tag-strategy"},
+	{key: "builder", flag: "builder"},
+	{key: "concurrency", flag: "concurrency"},
+	{key: "ignore"},
+	{key: "deployment_prefix"},
+	{key: "build_args"},
+}
+
+// effectiveProjectConfig is the workspace configuration after layering flags, environment variables, the file and defaults
+type effectiveProjectConfig struct {
+	// container-factory.yaml that was read; empty if there was none
+	File string
+	// Absolute docker base directory
+	Directory string
+	Config    dockerbuild.ProjectConfig
+	Sources   map[string]string
+	// Selected with --profile; empty when no profile is used
+	Profile       string
+	ProfileConfig dockerbuild.ProfileConfig
+}
+
+// resolveProjectConfig layers flags over environment variables over the selected profile over container-factory.yaml in the docker base directory over defaults
+func resolveProjectConfig(cmd *cobra.Command) (effectiveProjectConfig, error) {
+	effective := effectiveProjectConfig{
+		Sources: map[string]string{},
+		Profile: commandLineFlags.profile,
+	}
+	file := &dockerbuild.ProjectConfig{}
+	if commandLineFlags.dockerBaseDirectory != "" {
+		var err error
+		if effective.Directory, err = filesystem.BuildAbsolutePathFromHome(commandLineFlags.dockerBaseDirectory); err != nil {
+			return effective, err
+		}
+		read, err := dockerbuild.ReadProjectConfig(effective.Directory)
+		if err != nil {
+			return effective, err
+		}
+		if read != nil {
+			file = read
+			effective.File = filesystem.ForceTrailingSlash(effective.Directory) + dockerbuild.ProjectConfigFilename
+		}
+	}
+	if effective.Profile != "" {
+		var err error
+		if effective.ProfileConfig, err = file.GetProfile(effective.Profile); err != nil {
+			return effective, errors.New("Profile does not exist in " + dockerbuild.ProjectConfigFilename + ": " + effective.Profile)
+		}
+	}
+	values := map[string]string{
+		"registry_base_path": commandLineFlags.dockerRegistryBasePath,
+		"tag_strategy":       commandLineFlags.tagStrategy,
+		"builder":            commandLineFlags.builder,
+		"concurrency":        strconv.Itoa(commandLineFlags.concurrency),
+	}
+	fileValues := map[string]string{
+		"registry_base_path": file.RegistryBasePath,
+		"tag_strategy":       file.TagStrategy,
+		"builder":            file.Builder,
+	}
+	if file.Concurrency != 0 {
+		fileValues["concurrency"] = strconv.Itoa(file.Concurrency)
+	}
+	for _, s := range projectSettings {
+		if s.flag == "" {
+			continue
+		}
+		if flag := cmd.Flags().Lookup(s.flag); flag != nil && flag.Changed {
+			effective.Sources[s.key] = settingSourceFlag
+		} else if value := os.Getenv(getFlagEnvironmentVariable(s.flag)); value != "" {
+			values[s.key] = value
+			effective.Sources[s.key] = settingSourceEnv
+		} else if s.key == "registry_base_path" && effective.ProfileConfig.RegistryBasePath != "" {
+			values[s.key] = effective.ProfileConfig.RegistryBasePath
+			effective.Sources[s.key] = settingSourceProfile
+		} else if fileValues[s.key] != "" {
+			values[s.key] = fileValues[s.key]
+			effective.Sources[s.key] = settingSourceFile
+		} else {
+			values[s.key] = ""
+			effective.Sources[s.key] = settingSourceDefault
+		}
+	}
+
+	effective.Config = dockerbuild.ProjectConfig{
+		RegistryBasePath: values["registry_base_path"],
+		TagStrategy:      values["tag_strategy"],
+		Builder:          values["builder"],
+		Ignore:           file.Ignore,
+		DeploymentPrefix: file.DeploymentPrefix,
+		BuildArgs:        file.BuildArgs,
+		Profiles:         file.Profiles,
+	}
+	if values["concurrency"] != "" {
+		concurrency, err := strconv.Atoi(values["concurrency"])
+		if err != nil {
+			return effective, errors.New("Invalid concurrency; it must be a number: " + values["concurrency"])
+		}
+		effective.Config.Concurrency = concurrency
+	}
+	if err := effective.Config.Validate(); err != nil {
+		return effective, err
+	}
+	effective.Config = effective.Config.WithDefaults()
+	for key, fileSet := range map[string]bool{
+		"ignore":            len(file.Ignore) > 0,
+		"deployment_prefix": file.DeploymentPrefix != "",
+		"build_args":        len(file.BuildArgs) > 0,
+	} {
+		if fileSet {
+			effective.Sources[key] = settingSourceFile
+		} else {
+			effective.Sources[key] = settingSourceDefault
+		}
+	}
+	return effective, nil
+}
+
+// applyProjectConfig resolves the workspace configuration and profile for a local build, exiting if they are invalid
+// The registry base path, image tag and local-only flags are updated to their effective values; the returned context carries the other settings
+// Build args of --build-arg-file and --build-arg take precedence over those of the profile
+func applyProjectConfig(cmd *cobra.Command) context.Context {
+	effective, err := resolveProjectConfig(cmd)
+	if err != nil {
+		exitWithError(err)
+	}
+	commandLineFlags.dockerRegistryBasePath = effective.Config.RegistryBasePath
+	buildArgs, err := getCommandLineBuildArgs()
+	if err != nil {
+		exitWithError(err)
+	}
+	ctx := dockerbuild.WithProjectConfig(newInterruptibleContext(), effective.Config)
+	if effective.Profile == "" {
+		if len(buildArgs) > 0 {
+			ctx = dockerbuild.WithBuildArgs(ctx, buildArgs)
+		}
+		return ctx
+	}
+
+	if effective.ProfileConfig.Protected {
+		exitWithError(errors.New("Profile " + effective.Profile + " is protected; build it with --server so the job can be approved"))
+	}
+	if !effective.ProfileConfig.ShouldPush() {
+		commandLineFlags.localOnly = true
+	}
+	if commandLineFlags.imageTag == "" {
+		if commandLineFlags.imageTag, err = effective.ProfileConfig.RenderTag(effective.Profile, effective.Directory); err != nil {
+			exitWithError(err)
+		}
+	}
+	if buildArgs = dockerbuild.MergeBuildArgs(effective.ProfileConfig.BuildArgs, buildArgs); len(buildArgs) > 0 {
+		ctx = dockerbuild.WithBuildArgs(ctx, buildArgs)
+	}
+	return ctx
+}
+
+// addProjectConfigFlags adds the flags overriding container-factory.yaml to a command building locally
+func addProjectConfigFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&commandLineFlags.tagStrategy, "tag-strategy", "", "", "Tag built when no tag is given: user, git-commit or timestamp; overrides tag_strategy of "+dockerbuild.ProjectConfigFilename)
+	cmd.Flags().StringVarP(&commandLineFlags.builder, "builder", "", "", "Builder backend: docker or buildx; overrides builder of "+dockerbuild.ProjectConfigFilename)
+	cmd.Flags().IntVarP(&commandLineFlags.concurrency, "concurrency", "", 0, "Maximum number of base images built at once, 0 is unlimited; overrides concurrency of "+dockerbuild.ProjectConfigFilename)
+	cmd.Flags().StringVarP(&commandLineFlags.profile, "profile", "", "", "Profile of "+dockerbuild.ProjectConfigFilename+" to build with, i.e. prod")
+}
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// rejectJobCmd rejects a job waiting to build a protected tag
+var rejectJobCmd = &cobra.Command{
+	Use:   "reject-job <job-id>",
+	Short: "Reject a job waiting to build a protected tag on a container-factory server",
+	Long:  `Requires --server and a token with the approve:builds scope.  The job finishes with the rejected status without building.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		decideRemoteJob(args, false)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rejectJobCmd)
+	rejectJobCmd.Flags().StringVarP(&commandLineFlags.approvalComment, "comment", "m", "", "Reason recorded with the rejection")
+	rejectJobCmd.Flags().StringVarP(&commandLineFlags.outputFormat, "output-format", "o", "", "Specify output format.  Available options are stdout (default), json, and yaml")
+}
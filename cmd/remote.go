@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/client"
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// Flags of the build commands that a build on a server cannot honor, and why
+var localBuildFlags = []struct {
+	name   string
+	reason string
+}{
+	{"local-only", "the server always pushes the images it builds"},
+	{"tag-strategy", "the server tags builds without a tag from its workspace"},
+	{"builder", "the server uses the builder of its workspace configuration"},
+	{"concurrency", "the server uses the concurrency of its workspace configuration"},
+}
+
+// checkRemoteBuildFlags returns an error naming the flags or environment variables of cmd a build on a server would ignore
+func checkRemoteBuildFlags(cmd *cobra.Command) error {
+	for _, l := range localBuildFlags {
+		f := cmd.Flags().Lookup(l.name)
+		if f == nil || (!f.Changed && flagsFromEnvironment[l.name] == "") || (f.Value.Type() == "bool" && f.Value.String() == "false") {
+			continue
+		}
+		return errors.New(describeFlag(l.name) + " cannot be used with " + describeFlag("server") + "; " + l.reason)
+	}
+	return nil
+}
+
+func newRemoteClient() *client.Client {
+	return client.New(commandLineFlags.server, commandLineFlags.serverToken)
+}
+
+func isRemote() bool {
+	return commandLineFlags.server != ""
+}
+
+// followRemoteJob copies the log of a job to stdout until it finishes and returns an error unless it succeeded
+// Interrupting stops following; the job keeps running on the server
+func followRemoteJob(ctx context.Context, c *client.Client, id string) error {
+	logger.WithFields(logrus.Fields{
+		"job_id": id,
+	}).Debug("Following job on server")
+	job, err := c.WaitForJob(ctx, id, os.Stdout)
+	if ctx.Err() != nil {
+		return errors.New("Stopped following job " + id + "; it continues on the server")
+	} else if err != nil {
+		return err
+	}
+	if job.Status != client.JobStatusSucceeded {
+		return errors.New("Job " + id + " " + job.Status + ": " + job.Error)
+	}
+	return nil
+}
+
+// getRemoteBuildableImages converts base images listed by a server so they print the same as a local inventory
+func getRemoteBuildableImages(images []client.BaseImage) []dockerbuild.DockerBuildableImage {
+	l := make([]dockerbuild.DockerBuildableImage, 0, len(images))
+	for _, i := range images {
+		image := dockerbuild.DockerBuildableImage{
+			Name:     i.Name,
+			Children: getRemoteBuildableImages(i.Children),
+		}
+		if i.Metadata != nil {
+			image.Metadata = &dockerbuild.ImageMetadata{
+				Description:        i.Metadata.Description,
+				Owners:             i.Metadata.Owners,
+				BuildArgs:          i.Metadata.BuildArgs,
+				PropagateBuildArgs: i.Metadata.PropagateBuildArgs,
+				Labels:             i.Metadata.Labels,
+				ExtraTags:          i.Metadata.ExtraTags,
+				Platforms:          i.Metadata.Platforms,
+				Timeout:            i.Metadata.Timeout,
+				CachePolicy:        i.Metadata.CachePolicy,
+				Disabled:           i.Metadata.Disabled,
+			}
+		}
+		l = append(l, image)
+	}
+	return l
+}
+
+func getRemoteOrphanedImages(images []client.OrphanedImage) []dockerbuild.DockerOrphanedImage {
+	l := make([]dockerbuild.DockerOrphanedImage, 0, len(images))
+	for _, i := range images {
+		l = append(l, dockerbuild.DockerOrphanedImage{
+			Name:       i.Name,
+			ParentName: i.ParentName,
+		})
+	}
+	return l
+}
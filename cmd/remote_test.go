@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.mikenewswanger.com/container-factory/client"
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// newTestJobServer serves the log and status of the job with the given ID, or 404 for any other job
+func newTestJobServer(t *testing.T, id string, status string, jobError string) *client.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("%s was requested with Authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		switch r.URL.Path {
+		case "/api/v2/jobs/" + id + "/logs":
+			if r.URL.Query().Get("follow") != "true" {
+				t.Error("Job log was not followed")
+			}
+			w.Write([]byte("Building image\n"))
+		case "/api/v2/jobs/" + id:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"job": client.Job{ID: id, Status: status, Error: jobError},
+			})
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error": {"code": "job_not_found", "message": "Job does not exist"}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return client.New(server.URL+"/", "token")
+}
+
+func TestFollowRemoteJob(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		id       string
+		status   string
+		jobError string
+		want     string
+	}{
+		{"succeeded", context.Background(), "job-1", client.JobStatusSucceeded, "", ""},
+		{"failed", context.Background(), "job-1", client.JobStatusFailed, "Base images failed to build: app", "Job job-1 failed: Base images failed to build: app"},
+		{"rejected", context.Background(), "job-1", client.JobStatusRejected, "Rejected by release-manager", "Job job-1 rejected: Rejected by release-manager"},
+		{"missing", context.Background(), "job-2", client.JobStatusSucceeded, "", "Job does not exist"},
+		{"interrupted", cancelled, "job-1", client.JobStatusSucceeded, "", "Stopped following job job-1; it continues on the server"},
+	}
+	for _, test := range tests {
+		c := newTestJobServer(t, "job-1", test.status, test.jobError)
+		err := followRemoteJob(test.ctx, c, test.id)
+		if (test.want == "" && err != nil) || (test.want != "" && (err == nil || err.Error() != test.want)) {
+			t.Errorf("%s: followRemoteJob() = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestGetRemoteImages(t *testing.T) {
+	images := getRemoteBuildableImages([]client.BaseImage{
+		{
+			Name: "root",
+			Metadata: &client.ImageMetadata{
+				Description: "Base of every image",
+				Owners:      []string{"platform"},
+				BuildArgs:   map[string]string{"VERSION": "3"},
+				ExtraTags:   []string{"latest"},
+				Disabled:    true,
+			},
+			Children: []client.BaseImage{{Name: "child"}},
+		},
+	})
+	want := []dockerbuild.DockerBuildableImage{
+		{
+			Name: "root",
+			Metadata: &dockerbuild.ImageMetadata{
+				Description: "Base of every image",
+				Owners:      []string{"platform"},
+				BuildArgs:   map[string]string{"VERSION": "3"},
+				ExtraTags:   []string{"latest"},
+				Disabled:    true,
+			},
+			Children: []dockerbuild.DockerBuildableImage{{Name: "child", Children: []dockerbuild.DockerBuildableImage{}}},
+		},
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("getRemoteBuildableImages() = %+v, want %+v", images, want)
+	}
+
+	orphans := getRemoteOrphanedImages([]client.OrphanedImage{{Name: "lost", ParentName: "missing"}})
+	if !reflect.DeepEqual(orphans, []dockerbuild.DockerOrphanedImage{{Name: "lost", ParentName: "missing"}}) {
+		t.Errorf("getRemoteOrphanedImages() = %+v", orphans)
+	}
+}
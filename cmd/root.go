@@ -1,27 +1,60 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+
+	"go.mikenewswanger.com/container-factory/tracing"
 )
 
 type flags struct {
 	verbosity              int
+	agentCapacity          int
+	agentName              string
+	agentPlatform          string
+	agentWorkDirectory     string
+	approvalComment        string
+	authTokensFile         string
+	buildArgFile           string
+	buildArgs              []string
+	builder                string
+	concurrency            int
 	deploymentImageTag     string
 	dockerBaseDirectory    string
 	dockerRegistryBasePath string
+	followJob              bool
 	forceRebuild           bool
 	imageTag               string
 	listenPort             uint16
 	localOnly              bool
+	otlpEndpoint           string
+	maxConcurrentJobs      int
 	outputFormat           string
+	profile                string
+	server                 string
+	serverToken            string
+	serverConfigFile       string
+	shutdownTimeout        time.Duration
+	tagStrategy            string
+	tlsCertFile            string
+	tlsClientCAFile        string
+	tlsKeyFile             string
+	tokenName              string
+	tokenScopes            []string
 }
 
 var commandLineFlags = flags{}
 
+// Version is the release of the build tool; set at build time with -ldflags "-X go.mikenewswanger.com/container-factory/cmd.Version=..."
+var Version = "dev"
+
 var logger = logrus.New()
 
 // RootCmd represents the base command when called without any subcommands
@@ -30,6 +63,7 @@ var RootCmd = &cobra.Command{
 	Short: "Container Image Build Tool",
 	Long:  ``,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		envErr := applyEnvironmentVariables(cmd)
 		switch commandLineFlags.verbosity {
 		case 0:
 			logger.Level = logrus.ErrorLevel
@@ -47,21 +81,61 @@ var RootCmd = &cobra.Command{
 			break
 		}
 
+		if envErr != nil {
+			exitWithError(envErr)
+		}
+		warnAboutOverriddenEnvironment(os.Stderr)
+
+		tracing.Configure(commandLineFlags.otlpEndpoint, "container-factory", logger)
+
 		logger.Debug("Pre-run complete")
 	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		flushTraces()
+	},
 }
 
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	addEnvironmentVariableUsage(RootCmd)
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
 }
 
+// flushTraces exports any spans still buffered; it must run before the process exits
+func flushTraces() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tracing.Shutdown(ctx)
+}
+
+// exitWithError flushes traces, then logs err and exits with a non-zero status
+func exitWithError(err error) {
+	flushTraces()
+	logger.Fatal(err)
+}
+
+// newInterruptibleContext returns a context that is cancelled when the process receives SIGINT or SIGTERM
+func newInterruptibleContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Warn("Interrupted; stopping the build")
+		cancel()
+	}()
+	return ctx
+}
+
 func init() {
 	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.dockerRegistryBasePath, "registry-base-path", "p", "", "Image Registry Base Path i.e. registry.example.com")
 	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.dockerBaseDirectory, "digest-base-directory", "d", "", "Base Directory for build assets")
 	RootCmd.PersistentFlags().CountVarP(&commandLineFlags.verbosity, "verbosity", "v", "Output verbosity")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.server, "server", "", "", "Run builds and listings on a container-factory server, i.e. https://builds.example.com, instead of locally")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.serverToken, "token", "", "", "API token for --server")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.otlpEndpoint, "otlp-endpoint", "", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to export build traces to, i.e. http://localhost:4318; defaults to $OTEL_EXPORTER_OTLP_ENDPOINT")
 }
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 
 	"go.mikenewswanger.com/container-factory/webserver"
@@ -12,10 +14,26 @@ var serveCmd = &cobra.Command{
 	Short: "Run a web service to interact with the build tool",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
+		// Only the registry base path applies; builds take their other settings from the configuration file of each workspace
+		effective, err := resolveProjectConfig(cmd)
+		if err != nil {
+			exitWithError(err)
+		}
+		commandLineFlags.dockerRegistryBasePath = effective.Config.RegistryBasePath
 		webserver.Serve(
-			commandLineFlags.dockerBaseDirectory,
-			commandLineFlags.dockerRegistryBasePath,
-			commandLineFlags.listenPort,
+			webserver.ServerOptions{
+				DockerBaseDirectory:    commandLineFlags.dockerBaseDirectory,
+				DockerRegistryBasePath: commandLineFlags.dockerRegistryBasePath,
+				ListenPort:             commandLineFlags.listenPort,
+				AuthTokensFile:         commandLineFlags.authTokensFile,
+				TLSCertFile:            commandLineFlags.tlsCertFile,
+				TLSKeyFile:             commandLineFlags.tlsKeyFile,
+				TLSClientCAFile:        commandLineFlags.tlsClientCAFile,
+				MaxConcurrentJobs:      commandLineFlags.maxConcurrentJobs,
+				ShutdownTimeout:        commandLineFlags.shutdownTimeout,
+				Version:                Version,
+				ConfigFile:             commandLineFlags.serverConfigFile,
+			},
 			logger,
 			uint8(commandLineFlags.verbosity),
 		)
@@ -26,4 +44,11 @@ func init() {
 	RootCmd.AddCommand(serveCmd)
 
 	serveCmd.Flags().Uint16VarP(&commandLineFlags.listenPort, "listen-port", "l", 8080, "Port for web server to listen on")
+	serveCmd.Flags().StringVarP(&commandLineFlags.authTokensFile, "auth-tokens-file", "", "", "YAML file of hashed API tokens and their scopes; see generate-token")
+	serveCmd.Flags().StringVarP(&commandLineFlags.serverConfigFile, "server-config", "", "", "YAML file of additional server settings such as webhooks")
+	serveCmd.Flags().StringVarP(&commandLineFlags.tlsCertFile, "tls-cert", "", "", "PEM certificate to serve the web API over TLS; reloaded on SIGHUP")
+	serveCmd.Flags().StringVarP(&commandLineFlags.tlsKeyFile, "tls-key", "", "", "PEM private key for --tls-cert")
+	serveCmd.Flags().StringVarP(&commandLineFlags.tlsClientCAFile, "client-ca", "", "", "PEM CA bundle; when set, clients must present a certificate signed by it")
+	serveCmd.Flags().IntVarP(&commandLineFlags.maxConcurrentJobs, "max-concurrent-jobs", "", 0, "Maximum number of build jobs running at once; additional jobs are queued.  0 (the default) is unlimited")
+	serveCmd.Flags().DurationVarP(&commandLineFlags.shutdownTimeout, "shutdown-timeout", "", 5*time.Minute, "Time running jobs are given to finish on SIGTERM before they are cancelled")
 }
@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// versionCmd represents the version command
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version of the build tool",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		color.White(Version)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(versionCmd)
+}
@@ -0,0 +1,128 @@
+package dockerbuild
+
+import (
+	"sort"
+	"strings"
+
+	"go.mikenewswanger.com/utilities/filesystem"
+)
+
+// GetAffectedBuilds maps changed paths, relative to the docker base directory, to the builds they affect
+// Returns the changed base images and every deployment that changed or is built from a changed image or its descendants
+// Paths outside of dockerfiles/ and deployments/, and images no longer in the inventory, are ignored
+func GetAffectedBuilds(paths []string) (images []string, affectedDeployments []string) {
+	inv := getDefaultInventory()
+	if inv == nil {
+		return []string{}, []string{}
+	}
+	return inv.GetAffectedBuilds(paths, nil, "")
+}
+
+// GetAffectedBuilds maps changed paths, relative to the docker base directory, to the builds they affect in the inventory
+// Images and deployments whose build args from the workspace configuration, the named profile and image metadata differ from those of previous are also affected
+// When previous is nil and the configuration file changed, every build is affected if the configuration or the profile has build args
+func (inv *Inventory) GetAffectedBuilds(paths []string, previous *Inventory, profile string) (images []string, affectedDeployments []string) {
+	changedImages := map[string]bool{}
+	changedDeployments := map[string]bool{}
+	configChanged := false
+	for _, p := range paths {
+		p = strings.TrimPrefix(p, "/")
+		if p == ProjectConfigFilename {
+			configChanged = true
+		} else if strings.HasPrefix(p, "dockerfiles/") {
+			name := strings.TrimPrefix(p, "dockerfiles/")
+			if inv.BaseImageExists(name) {
+				changedImages[name] = true
+			} else if name = strings.TrimSuffix(name, imageMetadataExtension); inv.BaseImageExists(name) {
+				// Sidecar metadata changes how the image is built
+				changedImages[name] = true
+			}
+		} else if strings.HasPrefix(p, "deployments/") {
+			if name := strings.TrimPrefix(p, "deployments/"); inv.DeploymentExists(name) {
+				changedDeployments[name] = true
+			}
+		}
+	}
+
+	if previous != nil {
+		// Profile args take precedence over those of the image metadata, like the other args of the build run
+		profileArgs, previousProfileArgs := inv.getProfileBuildArgs(profile), previous.getProfileBuildArgs(profile)
+		for name := range inv.baseImageDockerfiles {
+			if _, existed := previous.baseImageDockerfiles[name]; existed && !buildArgsEqual(
+				MergeBuildArgs(inv.getImageBuildArgs(inv.config.BuildArgs, name), profileArgs),
+				MergeBuildArgs(previous.getImageBuildArgs(previous.config.BuildArgs, name), previousProfileArgs),
+			) {
+				changedImages[name] = true
+			}
+		}
+		for _, d := range inv.deployments {
+			if previous.DeploymentExists(d) && !buildArgsEqual(
+				MergeBuildArgs(inv.getDeploymentBuildArgs(inv.config.BuildArgs, d), profileArgs),
+				MergeBuildArgs(previous.getDeploymentBuildArgs(previous.config.BuildArgs, d), previousProfileArgs),
+			) {
+				changedDeployments[d] = true
+			}
+		}
+	} else if configChanged && (len(inv.config.BuildArgs) > 0 || len(inv.getProfileBuildArgs(profile)) > 0) {
+		for name := range inv.baseImageDockerfiles {
+			changedImages[name] = true
+		}
+		for _, d := range inv.deployments {
+			changedDeployments[d] = true
+		}
+	}
+
+	for _, d := range inv.deployments {
+		if changedDeployments[d] {
+			continue
+		}
+		for _, parent := range getDeploymentDependencies(inv.deploymentDirectory + d) {
+			if inv.isAffectedImage(parent, changedImages) {
+				changedDeployments[d] = true
+				break
+			}
+		}
+	}
+
+	images = []string{}
+	for name := range changedImages {
+		images = append(images, name)
+	}
+	affectedDeployments = []string{}
+	for name := range changedDeployments {
+		affectedDeployments = append(affectedDeployments, name)
+	}
+	sort.Strings(images)
+	sort.Strings(affectedDeployments)
+	return images, affectedDeployments
+}
+
+// isAffectedImage reports whether the image or any of its ancestors changed
+func (inv *Inventory) isAffectedImage(name string, changedImages map[string]bool) bool {
+	for name != "" {
+		if changedImages[name] {
+			return true
+		}
+		df, exists := inv.baseImageDockerfiles[name]
+		if !exists {
+			return false
+		}
+		name = df.parentName
+	}
+	return false
+}
+
+// getDeploymentDependencies returns every internal image referenced by a deployment, including earlier build stages
+func getDeploymentDependencies(deploymentFilename string) []string {
+	fileContents, err := filesystem.LoadFileString(deploymentFilename)
+	if err != nil {
+		return nil
+	}
+	dependencies := []string{}
+	for _, match := range fromSplitRegex.FindAllStringSubmatch(fileContents, -1) {
+		if len(match[2]) > 0 {
+			dependencies = append(dependencies, match[3])
+		}
+	}
+	return dependencies
+}
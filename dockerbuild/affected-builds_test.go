@@ -0,0 +1,103 @@
+package dockerbuild
+
+import (
+	"reflect"
+	"testing"
+)
+
+// affectedBuildsTestFiles is a hierarchy root > child with a deployment built from each image and one from an external image
+var affectedBuildsTestFiles = map[string]string{
+	"container-factory.yaml":  "build_args: {REGION: eu}\nprofiles:\n  production:\n    build_args: {STAGE: production}\n",
+	"dockerfiles/root":        "FROM alpine:3\n",
+	"dockerfiles/root.yaml":   "build_args: {VERSION: \"1\"}\npropagate_build_args: [VERSION]\n",
+	"dockerfiles/child":       "FROM {{ local }}/root\n",
+	"dockerfiles/other":       "FROM alpine:3\n",
+	"deployments/root-app":    "FROM {{ local }}/root\n",
+	"deployments/child-app":   "FROM {{ local }}/child\n",
+	"deployments/other-app":   "FROM {{ local }}/other\n",
+	"deployments/external":    "FROM alpine:3\n",
+	"deployments/nested/tool": "FROM {{ local }}/child AS build\nFROM alpine:3\n",
+}
+
+// withTestFiles returns a copy of files with changes applied
+func withTestFiles(files map[string]string, changes map[string]string) map[string]string {
+	merged := map[string]string{}
+	for name, contents := range files {
+		merged[name] = contents
+	}
+	for name, contents := range changes {
+		merged[name] = contents
+	}
+	return merged
+}
+
+func TestGetAffectedBuilds(t *testing.T) {
+	inv := loadTestInventory(t, affectedBuildsTestFiles)
+	tests := []struct {
+		name            string
+		paths           []string
+		wantImages      []string
+		wantDeployments []string
+	}{
+		{"nothing", []string{"readme.md"}, []string{}, []string{}},
+		{"root image", []string{"dockerfiles/root"}, []string{"root"}, []string{"child-app", "nested/tool", "root-app"}},
+		{"leaf image", []string{"/dockerfiles/other"}, []string{"other"}, []string{"other-app"}},
+		{"image metadata", []string{"dockerfiles/root.yaml"}, []string{"root"}, []string{"child-app", "nested/tool", "root-app"}},
+		{"deployment", []string{"deployments/external"}, []string{}, []string{"external"}},
+		{"nested deployment", []string{"deployments/nested/tool"}, []string{}, []string{"nested/tool"}},
+		{"removed image", []string{"dockerfiles/removed"}, []string{}, []string{}},
+		// Without the previous configuration, every build is affected since the configuration has build args
+		{"configuration", []string{"container-factory.yaml"}, []string{"child", "other", "root"}, []string{"child-app", "external", "nested/tool", "other-app", "root-app"}},
+	}
+	for _, test := range tests {
+		images, deployments := inv.GetAffectedBuilds(test.paths, nil, "")
+		if !reflect.DeepEqual(images, test.wantImages) || !reflect.DeepEqual(deployments, test.wantDeployments) {
+			t.Errorf("%s: GetAffectedBuilds(%v) = %v, %v; want %v, %v", test.name, test.paths, images, deployments, test.wantImages, test.wantDeployments)
+		}
+	}
+}
+
+func TestGetAffectedBuildsComparesBuildArgs(t *testing.T) {
+	previous := loadTestInventory(t, affectedBuildsTestFiles)
+	tests := []struct {
+		name    string
+		changes map[string]string
+		profile string
+		// Paths changed along with the configuration file
+		paths           []string
+		wantImages      []string
+		wantDeployments []string
+	}{
+		{"unchanged args", map[string]string{
+			"container-factory.yaml": "build_args: {REGION: eu}\nconcurrency: 2\nprofiles:\n  production:\n    build_args: {STAGE: production}\n",
+		}, "", nil, []string{}, []string{}},
+		{"workspace args", map[string]string{
+			"container-factory.yaml": "build_args: {REGION: us}\nprofiles:\n  production:\n    build_args: {STAGE: production}\n",
+		}, "", nil, []string{"child", "other", "root"}, []string{"child-app", "external", "nested/tool", "other-app", "root-app"}},
+		{"args of another profile", map[string]string{
+			"container-factory.yaml": "build_args: {REGION: eu}\nprofiles:\n  production:\n    build_args: {STAGE: staging}\n",
+		}, "", nil, []string{}, []string{}},
+		{"args of the profile", map[string]string{
+			"container-factory.yaml": "build_args: {REGION: eu}\nprofiles:\n  production:\n    build_args: {STAGE: staging}\n",
+		}, "production", nil, []string{"child", "other", "root"}, []string{"child-app", "external", "nested/tool", "other-app", "root-app"}},
+		// The image changed itself; its descendants and deployments are rebuilt with it
+		{"propagated args", map[string]string{
+			"dockerfiles/root.yaml": "build_args: {VERSION: \"2\"}\npropagate_build_args: [VERSION]\n",
+		}, "", []string{"dockerfiles/root.yaml"}, []string{"child", "root"}, []string{"child-app", "nested/tool", "root-app"}},
+		{"new propagated arg", map[string]string{
+			"dockerfiles/root.yaml": "build_args: {VERSION: \"1\", REGION: us}\npropagate_build_args: [VERSION, REGION]\n",
+		}, "", []string{"dockerfiles/root.yaml"}, []string{"child", "root"}, []string{"child-app", "nested/tool", "root-app"}},
+		{"new image and deployment", map[string]string{
+			"dockerfiles/new": "FROM alpine:3\n",
+			"deployments/new": "FROM {{ local }}/new\n",
+		}, "", nil, []string{}, []string{}},
+	}
+	for _, test := range tests {
+		inv := loadTestInventory(t, withTestFiles(affectedBuildsTestFiles, test.changes))
+		paths := append([]string{ProjectConfigFilename}, test.paths...)
+		images, deployments := inv.GetAffectedBuilds(paths, previous, test.profile)
+		if !reflect.DeepEqual(images, test.wantImages) || !reflect.DeepEqual(deployments, test.wantDeployments) {
+			t.Errorf("%s: GetAffectedBuilds() = %v, %v; want %v, %v", test.name, images, deployments, test.wantImages, test.wantDeployments)
+		}
+	}
+}
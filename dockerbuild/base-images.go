@@ -3,107 +3,417 @@ package dockerbuild
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"io/ioutil"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
-	"go.mikenewswanger.com/utilities/executil"
+	"go.mikenewswanger.com/container-factory/tracing"
 	"go.mikenewswanger.com/utilities/filesystem"
 )
 
 // BuildBaseImages builds all docker images by heirarchy
-func BuildBaseImages(dockerRegistryBasePath string, tag string, forceRebuild bool, pushToRemote bool) {
-	tag = getDefaultTag(tag)
+// Returns an error if any image failed to build or push, or ErrBuildCancelled if ctx was cancelled
+func BuildBaseImages(ctx context.Context, dockerRegistryBasePath string, tag string, forceRebuild bool, pushToRemote bool) error {
+	return BuildBaseImageSubtrees(ctx, dockerRegistryBasePath, tag, nil, forceRebuild, pushToRemote)
+}
 
-	logger.WithFields(logrus.Fields{
-		"tag": tag,
-	}).Info("Building all images")
+// BuildBaseImageSubtrees builds the named base images and all of their descendants
+// Parents of the named images must already be available at the same tag; all images are built when images is empty
+func BuildBaseImageSubtrees(ctx context.Context, dockerRegistryBasePath string, tag string, images []string, forceRebuild bool, pushToRemote bool) (err error) {
+	if tag, err = getDefaultTag(ctx, tag); err != nil {
+		getLogger(ctx).Error(err)
+		return err
+	}
+
+	ctx, span := tracing.Start(ctx, "build-base-images",
+		tracing.String("registry.base_path", dockerRegistryBasePath),
+		tracing.String("image.tag", tag),
+		tracing.String("build.images", strings.Join(images, ",")),
+		tracing.Bool("build.force_rebuild", forceRebuild),
+		tracing.Bool("build.push", pushToRemote),
+	)
+	defer func() {
+		span.End(err)
+	}()
+	log := getLogger(ctx)
+
+	inv := getInventory(ctx)
+	if inv == nil {
+		log.Error(ErrInventoryNotLoaded)
+		return ErrInventoryNotLoaded
+	}
+	roots, err := inv.getSubtreeRoots(images)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(images) > 0 {
+		log.WithFields(logrus.Fields{
+			"tag":    tag,
+			"images": strings.Join(images, ", "),
+		}).Info("Building image subtrees")
+	} else {
+		log.WithFields(logrus.Fields{
+			"tag": tag,
+		}).Info("Building all images")
+	}
 
 	if forceRebuild {
-		logger.Warn("Forcing a rebuild.  Caches will not be used.")
+		log.Warn("Forcing a rebuild.  Caches will not be used.")
 	}
 	if !pushToRemote {
-		logger.Warn("Push to remote is disabled")
+		log.Warn("Push to remote is disabled")
 	}
 
-	tempDir, _ := ioutil.TempDir(dockerfileDirectory, ".tmp-")
+	tempDir, _ := ioutil.TempDir(inv.dockerfileDirectory, ".tmp-")
 	defer filesystem.RemoveDirectory(tempDir, true)
-	logger.WithFields(logrus.Fields{
+	log.WithFields(logrus.Fields{
 		"path": tempDir,
 	}).Debug("Created temp directory")
 
+	var b = baseImagesBuild{
+		ctx:              ctx,
+		inventory:        inv,
+		tempDir:          tempDir,
+		registryBasePath: dockerRegistryBasePath,
+		tag:              tag,
+		forceRebuild:     forceRebuild,
+		pushToRemote:     pushToRemote,
+	}
+	if concurrency := getProjectConfig(ctx).Concurrency; concurrency > 0 {
+		b.buildSlots = make(chan struct{}, concurrency)
+	}
 	var waitGroup = sync.WaitGroup{}
 	waitGroup.Add(1)
 	go func() {
 		defer waitGroup.Done()
-		buildBaseImagesWithChildren(tempDir, dockerRegistryBasePath, tag, "", forceRebuild, pushToRemote)
+		b.buildImages(roots)
 	}()
 	waitGroup.Wait()
+
+	if ctx.Err() != nil {
+		log.Warn("Build cancelled")
+		return ErrBuildCancelled
+	}
+	return b.failures.err()
+}
+
+// BuildBaseImage builds a single base image without its descendants, i.e. for a build agent given one image at a time
+// Its parent must already be pushed at the same tag
+func BuildBaseImage(ctx context.Context, dockerRegistryBasePath string, tag string, image string, forceRebuild bool, pushToRemote bool) (err error) {
+	if tag, err = getDefaultTag(ctx, tag); err != nil {
+		getLogger(ctx).Error(err)
+		return err
+	}
+
+	ctx, span := tracing.Start(ctx, "build-base-image",
+		tracing.String("registry.base_path", dockerRegistryBasePath),
+		tracing.String("image.tag", tag),
+		tracing.Bool("build.force_rebuild", forceRebuild),
+		tracing.Bool("build.push", pushToRemote),
+	)
+	defer func() {
+		span.End(err)
+	}()
+	log := getLogger(ctx)
+
+	inv := getInventory(ctx)
+	if inv == nil {
+		log.Error(ErrInventoryNotLoaded)
+		return ErrInventoryNotLoaded
+	}
+	if !inv.BaseImageExists(image) {
+		err = errors.New("Base image does not exist: " + image)
+		log.Error(err)
+		return err
+	}
+	if inv.baseImageDockerfiles[image].metadata.isDisabled() {
+		err = errors.New("Base image is disabled: " + image)
+		log.Error(err)
+		return err
+	}
+
+	tempDir, _ := ioutil.TempDir(inv.dockerfileDirectory, ".tmp-")
+	defer filesystem.RemoveDirectory(tempDir, true)
+
+	var b = baseImagesBuild{
+		ctx:              ctx,
+		inventory:        inv,
+		tempDir:          tempDir,
+		registryBasePath: dockerRegistryBasePath,
+		tag:              tag,
+		forceRebuild:     forceRebuild,
+		pushToRemote:     pushToRemote,
+	}
+	reference, imageCtx, err := b.buildImage(inv.baseImageDockerfiles[image])
+	if err == nil {
+		if pushToRemote {
+			err = b.pushImage(imageCtx, reference, image)
+		} else {
+			reportImageResult(ctx, newImageResult(image, reference, imageStepBuild, nil))
+		}
+	}
+	if err == ErrBuildCancelled || ctx.Err() != nil {
+		log.Warn("Build cancelled")
+		return ErrBuildCancelled
+	}
+	return b.failures.err()
 }
 
 // GetBaseImageHeirarchy prints the heirachy of dockerfiles to be built to stdout
 // Returns buildable images and orphaned images respectively
 func GetBaseImageHeirarchy() ([]DockerBuildableImage, []DockerOrphanedImage) {
-	return buildableImages, orphanedImages
+	inv := getDefaultInventory()
+	if inv == nil {
+		return []DockerBuildableImage{}, []DockerOrphanedImage{}
+	}
+	return inv.GetBaseImageHeirarchy()
 }
 
-func buildBaseImagesWithChildren(tempDir string, registryBasePath string, tag string, parent string, forceRebuild bool, pushToRemote bool) {
-	var waitGroup = sync.WaitGroup{}
-	children, hasChildren := dockerfileHeirarchy[parent]
-	if hasChildren {
-		for _, c := range children {
-			var imageName = filesystem.ForceTrailingSlash(registryBasePath) + c.name
-			logger.WithFields(logrus.Fields{
-				"docker_image": imageName,
-			}).Info("Building Image")
-
-			arguments := []string{"build", "-t", imageName + ":" + tag, "-f", createDynamicDockerfile(tempDir, c.filename, registryBasePath, tag)}
-			if forceRebuild {
-				arguments = append(arguments, "--no-cache=true")
-			}
-			arguments = append(arguments, ".")
-			var cmd = executil.Command{
-				Name:             "Building Docker Image: " + imageName + ":" + tag,
-				Executable:       "docker",
-				Arguments:        arguments,
-				WorkingDirectory: dockerBaseDirectory,
+// GetBaseImageHeirarchy returns the buildable images and orphaned images in the inventory respectively
+func (inv *Inventory) GetBaseImageHeirarchy() ([]DockerBuildableImage, []DockerOrphanedImage) {
+	return inv.buildableImages, inv.orphanedImages
+}
+
+// BaseImageExists checks whether the image is a buildable base image in the inventory
+func BaseImageExists(imageName string) bool {
+	inv := getDefaultInventory()
+	return inv != nil && inv.BaseImageExists(imageName)
+}
+
+// BaseImageExists checks whether the image is a buildable base image in the inventory
+func (inv *Inventory) BaseImageExists(imageName string) bool {
+	_, exists := inv.baseImageDockerfiles[imageName]
+	return exists
+}
+
+// GetSubtrees returns the hierarchy below and including each named image, as built by BuildBaseImageSubtrees
+// Every buildable image is returned when images is empty
+func (inv *Inventory) GetSubtrees(images []string) ([]DockerBuildableImage, error) {
+	roots, err := inv.getSubtreeRoots(images)
+	if err != nil {
+		return nil, err
+	}
+	subtrees := []DockerBuildableImage{}
+	for _, df := range roots {
+		subtrees = append(subtrees, inv.getSubtree(df.name))
+	}
+	return subtrees, nil
+}
+
+func (inv *Inventory) getSubtree(name string) DockerBuildableImage {
+	image := DockerBuildableImage{
+		Name:     name,
+		Children: []DockerBuildableImage{},
+		Metadata: inv.baseImageDockerfiles[name].metadata,
+	}
+	for _, df := range inv.dockerfileHeirarchy[name] {
+		image.Children = append(image.Children, inv.getSubtree(df.name))
+	}
+	return image
+}
+
+// getSubtreeRoots resolves image names to the images a subtree build starts from
+// Images that are descendants of another requested image are dropped since they are built with their ancestor
+func (inv *Inventory) getSubtreeRoots(images []string) ([]*dockerfile, error) {
+	if len(images) == 0 {
+		return inv.dockerfileHeirarchy[""], nil
+	}
+
+	requested := map[string]bool{}
+	for _, name := range images {
+		if !inv.BaseImageExists(name) {
+			return nil, errors.New("Base image does not exist: " + name)
+		}
+		requested[name] = true
+	}
+
+	roots := []*dockerfile{}
+	for name := range requested {
+		df := inv.baseImageDockerfiles[name]
+		isDescendant := false
+		for parent := df.parentName; parent != ""; parent = inv.baseImageDockerfiles[parent].parentName {
+			if requested[parent] {
+				isDescendant = true
+				break
 			}
-			if err := cmd.Run(); err == nil {
-				waitGroup.Add(1)
-				if pushToRemote {
-					waitGroup.Add(1)
-					go func(image string) {
-						err := pushImageToRegistry(image)
-						if err != nil {
-							logger.WithFields(logrus.Fields{
-								"docker_image": imageName,
-							}).Error(err)
-						}
-						waitGroup.Done()
-					}(imageName + ":" + tag)
-				}
+		}
+		if !isDescendant {
+			roots = append(roots, df)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].name < roots[j].name })
+	return roots, nil
+}
+
+// baseImagesBuild holds the state shared by every image in a single BuildBaseImages run
+type baseImagesBuild struct {
+	ctx              context.Context
+	inventory        *Inventory
+	tempDir          string
+	registryBasePath string
+	tag              string
+	forceRebuild     bool
+	pushToRemote     bool
+	failures         buildFailures
+	// Limits the images built at once when the concurrency is set; nil is unlimited
+	buildSlots chan struct{}
+}
 
-				// Build all of the children
-				go func(parent string) {
+// buildImages builds each image, then its children once it has built successfully
+func (b *baseImagesBuild) buildImages(images []*dockerfile) {
+	var waitGroup = sync.WaitGroup{}
+	for _, c := range images {
+		// Stop descending once the build is cancelled; images already running are interrupted by their command
+		if b.ctx.Err() != nil {
+			break
+		}
+		if c.metadata.isDisabled() {
+			getLogger(b.ctx).WithFields(logrus.Fields{
+				"image": c.name,
+			}).Info("Skipping disabled image and its descendants")
+			continue
+		}
+
+		image, imageCtx, err := b.buildImage(c)
+		if err == ErrBuildCancelled {
+			break
+		}
+		if err == nil {
+			waitGroup.Add(1)
+			if b.pushToRemote {
+				waitGroup.Add(1)
+				go func(imageCtx context.Context, image string, name string) {
 					defer waitGroup.Done()
-					buildBaseImagesWithChildren(tempDir, registryBasePath, tag, parent, forceRebuild, pushToRemote)
-				}(c.name)
+					b.pushImage(imageCtx, image, name)
+				}(imageCtx, image, c.name)
 			} else {
-				logger.WithFields(logrus.Fields{
-					"docker_image": imageName,
-				}).Error("Image failed to build")
+				reportImageResult(b.ctx, newImageResult(c.name, image, imageStepBuild, nil))
 			}
+
+			// Build all of the children
+			go func(parent string) {
+				defer waitGroup.Done()
+				b.buildImages(b.inventory.dockerfileHeirarchy[parent])
+			}(c.name)
 		}
 	}
 	waitGroup.Wait()
 }
 
-func buildDockerImageHeirarchy() (map[string][]*dockerfile, []DockerBuildableImage, []DockerOrphanedImage) {
+// buildImage runs docker build for a single image, reporting it if the build fails
+// Returns the tagged image and the context of its build span
+func (b *baseImagesBuild) buildImage(c *dockerfile) (string, context.Context, error) {
+	log := getLogger(b.ctx)
+	var imageName = filesystem.ForceTrailingSlash(b.registryBasePath) + c.name
+	log.WithFields(logrus.Fields{
+		"docker_image": imageName,
+	}).Info("Building Image")
+
+	arguments := append(getBuildArguments(b.ctx), "-t", imageName+":"+b.tag)
+	for _, tag := range c.metadata.getExtraTags() {
+		arguments = append(arguments, "-t", imageName+":"+tag)
+	}
+	arguments = append(arguments, "-f", createDynamicDockerfile(b.tempDir, c.filename, b.registryBasePath, b.tag))
+	arguments = append(arguments, getBuildArgArguments(b.ctx, b.inventory.getImageBuildArgs(getProjectConfig(b.ctx).BuildArgs, c.name))...)
+	arguments = append(arguments, c.metadata.getMetadataArguments()...)
+	cachePolicy := c.metadata.getCachePolicy()
+	if b.forceRebuild || cachePolicy == CachePolicyNoCache {
+		arguments = append(arguments, "--no-cache=true")
+	}
+	if cachePolicy == CachePolicyPull || (!c.hasInternalDependencies && ShouldPullBaseImages(b.ctx)) || (c.hasInternalDependencies && shouldPullParentImages(b.ctx)) {
+		arguments = append(arguments, "--pull")
+	}
+	arguments = append(arguments, ".")
+	var cmd = dockerCommand{
+		name:             "Building Docker Image: " + imageName + ":" + b.tag,
+		arguments:        arguments,
+		workingDirectory: b.inventory.baseDirectory,
+	}
+	imageCtx, span := tracing.Start(b.ctx, "build-image",
+		tracing.String("image.name", c.name),
+		tracing.String("image.tag", b.tag),
+		tracing.String("image.parent", c.parentName),
+	)
+	if b.buildSlots != nil {
+		select {
+		case b.buildSlots <- struct{}{}:
+			defer func() { <-b.buildSlots }()
+		case <-b.ctx.Done():
+			span.End(ErrBuildCancelled)
+			return imageName + ":" + b.tag, imageCtx, ErrBuildCancelled
+		}
+	}
+	buildCtx := imageCtx
+	if c.metadata != nil && c.metadata.timeout > 0 {
+		var cancel context.CancelFunc
+		buildCtx, cancel = context.WithTimeout(imageCtx, c.metadata.timeout)
+		defer cancel()
+	}
+	started := time.Now()
+	output, err := cmd.runWithOutput(buildCtx)
+	if err == ErrBuildCancelled && b.ctx.Err() == nil && buildCtx.Err() == context.DeadlineExceeded {
+		// Only this image ran out of time, so it fails like any other image instead of cancelling the run
+		err = errors.New("Build timed out after " + c.metadata.Timeout)
+		log.WithFields(logrus.Fields{
+			"docker_image": imageName,
+			"timeout":      c.metadata.Timeout,
+		}).Warn(err)
+	}
+	observeDuration(imageBuildDuration, started, c.name, err)
+	span.SetAttributes(tracing.Bool("image.cache_hit", err == nil && !b.forceRebuild && cachePolicy != CachePolicyNoCache && isCachedBuild(output)))
+	span.End(err)
+	if err != nil && err != ErrBuildCancelled {
+		log.WithFields(logrus.Fields{
+			"docker_image": imageName,
+		}).Error("Image failed to build")
+		b.failures.add(imageName+":"+b.tag, imageStepBuild)
+		reportImageResult(b.ctx, newImageResult(c.name, imageName+":"+b.tag, imageStepBuild, err))
+	}
+	return imageName + ":" + b.tag, imageCtx, err
+}
+
+// pushImage pushes a built image and reports its result
+func (b *baseImagesBuild) pushImage(imageCtx context.Context, image string, name string) error {
+	err := pushImageToRegistry(imageCtx, image, name)
+	repository := strings.TrimSuffix(image, ":"+b.tag)
+	for _, tag := range b.inventory.baseImageDockerfiles[name].metadata.getExtraTags() {
+		if err != nil {
+			break
+		}
+		err = pushImageToRegistry(imageCtx, repository+":"+tag, name)
+	}
+	if err == ErrBuildCancelled {
+		return err
+	}
+	result := newImageResult(name, image, imageStepPush, err)
+	if err != nil {
+		getLogger(b.ctx).WithFields(logrus.Fields{
+			"docker_image": image,
+		}).Error(err)
+		b.failures.add(image, imageStepPush)
+	} else {
+		result.Digest = getImageDigest(imageCtx, image)
+	}
+	reportImageResult(b.ctx, result)
+	return err
+}
+
+// buildDockerImageHeirarchy loads the base image dockerfiles and sorts them into buildable and orphaned images
+func (inv *Inventory) buildDockerImageHeirarchy() error {
 	logger.Info("Building Docker image heirarchy")
 	dfh := map[string][]*dockerfile{}
-	allImages := loadBaseImageDockerfiles("")
+	allImages, err := inv.loadBaseImageDockerfiles("")
+	if err != nil {
+		return err
+	}
 	for _, df := range allImages {
 		if df.hasInternalDependencies {
 			dfh[df.parentName] = append(dfh[df.parentName], df)
@@ -124,7 +434,21 @@ func buildDockerImageHeirarchy() (map[string][]*dockerfile, []DockerBuildableIma
 		}
 	}
 
-	return dfh, bi, oi
+	inv.dockerfileHeirarchy = dfh
+	inv.buildableImages = bi
+	inv.orphanedImages = oi
+	return nil
+}
+
+// getFromReference returns the image reference of a FROM line, skipping flags such as --platform
+func getFromReference(line string) string {
+	fields := strings.Fields(line)
+	for i := 1; i < len(fields); i++ {
+		if !strings.HasPrefix(fields[i], "--") {
+			return fields[i]
+		}
+	}
+	return ""
 }
 
 func getChildImages(dfh map[string][]*dockerfile, parent string) []DockerBuildableImage {
@@ -136,6 +460,7 @@ func getChildImages(dfh map[string][]*dockerfile, parent string) []DockerBuildab
 			imageHeirarchy = append(imageHeirarchy, DockerBuildableImage{
 				Name:     df.name,
 				Children: getChildImages(dfh, df.name),
+				Metadata: df.metadata,
 			})
 		}
 	}
@@ -143,58 +468,76 @@ func getChildImages(dfh map[string][]*dockerfile, parent string) []DockerBuildab
 }
 
 // loadBaseImageDockerfiles loads base image dockerfiles from a directory recursively
-func loadBaseImageDockerfiles(subpath string) map[string]*dockerfile {
+func (inv *Inventory) loadBaseImageDockerfiles(subpath string) (map[string]*dockerfile, error) {
 	logger.WithFields(logrus.Fields{
 		"namespace": "/" + subpath,
 	}).Debug("Processing DockerFiles")
 
 	dockerfiles := map[string]*dockerfile{}
 
-	directoryContents, err := filesystem.GetDirectoryContents(dockerfileDirectory + subpath)
+	directoryContents, err := filesystem.GetDirectoryContents(inv.dockerfileDirectory + subpath)
 	if err != nil {
-		logger.Panic(err)
+		return nil, err
 	}
 	for _, f := range directoryContents {
 		var relativeFile = subpath + f
 
-		if !isValidDockerfile(f) {
+		if !isValidDockerfile(f) || isImageMetadataFile(f, directoryContents) || inv.isIgnored("dockerfiles/"+relativeFile) {
 			continue
 		}
 
 		// Loop through children; iterate any subfolders
-		if filesystem.IsDirectory(dockerfileDirectory + relativeFile) {
-			for n, df := range loadBaseImageDockerfiles(relativeFile + "/") {
+		if filesystem.IsDirectory(inv.dockerfileDirectory + relativeFile) {
+			children, err := inv.loadBaseImageDockerfiles(relativeFile + "/")
+			if err != nil {
+				return nil, err
+			}
+			for n, df := range children {
 				dockerfiles[n] = df
 			}
 		} else {
 			role := relativeFile
-			fileName := dockerfileDirectory + role
+			fileName := inv.dockerfileDirectory + role
 			firstLine, err := ioutil.ReadFile(fileName)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 			readbuffer := bytes.NewBuffer(firstLine)
 			reader := bufio.NewReader(readbuffer)
 			line, _, err := reader.ReadLine()
 			if err == nil {
 				matches := fromSplitRegex.FindStringSubmatch(string(line))
+				if matches == nil {
+					return nil, errors.New("Base image " + role + " does not start with a FROM instruction")
+				}
 
 				parentName := ""
+				externalParent := ""
 				hasInternalDependencies := len(matches[2]) > 0
 
 				if hasInternalDependencies {
 					parentName = strings.Replace(matches[1], matches[2], "", 1)
+				} else {
+					// The regex stops at a digest, so take the whole reference from the line
+					externalParent = getFromReference(string(line))
+				}
+
+				metadata, err := readImageMetadata(fileName)
+				if err != nil {
+					return nil, errors.New("Invalid metadata for base image " + role + ": " + err.Error())
 				}
 
 				var df = dockerfile{
 					name:                    role,
 					filename:                fileName,
 					parentName:              parentName,
+					externalParent:          externalParent,
 					hasInternalDependencies: hasInternalDependencies,
+					metadata:                metadata,
 				}
 				dockerfiles[df.name] = &df
 			}
 		}
 	}
-	return dockerfiles
+	return dockerfiles, nil
 }
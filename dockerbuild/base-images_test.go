@@ -0,0 +1,100 @@
+package dockerbuild
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// loadTestInventory writes files relative to a new base directory and loads its inventory
+func loadTestInventory(t *testing.T, files map[string]string) *Inventory {
+	baseDirectory := t.TempDir()
+	for _, directory := range []string{"dockerfiles", "deployments"} {
+		if err := os.MkdirAll(filepath.Join(baseDirectory, directory), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range files {
+		path := filepath.Join(baseDirectory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inv, err := LoadInventory(baseDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv
+}
+
+func TestGetFromReference(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"FROM alpine:3.18", "alpine:3.18"},
+		{"FROM alpine:3.18 AS build", "alpine:3.18"},
+		{"FROM   alpine@sha256:abc", "alpine@sha256:abc"},
+		{"FROM --platform=linux/amd64 alpine:3.18", "alpine:3.18"},
+		{"FROM --platform=$BUILDPLATFORM --other registry.example.com/base@sha256:abc AS build", "registry.example.com/base@sha256:abc"},
+		{"FROM", ""},
+		{"FROM --platform=linux/amd64", ""},
+	}
+	for _, test := range tests {
+		if got := getFromReference(test.line); got != test.want {
+			t.Errorf("getFromReference(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestLoadBaseImageDockerfilesParents(t *testing.T) {
+	inv := loadTestInventory(t, map[string]string{
+		"dockerfiles/root":          "FROM alpine:3.18\n",
+		"dockerfiles/platform-root": "FROM --platform=linux/amd64 alpine:3.18\n",
+		"dockerfiles/pinned":        "FROM --platform=$BUILDPLATFORM registry.example.com/base@sha256:abc AS build\n",
+		"dockerfiles/child":         "FROM --platform=linux/arm64 {{ local }}/root\n",
+		"dockerfiles/grandchild":    "FROM {{ local }}/child\n",
+	})
+
+	parents := map[string]string{}
+	for name, df := range inv.baseImageDockerfiles {
+		parents[name] = df.parentName
+	}
+	wantParents := map[string]string{"root": "", "platform-root": "", "pinned": "", "child": "root", "grandchild": "child"}
+	if !reflect.DeepEqual(parents, wantParents) {
+		t.Errorf("parents = %v, want %v", parents, wantParents)
+	}
+
+	wantExternal := map[string][]string{
+		"alpine:3.18":                          {"platform-root", "root"},
+		"registry.example.com/base@sha256:abc": {"pinned"},
+	}
+	if got := inv.GetExternalBaseImages(); !reflect.DeepEqual(got, wantExternal) {
+		t.Errorf("GetExternalBaseImages() = %v, want %v", got, wantExternal)
+	}
+}
+
+func TestLoadInventoryRejectsDockerfileWithoutFrom(t *testing.T) {
+	baseDirectory := t.TempDir()
+	for name, contents := range map[string]string{
+		"dockerfiles/root":  "FROM alpine:3.18\n",
+		"dockerfiles/child": "# syntax=docker/dockerfile:1\nFROM {{ local }}/root\n",
+		"deployments/app":   "FROM {{ local }}/root\n",
+	} {
+		path := filepath.Join(baseDirectory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := LoadInventory(baseDirectory); err == nil || err.Error() != "Base image child does not start with a FROM instruction" {
+		t.Errorf("LoadInventory() = %v, want an error for the dockerfile without FROM", err)
+	}
+}
@@ -0,0 +1,159 @@
+package dockerbuild
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var buildArgNameRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+type buildArgsContextKey struct{}
+
+// WithBuildArgs returns a context whose builds pass args to docker build as --build-arg
+// They take precedence over the build args of the workspace configuration and image metadata
+func WithBuildArgs(ctx context.Context, args map[string]string) context.Context {
+	return context.WithValue(ctx, buildArgsContextKey{}, args)
+}
+
+// GetBuildArgs returns the build args given to builds using ctx
+func GetBuildArgs(ctx context.Context) map[string]string {
+	args, _ := ctx.Value(buildArgsContextKey{}).(map[string]string)
+	return args
+}
+
+// ValidateBuildArgs checks that every build arg has a valid name
+func ValidateBuildArgs(args map[string]string) error {
+	for name := range args {
+		if !buildArgNameRegex.MatchString(name) {
+			return errors.New("Invalid build arg name: " + name)
+		}
+	}
+	return nil
+}
+
+// ParseBuildArgs parses build args given as NAME=VALUE, i.e. from --build-arg
+// Later values of the same name take precedence
+func ParseBuildArgs(values []string) (map[string]string, error) {
+	args := map[string]string{}
+	for _, value := range values {
+		i := strings.Index(value, "=")
+		if i < 0 {
+			return nil, errors.New("Invalid build arg; it must be NAME=VALUE: " + value)
+		}
+		args[value[:i]] = value[i+1:]
+	}
+	if err := ValidateBuildArgs(args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// ReadBuildArgsFile reads build args from a variables file with a NAME=VALUE pair per line
+// Blank lines and lines starting with # are skipped; values are taken as is, without removing quotes
+func ReadBuildArgsFile(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	args := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, errors.New("Invalid build arg on line " + strconv.Itoa(lineNumber) + " of " + filename + "; it must be NAME=VALUE")
+		}
+		args[strings.TrimSpace(line[:i])] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := ValidateBuildArgs(args); err != nil {
+		return nil, errors.New(err.Error() + " in " + filename)
+	}
+	return args, nil
+}
+
+// MergeBuildArgs combines sets of build args; values of later sets take precedence
+func MergeBuildArgs(sets ...map[string]string) map[string]string {
+	args := map[string]string{}
+	for _, set := range sets {
+		for name, value := range set {
+			args[name] = value
+		}
+	}
+	return args
+}
+
+// getImageBuildArgs returns the build args of an image before those of the build run are applied
+// Args propagated by its ancestors override workspaceArgs, nearest ancestor last, and are overridden by the image's own metadata
+func (inv *Inventory) getImageBuildArgs(workspaceArgs map[string]string, name string) map[string]string {
+	df, exists := inv.baseImageDockerfiles[name]
+	if !exists {
+		return MergeBuildArgs(workspaceArgs)
+	}
+	return MergeBuildArgs(workspaceArgs, inv.getInheritedBuildArgs(df.parentName), df.metadata.getBuildArgs())
+}
+
+// getDeploymentBuildArgs returns the build args of a deployment before those of the build run are applied
+// Args propagated by each image it is built from, including the image itself, override workspaceArgs; later stages take precedence
+func (inv *Inventory) getDeploymentBuildArgs(workspaceArgs map[string]string, deploymentName string) map[string]string {
+	sets := []map[string]string{workspaceArgs}
+	for _, name := range getDeploymentDependencies(inv.deploymentDirectory + deploymentName) {
+		sets = append(sets, inv.getInheritedBuildArgs(name))
+	}
+	return MergeBuildArgs(sets...)
+}
+
+// getProfileBuildArgs returns the build args of the named profile of the configuration; nil without a profile
+func (inv *Inventory) getProfileBuildArgs(profile string) map[string]string {
+	return inv.config.Profiles[profile].BuildArgs
+}
+
+// getInheritedBuildArgs returns the args an image and its ancestors propagate to its descendants, nearest ancestor last
+func (inv *Inventory) getInheritedBuildArgs(name string) map[string]string {
+	sets := []map[string]string{}
+	for df, exists := inv.baseImageDockerfiles[name]; exists; df, exists = inv.baseImageDockerfiles[df.parentName] {
+		sets = append([]map[string]string{df.metadata.getPropagatedBuildArgs()}, sets...)
+	}
+	return MergeBuildArgs(sets...)
+}
+
+// buildArgsEqual reports whether two sets of build args have the same values
+func buildArgsEqual(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, exists := b[name]; !exists || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// getBuildArgArguments returns the --build-arg arguments of imageArgs overridden by the build args in ctx, sorted by name
+func getBuildArgArguments(ctx context.Context, imageArgs map[string]string) []string {
+	args := MergeBuildArgs(imageArgs, GetBuildArgs(ctx))
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	arguments := []string{}
+	for _, name := range names {
+		arguments = append(arguments, "--build-arg", name+"="+args[name])
+	}
+	return arguments
+}
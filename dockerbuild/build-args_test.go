@@ -0,0 +1,128 @@
+package dockerbuild
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBuildArgs(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{[]string{"A=1", "B=x=y", "C="}, map[string]string{"A": "1", "B": "x=y", "C": ""}, false},
+		{[]string{"A=1", "A=2"}, map[string]string{"A": "2"}, false},
+		{[]string{"A"}, nil, true},
+		{[]string{"1A=1"}, nil, true},
+		{[]string{"=1"}, nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseBuildArgs(test.values)
+		if (err != nil) != test.wantErr || (!test.wantErr && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("ParseBuildArgs(%v) = %v, %v; want %v, error %v", test.values, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestReadBuildArgsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     map[string]string
+		wantErr  string
+	}{
+		{"pairs", "A=1\nB=x=y\n", map[string]string{"A": "1", "B": "x=y"}, ""},
+		{"comments and blank lines", "# settings\n\nA=1\n  # indented\n", map[string]string{"A": "1"}, ""},
+		{"values are used as is", "A=\"quoted\"\n  B = spaced \n", map[string]string{"A": "\"quoted\"", "B": " spaced"}, ""},
+		{"later values take precedence", "A=1\nA=2\n", map[string]string{"A": "2"}, ""},
+		{"no trailing newline", "A=1", map[string]string{"A": "1"}, ""},
+		{"empty", "", map[string]string{}, ""},
+		{"missing separator", "A=1\nB\n", nil, "Invalid build arg on line 2"},
+		{"invalid name", "A-B=1\n", nil, "Invalid build arg name: A-B"},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "build-args")
+		if err := ioutil.WriteFile(filename, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadBuildArgsFile(filename)
+		if test.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+				t.Errorf("%s: ReadBuildArgsFile() = %v, %v; want error %s", test.name, got, err, test.wantErr)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: ReadBuildArgsFile() = %v, %v; want %v", test.name, got, err, test.want)
+		}
+	}
+	if _, err := ReadBuildArgsFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("ReadBuildArgsFile() of a missing file did not return an error")
+	}
+}
+
+// buildArgsTestFiles is a hierarchy root > child > grandchild where root and child propagate VERSION and root also propagates REGION
+var buildArgsTestFiles = map[string]string{
+	"dockerfiles/root":            "FROM alpine:3\n",
+	"dockerfiles/root.yaml":       "build_args: {VERSION: root, REGION: eu, ROOT_ONLY: root}\npropagate_build_args: [VERSION, REGION]\n",
+	"dockerfiles/child":           "FROM {{ local }}/root\n",
+	"dockerfiles/child.yaml":      "build_args: {VERSION: child, CHILD_ONLY: child}\npropagate_build_args: [VERSION]\n",
+	"dockerfiles/grandchild":      "FROM {{ local }}/child\n",
+	"dockerfiles/grandchild.yaml": "build_args: {OWN: grandchild}\n",
+	"dockerfiles/other":           "FROM alpine:3\n",
+	"deployments/app":             "FROM {{ local }}/child\n",
+	"deployments/multi-stage":     "FROM {{ local }}/child AS build\nFROM {{ local }}/other\n",
+	"deployments/external":        "FROM alpine:3\n",
+}
+
+func TestGetImageBuildArgs(t *testing.T) {
+	inv := loadTestInventory(t, buildArgsTestFiles)
+	workspaceArgs := map[string]string{"VERSION": "workspace", "REGION": "us", "WORKSPACE": "workspace"}
+	tests := []struct {
+		name string
+		want map[string]string
+	}{
+		// The image's own args override the workspace
+		{"root", map[string]string{"VERSION": "root", "REGION": "eu", "ROOT_ONLY": "root", "WORKSPACE": "workspace"}},
+		// Only propagated args of ancestors are inherited, and the image's own args override them
+		{"child", map[string]string{"VERSION": "child", "REGION": "eu", "CHILD_ONLY": "child", "WORKSPACE": "workspace"}},
+		// The nearest ancestor takes precedence
+		{"grandchild", map[string]string{"VERSION": "child", "REGION": "eu", "OWN": "grandchild", "WORKSPACE": "workspace"}},
+		{"other", workspaceArgs},
+		{"missing", workspaceArgs},
+	}
+	for _, test := range tests {
+		if got := inv.getImageBuildArgs(workspaceArgs, test.name); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getImageBuildArgs(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetDeploymentBuildArgs(t *testing.T) {
+	inv := loadTestInventory(t, buildArgsTestFiles)
+	workspaceArgs := map[string]string{"VERSION": "workspace", "WORKSPACE": "workspace"}
+	tests := []struct {
+		name string
+		want map[string]string
+	}{
+		{"app", map[string]string{"VERSION": "child", "REGION": "eu", "WORKSPACE": "workspace"}},
+		{"multi-stage", map[string]string{"VERSION": "child", "REGION": "eu", "WORKSPACE": "workspace"}},
+		{"external", workspaceArgs},
+	}
+	for _, test := range tests {
+		if got := inv.getDeploymentBuildArgs(workspaceArgs, test.name); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getDeploymentBuildArgs(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetBuildArgArguments(t *testing.T) {
+	ctx := WithBuildArgs(context.Background(), map[string]string{"VERSION": "run", "RUN": "1"})
+	want := []string{"--build-arg", "IMAGE=1", "--build-arg", "RUN=1", "--build-arg", "VERSION=run"}
+	if got := getBuildArgArguments(ctx, map[string]string{"VERSION": "image", "IMAGE": "1"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("getBuildArgArguments() = %v, want %v", got, want)
+	}
+}
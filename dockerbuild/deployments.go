@@ -1,85 +1,181 @@
 package dockerbuild
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
-	"go.mikenewswanger.com/utilities/executil"
+	"go.mikenewswanger.com/container-factory/tracing"
 	"go.mikenewswanger.com/utilities/filesystem"
 )
 
 // BuildDeployment builds a docker image for a code deployment
-func BuildDeployment(registryBasePath string, deploymentName string, buildTargetTag string, deploymentTag string, pushToRemote bool) {
+func BuildDeployment(ctx context.Context, registryBasePath string, deploymentName string, buildTargetTag string, deploymentTag string, pushToRemote bool) (err error) {
+	log := getLogger(ctx)
 	if registryBasePath == "" {
-		logger.Panic("Registry Base Path must be specified")
+		log.Error("Registry Base Path must be specified")
+		return errors.New("Registry Base Path must be specified")
+	}
+	if buildTargetTag, err = getDefaultParentTag(ctx, buildTargetTag); err != nil {
+		log.Error(err)
+		return err
 	}
-	buildTargetTag = getDefaultTag(buildTargetTag)
 	if deploymentTag == "" {
 		deploymentTag = buildTargetTag
 	}
 
-	deploymentFilename := deploymentDirectory + deploymentName
-	if !filesystem.IsFile(deploymentFilename) {
-		logger.Panic("Deployment does not exist: " + deploymentName)
+	ctx, span := tracing.Start(ctx, "build-deployment",
+		tracing.String("registry.base_path", registryBasePath),
+		tracing.String("deployment.name", deploymentName),
+		tracing.String("image.tag", buildTargetTag),
+		tracing.String("deployment.tag", deploymentTag),
+		tracing.Bool("build.push", pushToRemote),
+	)
+	defer func() {
+		span.End(err)
+	}()
+
+	log.WithFields(logrus.Fields{
+		"deployment":     deploymentName,
+		"tag":            buildTargetTag,
+		"deployment_tag": deploymentTag,
+	}).Info("Building deployment")
+
+	inv := getInventory(ctx)
+	if inv == nil {
+		log.Error(ErrInventoryNotLoaded)
+		return ErrInventoryNotLoaded
 	}
-	tempDir, _ := ioutil.TempDir(deploymentDirectory, ".tmp-")
+	deploymentFilename := inv.deploymentDirectory + deploymentName
+	if !inv.DeploymentExists(deploymentName) || !filesystem.IsFile(deploymentFilename) {
+		log.WithFields(logrus.Fields{
+			"deployment": deploymentName,
+		}).Error("Deployment does not exist")
+		return ErrDeploymentNotFound
+	}
+	tempDir, _ := ioutil.TempDir(inv.deploymentDirectory, ".tmp-")
+	defer filesystem.RemoveDirectory(tempDir, true)
 	dockerfile := createDynamicDockerfile(tempDir+"/", deploymentFilename, registryBasePath, buildTargetTag)
 
-	var imageName = registryBasePath + "/deployments/" + deploymentName + ":" + deploymentTag
-	var cmd = executil.Command{
-		Name:       "Build Deployment - " + imageName,
-		Executable: "docker",
-		Arguments: []string{
-			"build",
-			"--no-cache",
-			"-t",
-			imageName,
-			"-f",
-			dockerfile,
-			".",
-		},
-		WorkingDirectory: dockerBaseDirectory,
+	var imageName = inv.GetDeploymentImageName(registryBasePath, deploymentName, deploymentTag)
+	arguments := append(getBuildArguments(ctx), "--no-cache", "-t", imageName, "-f", dockerfile)
+	arguments = append(arguments, getBuildArgArguments(ctx, inv.getDeploymentBuildArgs(getProjectConfig(ctx).BuildArgs, deploymentName))...)
+	if shouldPullParentImages(ctx) {
+		arguments = append(arguments, "--pull")
 	}
-	if err := cmd.Run(); err == nil {
-		if pushToRemote {
-			if err := pushImageToRegistry(imageName); err != nil {
-				logrus.Error("Failed to push image to remote registry")
-			}
+	var cmd = dockerCommand{
+		name:             "Build Deployment - " + imageName,
+		arguments:        append(arguments, "."),
+		workingDirectory: inv.baseDirectory,
+	}
+	imageCtx, imageSpan := tracing.Start(ctx, "build-image",
+		tracing.String("image.name", "deployments/"+deploymentName),
+		tracing.String("image.tag", deploymentTag),
+		tracing.String("image.parent", getDeploymentParent(deploymentFilename)),
+		tracing.Bool("image.cache_hit", false),
+	)
+	started := time.Now()
+	err = cmd.run(imageCtx)
+	observeDuration(imageBuildDuration, started, "deployments/"+deploymentName, err)
+	imageSpan.End(err)
+	if err == ErrBuildCancelled {
+		return err
+	} else if err != nil {
+		log.Error("Deployment failed to build")
+		reportImageResult(ctx, newImageResult("deployments/"+deploymentName, imageName, imageStepBuild, err))
+		return errors.New("Deployment failed to build: " + imageName)
+	}
+	result := newImageResult("deployments/"+deploymentName, imageName, imageStepBuild, nil)
+	if pushToRemote {
+		if err = pushImageToRegistry(imageCtx, imageName, "deployments/"+deploymentName); err == ErrBuildCancelled {
+			return err
+		} else if err != nil {
+			log.Error("Failed to push image to remote registry")
+			reportImageResult(ctx, newImageResult("deployments/"+deploymentName, imageName, imageStepPush, err))
+			return errors.New("Failed to push image to remote registry: " + imageName)
 		}
-	} else {
-		logrus.Error("Deployment failed to build")
+		result.Digest = getImageDigest(imageCtx, imageName)
 	}
+	reportImageResult(ctx, result)
 
-	filesystem.RemoveDirectory(tempDir, true)
+	return nil
+}
+
+// getDeploymentParent returns the internal image a deployment is built from, if any
+func getDeploymentParent(deploymentFilename string) string {
+	fileContents, err := filesystem.LoadFileString(deploymentFilename)
+	if err != nil {
+		return ""
+	}
+	parent := ""
+	// Multi-stage deployments are based on the image in the final FROM
+	for _, match := range fromSplitRegex.FindAllStringSubmatch(fileContents, -1) {
+		parent = ""
+		if len(match[2]) > 0 {
+			parent = match[3]
+		}
+	}
+	return parent
+}
+
+// DeploymentExists checks whether the deployment is present in the inventory
+func DeploymentExists(deploymentName string) bool {
+	inv := getDefaultInventory()
+	return inv != nil && inv.DeploymentExists(deploymentName)
+}
+
+// DeploymentExists checks whether the deployment is present in the inventory
+func (inv *Inventory) DeploymentExists(deploymentName string) bool {
+	for _, d := range inv.deployments {
+		if d == deploymentName {
+			return true
+		}
+	}
+	return false
 }
 
 // GetDeployments prints a list of configured deployments
 func GetDeployments() []string {
-	return deployments
+	inv := getDefaultInventory()
+	if inv == nil {
+		return []string{}
+	}
+	return inv.GetDeployments()
 }
 
-func getFolderDeployments(subpath string) []string {
+// GetDeployments returns the deployments in the inventory
+func (inv *Inventory) GetDeployments() []string {
+	return inv.deployments
+}
+
+func (inv *Inventory) getFolderDeployments(subpath string) ([]string, error) {
 	d := []string{}
-	directoryContents, err := filesystem.GetDirectoryContents(deploymentDirectory + subpath)
+	directoryContents, err := filesystem.GetDirectoryContents(inv.deploymentDirectory + subpath)
 	if err != nil {
-		logger.Panic(err)
+		return nil, err
 	}
 
 	for _, f := range directoryContents {
 		relativeFile := subpath + f
 
-		if !isValidDockerfile(f) {
+		if !isValidDockerfile(f) || inv.isIgnored("deployments/"+relativeFile) {
 			continue
 		}
 
 		// Loop through children; iterate any subfolders
-		if filesystem.IsFile(deploymentDirectory + relativeFile) {
+		if filesystem.IsFile(inv.deploymentDirectory + relativeFile) {
 			d = append(d, relativeFile)
 		} else {
-			d = append(d, getFolderDeployments(relativeFile+"/")...)
+			children, err := inv.getFolderDeployments(relativeFile + "/")
+			if err != nil {
+				return nil, err
+			}
+			d = append(d, children...)
 		}
 	}
 
-	return d
+	return d, nil
 }
@@ -0,0 +1,156 @@
+package dockerbuild
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Time given to the docker CLI to clean up after an interrupt before it is killed
+const dockerInterruptGracePeriod = 30 * time.Second
+
+// dockerCommand runs the docker CLI, interrupting it when the build context is cancelled
+type dockerCommand struct {
+	name             string
+	arguments        []string
+	workingDirectory string
+}
+
+func (dc dockerCommand) run(ctx context.Context) error {
+	_, err := dc.runWithOutput(ctx)
+	return err
+}
+
+// runWithOutput runs the command and returns everything it wrote to stdout and stderr
+func (dc dockerCommand) runWithOutput(ctx context.Context) (string, error) {
+	if ctx.Err() != nil {
+		return "", ErrBuildCancelled
+	}
+
+	log := getLogger(ctx)
+	loggerFields := logrus.Fields{
+		"command_name": dc.name,
+	}
+	log.WithFields(loggerFields).Info("Running command")
+	log.WithFields(loggerFields).Debugf("Command: docker %s", strings.Join(dc.arguments, " "))
+
+	cmd := exec.Command("docker", dc.arguments...)
+	cmd.Dir = dc.workingDirectory
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.Start(); err != nil {
+		log.WithFields(loggerFields).Warn("Could not start process")
+		return "", err
+	}
+
+	var stdoutBuffer, stderrBuffer bytes.Buffer
+	var outputWaitGroup sync.WaitGroup
+	outputWaitGroup.Add(2)
+	go dc.logOutput(ctx, stdout, &stdoutBuffer, loggerFields, logrus.InfoLevel, &outputWaitGroup)
+	go dc.logOutput(ctx, stderr, &stderrBuffer, loggerFields, logrus.WarnLevel, &outputWaitGroup)
+
+	// Interrupt docker on cancellation so it can stop cleanly; kill it if it does not exit in time
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			log.WithFields(loggerFields).Warn("Interrupting command")
+			cmd.Process.Signal(os.Interrupt)
+			select {
+			case <-exited:
+			case <-time.After(dockerInterruptGracePeriod):
+				cmd.Process.Kill()
+			}
+		}
+	}()
+
+	outputWaitGroup.Wait()
+	err = cmd.Wait()
+	close(exited)
+	output := stdoutBuffer.String() + stderrBuffer.String()
+
+	if ctx.Err() != nil {
+		log.WithFields(loggerFields).Warn("Command cancelled")
+		return output, ErrBuildCancelled
+	}
+	if err != nil {
+		log.WithFields(loggerFields).Warn("Command execution failed")
+		return output, err
+	}
+	log.WithFields(loggerFields).Info("Command succeeded")
+	return output, nil
+}
+
+// logOutput captures command output and copies it to the build run log output, if any
+// Output is also forwarded to the package logger when running at verbosity 3 and above
+func (dc dockerCommand) logOutput(ctx context.Context, r io.Reader, buffer *bytes.Buffer, loggerFields logrus.Fields, level logrus.Level, wg *sync.WaitGroup) {
+	defer wg.Done()
+	output := getLogOutput(ctx)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		buffer.WriteString(scanner.Text() + "\n")
+		if output != nil {
+			output.Write([]byte(scanner.Text() + "\n"))
+		}
+		if verbosity < 3 {
+			continue
+		}
+		if level == logrus.WarnLevel {
+			logger.WithFields(loggerFields).Warn(scanner.Text())
+		} else {
+			logger.WithFields(loggerFields).Info(scanner.Text())
+		}
+	}
+}
+
+// isCachedBuild reports whether every step of a docker build was served from the layer cache
+// Both the classic builder ("Using cache") and BuildKit ("CACHED") output formats are recognized
+// FROM steps pull the base image rather than building a layer, so they are not counted
+func isCachedBuild(output string) bool {
+	var classicSteps, classicCached int
+	buildkitSteps := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if matches := classicStepRegex.FindStringSubmatch(line); matches != nil {
+			if !strings.EqualFold(matches[1], "FROM") {
+				classicSteps++
+			}
+		} else if strings.HasPrefix(line, "---> Using cache") {
+			classicCached++
+		} else if matches := buildkitStepRegex.FindStringSubmatch(line); matches != nil {
+			if _, seen := buildkitSteps[matches[1]]; !seen && !strings.EqualFold(matches[2], "FROM") {
+				buildkitSteps[matches[1]] = false
+			}
+		} else if matches := buildkitCachedRegex.FindStringSubmatch(line); matches != nil {
+			if _, seen := buildkitSteps[matches[1]]; seen {
+				buildkitSteps[matches[1]] = true
+			}
+		}
+	}
+
+	if len(buildkitSteps) > 0 {
+		for _, cached := range buildkitSteps {
+			if !cached {
+				return false
+			}
+		}
+		return true
+	}
+	return classicSteps > 0 && classicCached >= classicSteps
+}
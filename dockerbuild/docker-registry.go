@@ -1,29 +1,47 @@
 package dockerbuild
 
 import (
+	"context"
+	"time"
+
 	"github.com/sirupsen/logrus"
 
-	"go.mikenewswanger.com/utilities/executil"
+	"go.mikenewswanger.com/container-factory/tracing"
 )
 
-func pushImageToRegistry(image string) error {
-	var err error
-	var cmd = executil.Command{
-		Name:       "Pushing Docker Image to Registry: " + image,
-		Executable: "docker",
-		Arguments:  []string{"push", image},
+// pushImageToRegistry pushes image, retrying failed attempts; name identifies the image in metrics
+func pushImageToRegistry(ctx context.Context, image string, name string) (err error) {
+	ctx, span := tracing.Start(ctx, "push-image",
+		tracing.String("image.name", name),
+		tracing.String("image.reference", image),
+	)
+	started := time.Now()
+	attempts := 0
+	defer func() {
+		observeDuration(imagePushDuration, started, name, err)
+		span.SetAttributes(tracing.Int("push.attempts", attempts))
+		span.End(err)
+	}()
+
+	var cmd = dockerCommand{
+		name:      "Pushing Docker Image to Registry: " + image,
+		arguments: []string{"push", image},
 	}
 
 	for retries := 2; retries >= 0; retries-- {
-		err = cmd.Run()
-		if err == nil {
+		attempts++
+		err = cmd.run(ctx)
+		if err == nil || err == ErrBuildCancelled {
 			return err
 		}
 
-		logger.WithFields(logrus.Fields{
+		getLogger(ctx).WithFields(logrus.Fields{
 			"docker_image":      image,
 			"retries_remaining": retries,
 		}).Warn("Failed to push image to registry")
+		if retries > 0 {
+			imagePushRetries.Inc(name)
+		}
 	}
 
 	return err
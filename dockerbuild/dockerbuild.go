@@ -1,7 +1,21 @@
 package dockerbuild
 
-import "os/user"
-import "strings"
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrDeploymentNotFound is returned when a requested deployment is not in the inventory
+var ErrDeploymentNotFound = errors.New("Deployment does not exist")
+
+// ErrBaseImageTagRequired is returned when a deployment is built without a base image tag under the timestamp tag strategy
+var ErrBaseImageTagRequired = errors.New("A base image tag is required to build a deployment with the timestamp tag strategy, since the current time does not name built base images")
+
+// ErrBuildCancelled is returned when a build stops early because its context was cancelled
+var ErrBuildCancelled = errors.New("Build cancelled")
 
 // DockerBuild provides build services for docker images
 type DockerBuild struct {
@@ -11,6 +25,7 @@ type DockerBuild struct {
 type DockerBuildableImage struct {
 	Name     string                 `json:"image_name"`
 	Children []DockerBuildableImage `json:"children"`
+	Metadata *ImageMetadata         `json:"metadata,omitempty"`
 }
 
 // DockerOrphanedImage provides a structure to export docker images that are not buildable
@@ -20,28 +35,65 @@ type DockerOrphanedImage struct {
 }
 
 type dockerfile struct {
-	name                    string
-	parentName              string
+	name       string
+	parentName string
+	// Image outside the inventory that a root image is built FROM, i.e. alpine:3.18
+	externalParent          string
 	filename                string
 	hasInternalDependencies bool
 	isBuildable             bool
+	// Read from the sidecar file of the image; nil when it has none
+	metadata *ImageMetadata
+}
+
+// buildFailures collects images that failed during a build run
+type buildFailures struct {
+	mutex  sync.Mutex
+	images []string
+}
+
+func (bf *buildFailures) add(image string, step string) {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+	bf.images = append(bf.images, image+" ("+step+")")
+}
+
+func (bf *buildFailures) err() error {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+	if len(bf.images) == 0 {
+		return nil
+	}
+	sort.Strings(bf.images)
+	return errors.New("Failed images: " + strings.Join(bf.images, ", "))
 }
 
 // BuildInventory loads available base images and deployments into memory
 func BuildInventory() {
-	deployments = getFolderDeployments("")
-	dockerfileHeirarchy, buildableImages, orphanedImages = buildDockerImageHeirarchy()
+	inventory, err := LoadInventory(dockerBaseDirectory)
+	if err != nil {
+		logger.Panic(err)
+	}
+	setDefaultInventory(inventory)
 }
 
-func getDefaultTag(tag string) string {
-	if tag == "" {
-		currentUser, err := user.Current()
-		if err != nil {
-			logger.Fatal(err)
-		}
-		tag = currentUser.Username
+// InventoryLoaded reports whether BuildInventory has completed
+func InventoryLoaded() bool {
+	return getDefaultInventory() != nil
+}
+
+// CheckDockerDaemon verifies that the docker daemon used for builds is reachable
+func CheckDockerDaemon(ctx context.Context) error {
+	var cmd = dockerCommand{
+		name:      "Checking Docker daemon",
+		arguments: []string{"version", "--format", "{{.Server.Version}}"},
+	}
+	if err := cmd.run(ctx); err == ErrBuildCancelled {
+		return errors.New("Timed out waiting for the docker daemon")
+	} else if err != nil {
+		return err
 	}
-	return tag
+	return nil
 }
 
 func isValidDockerfile(filename string) bool {
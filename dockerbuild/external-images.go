@@ -0,0 +1,49 @@
+package dockerbuild
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+type pullBaseImagesContextKey struct{}
+
+type pullParentImagesContextKey struct{}
+
+// WithPullBaseImages makes builds using ctx pull the external images that root images are built FROM, instead of using the copy cached by docker
+func WithPullBaseImages(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pullBaseImagesContextKey{}, true)
+}
+
+// ShouldPullBaseImages reports whether builds using ctx pull the external images that root images are built FROM
+func ShouldPullBaseImages(ctx context.Context) bool {
+	pull, _ := ctx.Value(pullBaseImagesContextKey{}).(bool)
+	return pull
+}
+
+// WithPullParentImages makes builds using ctx pull internal parent images from the registry instead of using a local copy
+// Needed when the parent may have been built on another host, which leaves any local copy stale
+func WithPullParentImages(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pullParentImagesContextKey{}, true)
+}
+
+func shouldPullParentImages(ctx context.Context) bool {
+	pull, _ := ctx.Value(pullParentImagesContextKey{}).(bool)
+	return pull
+}
+
+// GetExternalBaseImages maps each external image that buildable root images are built FROM to the names of those root images
+// References using build arguments or scratch are left out since they cannot be resolved
+func (inv *Inventory) GetExternalBaseImages() map[string][]string {
+	externalImages := map[string][]string{}
+	for _, df := range inv.baseImageDockerfiles {
+		if df.externalParent == "" || df.externalParent == "scratch" || strings.ContainsAny(df.externalParent, "${}") {
+			continue
+		}
+		externalImages[df.externalParent] = append(externalImages[df.externalParent], df.name)
+	}
+	for _, names := range externalImages {
+		sort.Strings(names)
+	}
+	return externalImages
+}
@@ -0,0 +1,219 @@
+package dockerbuild
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// imageMetadataExtension names the sidecar file of an image, i.e. python.yaml next to python
+const imageMetadataExtension = ".yaml"
+
+// Cache policies of an image build
+const (
+	// Builds use the layer cache and pull parents as configured for the run
+	CachePolicyDefault = "default"
+	// Builds never use the layer cache
+	CachePolicyNoCache = "no-cache"
+	// Builds always pull a newer version of the image they are built from
+	CachePolicyPull = "pull"
+)
+
+var extraTagRegex = regexp.MustCompile("^[\\w][\\w.-]{0,127}$")
+
+// ImageMetadata holds the settings of a base image read from its sidecar file
+type ImageMetadata struct {
+	Description string   `json:"description,omitempty"`
+	Owners      []string `json:"owners,omitempty"`
+	// Passed to docker build as --build-arg; build args of the run take precedence
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+	// Names of build args that are also passed to every descendant of the image
+	PropagateBuildArgs []string          `json:"propagate_build_args,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	// Tags the image is also tagged and pushed as besides the build tag, i.e. latest
+	ExtraTags []string `json:"extra_tags,omitempty"`
+	// Target platform of the build, i.e. linux/amd64; only one is supported since builds are loaded into the local image store before they are pushed
+	Platforms []string `json:"platforms,omitempty"`
+	// Longest the docker build of the image may run, i.e. 20m
+	Timeout     string `json:"timeout,omitempty"`
+	CachePolicy string `json:"cache_policy,omitempty"`
+	// Disabled images and their descendants are left out of builds
+	Disabled bool `json:"disabled,omitempty"`
+
+	timeout time.Duration
+}
+
+// isImageMetadataFile reports whether a file in a dockerfiles directory is the sidecar of another file in it
+func isImageMetadataFile(filename string, directoryContents []string) bool {
+	if !strings.HasSuffix(filename, imageMetadataExtension) {
+		return false
+	}
+	imageFilename := strings.TrimSuffix(filename, imageMetadataExtension)
+	for _, f := range directoryContents {
+		if f == imageFilename {
+			return true
+		}
+	}
+	return false
+}
+
+// readImageMetadata reads and validates the sidecar file of the dockerfile at filename
+// Returns nil if the image has no sidecar file
+func readImageMetadata(filename string) (*ImageMetadata, error) {
+	contents, err := ioutil.ReadFile(filename + imageMetadataExtension)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var metadata ImageMetadata
+	if err := yaml.Unmarshal(contents, &metadata); err != nil {
+		return nil, err
+	}
+	if err := metadata.validate(); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// validate checks the values set in the metadata and parses its timeout
+func (m *ImageMetadata) validate() error {
+	if err := ValidateBuildArgs(m.BuildArgs); err != nil {
+		return err
+	}
+	for _, name := range m.PropagateBuildArgs {
+		if _, exists := m.BuildArgs[name]; !exists {
+			return errors.New("Propagated build arg is not in build_args: " + name)
+		}
+	}
+	for name := range m.Labels {
+		if name == "" || strings.ContainsAny(name, "= \t") {
+			return errors.New("Invalid label name: " + name)
+		}
+	}
+	for _, tag := range m.ExtraTags {
+		if !extraTagRegex.MatchString(tag) {
+			return errors.New("Invalid extra tag: " + tag)
+		}
+	}
+	for _, platform := range m.Platforms {
+		if platform == "" || strings.ContainsAny(platform, ", \t") {
+			return errors.New("Invalid platform: " + platform)
+		}
+	}
+	if len(m.Platforms) > 1 {
+		return errors.New("Only one platform may be built, since images are loaded into the local image store before they are pushed: " + strings.Join(m.Platforms, ", "))
+	}
+	if m.Timeout != "" {
+		var err error
+		if m.timeout, err = time.ParseDuration(m.Timeout); err != nil || m.timeout <= 0 {
+			return errors.New("Invalid timeout; it must be a positive duration, i.e. 20m: " + m.Timeout)
+		}
+	}
+	switch m.CachePolicy {
+	case "", CachePolicyDefault, CachePolicyNoCache, CachePolicyPull:
+	default:
+		return errors.New("Invalid cache_policy; it must be default, no-cache or pull: " + m.CachePolicy)
+	}
+	return nil
+}
+
+// getMetadataArguments returns the docker build arguments setting the labels and platforms of the metadata
+func (m *ImageMetadata) getMetadataArguments() []string {
+	arguments := []string{}
+	if m == nil {
+		return arguments
+	}
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		arguments = append(arguments, "--label", name+"="+m.Labels[name])
+	}
+	if len(m.Platforms) > 0 {
+		arguments = append(arguments, "--platform", m.Platforms[0])
+	}
+	return arguments
+}
+
+// getExtraTags returns the tags the image is also pushed as; nil-safe for images without metadata
+func (m *ImageMetadata) getExtraTags() []string {
+	if m == nil {
+		return nil
+	}
+	return m.ExtraTags
+}
+
+// GetExtraTags returns the extra tags pushed by building the subtrees of images, sorted; every buildable image is included when images is empty
+// Images not in the inventory are skipped since their builds fail before anything is pushed
+func (inv *Inventory) GetExtraTags(images []string) []string {
+	known := []string{}
+	for _, name := range images {
+		if inv.BaseImageExists(name) {
+			known = append(known, name)
+		}
+	}
+	tags := map[string]bool{}
+	if len(images) == 0 || len(known) > 0 {
+		roots, _ := inv.getSubtreeRoots(known)
+		var add func(df *dockerfile)
+		add = func(df *dockerfile) {
+			for _, tag := range df.metadata.getExtraTags() {
+				tags[tag] = true
+			}
+			for _, child := range inv.dockerfileHeirarchy[df.name] {
+				add(child)
+			}
+		}
+		for _, df := range roots {
+			add(df)
+		}
+	}
+	sorted := make([]string, 0, len(tags))
+	for tag := range tags {
+		sorted = append(sorted, tag)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// getBuildArgs returns the build args declared for the image; nil-safe for images without metadata
+func (m *ImageMetadata) getBuildArgs() map[string]string {
+	if m == nil {
+		return nil
+	}
+	return m.BuildArgs
+}
+
+// getPropagatedBuildArgs returns the build args the image passes to its descendants
+func (m *ImageMetadata) getPropagatedBuildArgs() map[string]string {
+	args := map[string]string{}
+	if m == nil {
+		return args
+	}
+	for _, name := range m.PropagateBuildArgs {
+		args[name] = m.BuildArgs[name]
+	}
+	return args
+}
+
+// getCachePolicy returns the cache policy of the image, defaulting to CachePolicyDefault
+func (m *ImageMetadata) getCachePolicy() string {
+	if m == nil || m.CachePolicy == "" {
+		return CachePolicyDefault
+	}
+	return m.CachePolicy
+}
+
+// isDisabled reports whether the image is left out of builds
+func (m *ImageMetadata) isDisabled() bool {
+	return m != nil && m.Disabled
+}
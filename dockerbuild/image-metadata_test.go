@@ -0,0 +1,106 @@
+package dockerbuild
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsImageMetadataFile(t *testing.T) {
+	directoryContents := []string{"python", "python.yaml", "settings.yaml", "node.yml", "node", "go.yaml.yaml", "go.yaml"}
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"python.yaml", true},
+		{"python", false},
+		// No image named settings
+		{"settings.yaml", false},
+		// Only the .yaml extension names a sidecar
+		{"node.yml", false},
+		// The sidecar of an image whose name ends in .yaml
+		{"go.yaml.yaml", true},
+		{"go.yaml", false},
+		{"missing.yaml", false},
+	}
+	for _, test := range tests {
+		if got := isImageMetadataFile(test.filename, directoryContents); got != test.want {
+			t.Errorf("isImageMetadataFile(%q) = %v, want %v", test.filename, got, test.want)
+		}
+	}
+}
+
+func TestImageMetadataValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata ImageMetadata
+		wantErr  bool
+	}{
+		{"empty", ImageMetadata{}, false},
+		{"complete", ImageMetadata{
+			BuildArgs:          map[string]string{"VERSION": "3"},
+			PropagateBuildArgs: []string{"VERSION"},
+			Labels:             map[string]string{"org.opencontainers.image.source": "https://git.example.com"},
+			ExtraTags:          []string{"latest", "3.12"},
+			Platforms:          []string{"linux/amd64"},
+			Timeout:            "20m",
+			CachePolicy:        CachePolicyPull,
+		}, false},
+		{"propagated arg not declared", ImageMetadata{PropagateBuildArgs: []string{"VERSION"}}, true},
+		{"label name", ImageMetadata{Labels: map[string]string{"a=b": "c"}}, true},
+		{"extra tag", ImageMetadata{ExtraTags: []string{"-latest"}}, true},
+		{"platform", ImageMetadata{Platforms: []string{"linux/amd64,linux/arm64"}}, true},
+		{"several platforms", ImageMetadata{Platforms: []string{"linux/amd64", "linux/arm64"}}, true},
+		{"timeout", ImageMetadata{Timeout: "-1m"}, true},
+		{"cache policy", ImageMetadata{CachePolicy: "always"}, true},
+	}
+	for _, test := range tests {
+		if err := test.metadata.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: validate() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestGetMetadataArguments(t *testing.T) {
+	var none *ImageMetadata
+	if got := none.getMetadataArguments(); len(got) != 0 {
+		t.Errorf("getMetadataArguments() without metadata = %v", got)
+	}
+	m := &ImageMetadata{
+		Labels:    map[string]string{"b": "2", "a": "1"},
+		Platforms: []string{"linux/arm64"},
+	}
+	want := []string{"--label", "a=1", "--label", "b=2", "--platform", "linux/arm64"}
+	if got := m.getMetadataArguments(); !reflect.DeepEqual(got, want) {
+		t.Errorf("getMetadataArguments() = %v, want %v", got, want)
+	}
+}
+
+func TestGetExtraTags(t *testing.T) {
+	inv := loadTestInventory(t, map[string]string{
+		"dockerfiles/root":            "FROM alpine:3\n",
+		"dockerfiles/root.yaml":       "extra_tags: [latest]\n",
+		"dockerfiles/child":           "FROM {{ local }}/root\n",
+		"dockerfiles/child.yaml":      "extra_tags: [stable, latest]\n",
+		"dockerfiles/other":           "FROM alpine:3\n",
+		"dockerfiles/other.yaml":      "extra_tags: [\"3.12\"]\n",
+		"dockerfiles/grandchild":      "FROM {{ local }}/child\n",
+		"dockerfiles/grandchild.yaml": "extra_tags: [edge]\n",
+	})
+	tests := []struct {
+		name   string
+		images []string
+		want   []string
+	}{
+		{"every image", nil, []string{"3.12", "edge", "latest", "stable"}},
+		{"subtree", []string{"child"}, []string{"edge", "latest", "stable"}},
+		{"leaf", []string{"grandchild"}, []string{"edge"}},
+		{"several subtrees", []string{"grandchild", "other"}, []string{"3.12", "edge"}},
+		{"unknown image", []string{"missing"}, []string{}},
+		{"unknown and known images", []string{"missing", "other"}, []string{"3.12"}},
+	}
+	for _, test := range tests {
+		if got := inv.GetExtraTags(test.images); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: GetExtraTags(%v) = %v, want %v", test.name, test.images, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package dockerbuild
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	ImageStatusSucceeded = "succeeded"
+	ImageStatusFailed    = "failed"
+
+	imageStepBuild = "build"
+	imageStepPush  = "push"
+)
+
+// ImageResult describes the outcome of building, and optionally pushing, a single image
+// Images interrupted by cancellation are not reported
+type ImageResult struct {
+	Name       string `json:"image_name"`
+	Reference  string `json:"reference"`
+	Status     string `json:"status"`
+	FailedStep string `json:"failed_step,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type imageResultHandlerContextKey struct{}
+
+// WithImageResultHandler returns a context whose builds call handler as each image finishes
+// handler may be called from multiple goroutines at once
+func WithImageResultHandler(ctx context.Context, handler func(ImageResult)) context.Context {
+	return context.WithValue(ctx, imageResultHandlerContextKey{}, handler)
+}
+
+func reportImageResult(ctx context.Context, result ImageResult) {
+	if handler, ok := ctx.Value(imageResultHandlerContextKey{}).(func(ImageResult)); ok {
+		handler(result)
+	}
+}
+
+// ReportImageResult passes a result produced elsewhere, i.e. by a build agent, to the handler given to WithImageResultHandler
+func ReportImageResult(ctx context.Context, result ImageResult) {
+	reportImageResult(ctx, result)
+}
+
+// newImageResult builds the result for an image from the error of the step that failed, if any
+func newImageResult(name string, reference string, step string, err error) ImageResult {
+	result := ImageResult{
+		Name:      name,
+		Reference: reference,
+		Status:    ImageStatusSucceeded,
+	}
+	if err != nil {
+		result.Status = ImageStatusFailed
+		result.FailedStep = step
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// getImageDigest looks up the registry digest of a pushed image
+// Returns an empty string if the digest can not be determined
+func getImageDigest(ctx context.Context, image string) string {
+	repository := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repository = image[:i]
+	}
+	var cmd = dockerCommand{
+		name:      "Inspecting Docker Image: " + image,
+		arguments: []string{"inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", image},
+	}
+	output, err := cmd.runWithOutput(ctx)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, repository+"@") {
+			return strings.TrimPrefix(strings.TrimSpace(line), repository+"@")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package dockerbuild
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/utilities/filesystem"
+)
+
+// ErrInventoryNotLoaded is returned when building before any inventory has been loaded
+var ErrInventoryNotLoaded = errors.New("Inventory has not been loaded")
+
+// Inventory holds the base images and deployments found in a docker base directory
+// An Inventory is not modified once loaded, so it is safe to share between builds
+type Inventory struct {
+	baseDirectory        string
+	dockerfileDirectory  string
+	deploymentDirectory  string
+	deployments          []string
+	buildableImages      []DockerBuildableImage
+	orphanedImages       []DockerOrphanedImage
+	dockerfileHeirarchy  map[string][]*dockerfile
+	baseImageDockerfiles map[string]*dockerfile
+	config               ProjectConfig
+}
+
+type inventoryContextKey struct{}
+
+var inventoryMutex sync.RWMutex
+
+// LoadInventory reads the base images in dockerfiles/ and the deployments in deployments/ under baseDirectory
+// Paths matching the ignore patterns of its container-factory.yaml are left out
+func LoadInventory(baseDirectory string) (*Inventory, error) {
+	baseDirectory, err := filesystem.BuildAbsolutePathFromHome(baseDirectory)
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{
+		baseDirectory:       baseDirectory,
+		dockerfileDirectory: filesystem.ForceTrailingSlash(baseDirectory) + "dockerfiles/",
+		deploymentDirectory: filesystem.ForceTrailingSlash(baseDirectory) + "deployments/",
+	}
+	logger.WithFields(logrus.Fields{
+		"docker_base_directory": inv.baseDirectory,
+	}).Debug("Loading inventory")
+
+	config, err := ReadProjectConfig(baseDirectory)
+	if err != nil {
+		return nil, err
+	} else if config != nil {
+		inv.config = config.WithDefaults()
+	} else {
+		inv.config = ProjectConfig{}.WithDefaults()
+	}
+
+	if inv.deployments, err = inv.getFolderDeployments(""); err != nil {
+		return nil, err
+	}
+	if err = inv.buildDockerImageHeirarchy(); err != nil {
+		return nil, err
+	}
+	inv.baseImageDockerfiles = map[string]*dockerfile{}
+	for _, children := range inv.dockerfileHeirarchy {
+		for _, df := range children {
+			if df.isBuildable {
+				inv.baseImageDockerfiles[df.name] = df
+			}
+		}
+	}
+	return inv, nil
+}
+
+// BaseDirectory returns the directory the inventory was loaded from
+func (inv *Inventory) BaseDirectory() string {
+	return inv.baseDirectory
+}
+
+// WithInventory returns a context whose builds use inv instead of the inventory loaded by SetDockerBaseDirectory
+func WithInventory(ctx context.Context, inv *Inventory) context.Context {
+	return context.WithValue(ctx, inventoryContextKey{}, inv)
+}
+
+// getInventory returns the inventory builds in ctx should use
+func getInventory(ctx context.Context) *Inventory {
+	if inv, ok := ctx.Value(inventoryContextKey{}).(*Inventory); ok && inv != nil {
+		return inv
+	}
+	return getDefaultInventory()
+}
+
+func getDefaultInventory() *Inventory {
+	inventoryMutex.RLock()
+	defer inventoryMutex.RUnlock()
+	return defaultInventory
+}
+
+func setDefaultInventory(inv *Inventory) {
+	inventoryMutex.Lock()
+	defer inventoryMutex.Unlock()
+	defaultInventory = inv
+}
+
+// GetDefaultInventory returns the inventory builds use unless one is given with WithInventory
+// Returns nil until an inventory has been loaded
+func GetDefaultInventory() *Inventory {
+	return getDefaultInventory()
+}
+
+// SetDefaultInventory replaces the inventory builds use unless one is given with WithInventory
+func SetDefaultInventory(inv *Inventory) {
+	setDefaultInventory(inv)
+}
@@ -0,0 +1,86 @@
+package dockerbuild
+
+import (
+	"context"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+type buildLoggerContextKey struct{}
+
+// buildLogger captures the log of a single build run in addition to the package logger
+type buildLogger struct {
+	logger *logrus.Logger
+	output io.Writer
+}
+
+// WithLogOutput returns a context whose builds also write their log entries and docker output to w
+// Entries are still sent to the package logger; w must be safe for concurrent use
+func WithLogOutput(ctx context.Context, w io.Writer) context.Context {
+	l := logrus.New()
+	l.Out = w
+	l.Formatter = &logrus.TextFormatter{
+		DisableColors: true,
+		FullTimestamp: true,
+	}
+	l.Level = logrus.InfoLevel
+	if logger.Level > l.Level {
+		l.Level = logger.Level
+	}
+	l.Hooks.Add(forwardingHook{})
+
+	return context.WithValue(ctx, buildLoggerContextKey{}, buildLogger{
+		logger: l,
+		output: w,
+	})
+}
+
+// getLogger returns the logger for the build run in ctx, falling back to the package logger
+func getLogger(ctx context.Context) *logrus.Logger {
+	if bl, ok := ctx.Value(buildLoggerContextKey{}).(buildLogger); ok {
+		return bl.logger
+	}
+	return logger
+}
+
+// GetLogger returns the logger for the build run in ctx, so callers can add entries to the log of the run
+func GetLogger(ctx context.Context) *logrus.Logger {
+	return getLogger(ctx)
+}
+
+// GetLogOutput returns the writer given to WithLogOutput, or nil
+func GetLogOutput(ctx context.Context) io.Writer {
+	return getLogOutput(ctx)
+}
+
+// getLogOutput returns the writer receiving raw docker output for the build run in ctx, if any
+func getLogOutput(ctx context.Context) io.Writer {
+	if bl, ok := ctx.Value(buildLoggerContextKey{}).(buildLogger); ok {
+		return bl.output
+	}
+	return nil
+}
+
+// forwardingHook sends entries from a build run logger on to the package logger
+type forwardingHook struct{}
+
+func (forwardingHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (forwardingHook) Fire(entry *logrus.Entry) error {
+	e := logger.WithFields(entry.Data)
+	switch entry.Level {
+	case logrus.DebugLevel:
+		e.Debug(entry.Message)
+	case logrus.InfoLevel:
+		e.Info(entry.Message)
+	case logrus.WarnLevel:
+		e.Warn(entry.Message)
+	default:
+		// Fatal and panic entries are handled by the build run logger itself
+		e.Error(entry.Message)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package dockerbuild
+
+import (
+	"time"
+
+	"go.mikenewswanger.com/container-factory/metrics"
+)
+
+const (
+	outcomeSuccess   = "success"
+	outcomeFailure   = "failure"
+	outcomeCancelled = "cancelled"
+)
+
+var imageBuildDuration = metrics.NewHistogramVec(
+	"container_factory_image_build_duration_seconds",
+	"Time taken by docker build per image",
+	metrics.DurationBuckets,
+	"image", "outcome",
+)
+
+var imagePushDuration = metrics.NewHistogramVec(
+	"container_factory_image_push_duration_seconds",
+	"Time taken to push an image to the registry, including retries",
+	metrics.DurationBuckets,
+	"image", "outcome",
+)
+
+var imagePushRetries = metrics.NewCounterVec(
+	"container_factory_image_push_retries_total",
+	"Push attempts that failed and were retried",
+	"image",
+)
+
+// getOutcome maps a build or push result onto the outcome label
+func getOutcome(err error) string {
+	switch {
+	case err == nil:
+		return outcomeSuccess
+	case err == ErrBuildCancelled:
+		return outcomeCancelled
+	}
+	return outcomeFailure
+}
+
+func observeDuration(hv *metrics.HistogramVec, started time.Time, image string, err error) {
+	hv.Observe(time.Since(started).Seconds(), image, getOutcome(err))
+}
@@ -0,0 +1,116 @@
+package dockerbuild
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"os/user"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ErrProfileNotFound is returned when a build selects a profile the workspace configuration does not define
+var ErrProfileNotFound = errors.New("Profile does not exist")
+
+// ProfileConfig bundles the settings of a named build target of the workspace, such as the registry of an environment
+type ProfileConfig struct {
+	// Overrides the registry base path of the workspace configuration
+	RegistryBasePath string `json:"registry_base_path,omitempty"`
+	// Go template of the tag built when none is given, with .User, .Commit, .Timestamp and .Profile, i.e. release-{{ .Commit }}
+	TagTemplate string `json:"tag_template,omitempty"`
+	// Pushes the built images; true when unset
+	Push *bool `json:"push,omitempty"`
+	// Builds must be approved on a server and are refused locally
+	Protected bool              `json:"protected,omitempty"`
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+}
+
+// tagTemplateData is given to tag templates; its values are only computed when the template uses them
+type tagTemplateData struct {
+	directory string
+	profile   string
+}
+
+func validateProfiles(profiles map[string]ProfileConfig) error {
+	for name, p := range profiles {
+		if name == "" {
+			return errors.New("Profiles require a name")
+		}
+		if p.TagTemplate != "" {
+			if _, err := template.New(name).Parse(p.TagTemplate); err != nil {
+				return errors.New("Invalid tag_template for profile " + name + ": " + err.Error())
+			}
+		}
+		if err := ValidateBuildArgs(p.BuildArgs); err != nil {
+			return errors.New("Invalid build_args for profile " + name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// GetProfile returns the named profile of the configuration
+func (c ProjectConfig) GetProfile(name string) (ProfileConfig, error) {
+	p, exists := c.Profiles[name]
+	if !exists {
+		return ProfileConfig{}, ErrProfileNotFound
+	}
+	return p, nil
+}
+
+// ShouldPush reports whether builds with the profile push their images
+func (p ProfileConfig) ShouldPush() bool {
+	return p.Push == nil || *p.Push
+}
+
+// RenderTag returns the tag given by the tag template of the profile named name, or an empty string if it has none
+// directory is the checkout of the workspace that .Commit is read from
+func (p ProfileConfig) RenderTag(name string, directory string) (string, error) {
+	if p.TagTemplate == "" {
+		return "", nil
+	}
+	t, err := template.New(name).Option("missingkey=error").Parse(p.TagTemplate)
+	if err != nil {
+		return "", err
+	}
+	var tag bytes.Buffer
+	if err := t.Execute(&tag, tagTemplateData{directory: directory, profile: name}); err != nil {
+		return "", errors.New("Could not render the tag template of profile " + name + ": " + err.Error())
+	}
+	return strings.TrimSpace(tag.String()), nil
+}
+
+// User returns the name of the user running the build
+func (d tagTemplateData) User() (string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return currentUser.Username, nil
+}
+
+// Commit returns the short commit checked out in the workspace
+func (d tagTemplateData) Commit() (string, error) {
+	return getShortCommit(d.directory)
+}
+
+// Timestamp returns the current UTC time as YYYYMMDDhhmmss
+func (d tagTemplateData) Timestamp() string {
+	return time.Now().UTC().Format("20060102150405")
+}
+
+// Profile returns the name of the profile
+func (d tagTemplateData) Profile() string {
+	return d.profile
+}
+
+// getShortCommit returns the short commit checked out in directory
+func getShortCommit(directory string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--short", "HEAD")
+	cmd.Dir = directory
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("Could not read the git commit of " + directory + ": " + err.Error())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,192 @@
+package dockerbuild
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// ProjectConfigFilename is the workspace configuration file read from the docker base directory
+const ProjectConfigFilename = "container-factory.yaml"
+
+// Tag strategies used when a build is not given a tag
+const (
+	TagStrategyUser      = "user"
+	TagStrategyGitCommit = "git-commit"
+	TagStrategyTimestamp = "timestamp"
+)
+
+// Builder backends running docker builds
+const (
+	BuilderDocker = "docker"
+	BuilderBuildx = "buildx"
+)
+
+const defaultDeploymentPrefix = "deployments"
+
+// ProjectConfig holds the workspace settings of container-factory.yaml
+type ProjectConfig struct {
+	RegistryBasePath string `json:"registry_base_path,omitempty"`
+	// Tag built when none is given: user (the current user, the default), git-commit or timestamp
+	TagStrategy string `json:"tag_strategy,omitempty"`
+	// docker (the default) runs docker build; buildx runs docker buildx build --load
+	Builder string `json:"builder,omitempty"`
+	// Maximum number of base images built at once; 0 is unlimited
+	Concurrency int `json:"concurrency,omitempty"`
+	// Globs of paths under dockerfiles/ and deployments/ left out of the inventory, i.e. dockerfiles/legacy/*
+	Ignore []string `json:"ignore,omitempty"`
+	// Repository deployments are pushed under below the registry base path
+	DeploymentPrefix string `json:"deployment_prefix,omitempty"`
+	// Passed to every base image and deployment build as --build-arg
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+	// Named build targets selected with --profile or the profile of an API request
+	Profiles map[string]ProfileConfig `json:"profiles,omitempty"`
+}
+
+type projectConfigContextKey struct{}
+
+// ReadProjectConfig reads and validates container-factory.yaml in baseDirectory
+// Returns nil if the directory has no configuration file
+func ReadProjectConfig(baseDirectory string) (*ProjectConfig, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(baseDirectory, ProjectConfigFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var config ProjectConfig
+	if err := yaml.Unmarshal(contents, &config); err != nil {
+		return nil, errors.New("Invalid " + ProjectConfigFilename + ": " + err.Error())
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate checks the values set in the configuration; empty values are left to their defaults
+func (c ProjectConfig) Validate() error {
+	switch c.TagStrategy {
+	case "", TagStrategyUser, TagStrategyGitCommit, TagStrategyTimestamp:
+	default:
+		return errors.New("Invalid tag_strategy; it must be user, git-commit or timestamp: " + c.TagStrategy)
+	}
+	switch c.Builder {
+	case "", BuilderDocker, BuilderBuildx:
+	default:
+		return errors.New("Invalid builder; it must be docker or buildx: " + c.Builder)
+	}
+	if c.Concurrency < 0 {
+		return errors.New("Invalid concurrency; it must not be negative: " + strconv.Itoa(c.Concurrency))
+	}
+	for _, pattern := range c.Ignore {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return errors.New("Invalid ignore pattern: " + pattern)
+		}
+	}
+	if strings.HasPrefix(c.DeploymentPrefix, "/") || strings.HasSuffix(c.DeploymentPrefix, "/") {
+		return errors.New("Invalid deployment_prefix; it must not start or end with /: " + c.DeploymentPrefix)
+	}
+	if err := ValidateBuildArgs(c.BuildArgs); err != nil {
+		return err
+	}
+	return validateProfiles(c.Profiles)
+}
+
+// WithDefaults returns the configuration with empty values replaced by their defaults
+func (c ProjectConfig) WithDefaults() ProjectConfig {
+	if c.TagStrategy == "" {
+		c.TagStrategy = TagStrategyUser
+	}
+	if c.Builder == "" {
+		c.Builder = BuilderDocker
+	}
+	if c.DeploymentPrefix == "" {
+		c.DeploymentPrefix = defaultDeploymentPrefix
+	}
+	if c.Ignore == nil {
+		c.Ignore = []string{}
+	}
+	return c
+}
+
+// WithProjectConfig returns a context whose builds use config instead of the configuration file of their inventory
+// The ignore patterns and deployment prefix always come from the inventory, since they describe its layout
+func WithProjectConfig(ctx context.Context, config ProjectConfig) context.Context {
+	return context.WithValue(ctx, projectConfigContextKey{}, config.WithDefaults())
+}
+
+// getProjectConfig returns the configuration builds in ctx use
+func getProjectConfig(ctx context.Context) ProjectConfig {
+	if config, ok := ctx.Value(projectConfigContextKey{}).(ProjectConfig); ok {
+		return config
+	}
+	if inv := getInventory(ctx); inv != nil {
+		return inv.config
+	}
+	return ProjectConfig{}.WithDefaults()
+}
+
+// getDefaultTag returns tag, or the tag given by the tag strategy when it is empty
+func getDefaultTag(ctx context.Context, tag string) (string, error) {
+	if tag != "" {
+		return tag, nil
+	}
+	switch getProjectConfig(ctx).TagStrategy {
+	case TagStrategyGitCommit:
+		directory := dockerBaseDirectory
+		if inv := getInventory(ctx); inv != nil {
+			directory = inv.baseDirectory
+		}
+		return getShortCommit(directory)
+	case TagStrategyTimestamp:
+		return tagTemplateData{}.Timestamp(), nil
+	default:
+		return tagTemplateData{}.User()
+	}
+}
+
+// getDefaultParentTag returns tag, or the tag given by the tag strategy when it is empty, for base images a build uses rather than produces
+// Returns ErrBaseImageTagRequired under the timestamp strategy, which only names images as they are built
+func getDefaultParentTag(ctx context.Context, tag string) (string, error) {
+	if tag == "" && getProjectConfig(ctx).TagStrategy == TagStrategyTimestamp {
+		return "", ErrBaseImageTagRequired
+	}
+	return getDefaultTag(ctx, tag)
+}
+
+// getBuildArguments returns the docker arguments starting an image build with the configured builder
+func getBuildArguments(ctx context.Context) []string {
+	if getProjectConfig(ctx).Builder == BuilderBuildx {
+		// Loaded into the local image store so the image can be pushed like one built by docker build
+		return []string{"buildx", "build", "--load"}
+	}
+	return []string{"build"}
+}
+
+// isIgnored reports whether a path relative to the base directory matches an ignore pattern of the inventory
+func (inv *Inventory) isIgnored(relativePath string) bool {
+	for _, pattern := range inv.config.Ignore {
+		if matched, _ := path.Match(pattern, relativePath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ProjectConfig returns the configuration file the inventory was loaded with, with defaults applied
+func (inv *Inventory) ProjectConfig() ProjectConfig {
+	return inv.config
+}
+
+// GetDeploymentImageName returns the image a deployment is pushed as
+func (inv *Inventory) GetDeploymentImageName(registryBasePath string, deploymentName string, deploymentTag string) string {
+	return registryBasePath + "/" + inv.config.DeploymentPrefix + "/" + deploymentName + ":" + deploymentTag
+}
@@ -0,0 +1,89 @@
+package dockerbuild
+
+import (
+	"context"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"testing"
+)
+
+func TestProjectConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ProjectConfig
+		wantErr bool
+	}{
+		{"empty", ProjectConfig{}, false},
+		{"complete", ProjectConfig{TagStrategy: TagStrategyTimestamp, Builder: BuilderBuildx, Concurrency: 2, Ignore: []string{"dockerfiles/legacy/*"}, DeploymentPrefix: "apps/deployments"}, false},
+		{"tag strategy", ProjectConfig{TagStrategy: "branch"}, true},
+		{"builder", ProjectConfig{Builder: "podman"}, true},
+		{"concurrency", ProjectConfig{Concurrency: -1}, true},
+		{"ignore pattern", ProjectConfig{Ignore: []string{"dockerfiles/["}}, true},
+		{"empty ignore pattern", ProjectConfig{Ignore: []string{""}}, true},
+		{"deployment prefix", ProjectConfig{DeploymentPrefix: "/deployments"}, true},
+	}
+	for _, test := range tests {
+		if err := test.config.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: Validate() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestGetDefaultTag(t *testing.T) {
+	inv := loadTestInventory(t, map[string]string{"dockerfiles/base": "FROM alpine:3\n"})
+	for _, arguments := range [][]string{
+		{"init", "-q"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "Initial commit"},
+	} {
+		cmd := exec.Command("git", arguments...)
+		cmd.Dir = inv.baseDirectory
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", arguments, err, output)
+		}
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		strategy string
+		tag      string
+		// Matched against the tag produced, and the base tag a deployment uses unless wantParentErr
+		want          string
+		wantParentErr error
+	}{
+		{"given tag", TagStrategyTimestamp, "v1", "^v1$", nil},
+		{"user", TagStrategyUser, "", "^" + regexp.QuoteMeta(currentUser.Username) + "$", nil},
+		{"git commit", TagStrategyGitCommit, "", "^[0-9a-f]{7,}$", nil},
+		{"timestamp", TagStrategyTimestamp, "", "^[0-9]{14}$", ErrBaseImageTagRequired},
+	}
+	for _, test := range tests {
+		ctx := WithProjectConfig(WithInventory(context.Background(), inv), ProjectConfig{TagStrategy: test.strategy})
+		tag, err := getDefaultTag(ctx, test.tag)
+		if err != nil || !regexp.MustCompile(test.want).MatchString(tag) {
+			t.Errorf("%s: getDefaultTag() = %q, %v; want a match for %s", test.name, tag, err, test.want)
+		}
+		tag, err = getDefaultParentTag(ctx, test.tag)
+		if test.wantParentErr != nil {
+			if err != test.wantParentErr {
+				t.Errorf("%s: getDefaultParentTag() = %q, %v; want %v", test.name, tag, err, test.wantParentErr)
+			}
+		} else if err != nil || !regexp.MustCompile(test.want).MatchString(tag) {
+			t.Errorf("%s: getDefaultParentTag() = %q, %v; want a match for %s", test.name, tag, err, test.want)
+		}
+	}
+}
+
+func TestBuildDeploymentRequiresBaseTagWithTimestampStrategy(t *testing.T) {
+	inv := loadTestInventory(t, map[string]string{
+		"dockerfiles/base": "FROM alpine:3\n",
+		"deployments/app":  "FROM {{ local }}/base\n",
+	})
+	ctx := WithProjectConfig(WithInventory(context.Background(), inv), ProjectConfig{TagStrategy: TagStrategyTimestamp})
+	if err := BuildDeployment(ctx, "registry.test/base", "app", "", "", false); err != ErrBaseImageTagRequired {
+		t.Errorf("BuildDeployment() = %v, want %v", err, ErrBaseImageTagRequired)
+	}
+}
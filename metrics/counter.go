@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bufio"
+	"sync"
+)
+
+// CounterVec is a set of monotonically increasing counters partitioned by labels
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mutex  sync.Mutex
+	labels map[string]labelSet
+	values map[string]float64
+}
+
+// NewCounterVec creates a counter and registers it with the default registry
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	cv := &CounterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		labels:     map[string]labelSet{},
+		values:     map[string]float64{},
+	}
+	DefaultRegistry.register(cv)
+	return cv
+}
+
+// Inc adds one to the counter with the given label values
+func (cv *CounterVec) Inc(labelValues ...string) {
+	cv.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter with the given label values
+func (cv *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("Counters cannot decrease: " + cv.name)
+	}
+	ls := newLabelSet(cv.labelNames, labelValues)
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	cv.labels[ls.key] = ls
+	cv.values[ls.key] += v
+}
+
+func (cv *CounterVec) describe() (string, string, string) {
+	return cv.name, cv.help, "counter"
+}
+
+func (cv *CounterVec) write(w *bufio.Writer) {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	for _, k := range sortedKeys(cv.labels) {
+		w.WriteString(cv.name + formatLabels(cv.labelNames, cv.labels[k].values, "", "") + " " + formatValue(cv.values[k]) + "\n")
+	}
+}
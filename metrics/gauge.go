@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"bufio"
+)
+
+// GaugeFunc is a gauge whose value is read from a function at collection time
+type GaugeFunc struct {
+	name     string
+	help     string
+	function func() float64
+}
+
+// NewGaugeFunc creates a gauge and registers it with the default registry
+// f is called on every scrape and must be safe for concurrent use
+func NewGaugeFunc(name string, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		name:     name,
+		help:     help,
+		function: f,
+	}
+	DefaultRegistry.register(g)
+	return g
+}
+
+func (g *GaugeFunc) describe() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	w.WriteString(g.name + " " + formatValue(g.function()) + "\n")
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"sort"
+	"sync"
+)
+
+// HistogramVec is a set of histograms partitioned by labels
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	mutex  sync.Mutex
+	labels map[string]labelSet
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// counts[i] holds observations less than or equal to buckets[i]; the +Inf bucket is count
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram and registers it with the default registry
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+	hv := &HistogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    sortedBuckets,
+		labels:     map[string]labelSet{},
+		series:     map[string]*histogramSeries{},
+	}
+	DefaultRegistry.register(hv)
+	return hv
+}
+
+// Observe records v in the histogram with the given label values
+func (hv *HistogramVec) Observe(v float64, labelValues ...string) {
+	ls := newLabelSet(hv.labelNames, labelValues)
+	hv.mutex.Lock()
+	defer hv.mutex.Unlock()
+
+	s, exists := hv.series[ls.key]
+	if !exists {
+		s = &histogramSeries{
+			counts: make([]uint64, len(hv.buckets)),
+		}
+		hv.series[ls.key] = s
+		hv.labels[ls.key] = ls
+	}
+	for i, upperBound := range hv.buckets {
+		if v <= upperBound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (hv *HistogramVec) describe() (string, string, string) {
+	return hv.name, hv.help, "histogram"
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.mutex.Lock()
+	defer hv.mutex.Unlock()
+	for _, k := range sortedKeys(hv.labels) {
+		values := hv.labels[k].values
+		s := hv.series[k]
+		for i, upperBound := range hv.buckets {
+			w.WriteString(hv.name + "_bucket" + formatLabels(hv.labelNames, values, "le", formatValue(upperBound)) + " " + formatValue(float64(s.counts[i])) + "\n")
+		}
+		w.WriteString(hv.name + "_bucket" + formatLabels(hv.labelNames, values, "le", formatValue(math.Inf(1))) + " " + formatValue(float64(s.count)) + "\n")
+		w.WriteString(hv.name + "_sum" + formatLabels(hv.labelNames, values, "", "") + " " + formatValue(s.sum) + "\n")
+		w.WriteString(hv.name + "_count" + formatLabels(hv.labelNames, values, "", "") + " " + formatValue(float64(s.count)) + "\n")
+	}
+}
@@ -0,0 +1,135 @@
+// Package metrics collects counters, gauges and histograms and exposes them in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DurationBuckets are histogram buckets in seconds suited to image builds and pushes
+var DurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// collector is implemented by every metric type held by the registry
+type collector interface {
+	describe() (name string, help string, metricType string)
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics to be exposed together
+type Registry struct {
+	mutex      sync.RWMutex
+	collectors map[string]collector
+}
+
+// DefaultRegistry is used by the New* functions and served by Handler
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: map[string]collector{},
+	}
+}
+
+func (r *Registry) register(c collector) {
+	name, _, _ := c.describe()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.collectors[name]; exists {
+		panic("Metric registered twice: " + name)
+	}
+	r.collectors[name] = c
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format, ordered by name
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for n := range r.collectors {
+		names = append(names, n)
+	}
+	collectors := r.collectors
+	r.mutex.RUnlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, n := range names {
+		name, help, metricType := collectors[n].describe()
+		bw.WriteString("# HELP " + name + " " + strings.Replace(help, "\n", " ", -1) + "\n")
+		bw.WriteString("# TYPE " + name + " " + metricType + "\n")
+		collectors[n].write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		DefaultRegistry.WriteText(w)
+	})
+}
+
+// labelSet identifies one series of a vector by its label values
+type labelSet struct {
+	key    string
+	values []string
+}
+
+func newLabelSet(labelNames []string, values []string) labelSet {
+	if len(values) != len(labelNames) {
+		panic("Expected " + strconv.Itoa(len(labelNames)) + " label values, got " + strconv.Itoa(len(values)))
+	}
+	return labelSet{
+		key:    strings.Join(values, "\xff"),
+		values: values,
+	}
+}
+
+func formatLabels(labelNames []string, values []string, extraName string, extraValue string) string {
+	pairs := []string{}
+	for i, n := range labelNames {
+		pairs = append(pairs, n+"=\""+escapeLabelValue(values[i])+"\"")
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+escapeLabelValue(extraValue)+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "\"", "\\\"", -1)
+	return strings.Replace(v, "\n", "\\n", -1)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns series keys in a stable order so output does not shuffle between scrapes
+func sortedKeys(m map[string]labelSet) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
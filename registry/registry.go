@@ -0,0 +1,225 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegistry     = "docker.io"
+	defaultRegistryHost = "registry-1.docker.io"
+	defaultTag          = "latest"
+	requestTimeout      = 30 * time.Second
+)
+
+// ErrNotFound is returned when the registry does not have the requested image
+var ErrNotFound = errors.New("Image does not exist in the registry")
+
+// Manifest types accepted when resolving a digest; lists and indexes come first so multi-platform images resolve to the digest docker pulls
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+var authenticateParameterRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Reference is an image reference split into the registry host, repository and tag or digest
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference as given to FROM, i.e. alpine:3.18 or registry.example.com/base/python
+// Images without a registry are on Docker Hub; official images are in the library/ namespace
+func ParseReference(reference string) (Reference, error) {
+	r := Reference{
+		Registry: defaultRegistry,
+	}
+	remainder := reference
+	if i := strings.Index(remainder, "@"); i >= 0 {
+		r.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+	}
+	if i := strings.Index(remainder, "/"); i >= 0 {
+		if host := remainder[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			r.Registry = host
+			remainder = remainder[i+1:]
+		}
+	}
+	if i := strings.LastIndex(remainder, ":"); i >= 0 {
+		r.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+	}
+	if remainder == "" || strings.ContainsAny(remainder, ":@ ") {
+		return Reference{}, errors.New("Invalid image reference: " + reference)
+	}
+	if r.Registry == defaultRegistry && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+	r.Repository = remainder
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = defaultTag
+	}
+	return r, nil
+}
+
+// Client resolves image digests with the Docker Registry HTTP API V2, using anonymous bearer tokens where the registry requires them
+type Client struct {
+	HTTPClient *http.Client
+	// Registries served over plain HTTP, i.e. localhost:5000
+	InsecureRegistries []string
+}
+
+// NewClient returns a client that reaches registries over HTTPS, except for the given insecure registries
+func NewClient(insecureRegistries []string) *Client {
+	return &Client{
+		HTTPClient: &http.Client{
+			Timeout: requestTimeout,
+		},
+		InsecureRegistries: insecureRegistries,
+	}
+}
+
+// ResolveDigest returns the content digest the registry currently serves for reference
+func (c *Client) ResolveDigest(ctx context.Context, reference string) (string, error) {
+	r, err := ParseReference(reference)
+	if err != nil {
+		return "", err
+	}
+	manifestReference := r.Tag
+	if r.Digest != "" {
+		manifestReference = r.Digest
+	}
+	manifestURL := c.getBaseURL(r.Registry) + "/v2/" + r.Repository + "/manifests/" + manifestReference
+
+	token := ""
+	response, err := c.requestManifest(ctx, "HEAD", manifestURL, token)
+	if err == nil && response.StatusCode == 401 {
+		response.Body.Close()
+		if token, err = c.getToken(ctx, response.Header.Get("WWW-Authenticate"), r.Repository); err != nil {
+			return "", err
+		}
+		response, err = c.requestManifest(ctx, "HEAD", manifestURL, token)
+	}
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode == 200 && response.Header.Get("Docker-Content-Digest") == "" {
+		// Some registries only send the digest for GET requests
+		response.Body.Close()
+		if response, err = c.requestManifest(ctx, "GET", manifestURL, token); err != nil {
+			return "", err
+		}
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == 404:
+		return "", ErrNotFound
+	case response.StatusCode != 200:
+		return "", errors.New("Registry " + r.Registry + " responded with status " + strconv.Itoa(response.StatusCode) + " for " + reference)
+	}
+	if digest := response.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	if response.Request.Method != "GET" {
+		return "", errors.New("Registry " + r.Registry + " did not return a digest for " + reference)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, response.Body); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *Client) requestManifest(ctx context.Context, method string, manifestURL string, token string) (*http.Response, error) {
+	request, err := http.NewRequest(method, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.HTTPClient.Do(request)
+}
+
+// getToken requests an anonymous pull token as described by a Bearer WWW-Authenticate challenge
+func (c *Client) getToken(ctx context.Context, challenge string, repository string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", errors.New("Registry requires unsupported authentication: " + challenge)
+	}
+	parameters := map[string]string{}
+	for _, match := range authenticateParameterRegex.FindAllStringSubmatch(challenge, -1) {
+		parameters[strings.ToLower(match[1])] = match[2]
+	}
+	if parameters["realm"] == "" {
+		return "", errors.New("Registry authentication challenge has no realm: " + challenge)
+	}
+
+	query := url.Values{}
+	if parameters["service"] != "" {
+		query.Set("service", parameters["service"])
+	}
+	scope := parameters["scope"]
+	if scope == "" {
+		scope = "repository:" + repository + ":pull"
+	}
+	query.Set("scope", scope)
+	request, err := http.NewRequest("GET", parameters["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := c.HTTPClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return "", errors.New("Token request responded with status " + strconv.Itoa(response.StatusCode))
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(contents, &body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+func (c *Client) getBaseURL(registry string) string {
+	if registry == defaultRegistry {
+		registry = defaultRegistryHost
+	}
+	for _, r := range c.InsecureRegistries {
+		if r == registry {
+			return "http://" + registry
+		}
+	}
+	return "https://" + registry
+}
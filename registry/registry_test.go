@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		reference string
+		want      Reference
+	}{
+		{"alpine", Reference{"docker.io", "library/alpine", "latest", ""}},
+		{"alpine:3.18", Reference{"docker.io", "library/alpine", "3.18", ""}},
+		{"bitnami/redis:7", Reference{"docker.io", "bitnami/redis", "7", ""}},
+		{"docker.io/library/alpine:3.18", Reference{"docker.io", "library/alpine", "3.18", ""}},
+		{"registry.example.com/base/python", Reference{"registry.example.com", "base/python", "latest", ""}},
+		{"registry.example.com:5000/base/python:3.12-slim", Reference{"registry.example.com:5000", "base/python", "3.12-slim", ""}},
+		{"localhost/base", Reference{"localhost", "base", "latest", ""}},
+		{"localhost:5000/base:dev", Reference{"localhost:5000", "base", "dev", ""}},
+		{"alpine@sha256:abc", Reference{"docker.io", "library/alpine", "", "sha256:abc"}},
+		{"alpine:3.18@sha256:abc", Reference{"docker.io", "library/alpine", "3.18", "sha256:abc"}},
+		{"registry.example.com:5000/base@sha256:abc", Reference{"registry.example.com:5000", "base", "", "sha256:abc"}},
+	}
+	for _, test := range tests {
+		got, err := ParseReference(test.reference)
+		if err != nil {
+			t.Errorf("ParseReference(%q): %v", test.reference, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseReference(%q) = %+v, want %+v", test.reference, got, test.want)
+		}
+	}
+
+	for _, reference := range []string{"", ":3.18", "@sha256:abc", "registry.example.com/", "alpine:3:18", "al pine"} {
+		if got, err := ParseReference(reference); err == nil {
+			t.Errorf("ParseReference(%q) = %+v, want an error", reference, got)
+		}
+	}
+}
+
+// testRegistry stands in for a registry serving one manifest, optionally behind anonymous bearer tokens
+type testRegistry struct {
+	server   *httptest.Server
+	manifest string
+	// Repository served, i.e. base/python
+	repository string
+	// Token required for manifest requests; anonymous requests are allowed when empty
+	token string
+	// Challenge sent instead of the bearer challenge, i.e. Basic realm="registry"
+	challenge string
+	// Whether responses leave out Docker-Content-Digest, so the digest is taken from the manifest
+	omitDigest bool
+	status     int
+
+	tokenQueries []string
+}
+
+func newTestRegistry(t *testing.T, r *testRegistry) *testRegistry {
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *testRegistry) digest() string {
+	sum := sha256.Sum256([]byte(r.manifest))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (r *testRegistry) serveHTTP(w http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == "/token" {
+		r.tokenQueries = append(r.tokenQueries, request.URL.RawQuery)
+		w.Write([]byte(`{"access_token":"` + r.token + `"}`))
+		return
+	}
+	if r.token != "" && request.Header.Get("Authorization") != "Bearer "+r.token {
+		challenge := r.challenge
+		if challenge == "" {
+			challenge = `Bearer realm="` + r.server.URL + `/token",service="test-registry"`
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		w.WriteHeader(401)
+		return
+	}
+	if !strings.Contains(request.Header.Get("Accept"), "application/vnd.docker.distribution.manifest.list.v2+json") {
+		w.WriteHeader(406)
+		return
+	}
+	if r.status != 0 {
+		w.WriteHeader(r.status)
+		return
+	}
+	if request.URL.Path != "/v2/"+r.repository+"/manifests/latest" && request.URL.Path != "/v2/"+r.repository+"/manifests/"+r.digest() {
+		w.WriteHeader(404)
+		return
+	}
+	if !r.omitDigest {
+		w.Header().Set("Docker-Content-Digest", r.digest())
+	}
+	w.Write([]byte(r.manifest))
+}
+
+func TestResolveDigest(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry *testRegistry
+		image    string
+		wantErr  bool
+	}{
+		{"anonymous", &testRegistry{repository: "base/python"}, "base/python", false},
+		{"bearer token", &testRegistry{repository: "base/python", token: "secret"}, "base/python", false},
+		{"digest from manifest", &testRegistry{repository: "base/python", omitDigest: true}, "base/python", false},
+		{"by digest", &testRegistry{repository: "base/python"}, "base/python@", false},
+		{"missing image", &testRegistry{repository: "base/python"}, "base/ruby", true},
+		{"server error", &testRegistry{repository: "base/python", status: 500}, "base/python", true},
+		{"unsupported challenge", &testRegistry{repository: "base/python", token: "secret", challenge: `Basic realm="test"`}, "base/python", true},
+	}
+	for _, test := range tests {
+		r := newTestRegistry(t, test.registry)
+		r.manifest = `{"schemaVersion":2,"name":"` + test.name + `"}`
+		reference := r.host() + "/" + test.image
+		if strings.HasSuffix(reference, "@") {
+			reference += r.digest()
+		}
+		client := NewClient([]string{r.host()})
+
+		digest, err := client.ResolveDigest(context.Background(), reference)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: ResolveDigest(%q) = %s, want an error", test.name, reference, digest)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ResolveDigest(%q): %v", test.name, reference, err)
+			continue
+		}
+		if digest != r.digest() {
+			t.Errorf("%s: ResolveDigest(%q) = %s, want %s", test.name, reference, digest, r.digest())
+		}
+		if r.token != "" {
+			if len(r.tokenQueries) != 1 || r.tokenQueries[0] != "scope=repository%3Abase%2Fpython%3Apull&service=test-registry" {
+				t.Errorf("%s: token requests = %v, want one for a pull of base/python", test.name, r.tokenQueries)
+			}
+		}
+	}
+}
+
+func TestResolveDigestMissingImageIsNotFound(t *testing.T) {
+	r := newTestRegistry(t, &testRegistry{repository: "base/python", manifest: "{}"})
+	if _, err := NewClient([]string{r.host()}).ResolveDigest(context.Background(), r.host()+"/base/ruby"); err != ErrNotFound {
+		t.Errorf("ResolveDigest of a missing image error = %v, want %v", err, ErrNotFound)
+	}
+}
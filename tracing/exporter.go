@@ -0,0 +1,200 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exportBatchSize    = 256
+	exportInterval     = 5 * time.Second
+	exportTimeout      = 10 * time.Second
+	exportQueueSize    = 4096
+	otlpTracesPath     = "/v1/traces"
+	otlpStatusCodeOK   = 1
+	otlpStatusCodeFail = 2
+)
+
+// exporter batches finished spans and posts them to an OTLP/HTTP collector using the JSON encoding
+type exporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	queue       chan *Span
+	flush       chan chan struct{}
+}
+
+func newExporter(endpoint string, serviceName string) *exporter {
+	url := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(url, otlpTracesPath) {
+		url += otlpTracesPath
+	}
+	e := &exporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, exportQueueSize),
+		flush:       make(chan chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// enqueue hands a finished span to the exporter; spans are dropped rather than blocking builds when the queue is full
+func (e *exporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		logger.Warn("Trace export queue is full; dropping span")
+	}
+}
+
+func (e *exporter) shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (e *exporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= exportBatchSize {
+				e.export(batch)
+				batch = []*Span{}
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = []*Span{}
+			}
+		case done := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = []*Span{}
+			}
+			close(done)
+		}
+	}
+}
+
+func (e *exporter) export(batch []*Span) {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, encodeSpan(s))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": encodeAttributes([]Attribute{String("service.name", e.serviceName)}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{
+							"name": e.serviceName,
+						},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	response, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err,
+			"spans": len(batch),
+		}).Warn("Failed to export spans")
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		logger.WithFields(logrus.Fields{
+			"status": response.StatusCode,
+			"spans":  len(batch),
+		}).Warn("Collector rejected spans")
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"spans": len(batch),
+	}).Debug("Exported spans")
+}
+
+func encodeSpan(s *Span) map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.context.TraceID[:]),
+		"spanId":            hex.EncodeToString(s.context.SpanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        encodeAttributes(s.attributes),
+		"status": map[string]interface{}{
+			"code": otlpStatusCodeOK,
+		},
+	}
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		span["status"] = map[string]interface{}{
+			"code":    otlpStatusCodeFail,
+			"message": s.err.Error(),
+		}
+	}
+	return span
+}
+
+func encodeAttributes(attributes []Attribute) []interface{} {
+	encoded := make([]interface{}, 0, len(attributes))
+	for _, a := range attributes {
+		var value map[string]interface{}
+		switch v := a.Value.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		default:
+			continue
+		}
+		encoded = append(encoded, map[string]interface{}{
+			"key":   a.Key,
+			"value": value,
+		})
+	}
+	return encoded
+}
@@ -0,0 +1,206 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type testAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type testSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Attributes   []testAttribute `json:"attributes"`
+	Status       struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type testExport struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []testAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []testSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// testCollector records the exports posted by the exporter
+type testCollector struct {
+	mutex   sync.Mutex
+	paths   []string
+	exports []testExport
+}
+
+func (c *testCollector) getSpans() []testSpan {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	spans := []testSpan{}
+	for _, e := range c.exports {
+		for _, rs := range e.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func (c *testCollector) getExportCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.exports)
+}
+
+// configureTestCollector enables tracing with a local collector for the duration of the test
+func configureTestCollector(t *testing.T) *testCollector {
+	c := &testCollector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e testExport
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.paths = append(c.paths, r.URL.Path)
+		c.exports = append(c.exports, e)
+	}))
+	previousLogger := logger
+	t.Cleanup(func() {
+		server.Close()
+		activeExporter = nil
+		logger = previousLogger
+	})
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	Configure(server.URL+"/", "test-service", l)
+	return c
+}
+
+func getTestAttribute(attributes []testAttribute, key string) interface{} {
+	for _, a := range attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func TestExportOnShutdown(t *testing.T) {
+	c := configureTestCollector(t)
+	ctx, parent := StartWithKind(context.Background(), "build", KindServer, String("tag", "v1"))
+	_, child := Start(ctx, "push", Bool("pushed", true), Int("layers", 3))
+	child.End(errors.New("Push failed"))
+	parent.End(nil)
+	// Spans are exported once, however often they are ended
+	parent.End(nil)
+	if c.getExportCount() != 0 {
+		t.Fatal("Spans were exported before the batch filled or the interval passed")
+	}
+
+	Shutdown(context.Background())
+	spans := c.getSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Collector received %d spans, want 2", len(spans))
+	}
+	if c.paths[0] != otlpTracesPath {
+		t.Errorf("Spans were posted to %s, want %s", c.paths[0], otlpTracesPath)
+	}
+	if service := getTestAttribute(c.exports[0].ResourceSpans[0].Resource.Attributes, "service.name"); service != "test-service" {
+		t.Errorf("service.name = %v, want test-service", service)
+	}
+
+	pushed, built := spans[0], spans[1]
+	if built.Name != "build" || built.Kind != KindServer || built.ParentSpanID != "" || built.Status.Code != otlpStatusCodeOK || getTestAttribute(built.Attributes, "tag") != "v1" {
+		t.Errorf("Parent span is %+v", built)
+	}
+	if pushed.Name != "push" || pushed.Kind != KindInternal || pushed.TraceID != built.TraceID || pushed.ParentSpanID != built.SpanID {
+		t.Errorf("Child span %+v is not part of the trace of %+v", pushed, built)
+	}
+	if pushed.Status.Code != otlpStatusCodeFail || pushed.Status.Message != "Push failed" {
+		t.Errorf("Child span status = %+v, want failed with the error", pushed.Status)
+	}
+	if getTestAttribute(pushed.Attributes, "pushed") != true || getTestAttribute(pushed.Attributes, "layers") != "3" {
+		t.Errorf("Child span attributes = %+v", pushed.Attributes)
+	}
+}
+
+func TestExportFullBatch(t *testing.T) {
+	c := configureTestCollector(t)
+	for i := 0; i < exportBatchSize; i++ {
+		_, s := Start(context.Background(), "image")
+		s.End(nil)
+	}
+	// A full batch is exported without waiting for the interval
+	for deadline := time.Now().Add(exportInterval / 2); c.getExportCount() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Full batch was not exported")
+		}
+	}
+	if spans := c.getSpans(); len(spans) != exportBatchSize {
+		t.Errorf("Collector received %d spans, want %d", len(spans), exportBatchSize)
+	}
+
+	Shutdown(context.Background())
+	if count := c.getExportCount(); count != 1 {
+		t.Errorf("Collector received %d exports, want 1 since nothing was left to flush", count)
+	}
+}
+
+func TestExportQueueFull(t *testing.T) {
+	previousLogger := logger
+	defer func() { logger = previousLogger }()
+	logger = logrus.New()
+	logger.Out = ioutil.Discard
+
+	// Without a running exporter the queue is never drained
+	e := &exporter{queue: make(chan *Span, 1), flush: make(chan chan struct{})}
+	e.enqueue(&Span{name: "kept"})
+	e.enqueue(&Span{name: "dropped"})
+	if len(e.queue) != 1 || (<-e.queue).name != "kept" {
+		t.Error("Span was not dropped when the queue was full")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	finished := make(chan struct{})
+	go func() {
+		e.shutdown(ctx)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Error("shutdown did not return once its context was cancelled")
+	}
+}
+
+func TestSpansAreNotRecordedWhenDisabled(t *testing.T) {
+	ctx, s := Start(context.Background(), "build")
+	if s != nil || SpanContextFromContext(ctx).IsValid() {
+		t.Error("Span was recorded without an exporter")
+	}
+	// Methods are safe to call on the nil span
+	s.SetAttributes(String("tag", "v1"))
+	s.End(nil)
+}
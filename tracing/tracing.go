@@ -0,0 +1,199 @@
+// Package tracing records spans for build runs and exports them to an OTLP/HTTP collector
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Span kinds as defined by the OTLP protocol
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+var logger = logrus.New()
+
+// Set by Configure(); spans are not recorded while nil
+var activeExporter *exporter
+
+type contextKey struct{}
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether the span context carries a trace
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{}
+}
+
+// Attribute is a key/value pair attached to a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String creates a string attribute
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool creates a boolean attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int creates an integer attribute
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+// Span is a single timed operation; methods are safe to call on a nil span
+type Span struct {
+	mutex      sync.Mutex
+	name       string
+	kind       int
+	context    SpanContext
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	attributes []Attribute
+	err        error
+	ended      bool
+}
+
+// Configure starts exporting spans to the OTLP/HTTP endpoint, i.e. http://localhost:4318
+// Tracing stays disabled when endpoint is empty
+func Configure(endpoint string, serviceName string, l *logrus.Logger) {
+	logger = l
+	if endpoint == "" {
+		return
+	}
+	activeExporter = newExporter(endpoint, serviceName)
+	logger.WithFields(logrus.Fields{
+		"otlp_endpoint": endpoint,
+	}).Info("Tracing enabled")
+}
+
+// Shutdown flushes spans that have not been exported yet
+func Shutdown(ctx context.Context) {
+	if activeExporter != nil {
+		activeExporter.shutdown(ctx)
+	}
+}
+
+// Enabled reports whether spans are being recorded
+func Enabled() bool {
+	return activeExporter != nil
+}
+
+// Start begins a span as a child of the span in ctx, if any
+func Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	return StartWithKind(ctx, name, KindInternal, attributes...)
+}
+
+// StartWithKind begins a span of the given kind as a child of the span in ctx, if any
+func StartWithKind(ctx context.Context, name string, kind int, attributes ...Attribute) (context.Context, *Span) {
+	if activeExporter == nil {
+		return ctx, nil
+	}
+
+	parent := SpanContextFromContext(ctx)
+	s := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: attributes,
+	}
+	if parent.IsValid() {
+		s.context.TraceID = parent.TraceID
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+	}
+	rand.Read(s.context.SpanID[:])
+
+	return context.WithValue(ctx, contextKey{}, s.context), s
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// End completes the span; a non-nil err marks the span as failed
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.err = err
+	s.mutex.Unlock()
+
+	if activeExporter != nil {
+		activeExporter.enqueue(s)
+	}
+}
+
+// SpanContextFromContext returns the span context stored in ctx
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if sc, ok := ctx.Value(contextKey{}).(SpanContext); ok {
+		return sc
+	}
+	return SpanContext{}
+}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc as the current span
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// Extract reads a W3C traceparent header into ctx so new spans continue the caller's trace
+func Extract(ctx context.Context, header http.Header) context.Context {
+	// traceparent: version-traceid-spanid-flags
+	parts := strings.Split(strings.TrimSpace(header.Get("traceparent")), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// Inject writes the span in ctx to a W3C traceparent header
+func Inject(ctx context.Context, header http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	header.Set("traceparent", "00-"+hex.EncodeToString(sc.TraceID[:])+"-"+hex.EncodeToString(sc.SpanID[:])+"-01")
+}
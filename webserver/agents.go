@@ -0,0 +1,662 @@
+package webserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/agent"
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/utilities/filesystem"
+)
+
+const (
+	errorCodeAgentNotFound = "agent_not_found"
+	errorCodeTaskNotFound  = "task_not_found"
+
+	defaultAgentHeartbeatTimeout = time.Minute
+	agentHeartbeatInterval       = 10 * time.Second
+	// Polls without a task are answered with 204 after this long so agents notice a lost server
+	agentPollTimeout = 30 * time.Second
+	// Tasks fail once this many agents stopped responding while building them
+	maxAgentTaskAttempts = 3
+	// Longest line accepted in a task log
+	maxAgentLogLineBytes = 1024 * 1024
+)
+
+var errAgentNotFound = errors.New("Build agent is not registered")
+var errAgentTaskNotFound = errors.New("Task is not assigned to this build agent")
+
+// agentsConfig makes the server dispatch builds to agents started with the agent command instead of its own docker daemon
+type agentsConfig struct {
+	// Agents not heard from within this time are considered gone and their tasks reassigned, i.e. 1m
+	HeartbeatTimeout string `json:"heartbeat_timeout"`
+	// Only agents advertising this platform receive tasks, i.e. linux/amd64; any platform when empty
+	Platform string `json:"platform"`
+
+	heartbeatTimeout time.Duration
+}
+
+// buildAgent is an agent registered with the server
+type buildAgent struct {
+	ID string `json:"id"`
+	agent.Registration
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+	// IDs of the tasks assigned to the agent
+	Tasks []string `json:"tasks"`
+}
+
+// dispatchedTask is a task waiting for or assigned to an agent
+type dispatchedTask struct {
+	agent.Task
+	// Run context of the job; carries the job log and image result handler
+	ctx    context.Context
+	source buildSource
+	// Name and reference reported when the task fails without an image result
+	imageName  string
+	reference  string
+	agentID    string
+	assignedAt time.Time
+	done       chan agent.TaskResult
+}
+
+type agentPool struct {
+	config  *agentsConfig
+	mutex   sync.Mutex
+	agents  map[string]*buildAgent
+	tasks   map[string]*dispatchedTask
+	pending []*dispatchedTask
+	// Closed and replaced whenever a task is queued to wake polling agents
+	queued chan struct{}
+}
+
+var buildAgents = agentPool{
+	agents: map[string]*buildAgent{},
+	tasks:  map[string]*dispatchedTask{},
+	queued: make(chan struct{}),
+}
+
+func validateAgents(config *agentsConfig) error {
+	if config == nil {
+		return nil
+	}
+	config.heartbeatTimeout = defaultAgentHeartbeatTimeout
+	if config.HeartbeatTimeout != "" {
+		var err error
+		if config.heartbeatTimeout, err = time.ParseDuration(config.HeartbeatTimeout); err != nil || config.heartbeatTimeout <= agentHeartbeatInterval {
+			return errors.New("Invalid heartbeat_timeout for agents; it must be longer than " + agentHeartbeatInterval.String() + ": " + config.HeartbeatTimeout)
+		}
+	}
+	return nil
+}
+
+func (p *agentPool) configure(config *agentsConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.config = config
+}
+
+// enabled reports whether builds are dispatched to agents
+func (p *agentPool) enabled() bool {
+	return p.config != nil
+}
+
+// start watches for agents that stopped responding
+func (p *agentPool) start() {
+	if p.config == nil {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(p.config.heartbeatTimeout / 4)
+			p.mutex.Lock()
+			for _, a := range p.agents {
+				if time.Since(a.LastSeen) > p.config.heartbeatTimeout {
+					logger.WithFields(logrus.Fields{
+						"agent_id": a.ID,
+						"agent":    a.Name,
+					}).Warn("Build agent stopped responding")
+					p.removeAgent(a, "Build agent "+a.Name+" stopped responding")
+				}
+			}
+			p.mutex.Unlock()
+		}
+	}()
+}
+
+// register adds an agent, replacing an earlier registration with the same name since that agent has restarted
+func (p *agentPool) register(registration agent.Registration) buildAgent {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, a := range p.agents {
+		if a.Name == registration.Name {
+			p.removeAgent(a, "Build agent "+a.Name+" registered again")
+		}
+	}
+	now := time.Now().UTC()
+	a := &buildAgent{
+		ID:           newJobID(),
+		Registration: registration,
+		RegisteredAt: now,
+		LastSeen:     now,
+		Tasks:        []string{},
+	}
+	p.agents[a.ID] = a
+	logger.WithFields(logrus.Fields{
+		"agent_id": a.ID,
+		"agent":    a.Name,
+		"platform": a.Platform,
+		"capacity": a.Capacity,
+	}).Info("Build agent registered")
+	// Tasks may have been waiting for an agent of this platform
+	p.notify()
+	return *a
+}
+
+// deregister removes an agent that is stopping and reassigns its tasks
+func (p *agentPool) deregister(agentID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	a, exists := p.agents[agentID]
+	if !exists {
+		return errAgentNotFound
+	}
+	logger.WithFields(logrus.Fields{
+		"agent_id": a.ID,
+		"agent":    a.Name,
+	}).Info("Build agent deregistered")
+	p.removeAgent(a, "Build agent "+a.Name+" stopped")
+	return nil
+}
+
+// removeAgent forgets an agent and requeues its tasks; the caller must hold the lock
+func (p *agentPool) removeAgent(a *buildAgent, reason string) {
+	delete(p.agents, a.ID)
+	for _, id := range a.Tasks {
+		if t, exists := p.tasks[id]; exists {
+			p.requeue(t, reason)
+		}
+	}
+	a.Tasks = []string{}
+}
+
+// requeue returns a task to the front of the queue, failing it once too many agents were lost building it
+// The caller must hold the lock and remove the task from its agent
+func (p *agentPool) requeue(t *dispatchedTask, reason string) {
+	t.agentID = ""
+	log := dockerbuild.GetLogger(t.ctx).WithFields(logrus.Fields{
+		"image":   t.Image,
+		"attempt": t.Attempt,
+	})
+	if t.Attempt >= maxAgentTaskAttempts {
+		delete(p.tasks, t.ID)
+		log.Error(reason + "; giving up on the task")
+		t.done <- agent.TaskResult{
+			Status: agent.TaskStatusFailed,
+			Error:  reason + " after " + t.Image + " was assigned to " + strconv.Itoa(t.Attempt) + " build agents",
+		}
+		return
+	}
+	log.Warn(reason + "; reassigning the task")
+	p.pending = append([]*dispatchedTask{t}, p.pending...)
+	p.notify()
+}
+
+// notify wakes polling agents; the caller must hold the lock
+func (p *agentPool) notify() {
+	close(p.queued)
+	p.queued = make(chan struct{})
+}
+
+// poll waits for a task the agent can take; returns nil if none became available in time
+func (p *agentPool) poll(ctx context.Context, agentID string) (*agent.Task, error) {
+	timeout := time.NewTimer(agentPollTimeout)
+	defer timeout.Stop()
+	for {
+		p.mutex.Lock()
+		a, exists := p.agents[agentID]
+		if !exists {
+			p.mutex.Unlock()
+			return nil, errAgentNotFound
+		}
+		a.LastSeen = time.Now().UTC()
+		if t := p.assign(a); t != nil {
+			task := t.Task
+			p.mutex.Unlock()
+			return &task, nil
+		}
+		queued := p.queued
+		p.mutex.Unlock()
+
+		select {
+		case <-queued:
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// assign gives the oldest queued task to an agent with spare capacity; the caller must hold the lock
+func (p *agentPool) assign(a *buildAgent) *dispatchedTask {
+	if len(p.pending) == 0 || len(a.Tasks) >= a.Capacity || (p.config.Platform != "" && a.Platform != p.config.Platform) {
+		return nil
+	}
+	t := p.pending[0]
+	p.pending = p.pending[1:]
+	t.agentID = a.ID
+	t.assignedAt = time.Now().UTC()
+	t.Attempt++
+	a.Tasks = append(a.Tasks, t.ID)
+	dockerbuild.GetLogger(t.ctx).WithFields(logrus.Fields{
+		"image":   t.Image,
+		"agent":   a.Name,
+		"attempt": t.Attempt,
+	}).Info("Assigned to build agent")
+	return t
+}
+
+// heartbeat records that an agent is alive and returns the running tasks it should stop
+// Tasks assigned to the agent that it has not started, i.e. because the poll response was lost, are reassigned
+func (p *agentPool) heartbeat(agentID string, running []string) ([]string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	a, exists := p.agents[agentID]
+	if !exists {
+		return nil, errAgentNotFound
+	}
+	a.LastSeen = time.Now().UTC()
+
+	isRunning := map[string]bool{}
+	cancel := []string{}
+	for _, id := range running {
+		isRunning[id] = true
+		if t, exists := p.tasks[id]; !exists || t.agentID != a.ID {
+			cancel = append(cancel, id)
+		}
+	}
+	for _, id := range append([]string{}, a.Tasks...) {
+		t, exists := p.tasks[id]
+		if exists && !isRunning[id] && time.Since(t.assignedAt) > 2*agentHeartbeatInterval {
+			p.removeAgentTask(a, id)
+			p.requeue(t, "Build agent "+a.Name+" did not start the task")
+		}
+	}
+	return cancel, nil
+}
+
+// getTask returns a task assigned to the agent
+func (p *agentPool) getTask(agentID string, taskID string) (*dispatchedTask, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, exists := p.agents[agentID]; !exists {
+		return nil, errAgentNotFound
+	}
+	t, exists := p.tasks[taskID]
+	if !exists || t.agentID != agentID {
+		return nil, errAgentTaskNotFound
+	}
+	return t, nil
+}
+
+// complete records the result an agent reported for a task
+func (p *agentPool) complete(agentID string, taskID string, result agent.TaskResult) error {
+	p.mutex.Lock()
+	a, exists := p.agents[agentID]
+	if !exists {
+		p.mutex.Unlock()
+		return errAgentNotFound
+	}
+	a.LastSeen = time.Now().UTC()
+	t, exists := p.tasks[taskID]
+	if !exists || t.agentID != agentID {
+		p.mutex.Unlock()
+		return errAgentTaskNotFound
+	}
+	delete(p.tasks, taskID)
+	p.removeAgentTask(a, taskID)
+	// The agent has capacity for another task
+	p.notify()
+	p.mutex.Unlock()
+
+	t.done <- result
+	return nil
+}
+
+// cancel withdraws a task whose job was cancelled; an agent running it is told to stop on its next heartbeat
+func (p *agentPool) cancel(t *dispatchedTask) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.tasks, t.ID)
+	for i, pending := range p.pending {
+		if pending == t {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			break
+		}
+	}
+	if a, exists := p.agents[t.agentID]; exists {
+		p.removeAgentTask(a, t.ID)
+	}
+}
+
+// removeAgentTask drops a task from the tasks of an agent; the caller must hold the lock
+func (p *agentPool) removeAgentTask(a *buildAgent, taskID string) {
+	for i, id := range a.Tasks {
+		if id == taskID {
+			a.Tasks = append(a.Tasks[:i], a.Tasks[i+1:]...)
+			return
+		}
+	}
+}
+
+// list returns copies of the registered agents sorted by name, and the number of queued tasks
+func (p *agentPool) list() ([]buildAgent, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	l := make([]buildAgent, 0, len(p.agents))
+	for _, a := range p.agents {
+		c := *a
+		c.Tasks = append([]string{}, a.Tasks...)
+		l = append(l, c)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return l, len(p.pending)
+}
+
+// run queues a task and waits for an agent to finish it, reporting its image result to the job
+func (p *agentPool) run(ctx context.Context, source buildSource, task agent.Task, imageName string, reference string) agent.TaskResult {
+	task.ID = newJobID()
+	task.JobID = getJobID(ctx)
+	task.RegistryBasePath = source.registryBasePath
+	task.BuildArgs = dockerbuild.GetBuildArgs(ctx)
+	t := &dispatchedTask{
+		Task:      task,
+		ctx:       ctx,
+		source:    source,
+		imageName: imageName,
+		reference: reference,
+		done:      make(chan agent.TaskResult, 1),
+	}
+	p.mutex.Lock()
+	p.tasks[t.ID] = t
+	p.pending = append(p.pending, t)
+	p.notify()
+	p.mutex.Unlock()
+	dockerbuild.GetLogger(ctx).WithFields(logrus.Fields{
+		"image": task.Image,
+	}).Info("Waiting for a build agent")
+
+	select {
+	case result := <-t.done:
+		if result.Image != nil {
+			dockerbuild.ReportImageResult(ctx, *result.Image)
+		} else if result.Status == agent.TaskStatusFailed {
+			dockerbuild.ReportImageResult(ctx, dockerbuild.ImageResult{
+				Name:       imageName,
+				Reference:  reference,
+				Status:     dockerbuild.ImageStatusFailed,
+				FailedStep: "build",
+				Error:      result.Error,
+			})
+		}
+		return result
+	case <-ctx.Done():
+		p.cancel(t)
+		return agent.TaskResult{
+			Status: agent.TaskStatusFailed,
+			Error:  dockerbuild.ErrBuildCancelled.Error(),
+		}
+	}
+}
+
+// buildBaseImageSubtrees builds each image of the subtrees as a separate task, queueing children once their parent is pushed
+func (p *agentPool) buildBaseImageSubtrees(ctx context.Context, source buildSource, tag string, images []string, forceRebuild bool) error {
+	log := dockerbuild.GetLogger(ctx)
+	subtrees, err := source.inventory.GetSubtrees(images)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"tag":    tag,
+		"images": strings.Join(images, ", "),
+	}).Info("Building base images on build agents")
+
+	var failuresMutex sync.Mutex
+	failures := []string{}
+	var waitGroup sync.WaitGroup
+	var build func(images []dockerbuild.DockerBuildableImage)
+	build = func(images []dockerbuild.DockerBuildableImage) {
+		for _, image := range images {
+			if image.Metadata != nil && image.Metadata.Disabled {
+				log.WithFields(logrus.Fields{
+					"image": image.Name,
+				}).Info("Skipping disabled image and its descendants")
+				continue
+			}
+			waitGroup.Add(1)
+			go func(image dockerbuild.DockerBuildableImage) {
+				defer waitGroup.Done()
+				reference := filesystem.ForceTrailingSlash(source.registryBasePath) + image.Name + ":" + tag
+				result := p.run(ctx, source, agent.Task{
+					Type:           agent.TaskTypeBaseImage,
+					Image:          image.Name,
+					Tag:            tag,
+					ForceRebuild:   forceRebuild,
+					PullBaseImages: dockerbuild.ShouldPullBaseImages(ctx),
+				}, image.Name, reference)
+				if result.Status == agent.TaskStatusSucceeded {
+					build(image.Children)
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				step := "build"
+				if result.Image != nil && result.Image.FailedStep != "" {
+					step = result.Image.FailedStep
+				}
+				failuresMutex.Lock()
+				failures = append(failures, reference+" ("+step+")")
+				failuresMutex.Unlock()
+			}(image)
+		}
+	}
+	build(subtrees)
+	waitGroup.Wait()
+
+	if ctx.Err() != nil {
+		log.Warn("Build cancelled")
+		return dockerbuild.ErrBuildCancelled
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return errors.New("Failed images: " + strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// buildDeployment builds a deployment as a single task
+func (p *agentPool) buildDeployment(ctx context.Context, source buildSource, deploymentName string, tag string, deploymentTag string) error {
+	if !source.inventory.DeploymentExists(deploymentName) {
+		return dockerbuild.ErrDeploymentNotFound
+	}
+	if deploymentTag == "" {
+		deploymentTag = tag
+	}
+	result := p.run(ctx, source, agent.Task{
+		Type:          agent.TaskTypeDeployment,
+		Image:         deploymentName,
+		Tag:           tag,
+		DeploymentTag: deploymentTag,
+	}, "deployments/"+deploymentName, source.inventory.GetDeploymentImageName(source.registryBasePath, deploymentName, deploymentTag))
+	if ctx.Err() != nil {
+		return dockerbuild.ErrBuildCancelled
+	}
+	if result.Status != agent.TaskStatusSucceeded {
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
+// runBaseImagesBuild builds the subtrees of images on build agents when they are configured and with the local docker daemon otherwise
+func runBaseImagesBuild(ctx context.Context, source buildSource, tag string, images []string, forceRebuild bool) error {
+	if buildAgents.enabled() {
+		return buildAgents.buildBaseImageSubtrees(ctx, source, tag, images, forceRebuild)
+	}
+	return dockerbuild.BuildBaseImageSubtrees(ctx, source.registryBasePath, tag, images, forceRebuild, true)
+}
+
+// runDeploymentBuild builds a deployment on a build agent when they are configured and with the local docker daemon otherwise
+func runDeploymentBuild(ctx context.Context, source buildSource, deploymentName string, tag string, deploymentTag string) error {
+	if buildAgents.enabled() {
+		return buildAgents.buildDeployment(ctx, source, deploymentName, tag, deploymentTag)
+	}
+	return dockerbuild.BuildDeployment(ctx, source.registryBasePath, deploymentName, tag, deploymentTag, true)
+}
+
+func addAgentRoutes() {
+	if buildAgents.config == nil {
+		return
+	}
+	ginEngine.GET("/api/v1/agents", requireScope(scopeRead), func(c *gin.Context) { renderAgents(c) })
+	ginEngine.POST("/api/v1/agents", audit("agent.register"), requireScope(scopeAgent), func(c *gin.Context) { registerAgent(c) })
+	ginEngine.DELETE("/api/v1/agents/:id", audit("agent.deregister"), requireScope(scopeAgent), func(c *gin.Context) { deregisterAgent(c) })
+	ginEngine.POST("/api/v1/agents/:id/heartbeat", requireScope(scopeAgent), func(c *gin.Context) { receiveAgentHeartbeat(c) })
+	ginEngine.POST("/api/v1/agents/:id/poll", requireScope(scopeAgent), func(c *gin.Context) { pollAgentTasks(c) })
+	ginEngine.GET("/api/v1/agents/:id/tasks/:task/source", requireScope(scopeAgent), func(c *gin.Context) { renderAgentTaskSource(c) })
+	ginEngine.POST("/api/v1/agents/:id/tasks/:task/logs", requireScope(scopeAgent), func(c *gin.Context) { receiveAgentTaskLogs(c) })
+	ginEngine.POST("/api/v1/agents/:id/tasks/:task/result", audit("agent.task-result"), requireScope(scopeAgent), func(c *gin.Context) { receiveAgentTaskResult(c) })
+}
+
+func renderAgents(c *gin.Context) {
+	agents, queued := buildAgents.list()
+	c.JSON(200, gin.H{
+		"agents":       agents,
+		"queued_tasks": queued,
+	})
+}
+
+func registerAgent(c *gin.Context) {
+	var registration agent.Registration
+	if err := c.ShouldBindJSON(&registration); err != nil {
+		renderAPIError(c, 400, errorCodeInvalidRequest, "Request body must be an agent registration")
+		return
+	}
+	if registration.Name == "" {
+		registration.Name = getCaller(c)
+	}
+	if registration.Capacity < 1 {
+		registration.Capacity = 1
+	}
+	c.JSON(201, gin.H{
+		"agent":              buildAgents.register(registration),
+		"heartbeat_interval": agentHeartbeatInterval.String(),
+	})
+}
+
+func deregisterAgent(c *gin.Context) {
+	if err := buildAgents.deregister(c.Param("id")); err != nil {
+		renderAgentError(c, err)
+		return
+	}
+	c.Status(204)
+}
+
+func receiveAgentHeartbeat(c *gin.Context) {
+	var heartbeat agent.Heartbeat
+	if err := c.ShouldBindJSON(&heartbeat); err != nil {
+		renderAPIError(c, 400, errorCodeInvalidRequest, "Request body must be a heartbeat")
+		return
+	}
+	cancel, err := buildAgents.heartbeat(c.Param("id"), heartbeat.Running)
+	if err != nil {
+		renderAgentError(c, err)
+		return
+	}
+	c.JSON(200, agent.HeartbeatResponse{
+		Cancel: cancel,
+	})
+}
+
+// pollAgentTasks holds the request open until a task is assigned to the agent or the poll times out with 204
+func pollAgentTasks(c *gin.Context) {
+	task, err := buildAgents.poll(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		renderAgentError(c, err)
+		return
+	}
+	if task == nil {
+		c.Status(204)
+		return
+	}
+	c.JSON(200, gin.H{
+		"task": task,
+	})
+}
+
+// renderAgentTaskSource sends the build assets of the job as a gzipped tarball
+func renderAgentTaskSource(c *gin.Context) {
+	t, err := buildAgents.getTask(c.Param("id"), c.Param("task"))
+	if err != nil {
+		renderAgentError(c, err)
+		return
+	}
+	c.Header("Content-Type", "application/gzip")
+	c.Status(200)
+	if err := agent.WriteSourceArchive(c.Writer, t.source.inventory.BaseDirectory()); err != nil {
+		logger.WithFields(logrus.Fields{
+			"task_id": t.ID,
+			"error":   err,
+		}).Error("Failed to send build source to agent")
+	}
+}
+
+// receiveAgentTaskLogs appends the streamed output of a task to the log of its job, a line at a time so concurrent tasks do not interleave mid-line
+func receiveAgentTaskLogs(c *gin.Context) {
+	t, err := buildAgents.getTask(c.Param("id"), c.Param("task"))
+	if err != nil {
+		renderAgentError(c, err)
+		return
+	}
+	output := dockerbuild.GetLogOutput(t.ctx)
+	scanner := bufio.NewScanner(c.Request.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxAgentLogLineBytes)
+	for scanner.Scan() {
+		if output != nil {
+			output.Write([]byte(scanner.Text() + "\n"))
+		}
+	}
+	c.Status(204)
+}
+
+func receiveAgentTaskResult(c *gin.Context) {
+	var result agent.TaskResult
+	if err := c.ShouldBindJSON(&result); err != nil || (result.Status != agent.TaskStatusSucceeded && result.Status != agent.TaskStatusFailed) {
+		renderAPIError(c, 400, errorCodeInvalidRequest, "Request body must be a task result")
+		return
+	}
+	if err := buildAgents.complete(c.Param("id"), c.Param("task"), result); err != nil {
+		renderAgentError(c, err)
+		return
+	}
+	c.Status(204)
+}
+
+func renderAgentError(c *gin.Context, err error) {
+	if err == errAgentNotFound {
+		renderAPIError(c, 404, errorCodeAgentNotFound, err.Error())
+		return
+	}
+	renderAPIError(c, 404, errorCodeTaskNotFound, err.Error())
+}
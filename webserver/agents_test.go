@@ -0,0 +1,223 @@
+package webserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.mikenewswanger.com/container-factory/agent"
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// fakeDockerScript logs every docker command with the directory it ran in, sleeping for builds so tasks overlap
+const fakeDockerScript = `#!/bin/sh
+echo "$(pwd) $*" >> "$FAKE_DOCKER_LOG"
+case "$1" in
+  build) sleep "${FAKE_DOCKER_BUILD_SLEEP:-0}" ;;
+  inspect) echo "registry.test/base@sha256:0123" ;;
+esac
+`
+
+// agentTestServer serves the agent routes to build agents running in the test process
+type agentTestServer struct {
+	t         *testing.T
+	server    *httptest.Server
+	dockerLog string
+	source    buildSource
+	agents    sync.WaitGroup
+}
+
+// installFakeDocker runs the fake docker script instead of docker for the duration of the test, returning the path of its log
+func installFakeDocker(t *testing.T, buildSleep string) string {
+	binDirectory := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(binDirectory, "docker"), []byte(fakeDockerScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dockerLog := filepath.Join(t.TempDir(), "docker.log")
+	t.Setenv("PATH", binDirectory+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_DOCKER_LOG", dockerLog)
+	t.Setenv("FAKE_DOCKER_BUILD_SLEEP", buildSleep)
+	return dockerLog
+}
+
+func newAgentTestServer(t *testing.T, buildSleep string) *agentTestServer {
+	s := &agentTestServer{
+		t:         t,
+		dockerLog: installFakeDocker(t, buildSleep),
+	}
+
+	baseDirectory := t.TempDir()
+	for name, contents := range map[string]string{
+		"dockerfiles/root":    "FROM alpine:3\n",
+		"dockerfiles/child-a": "FROM {{ local }}/root\n",
+		"dockerfiles/child-b": "FROM {{ local }}/root\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(baseDirectory, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(baseDirectory, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(baseDirectory, "deployments"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	inventory, err := dockerbuild.LoadInventory(baseDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.source = buildSource{
+		inventory:        inventory,
+		registryBasePath: "registry.test/base",
+		release:          func() {},
+	}
+
+	previousEngine, previousConfig := ginEngine, buildAgents.config
+	gin.SetMode(gin.TestMode)
+	ginEngine = gin.New()
+	buildAgents.configure(&agentsConfig{heartbeatTimeout: defaultAgentHeartbeatTimeout})
+	addAgentRoutes()
+	s.server = httptest.NewServer(ginEngine)
+	t.Cleanup(func() {
+		s.agents.Wait()
+		s.server.Close()
+		ginEngine = previousEngine
+		buildAgents.configure(previousConfig)
+	})
+	return s
+}
+
+// startAgent runs a build agent until the returned function is called, which waits for it to deregister
+func (s *agentTestServer) startAgent(name string) (workDirectory string, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	workDirectory = filepath.Join(s.t.TempDir(), name)
+	if err := os.Mkdir(workDirectory, 0755); err != nil {
+		s.t.Fatal(err)
+	}
+	done := make(chan struct{})
+	s.agents.Add(1)
+	go func() {
+		defer s.agents.Done()
+		defer close(done)
+		if err := agent.Run(ctx, agent.Options{
+			ServerURL:     s.server.URL,
+			Name:          name,
+			Platform:      "linux/amd64",
+			Capacity:      1,
+			WorkDirectory: workDirectory,
+		}); err != nil {
+			s.t.Error(err)
+		}
+	}()
+	s.t.Cleanup(cancel)
+	return workDirectory, func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitForAgents waits until count agents are registered
+func (s *agentTestServer) waitForAgents(count int) {
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if agents, _ := buildAgents.list(); len(agents) >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("%d build agents did not register", count)
+		}
+	}
+}
+
+// getDockerCommands returns the logged docker commands with the directory they ran in
+func (s *agentTestServer) getDockerCommands() []string {
+	contents, err := ioutil.ReadFile(s.dockerLog)
+	if err != nil && !os.IsNotExist(err) {
+		s.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(contents)), "\n")
+}
+
+// findDockerCommand returns the index of the first logged command containing all of parts, or -1
+func findDockerCommand(commands []string, parts ...string) int {
+	for i, command := range commands {
+		matched := true
+		for _, part := range parts {
+			matched = matched && strings.Contains(command, part)
+		}
+		if matched {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestAgentsBuildHierarchyAcrossAgents(t *testing.T) {
+	s := newAgentTestServer(t, "0.5")
+	directoryA, _ := s.startAgent("agent-a")
+	directoryB, _ := s.startAgent("agent-b")
+	s.waitForAgents(2)
+
+	ctx := context.WithValue(context.Background(), jobIDContextKey{}, "job-hierarchy")
+	if err := buildAgents.buildBaseImageSubtrees(ctx, s.source, "test", []string{"root"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := s.getDockerCommands()
+	rootPush := findDockerCommand(commands, "push registry.test/base/root:test")
+	if rootPush < 0 {
+		t.Fatalf("root was not pushed: %v", commands)
+	}
+	for _, image := range []string{"root", "child-a", "child-b"} {
+		build := findDockerCommand(commands, "build", "registry.test/base/"+image+":test")
+		if build < 0 {
+			t.Errorf("%s was not built: %v", image, commands)
+		} else if image != "root" && build < rootPush {
+			t.Errorf("%s was built before root was pushed: %v", image, commands)
+		}
+	}
+	// Both children are queued at once and each agent takes one task at a time
+	for _, directory := range []string{directoryA, directoryB} {
+		if findDockerCommand(commands, directory, "build") < 0 {
+			t.Errorf("Agent in %s built nothing: %v", directory, commands)
+		}
+	}
+}
+
+func TestAgentsReassignTasksOfStoppedAgents(t *testing.T) {
+	s := newAgentTestServer(t, "2")
+	directoryA, stopA := s.startAgent("agent-a")
+	s.waitForAgents(1)
+
+	ctx := context.WithValue(context.Background(), jobIDContextKey{}, "job-reassign")
+	built := make(chan error, 1)
+	go func() {
+		built <- buildAgents.buildBaseImageSubtrees(ctx, s.source, "test", []string{"child-a"}, true)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); findDockerCommand(s.getDockerCommands(), directoryA, "build") < 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("agent-a did not start building")
+		}
+	}
+	stopA()
+	directoryB, _ := s.startAgent("agent-b")
+
+	select {
+	case err := <-built:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("Task was not reassigned")
+	}
+	if findDockerCommand(s.getDockerCommands(), directoryB, "build", "registry.test/base/child-a:test") < 0 {
+		t.Errorf("agent-b did not build the reassigned task: %v", s.getDockerCommands())
+	}
+}
@@ -0,0 +1,92 @@
+package webserver
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/go-playground/validator.v8"
+)
+
+const (
+	errorCodeInvalidRequest     = "invalid_request"
+	errorCodeValidationFailed   = "validation_failed"
+	errorCodeDeploymentNotFound = "deployment_not_found"
+	errorCodeImageNotFound      = "image_not_found"
+	errorCodeJobNotFound        = "job_not_found"
+	errorCodeRouteNotFound      = "route_not_found"
+	errorCodeShuttingDown       = "shutting_down"
+)
+
+// apiError is the body of every error response from the v2 API
+type apiError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// docker tags are limited to 128 characters and may not start with a period or dash
+var dockerTagRegex = regexp.MustCompile("^[\\w][\\w.-]{0,127}$")
+
+func renderAPIError(c *gin.Context, status int, code string, message string) {
+	c.Set(apiErrorContextKey, message)
+	c.AbortWithStatusJSON(status, gin.H{
+		"error": apiError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// renderBindingError converts request binding failures into a structured error response
+// Validation failures are reported per field using the field names from the json tags of request
+func renderBindingError(c *gin.Context, request interface{}, err error) {
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		renderAPIError(c, 400, errorCodeInvalidRequest, "Request body must be a valid JSON object")
+		return
+	}
+
+	fields := map[string]string{}
+	requestType := reflect.TypeOf(request)
+	if requestType.Kind() == reflect.Ptr {
+		requestType = requestType.Elem()
+	}
+	for _, fe := range validationErrors {
+		name := fe.Field
+		if sf, found := requestType.FieldByName(fe.Field); found {
+			if jsonName := strings.Split(sf.Tag.Get("json"), ",")[0]; jsonName != "" {
+				name = jsonName
+			}
+		}
+		fields[name] = fe.Tag
+	}
+
+	c.AbortWithStatusJSON(422, gin.H{
+		"error": apiError{
+			Code:    errorCodeValidationFailed,
+			Message: "Request failed validation",
+			Fields:  fields,
+		},
+	})
+}
+
+// renderMissingFieldError reports a field that is required by the rest of the request, in the same form as renderBindingError
+func renderMissingFieldError(c *gin.Context, name string) {
+	c.AbortWithStatusJSON(422, gin.H{
+		"error": apiError{
+			Code:    errorCodeValidationFailed,
+			Message: "Request failed validation",
+			Fields:  map[string]string{name: "required"},
+		},
+	})
+}
+
+// validateDockerTag is registered with the request validator as docker_tag
+func validateDockerTag(v *validator.Validate, topStruct reflect.Value, currentStruct reflect.Value, field reflect.Value, fieldType reflect.Type, fieldKind reflect.Kind, param string) bool {
+	if fieldKind != reflect.String {
+		return false
+	}
+	return field.String() == "" || dockerTagRegex.MatchString(field.String())
+}
@@ -0,0 +1,266 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+type baseImagesBuildRequest struct {
+	// Required unless the profile has a tag template
+	Tag          string `json:"tag" binding:"docker_tag"`
+	ForceRebuild bool   `json:"force_rebuild"`
+	// Builds only these images and their descendants; every base image is built when empty
+	Images []string `json:"images"`
+	// Branch, tag or commit to build when serving from a git workspace
+	Ref string `json:"ref"`
+	// Profile of the workspace configuration to build with
+	Profile string `json:"profile"`
+	// Passed to every image as --build-arg, taking precedence over the build args of the profile
+	BuildArgs map[string]string `json:"build_args"`
+}
+
+type deploymentBuildRequest struct {
+	Name string `json:"name" binding:"required"`
+	// Required unless the profile has a tag template
+	Tag           string            `json:"tag" binding:"docker_tag"`
+	DeploymentTag string            `json:"deployment_tag" binding:"docker_tag"`
+	Ref           string            `json:"ref"`
+	Profile       string            `json:"profile"`
+	BuildArgs     map[string]string `json:"build_args"`
+}
+
+func addV2Routes() {
+	v2 := ginEngine.Group("/api/v2")
+	v2.GET("/base-images", requireScope(scopeRead), func(c *gin.Context) { renderBaseImagesV2(c) })
+	v2.POST("/base-images/builds", audit("base-images.build"), requireScope(scopeBuildBase), func(c *gin.Context) { buildBaseImagesV2(c) })
+	v2.GET("/deployments", requireScope(scopeRead), func(c *gin.Context) { renderDeploymentsV2(c) })
+	v2.POST("/deployments/builds", audit("deployment.build"), requireScope(scopeBuildDeployment), func(c *gin.Context) { buildDeploymentV2(c) })
+	v2.GET("/jobs", requireScope(scopeRead), func(c *gin.Context) { renderJobsV2(c) })
+	v2.GET("/jobs/:id", requireScope(scopeRead), func(c *gin.Context) { renderJobV2(c) })
+	v2.GET("/jobs/:id/logs", requireScope(scopeRead), func(c *gin.Context) { renderJobLogsV2(c) })
+	v2.POST("/jobs/:id/approve", audit("job.approve"), requireScope(scopeApproveBuilds), func(c *gin.Context) { approveJobV2(c) })
+	v2.POST("/jobs/:id/reject", audit("job.reject"), requireScope(scopeApproveBuilds), func(c *gin.Context) { rejectJobV2(c) })
+	v2.GET("/webhooks/deliveries", requireScope(scopeRead), func(c *gin.Context) { renderWebhookDeliveriesV2(c) })
+	v2.GET("/whoami", requireScope(scopeRead), func(c *gin.Context) { renderWhoAmIV2(c) })
+
+	ginEngine.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/api/v2/") {
+			renderAPIError(c, 404, errorCodeRouteNotFound, "No route for "+c.Request.Method+" "+c.Request.URL.Path)
+			return
+		}
+		c.String(404, "404 page not found")
+	})
+}
+
+func buildBaseImagesV2(c *gin.Context) {
+	var request baseImagesBuildRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		renderBindingError(c, &request, err)
+		return
+	}
+
+	source, err := defaultWorkspace.prepareBuildSource(c.Request.Context(), request.Ref)
+	if err != nil {
+		renderBuildSourceError(c, err)
+		return
+	}
+	if request.Tag, err = source.applyProfile(request.Profile, request.Tag); err != nil {
+		source.release()
+		renderProfileError(c, request.Profile, err)
+		return
+	} else if request.Tag == "" {
+		source.release()
+		renderMissingFieldError(c, "tag")
+		return
+	}
+	if err := source.applyBuildArgs(request.BuildArgs); err != nil {
+		source.release()
+		renderAPIError(c, 422, errorCodeValidationFailed, err.Error())
+		return
+	}
+	for _, image := range request.Images {
+		if !source.inventory.BaseImageExists(image) {
+			source.release()
+			renderAPIError(c, 404, errorCodeImageNotFound, "Base image does not exist: "+image)
+			return
+		}
+	}
+
+	j, err := startBaseImagesJob(c.Request.Context(), getCaller(c), source, request.Tag, request.Images, request.ForceRebuild)
+	if err != nil {
+		renderAPIError(c, 503, errorCodeShuttingDown, err.Error())
+		return
+	}
+	renderJobAccepted(c, j)
+}
+
+func buildDeploymentV2(c *gin.Context) {
+	var request deploymentBuildRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		renderBindingError(c, &request, err)
+		return
+	}
+
+	source, err := defaultWorkspace.prepareBuildSource(c.Request.Context(), request.Ref)
+	if err != nil {
+		renderBuildSourceError(c, err)
+		return
+	}
+	if request.Tag, err = source.applyProfile(request.Profile, request.Tag); err != nil {
+		source.release()
+		renderProfileError(c, request.Profile, err)
+		return
+	} else if request.Tag == "" {
+		source.release()
+		renderMissingFieldError(c, "tag")
+		return
+	}
+	if err := source.applyBuildArgs(request.BuildArgs); err != nil {
+		source.release()
+		renderAPIError(c, 422, errorCodeValidationFailed, err.Error())
+		return
+	}
+	if !source.inventory.DeploymentExists(request.Name) {
+		source.release()
+		renderAPIError(c, 404, errorCodeDeploymentNotFound, "Deployment does not exist: "+request.Name)
+		return
+	}
+
+	j, err := startDeploymentJob(c.Request.Context(), getCaller(c), source, request.Name, request.Tag, request.DeploymentTag)
+	if err != nil {
+		renderAPIError(c, 503, errorCodeShuttingDown, err.Error())
+		return
+	}
+	renderJobAccepted(c, j)
+}
+
+// renderBaseImagesV2 lists the base images of the default workspace, which the v2 build endpoints build from
+func renderBaseImagesV2(c *gin.Context) {
+	buildableImages, orphanedImages := defaultWorkspace.getInventory().GetBaseImageHeirarchy()
+	c.JSON(200, gin.H{
+		"buildable_images": buildableImages,
+		"orphaned_images":  orphanedImages,
+	})
+}
+
+func renderDeploymentsV2(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"deployments": defaultWorkspace.getInventory().GetDeployments(),
+	})
+}
+
+// renderJobsV2 lists the jobs of the workspaces the caller may read
+func renderJobsV2(c *gin.Context) {
+	visible := []job{}
+	for _, j := range jobs.list() {
+		if canAccessJob(c, j, scopeRead) {
+			visible = append(visible, j)
+		}
+	}
+	c.JSON(200, gin.H{
+		"jobs": visible,
+	})
+}
+
+func renderJobV2(c *gin.Context) {
+	j, exists := getJob(c, scopeRead)
+	if !exists {
+		return
+	}
+	c.JSON(200, gin.H{
+		"job": j,
+	})
+}
+
+func renderJobLogsV2(c *gin.Context) {
+	j, exists := getJob(c, scopeRead)
+	if !exists {
+		return
+	}
+	renderJobLogs(c, j)
+}
+
+// getJob returns the job named in the path, rendering a 404 when it does not exist or the caller is missing scope in its workspace
+// Jobs of other workspaces are not found rather than forbidden so their IDs are not disclosed
+func getJob(c *gin.Context, scope string) (job, bool) {
+	j, exists := jobs.get(c.Param("id"))
+	if !exists || !canAccessJob(c, j, scope) {
+		renderAPIError(c, 404, errorCodeJobNotFound, "Job does not exist: "+c.Param("id"))
+		return job{}, false
+	}
+	return j, true
+}
+
+func renderWhoAmIV2(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"caller":                 getCaller(c),
+		"scopes":                 getCallerScopes(c),
+		"authentication_enabled": apiTokens != nil,
+	})
+}
+
+func renderJobAccepted(c *gin.Context, j job) {
+	location := "/api/v2/jobs/" + j.ID
+	c.Header("Location", location)
+	c.JSON(202, gin.H{
+		"job":      j,
+		"location": location,
+	})
+}
+
+func startBaseImagesJob(parent context.Context, caller string, source buildSource, tag string, images []string, forceRebuild bool) (job, error) {
+	parameters := map[string]string{
+		"tag": tag,
+	}
+	if len(images) > 0 {
+		parameters["images"] = strings.Join(images, ",")
+	}
+	if forceRebuild {
+		parameters["force_rebuild"] = "true"
+	}
+	return jobs.start(parent, jobTypeBaseImages, caller, parameters, source, func(ctx context.Context) error {
+		return runBaseImagesBuild(ctx, source, tag, images, forceRebuild)
+	})
+}
+
+func startDeploymentJob(parent context.Context, caller string, source buildSource, deploymentName string, tag string, deploymentTag string) (job, error) {
+	parameters := map[string]string{
+		"name": deploymentName,
+		"tag":  tag,
+	}
+	if deploymentTag != "" {
+		parameters["deployment_tag"] = deploymentTag
+	}
+	return jobs.start(parent, jobTypeDeployment, caller, parameters, source, func(ctx context.Context) error {
+		return runDeploymentBuild(ctx, source, deploymentName, tag, deploymentTag)
+	})
+}
+
+// buildSubtreesThenDeployments builds the subtrees of images, then each deployment
+// Deployments are skipped if any base image fails since they would be built from stale images
+func buildSubtreesThenDeployments(ctx context.Context, source buildSource, tag string, images []string, forceRebuild bool, deployments []string) error {
+	if len(images) > 0 {
+		if err := runBaseImagesBuild(ctx, source, tag, images, forceRebuild); err != nil {
+			return err
+		}
+	}
+
+	failed := []string{}
+	for _, d := range deployments {
+		err := runDeploymentBuild(ctx, source, d, tag, "")
+		if err == dockerbuild.ErrBuildCancelled {
+			return err
+		} else if err != nil {
+			failed = append(failed, d)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("Deployments failed to build: " + strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package webserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// loadTestWorkspaceInventory writes files relative to a new base directory and loads its inventory
+func loadTestWorkspaceInventory(t *testing.T, files map[string]string) *dockerbuild.Inventory {
+	baseDirectory := t.TempDir()
+	for _, directory := range []string{"dockerfiles", "deployments"} {
+		if err := os.MkdirAll(filepath.Join(baseDirectory, directory), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range files {
+		path := filepath.Join(baseDirectory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inventory, err := dockerbuild.LoadInventory(baseDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inventory
+}
+
+func TestListingsV2UseTheDefaultWorkspace(t *testing.T) {
+	previousEngine, previousWorkspace := ginEngine, defaultWorkspace
+	t.Cleanup(func() { ginEngine, defaultWorkspace = previousEngine, previousWorkspace })
+	gin.SetMode(gin.TestMode)
+	ginEngine = gin.New()
+	addV2Routes()
+
+	// The dockerbuild default inventory is left as it is, as when a reload has not replaced it yet
+	defaultWorkspace = &serverWorkspace{}
+	defaultWorkspace.inventory = loadTestWorkspaceInventory(t, map[string]string{
+		"dockerfiles/workspace-image": "FROM alpine:3\n",
+		"deployments/workspace-app":   "FROM {{ local }}/workspace-image\n",
+	})
+
+	var images struct {
+		BuildableImages []dockerbuild.DockerBuildableImage `json:"buildable_images"`
+	}
+	var deployments struct {
+		Deployments []string `json:"deployments"`
+	}
+	for path, response := range map[string]interface{}{"/api/v2/base-images": &images, "/api/v2/deployments": &deployments} {
+		w := httptest.NewRecorder()
+		ginEngine.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	if len(images.BuildableImages) != 1 || images.BuildableImages[0].Name != "workspace-image" {
+		t.Errorf("base images = %+v, want workspace-image", images.BuildableImages)
+	}
+	if len(deployments.Deployments) != 1 || deployments.Deployments[0] != "workspace-app" {
+		t.Errorf("deployments = %v, want workspace-app", deployments.Deployments)
+	}
+}
+
+// setTestWorkspaceTokens authenticates each caller with a token equal to its name and serves workspaces a and b, where team-a only has permissions in a
+func setTestWorkspaceTokens(t *testing.T) {
+	previousTokens, previousWorkspaces := apiTokens, namedWorkspaces
+	t.Cleanup(func() { apiTokens, namedWorkspaces = previousTokens, previousWorkspaces })
+	apiTokens = nil
+	for _, name := range []string{"team-a", "admin"} {
+		h := sha256.Sum256([]byte(name))
+		apiTokens = append(apiTokens, apiToken{Name: name, Scopes: []string{scopeAll}, hash: h[:]})
+	}
+	namedWorkspaces = map[string]*serverWorkspace{
+		"a": {config: workspaceConfig{Name: "a", Permissions: map[string][]string{
+			"team-a": {scopeRead, scopeApproveBuilds},
+			"admin":  {scopeAll},
+		}}},
+		"b": {config: workspaceConfig{Name: "b", Permissions: map[string][]string{
+			"admin": {scopeAll},
+		}}},
+	}
+}
+
+func TestJobsV2OnlyShowJobsOfTheCallersWorkspaces(t *testing.T) {
+	setTestWorkspaceTokens(t)
+	setTestProtectedTags(t, []protectedTagConfig{{Pattern: "prod"}})
+	previousEngine := ginEngine
+	t.Cleanup(func() { ginEngine = previousEngine })
+	gin.SetMode(gin.TestMode)
+	ginEngine = gin.New()
+	addV2Routes()
+
+	started := map[string]job{}
+	for _, name := range []string{"a", "b"} {
+		source := buildSource{workspace: name, release: func() {}}
+		j, err := jobs.start(context.Background(), jobTypeBaseImages, "ci", map[string]string{"tag": "prod"}, source, func(ctx context.Context) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		started[name] = j
+	}
+	t.Cleanup(func() {
+		for _, j := range started {
+			jobs.decide(j.ID, "admin", false, "")
+			waitForJob(t, j.ID, 5*time.Second, func(j job) bool { return j.FinishedAt != nil })
+		}
+	})
+
+	request := func(caller string, method string, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+caller)
+		w := httptest.NewRecorder()
+		ginEngine.ServeHTTP(w, r)
+		return w
+	}
+	listJobIDs := func(caller string) map[string]bool {
+		var response struct {
+			Jobs []job `json:"jobs"`
+		}
+		if err := json.Unmarshal(request(caller, "GET", "/api/v2/jobs").Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		ids := map[string]bool{}
+		for _, j := range response.Jobs {
+			ids[j.ID] = true
+		}
+		return ids
+	}
+
+	if ids := listJobIDs("team-a"); !ids[started["a"].ID] || ids[started["b"].ID] {
+		t.Errorf("team-a listed jobs %v, want the job of workspace a only", ids)
+	}
+	if ids := listJobIDs("admin"); !ids[started["a"].ID] || !ids[started["b"].ID] {
+		t.Errorf("admin listed jobs %v, want the jobs of both workspaces", ids)
+	}
+
+	tests := []struct {
+		caller     string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"team-a", "GET", "/api/v2/jobs/" + started["a"].ID, http.StatusOK},
+		{"team-a", "GET", "/api/v2/jobs/" + started["b"].ID, http.StatusNotFound},
+		{"team-a", "GET", "/api/v2/jobs/" + started["b"].ID + "/logs", http.StatusNotFound},
+		{"team-a", "POST", "/api/v2/jobs/" + started["b"].ID + "/approve", http.StatusNotFound},
+		{"team-a", "POST", "/api/v2/jobs/" + started["b"].ID + "/reject", http.StatusNotFound},
+		{"admin", "GET", "/api/v2/jobs/" + started["b"].ID, http.StatusOK},
+		{"team-a", "POST", "/api/v2/jobs/" + started["a"].ID + "/approve", http.StatusOK},
+	}
+	for _, test := range tests {
+		if w := request(test.caller, test.method, test.path); w.Code != test.wantStatus {
+			t.Errorf("%s %s by %s = %d, want %d: %s", test.method, test.path, test.caller, w.Code, test.wantStatus, w.Body.String())
+		}
+	}
+	if j, _ := jobs.get(started["b"].ID); j.Status != jobStatusPendingApproval {
+		t.Errorf("job of workspace b is %s, want it still pending approval", j.Status)
+	}
+}
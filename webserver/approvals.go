@@ -0,0 +1,222 @@
+package webserver
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	approvalStatusPending  = "pending"
+	approvalStatusApproved = "approved"
+	approvalStatusRejected = "rejected"
+
+	errorCodeApprovalForbidden     = "approval_forbidden"
+	errorCodeJobNotPendingApproval = "job_not_pending_approval"
+)
+
+var (
+	errJobNotPendingApproval = errors.New("Job is not waiting for approval")
+	errSelfApproval          = errors.New("Jobs must be approved by a caller other than the one that started them")
+	errNotApprover           = errors.New("Caller is not an approver of the protected tag")
+	errJobRejected           = errors.New("Job was rejected")
+)
+
+// protectedTagConfig requires jobs building a matching tag to be approved before they run
+type protectedTagConfig struct {
+	// Glob matched against the tag, deployment tag and extra tags of a job, i.e. prod or release-*
+	Pattern string `json:"pattern"`
+	// Callers allowed to approve; any caller with the approve:builds scope when empty
+	Approvers []string `json:"approvers"`
+}
+
+// jobApproval records the approval a job building a protected tag waits for
+type jobApproval struct {
+	Tag string `json:"tag"`
+	// Pattern of the protected tag matching Tag, whose approvers decide the job; empty when only its profile is protected
+	Pattern string `json:"pattern"`
+	// Protected profile of the workspace configuration the job builds with
+	Profile   string     `json:"profile,omitempty"`
+	Status    string     `json:"status"`
+	DecidedBy string     `json:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+}
+
+type approvalRequest struct {
+	Comment string `json:"comment"`
+}
+
+var protectedTags []protectedTagConfig
+
+func validateProtectedTags(config []protectedTagConfig) error {
+	for _, p := range config {
+		if p.Pattern == "" {
+			return errors.New("Protected tags require a pattern")
+		}
+		if _, err := path.Match(p.Pattern, ""); err != nil {
+			return errors.New("Invalid protected tag pattern: " + p.Pattern)
+		}
+	}
+	return nil
+}
+
+// getRequiredApproval returns the pending approval a job needs before it runs, or nil if it builds no protected tag and uses no protected profile
+// A job with a protected profile that also builds a protected tag records both, so the approvers of the tag still apply
+// Scheduled and upstream rebuilds are started by the server from its own configuration and are not held
+func getRequiredApproval(caller string, parameters map[string]string, source buildSource) *jobApproval {
+	if strings.HasPrefix(caller, scheduleCallerPrefix) || caller == upstreamPollerCaller {
+		return nil
+	}
+	var approval *jobApproval
+	tags := []string{parameters["tag"], parameters["deployment_tag"]}
+	if parameters["extra_tags"] != "" {
+		tags = append(tags, strings.Split(parameters["extra_tags"], ",")...)
+	}
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		if p := getProtectedTag(tag); p != nil {
+			approval = &jobApproval{
+				Tag:     tag,
+				Pattern: p.Pattern,
+				Status:  approvalStatusPending,
+			}
+			break
+		}
+	}
+	if source.protectedProfile {
+		if approval == nil {
+			approval = &jobApproval{
+				Tag:    getBuildLockTag(parameters),
+				Status: approvalStatusPending,
+			}
+		}
+		approval.Profile = source.profile
+	}
+	return approval
+}
+
+// getProtectedTag returns the first protected tag pattern matching tag
+func getProtectedTag(tag string) *protectedTagConfig {
+	for i, p := range protectedTags {
+		if matched, _ := path.Match(p.Pattern, tag); matched {
+			return &protectedTags[i]
+		}
+	}
+	return nil
+}
+
+// isApprover reports whether caller may approve jobs building tags matching pattern
+func isApprover(pattern string, caller string) bool {
+	for _, p := range protectedTags {
+		if p.Pattern != pattern {
+			continue
+		}
+		if len(p.Approvers) == 0 {
+			return true
+		}
+		for _, a := range p.Approvers {
+			if a == caller {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// decide approves or rejects a job waiting for approval and releases it
+func (jr *jobRegistry) decide(id string, caller string, approve bool, comment string) (job, error) {
+	jr.mutex.Lock()
+	j, exists := jr.jobs[id]
+	if !exists {
+		jr.mutex.Unlock()
+		return job{}, errJobNotFound
+	}
+	if j.Approval == nil || j.Approval.Status != approvalStatusPending {
+		jr.mutex.Unlock()
+		return job{}, errJobNotPendingApproval
+	}
+	if approve && caller == j.CreatedBy {
+		jr.mutex.Unlock()
+		return job{}, errSelfApproval
+	}
+	if !isApprover(j.Approval.Pattern, caller) {
+		jr.mutex.Unlock()
+		return job{}, errNotApprover
+	}
+
+	// Replaced rather than modified since copies of the job share the approval
+	decidedAt := time.Now().UTC()
+	approval := *j.Approval
+	approval.DecidedBy = caller
+	approval.DecidedAt = &decidedAt
+	approval.Comment = comment
+	action := "Approved"
+	if approve {
+		approval.Status = approvalStatusApproved
+		j.Status = jobStatusQueued
+	} else {
+		action = "Rejected"
+		approval.Status = approvalStatusRejected
+		j.Status = jobStatusRejected
+		j.Error = "Rejected by " + caller
+		if comment != "" {
+			j.Error += ": " + comment
+		}
+	}
+	j.Approval = &approval
+	close(j.decided)
+	current := *j
+	jr.mutex.Unlock()
+
+	j.log.Write([]byte(action + " by " + caller + "\n"))
+	logger.WithFields(logrus.Fields{
+		"job_id":  id,
+		"caller":  caller,
+		"tag":     current.Approval.Tag,
+		"comment": comment,
+	}).Info("Job " + strings.ToLower(action))
+	return current, nil
+}
+
+func approveJobV2(c *gin.Context) {
+	decideJobV2(c, true)
+}
+
+func rejectJobV2(c *gin.Context) {
+	decideJobV2(c, false)
+}
+
+func decideJobV2(c *gin.Context, approve bool) {
+	var request approvalRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			renderAPIError(c, 400, errorCodeInvalidRequest, "Request body must be a valid JSON object")
+			return
+		}
+	}
+	if _, exists := getJob(c, scopeApproveBuilds); !exists {
+		return
+	}
+	j, err := jobs.decide(c.Param("id"), getCaller(c), approve, request.Comment)
+	switch err {
+	case nil:
+		recordAuditJob(c.Request.Context(), j)
+		c.JSON(200, gin.H{
+			"job": j,
+		})
+	case errJobNotFound:
+		renderAPIError(c, 404, errorCodeJobNotFound, "Job does not exist: "+c.Param("id"))
+	case errJobNotPendingApproval:
+		renderAPIError(c, 409, errorCodeJobNotPendingApproval, err.Error())
+	default:
+		renderAPIError(c, 403, errorCodeApprovalForbidden, err.Error())
+	}
+}
@@ -0,0 +1,257 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setTestProtectedTags replaces the protected tags for the duration of the test
+func setTestProtectedTags(t *testing.T, config []protectedTagConfig) {
+	previous := protectedTags
+	t.Cleanup(func() { protectedTags = previous })
+	protectedTags = config
+}
+
+func TestGetRequiredApproval(t *testing.T) {
+	setTestProtectedTags(t, []protectedTagConfig{
+		{Pattern: "prod", Approvers: []string{"release-manager"}},
+		{Pattern: "release-*"},
+	})
+	tests := []struct {
+		name       string
+		caller     string
+		parameters map[string]string
+		source     buildSource
+		want       *jobApproval
+	}{
+		{"unprotected", "ci", map[string]string{"tag": "dev"}, buildSource{}, nil},
+		{"protected tag", "ci", map[string]string{"tag": "prod"}, buildSource{},
+			&jobApproval{Tag: "prod", Pattern: "prod", Status: approvalStatusPending}},
+		{"protected deployment tag", "ci", map[string]string{"tag": "dev", "deployment_tag": "release-1"}, buildSource{},
+			&jobApproval{Tag: "release-1", Pattern: "release-*", Status: approvalStatusPending}},
+		{"protected extra tag", "ci", map[string]string{"tag": "dev", "extra_tags": "latest,release-2"}, buildSource{},
+			&jobApproval{Tag: "release-2", Pattern: "release-*", Status: approvalStatusPending}},
+		{"protected profile", "ci", map[string]string{"tag": "dev"}, buildSource{profile: "production", protectedProfile: true},
+			&jobApproval{Tag: "dev", Profile: "production", Status: approvalStatusPending}},
+		{"protected profile and tag", "ci", map[string]string{"tag": "prod"}, buildSource{profile: "production", protectedProfile: true},
+			&jobApproval{Tag: "prod", Pattern: "prod", Profile: "production", Status: approvalStatusPending}},
+		{"unprotected profile", "ci", map[string]string{"tag": "dev"}, buildSource{profile: "staging"}, nil},
+		{"schedule", scheduleCallerPrefix + "nightly", map[string]string{"tag": "prod"}, buildSource{profile: "production", protectedProfile: true}, nil},
+		{"upstream poller", upstreamPollerCaller, map[string]string{"tag": "prod"}, buildSource{}, nil},
+	}
+	for _, test := range tests {
+		if got := getRequiredApproval(test.caller, test.parameters, test.source); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: getRequiredApproval() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecideEnforcesApprovers(t *testing.T) {
+	setTestProtectedTags(t, []protectedTagConfig{
+		{Pattern: "prod", Approvers: []string{"release-manager"}},
+	})
+	tests := []struct {
+		name    string
+		source  buildSource
+		tag     string
+		caller  string
+		wantErr error
+	}{
+		{"protected profile by any caller", buildSource{profile: "production", protectedProfile: true}, "dev", "developer", nil},
+		{"protected tag by an approver", buildSource{}, "prod", "release-manager", nil},
+		{"protected tag by another caller", buildSource{}, "prod", "developer", errNotApprover},
+		{"protected profile and tag by another caller", buildSource{profile: "production", protectedProfile: true}, "prod", "developer", errNotApprover},
+		{"protected profile and tag by an approver", buildSource{profile: "production", protectedProfile: true}, "prod", "release-manager", nil},
+		{"self approval", buildSource{}, "prod", "ci", errSelfApproval},
+	}
+	for _, test := range tests {
+		test.source.release = func() {}
+		started, err := jobs.start(context.Background(), jobTypeBaseImages, "ci", map[string]string{"tag": test.tag}, test.source, func(ctx context.Context) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = jobs.decide(started.ID, test.caller, true, "")
+		if err != test.wantErr {
+			t.Errorf("%s: decide() = %v, want %v", test.name, err, test.wantErr)
+		}
+		if err != nil {
+			// Leave no job waiting for approval
+			if _, err := jobs.decide(started.ID, "release-manager", false, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitForJob(t, started.ID, 5*time.Second, func(j job) bool { return j.FinishedAt != nil })
+	}
+}
+
+func TestValidateProtectedTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		config []protectedTagConfig
+		want   string
+	}{
+		{"none", nil, ""},
+		{"patterns", []protectedTagConfig{{Pattern: "prod"}, {Pattern: "release-*", Approvers: []string{"release-manager"}}}, ""},
+		{"missing pattern", []protectedTagConfig{{Approvers: []string{"release-manager"}}}, "Protected tags require a pattern"},
+		{"invalid pattern", []protectedTagConfig{{Pattern: "release-["}}, "Invalid protected tag pattern: release-["},
+	}
+	for _, test := range tests {
+		err := validateProtectedTags(test.config)
+		if (test.want == "" && err != nil) || (test.want != "" && (err == nil || err.Error() != test.want)) {
+			t.Errorf("%s: validateProtectedTags() = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestIsApprover(t *testing.T) {
+	setTestProtectedTags(t, []protectedTagConfig{
+		{Pattern: "prod", Approvers: []string{"release-manager", "operator"}},
+		{Pattern: "release-*"},
+	})
+	tests := []struct {
+		pattern string
+		caller  string
+		want    bool
+	}{
+		{"prod", "release-manager", true},
+		{"prod", "operator", true},
+		{"prod", "developer", false},
+		// Any caller may approve a pattern without approvers
+		{"release-*", "developer", true},
+		// Jobs held only for a protected profile have no pattern
+		{"", "developer", true},
+	}
+	for _, test := range tests {
+		if got := isApprover(test.pattern, test.caller); got != test.want {
+			t.Errorf("isApprover(%q, %q) = %v, want %v", test.pattern, test.caller, got, test.want)
+		}
+	}
+}
+
+// startTestApprovalJob starts a job building tag as ci, returning a channel closed once it runs
+func startTestApprovalJob(t *testing.T, tag string) (job, chan struct{}) {
+	ran := make(chan struct{})
+	j, err := jobs.start(context.Background(), jobTypeBaseImages, "ci", map[string]string{"tag": tag}, buildSource{release: func() {}}, func(ctx context.Context) error {
+		close(ran)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, ran
+}
+
+func TestApprovalHoldsProtectedTags(t *testing.T) {
+	setTestProtectedTags(t, []protectedTagConfig{{Pattern: "prod"}})
+
+	unprotected, ran := startTestApprovalJob(t, "dev")
+	if unprotected.Status == jobStatusPendingApproval || unprotected.Approval != nil {
+		t.Errorf("Job building an unprotected tag is %s with approval %+v", unprotected.Status, unprotected.Approval)
+	}
+	<-ran
+	if _, err := jobs.decide(unprotected.ID, "reviewer", true, ""); err != errJobNotPendingApproval {
+		t.Errorf("decide() on a job not waiting for approval = %v, want %v", err, errJobNotPendingApproval)
+	}
+
+	approved, ran := startTestApprovalJob(t, "prod")
+	if approved.Status != jobStatusPendingApproval || approved.Approval == nil || approved.Approval.Status != approvalStatusPending {
+		t.Fatalf("Job building a protected tag is %s with approval %+v", approved.Status, approved.Approval)
+	}
+	select {
+	case <-ran:
+		t.Fatal("Job ran before it was approved")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := jobs.decide(approved.ID, "ci", true, ""); err != errSelfApproval {
+		t.Errorf("decide() by the caller that started the job = %v, want %v", err, errSelfApproval)
+	}
+	decided, err := jobs.decide(approved.ID, "reviewer", true, "Looks good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decided.Approval.Status != approvalStatusApproved || decided.Approval.DecidedBy != "reviewer" || decided.Approval.Comment != "Looks good" || decided.Approval.DecidedAt == nil {
+		t.Errorf("Approval is %+v", decided.Approval)
+	}
+	if j := waitForJob(t, approved.ID, 5*time.Second, func(j job) bool { return j.FinishedAt != nil }); j.Status != jobStatusSucceeded {
+		t.Errorf("Approved job finished %s: %s", j.Status, j.Error)
+	}
+	<-ran
+	if _, err := jobs.decide(approved.ID, "reviewer", false, ""); err != errJobNotPendingApproval {
+		t.Errorf("decide() on an approved job = %v, want %v", err, errJobNotPendingApproval)
+	}
+
+	rejected, ran := startTestApprovalJob(t, "prod")
+	// The caller that started a job may reject it
+	if _, err := jobs.decide(rejected.ID, "ci", false, "Wrong tag"); err != nil {
+		t.Fatal(err)
+	}
+	j := waitForJob(t, rejected.ID, 5*time.Second, func(j job) bool { return j.FinishedAt != nil })
+	if j.Status != jobStatusRejected || j.Error != "Rejected by ci: Wrong tag" {
+		t.Errorf("Rejected job finished %s: %s", j.Status, j.Error)
+	}
+	select {
+	case <-ran:
+		t.Error("Rejected job ran")
+	default:
+	}
+
+	if _, err := jobs.decide("missing", "reviewer", true, ""); err != errJobNotFound {
+		t.Errorf("decide() on a missing job = %v, want %v", err, errJobNotFound)
+	}
+}
+
+func TestDecideJobV2(t *testing.T) {
+	setTestWorkspaceTokens(t)
+	setTestProtectedTags(t, []protectedTagConfig{{Pattern: "prod"}})
+	previousEngine := ginEngine
+	t.Cleanup(func() { ginEngine = previousEngine })
+	gin.SetMode(gin.TestMode)
+	ginEngine = gin.New()
+	addV2Routes()
+
+	started, err := jobs.start(context.Background(), jobTypeBaseImages, "team-a", map[string]string{"tag": "prod"}, buildSource{release: func() {}}, func(ctx context.Context) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		caller     string
+		action     string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"self approval", "team-a", "approve", "", 403, errorCodeApprovalForbidden},
+		{"invalid body", "admin", "approve", "[", 400, errorCodeInvalidRequest},
+		{"approval", "admin", "approve", `{"comment": "Ship it"}`, 200, ""},
+		{"already approved", "admin", "reject", "", 409, errorCodeJobNotPendingApproval},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/v2/jobs/"+started.ID+"/"+test.action, strings.NewReader(test.body))
+		r.Header.Set("Authorization", "Bearer "+test.caller)
+		w := httptest.NewRecorder()
+		ginEngine.ServeHTTP(w, r)
+
+		var response struct {
+			Job   job `json:"job"`
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != test.wantStatus || response.Error.Code != test.wantCode {
+			t.Errorf("%s: response is %d %s, want %d %s", test.name, w.Code, response.Error.Code, test.wantStatus, test.wantCode)
+		}
+		if w.Code == 200 && (response.Job.Approval == nil || response.Job.Approval.DecidedBy != "admin" || response.Job.Approval.Comment != "Ship it") {
+			t.Errorf("%s: approval is %+v", test.name, response.Job.Approval)
+		}
+	}
+	waitForJob(t, started.ID, 5*time.Second, func(j job) bool { return j.FinishedAt != nil })
+}
@@ -0,0 +1,478 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditOutcomeSucceeded = "succeeded"
+	auditOutcomeFailed    = "failed"
+	auditOutcomeDenied    = "denied"
+
+	auditActionJobFinished = "job.finished"
+
+	auditLogFilename       = "audit.jsonl"
+	defaultAuditMaxSizeMB  = 100
+	defaultAuditMaxFiles   = 5
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+
+	// Longest entry read back from the audit log
+	maxAuditEntryBytes = 1024 * 1024
+	// Size of the blocks audit files are read backwards in
+	auditReadBlockSize = 64 * 1024
+	// Entries are recorded once requests finish, so they are only roughly in time order
+	// Reading stops at the first entry older than since by more than this
+	auditTimeSkew = time.Minute
+
+	errorCodeAuditLogUnreadable = "audit_log_unreadable"
+
+	// Key used to store the message of an API error response on the gin context
+	apiErrorContextKey = "api_error"
+)
+
+type auditEntryContextKey struct{}
+
+// auditLogConfig enables recording mutating API calls and finished jobs to an append-only JSON lines file
+type auditLogConfig struct {
+	// File entries are appended to; audit.jsonl in the state directory when empty
+	Path string `json:"path"`
+	// Size in megabytes at which the file is rotated; 100 when unset
+	MaxSizeMB int `json:"max_size_mb"`
+	// Number of rotated files kept, named <path>.1 (newest) to <path>.<max_files>; 5 when unset
+	MaxFiles int `json:"max_files"`
+}
+
+// auditEntry is a single line of the audit log
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Route or event recorded, i.e. base-images.build or job.finished
+	Action   string `json:"action"`
+	Caller   string `json:"caller"`
+	SourceIP string `json:"source_ip,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path,omitempty"`
+	// HTTP status of the response; unset for job events
+	Status        int    `json:"status,omitempty"`
+	Workspace     string `json:"workspace,omitempty"`
+	Tag           string `json:"tag,omitempty"`
+	DeploymentTag string `json:"deployment_tag,omitempty"`
+	// Images or deployments the build was limited to
+	Selection []string `json:"selection,omitempty"`
+	JobID     string   `json:"job_id,omitempty"`
+	// Images pushed by a finished job, as reference@digest
+	Pushed []string `json:"pushed,omitempty"`
+	// succeeded, failed or denied for API calls; the job status for job events
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditLogFile appends entries to the audit log, rotating it once it grows past its maximum size
+type auditLogFile struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// auditLog is nil when no audit log is configured
+var auditLog *auditLogFile
+
+func validateAuditLog(config *auditLogConfig, stateDirectory string) error {
+	if config == nil {
+		return nil
+	}
+	if config.Path == "" && stateDirectory == "" {
+		return errors.New("The audit log requires a path or state_directory")
+	}
+	if config.MaxSizeMB < 0 || config.MaxFiles < 0 {
+		return errors.New("max_size_mb and max_files of the audit log may not be negative")
+	}
+	return nil
+}
+
+// openAuditLog opens the audit log for appending; returns nil when config is nil
+func openAuditLog(config *auditLogConfig, stateDirectory string) (*auditLogFile, error) {
+	if config == nil {
+		return nil, nil
+	}
+	al := &auditLogFile{
+		path:     config.Path,
+		maxSize:  int64(config.MaxSizeMB) * 1024 * 1024,
+		maxFiles: config.MaxFiles,
+	}
+	if al.path == "" {
+		al.path = filepath.Join(stateDirectory, auditLogFilename)
+	}
+	if al.maxSize == 0 {
+		al.maxSize = defaultAuditMaxSizeMB * 1024 * 1024
+	}
+	if al.maxFiles == 0 {
+		al.maxFiles = defaultAuditMaxFiles
+	}
+	if err := os.MkdirAll(filepath.Dir(al.path), 0755); err != nil {
+		return nil, err
+	}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// open opens the current file for appending; the caller must hold the lock unless the log is not yet shared
+func (al *auditLogFile) open() error {
+	f, err := os.OpenFile(al.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.file = f
+	al.size = info.Size()
+	return nil
+}
+
+// record appends an entry; failures are logged since they must not fail the request being audited
+func (al *auditLogFile) record(entry auditEntry) {
+	if al == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	line = append(line, '\n')
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.file == nil {
+		// A previous rotation failed to reopen the file
+		if err := al.open(); err != nil {
+			al.logWriteError(entry, err)
+			return
+		}
+	}
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		al.logWriteError(entry, err)
+		return
+	}
+	if al.size >= al.maxSize {
+		if err := al.rotate(); err != nil {
+			logger.WithFields(logrus.Fields{
+				"path":  al.path,
+				"error": err,
+			}).Error("Failed to rotate the audit log")
+		}
+	}
+}
+
+func (al *auditLogFile) logWriteError(entry auditEntry, err error) {
+	logger.WithFields(logrus.Fields{
+		"path":   al.path,
+		"action": entry.Action,
+		"caller": entry.Caller,
+		"error":  err,
+	}).Error("Failed to write to the audit log")
+}
+
+// rotate shifts <path>.N to <path>.N+1, dropping the oldest, moves the current file to <path>.1 and starts a new one; the caller must hold the lock
+func (al *auditLogFile) rotate() error {
+	al.file.Close()
+	al.file = nil
+	os.Remove(al.rotatedPath(al.maxFiles))
+	for i := al.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(al.rotatedPath(i), al.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(al.path, al.rotatedPath(1)); err != nil {
+		return err
+	}
+	return al.open()
+}
+
+func (al *auditLogFile) rotatedPath(index int) string {
+	return al.path + "." + strconv.Itoa(index)
+}
+
+// auditQuery filters entries read back from the audit log
+type auditQuery struct {
+	since  time.Time
+	until  time.Time
+	caller string
+	action string
+	jobID  string
+	limit  int
+}
+
+func (q auditQuery) matches(e auditEntry) bool {
+	return (q.since.IsZero() || !e.Time.Before(q.since)) &&
+		(q.until.IsZero() || e.Time.Before(q.until)) &&
+		(q.caller == "" || e.Caller == q.caller) &&
+		(q.action == "" || e.Action == q.action) &&
+		(q.jobID == "" || e.JobID == q.jobID)
+}
+
+// auditFile is an audit file opened for reading and its size when it was opened
+type auditFile struct {
+	file *os.File
+	size int64
+}
+
+// openFiles opens the current file and each rotated file, newest first
+// The lock is only held while opening them, so rotations and writes during a query do not change what it reads
+func (al *auditLogFile) openFiles() ([]auditFile, error) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	files := []auditFile{}
+	for i := 0; i <= al.maxFiles; i++ {
+		path := al.path
+		if i > 0 {
+			path = al.rotatedPath(i)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			closeAuditFiles(files)
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeAuditFiles(files)
+			return nil, err
+		}
+		files = append(files, auditFile{file: f, size: info.Size()})
+	}
+	return files, nil
+}
+
+func closeAuditFiles(files []auditFile) {
+	for _, f := range files {
+		f.file.Close()
+	}
+}
+
+// query returns the newest entries matching q, newest first, reading the current file then each rotated file
+func (al *auditLogFile) query(q auditQuery) ([]auditEntry, error) {
+	files, err := al.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAuditFiles(files)
+
+	matched := []auditEntry{}
+	for _, f := range files {
+		entries, reachedSince, err := readAuditFile(f, q, q.limit-len(matched))
+		if err != nil {
+			return nil, err
+		}
+		matched = append(matched, entries...)
+		if reachedSince || len(matched) >= q.limit {
+			break
+		}
+	}
+	return matched, nil
+}
+
+// readAuditFile returns up to limit entries of a single audit file matching q, newest first, and whether entries older than q.since were reached
+// The file is read backwards from its end so only as much of it is read as is needed to find them
+func readAuditFile(f auditFile, q auditQuery, limit int) ([]auditEntry, bool, error) {
+	entries := []auditEntry{}
+	reachedSince := false
+	addLine := func(line []byte) {
+		var e auditEntry
+		if len(line) == 0 || json.Unmarshal(line, &e) != nil {
+			// Skip a line torn by a crash mid-write
+			return
+		}
+		if !q.since.IsZero() && e.Time.Before(q.since.Add(-auditTimeSkew)) {
+			reachedSince = true
+		} else if q.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+
+	// pending holds the start of the file's unread bytes up to offset, the last of which may be a partial line
+	offset := f.size
+	pending := []byte{}
+	// Set while discarding a line longer than maxAuditEntryBytes
+	skipping := false
+	for len(entries) < limit && !reachedSince && offset > 0 {
+		n := int64(auditReadBlockSize)
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		block := make([]byte, n, n+int64(len(pending)))
+		if _, err := f.file.ReadAt(block, offset); err != nil {
+			return nil, false, err
+		}
+		pending = append(block, pending...)
+		for len(entries) < limit && !reachedSince {
+			i := bytes.LastIndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			if !skipping {
+				addLine(pending[i+1:])
+			}
+			skipping = false
+			pending = pending[:i]
+		}
+		if len(pending) > maxAuditEntryBytes {
+			pending = pending[:0]
+			skipping = true
+		}
+	}
+	if len(entries) < limit && !reachedSince && offset == 0 && !skipping {
+		// The first line of the file has no newline before it
+		addLine(pending)
+	}
+	return entries, reachedSince, nil
+}
+
+// audit records the outcome of the request to the audit log under action once it is handled
+// Placed before the scope check so requests rejected for authentication or scope are recorded as denied
+func audit(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if auditLog == nil {
+			return
+		}
+		entry := &auditEntry{
+			Time:      time.Now().UTC(),
+			Action:    action,
+			SourceIP:  c.ClientIP(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Workspace: c.Param("workspace"),
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), auditEntryContextKey{}, entry))
+		c.Next()
+
+		entry.Caller = getCaller(c)
+		entry.Status = c.Writer.Status()
+		switch {
+		case entry.Status == 401 || entry.Status == 403:
+			entry.Outcome = auditOutcomeDenied
+		case entry.Status >= 400:
+			entry.Outcome = auditOutcomeFailed
+		default:
+			entry.Outcome = auditOutcomeSucceeded
+		}
+		entry.Error = c.GetString(apiErrorContextKey)
+		auditLog.record(*entry)
+	}
+}
+
+// recordAuditJob adds the job started, approved or rejected by a request to its audit entry
+func recordAuditJob(ctx context.Context, j job) {
+	entry, _ := ctx.Value(auditEntryContextKey{}).(*auditEntry)
+	if entry == nil {
+		return
+	}
+	setAuditJobFields(entry, j)
+}
+
+// recordAuditJobFinished records the outcome of a job, including the images it pushed
+func recordAuditJobFinished(j job) {
+	if auditLog == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:    time.Now().UTC(),
+		Action:  auditActionJobFinished,
+		Caller:  j.CreatedBy,
+		Outcome: j.Status,
+		Error:   j.Error,
+	}
+	setAuditJobFields(&entry, j)
+	for _, i := range j.Images {
+		if i.Digest != "" {
+			entry.Pushed = append(entry.Pushed, i.Reference+"@"+i.Digest)
+		}
+	}
+	auditLog.record(entry)
+}
+
+func setAuditJobFields(entry *auditEntry, j job) {
+	entry.JobID = j.ID
+	entry.Workspace = j.Parameters["workspace"]
+	entry.Tag = j.Parameters["tag"]
+	entry.DeploymentTag = j.Parameters["deployment_tag"]
+	entry.Selection = nil
+	for _, name := range []string{"images", "deployments", "name"} {
+		if j.Parameters[name] != "" {
+			entry.Selection = append(entry.Selection, strings.Split(j.Parameters[name], ",")...)
+		}
+	}
+}
+
+func addAuditRoutes() {
+	if auditLog == nil {
+		return
+	}
+	ginEngine.GET("/api/v1/audit", requireScope(scopeReadAudit), func(c *gin.Context) { renderAuditLog(c) })
+}
+
+// renderAuditLog lists audit entries newest first, filtered by since, until, caller, action and job_id
+func renderAuditLog(c *gin.Context) {
+	q := auditQuery{
+		caller: c.Query("caller"),
+		action: c.Query("action"),
+		jobID:  c.Query("job_id"),
+		limit:  defaultAuditQueryLimit,
+	}
+	for name, t := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+		if value := c.Query(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				renderAPIError(c, 400, errorCodeInvalidRequest, name+" must be an RFC 3339 time, i.e. 2024-01-02T15:04:05Z")
+				return
+			}
+			*t = parsed
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditQueryLimit {
+			renderAPIError(c, 400, errorCodeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditQueryLimit))
+			return
+		}
+		q.limit = limit
+	}
+
+	entries, err := auditLog.query(q)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to read the audit log")
+		renderAPIError(c, 500, errorCodeAuditLogUnreadable, "Audit log could not be read")
+		return
+	}
+	c.JSON(200, gin.H{
+		"entries": entries,
+	})
+}
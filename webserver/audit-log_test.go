@@ -0,0 +1,166 @@
+package webserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestAuditLog records count entries, numbered by their job ID from oldest to newest, rotating every maxSize bytes
+func openTestAuditLog(t *testing.T, count int, maxSize int64) *auditLogFile {
+	al, err := openAuditLog(&auditLogConfig{Path: filepath.Join(t.TempDir(), auditLogFilename), MaxFiles: 3}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { al.file.Close() })
+	al.maxSize = maxSize
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		caller := "ci"
+		if i%2 == 1 {
+			caller = "operator"
+		}
+		al.record(auditEntry{
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Action:  "base-images.build",
+			Caller:  caller,
+			JobID:   strconv.Itoa(i),
+			Outcome: auditOutcomeSucceeded,
+		})
+	}
+	return al
+}
+
+// openTestAuditFile writes contents to a new audit file and opens it for reading
+func openTestAuditFile(t *testing.T, contents string) auditFile {
+	path := filepath.Join(t.TempDir(), auditLogFilename)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return auditFile{file: f, size: int64(len(contents))}
+}
+
+func getAuditJobIDs(entries []auditEntry) string {
+	ids := []string{}
+	for _, e := range entries {
+		ids = append(ids, e.JobID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		maxSize int64
+		query   auditQuery
+		want    string
+	}{
+		{"newest first", 1 << 20, auditQuery{limit: 3}, "9,8,7"},
+		{"all", 1 << 20, auditQuery{limit: 100}, "9,8,7,6,5,4,3,2,1,0"},
+		{"caller", 1 << 20, auditQuery{caller: "operator", limit: 2}, "9,7"},
+		{"time range", 1 << 20, auditQuery{since: start.Add(2 * time.Minute), until: start.Add(5 * time.Minute), limit: 100}, "4,3,2"},
+		{"since across rotated files", 1, auditQuery{since: start.Add(8 * time.Minute), limit: 100}, "9,8"},
+		{"job", 1 << 20, auditQuery{jobID: "0", limit: 100}, "0"},
+		// Every entry is rotated into its own file, and only the newest three rotated files are kept
+		{"across rotated files", 1, auditQuery{limit: 100}, "9,8,7"},
+		{"limit across rotated files", 1, auditQuery{limit: 2}, "9,8"},
+	}
+	for _, test := range tests {
+		al := openTestAuditLog(t, 10, test.maxSize)
+		entries, err := al.query(test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := getAuditJobIDs(entries); got != test.want {
+			t.Errorf("%s: job IDs = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadAuditFile(t *testing.T) {
+	entry := `{"time":"2024-01-02T10:00:00Z","action":"base-images.build","caller":"ci","job_id":"%s","outcome":"succeeded"}`
+	line := func(id string) string { return strings.Replace(entry, "%s", id, 1) + "\n" }
+	lineAt := func(id string, clock string) string {
+		return strings.Replace(line(id), "10:00:00", clock, 1)
+	}
+	since := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	// Enough entries to span several blocks
+	many := ""
+	for i := 0; i < 2000; i++ {
+		many += line(strconv.Itoa(i))
+	}
+	tests := []struct {
+		name     string
+		contents string
+		query    auditQuery
+		limit    int
+		want     string
+		// Whether reading stopped at an entry older than since
+		wantReachedSince bool
+	}{
+		{"empty", "", auditQuery{}, 10, "", false},
+		{"no trailing newline", line("a") + strings.TrimSuffix(line("b"), "\n"), auditQuery{}, 10, "b,a", false},
+		{"torn lines", line("a") + `{"time":` + "\n" + line("b") + `{"act`, auditQuery{}, 10, "b,a", false},
+		{"limit", line("a") + line("b") + line("c"), auditQuery{}, 2, "c,b", false},
+		{"across blocks", many, auditQuery{}, 3, "1999,1998,1997", false},
+		{"overlong line", line("a") + strings.Repeat("x", maxAuditEntryBytes+auditReadBlockSize) + "\n" + line("b"), auditQuery{}, 10, "b,a", false},
+		{"overlong first line", strings.Repeat("x", maxAuditEntryBytes+auditReadBlockSize) + "\n" + line("b"), auditQuery{}, 10, "b", false},
+		// Entries after the first one older than since by more than the skew are not read, even when they match
+		{"stops before since", lineAt("a", "12:00:00") + lineAt("b", "08:00:00") + lineAt("c", "10:05:00") + lineAt("d", "09:59:30") + lineAt("e", "11:00:00"),
+			auditQuery{since: since}, 10, "e,c", true},
+		{"all since", lineAt("a", "10:00:00") + lineAt("b", "11:00:00"), auditQuery{since: since}, 10, "b,a", false},
+	}
+	for _, test := range tests {
+		entries, reachedSince, err := readAuditFile(openTestAuditFile(t, test.contents), test.query, test.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := getAuditJobIDs(entries); got != test.want || reachedSince != test.wantReachedSince {
+			t.Errorf("%s: job IDs = %s, reached since %v; want %s, %v", test.name, got, reachedSince, test.want, test.wantReachedSince)
+		}
+	}
+
+	if entries, _, err := readAuditFile(openTestAuditFile(t, many), auditQuery{}, 5000); err != nil || len(entries) != 2000 || entries[0].JobID != "1999" || entries[1999].JobID != "0" {
+		t.Errorf("readAuditFile of the whole file returned %d entries, %v", len(entries), err)
+	}
+}
+
+func TestAuditLogQueryWhileRotating(t *testing.T) {
+	al := openTestAuditLog(t, 0, 512)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			al.record(auditEntry{Time: time.Now().UTC(), Action: "base-images.build", Caller: "ci", JobID: strconv.Itoa(i), Outcome: auditOutcomeSucceeded})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		entries, err := al.query(auditQuery{limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Entries are newest first, so job IDs only decrease
+		for i := 1; i < len(entries); i++ {
+			previous, _ := strconv.Atoi(entries[i-1].JobID)
+			current, _ := strconv.Atoi(entries[i].JobID)
+			if current >= previous {
+				t.Fatalf("query() returned job %d after job %d", current, previous)
+			}
+		}
+	}
+}
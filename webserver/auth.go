@@ -0,0 +1,211 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	scopeAll             = "*"
+	scopeRead            = "read"
+	scopeBuildBase       = "build:base"
+	scopeBuildDeployment = "build:deployment"
+	scopeManageSchedules = "manage:schedules"
+	scopeApproveBuilds   = "approve:builds"
+	scopeReadAudit       = "read:audit"
+	// Granted to build agents so they can register and receive tasks
+	scopeAgent = "agent"
+
+	anonymousCaller = "anonymous"
+
+	// Keys used to store the authenticated caller and its scopes on the gin context
+	callerContextKey       = "caller"
+	callerScopesContextKey = "caller_scopes"
+)
+
+const (
+	errorCodeUnauthorized = "unauthorized"
+	errorCodeForbidden    = "forbidden"
+)
+
+var knownScopes = []string{scopeAll, scopeRead, scopeBuildBase, scopeBuildDeployment, scopeManageSchedules, scopeApproveBuilds, scopeReadAudit, scopeAgent}
+
+// apiToken describes a single entry in the tokens file
+// Only the SHA-256 hash of the token is stored; the token itself is never written to disk by the server
+type apiToken struct {
+	Name        string   `json:"name"`
+	TokenSHA256 string   `json:"token_sha256"`
+	Scopes      []string `json:"scopes"`
+	hash        []byte
+}
+
+type apiTokensFile struct {
+	Tokens []apiToken `json:"tokens"`
+}
+
+// Populated by loadAPITokens(); authentication is disabled when nil
+var apiTokens []apiToken
+
+// HashAPIToken returns the hex encoded SHA-256 hash of a token for use in the tokens file
+func HashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// loadAPITokens reads and validates the tokens file
+func loadAPITokens(path string) ([]apiToken, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tf apiTokensFile
+	if err := yaml.Unmarshal(contents, &tf); err != nil {
+		return nil, err
+	}
+	if len(tf.Tokens) == 0 {
+		return nil, errors.New("No tokens defined in " + path)
+	}
+
+	names := map[string]bool{}
+	for i, t := range tf.Tokens {
+		if t.Name == "" {
+			return nil, errors.New("Token name is required")
+		}
+		if names[t.Name] {
+			return nil, errors.New("Duplicate token name: " + t.Name)
+		}
+		names[t.Name] = true
+
+		tf.Tokens[i].hash, err = hex.DecodeString(strings.ToLower(t.TokenSHA256))
+		if err != nil || len(tf.Tokens[i].hash) != sha256.Size {
+			return nil, errors.New("Invalid token_sha256 for token: " + t.Name)
+		}
+		for _, s := range t.Scopes {
+			if !isKnownScope(s) {
+				return nil, errors.New("Unknown scope " + s + " for token: " + t.Name)
+			}
+		}
+	}
+
+	return tf.Tokens, nil
+}
+
+func isKnownScope(scope string) bool {
+	for _, s := range knownScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t apiToken) hasScope(scope string) bool {
+	return hasScope(t.Scopes, scope)
+}
+
+// hasScope reports whether scopes grant scope
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope || s == scopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the token matching the bearer token on the request
+func authenticate(c *gin.Context) (apiToken, bool) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return apiToken{}, false
+	}
+	h := sha256.Sum256([]byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))))
+
+	var match apiToken
+	var found bool
+	for _, t := range apiTokens {
+		if subtle.ConstantTimeCompare(h[:], t.hash) == 1 {
+			match = t
+			found = true
+		}
+	}
+	return match, found
+}
+
+// requireScope builds middleware rejecting callers without the given scope
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller, scopes, authenticated := authenticateCaller(c)
+		if !authenticated {
+			return
+		}
+		// Set before the scope check so rejected requests are attributed in the audit log
+		c.Set(callerContextKey, caller)
+		if !hasScope(scopes, scope) {
+			logger.WithFields(logrus.Fields{
+				"caller": caller,
+				"scope":  scope,
+				"path":   c.Request.URL.Path,
+			}).Warn("Rejected request with insufficient scope")
+			renderAPIError(c, 403, errorCodeForbidden, "Token is missing the required scope: "+scope)
+			return
+		}
+
+		c.Set(callerScopesContextKey, scopes)
+	}
+}
+
+// authenticateCaller identifies the caller and the scopes granted by its token, rejecting requests without a valid token
+// Every scope is granted when authentication is disabled
+func authenticateCaller(c *gin.Context) (string, []string, bool) {
+	if apiTokens == nil {
+		return getClientCertificateCaller(c), []string{scopeAll}, true
+	}
+
+	t, authenticated := authenticate(c)
+	if !authenticated {
+		logger.WithFields(logrus.Fields{
+			"client_ip": c.ClientIP(),
+			"path":      c.Request.URL.Path,
+		}).Warn("Rejected unauthenticated request")
+		c.Header("WWW-Authenticate", "Bearer realm=\"container-factory\"")
+		renderAPIError(c, 401, errorCodeUnauthorized, "A valid bearer token is required")
+		return "", nil, false
+	}
+	return t.Name, t.Scopes, true
+}
+
+// getClientCertificateCaller identifies callers by the common name of a verified client certificate
+func getClientCertificateCaller(c *gin.Context) string {
+	if c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0 {
+		if cn := c.Request.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return "cert:" + cn
+		}
+	}
+	return anonymousCaller
+}
+
+// getCaller returns the identity attached to the request by requireScope
+func getCaller(c *gin.Context) string {
+	if caller := c.GetString(callerContextKey); caller != "" {
+		return caller
+	}
+	return anonymousCaller
+}
+
+// getCallerScopes returns the scopes granted to the caller
+func getCallerScopes(c *gin.Context) []string {
+	if scopes := c.GetStringSlice(callerScopesContextKey); scopes != nil {
+		return scopes
+	}
+	return []string{}
+}
@@ -0,0 +1,151 @@
+package webserver
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setTestAPITokens authenticates each caller with a token equal to its name for the duration of the test
+func setTestAPITokens(t *testing.T, scopes map[string][]string) {
+	previous := apiTokens
+	t.Cleanup(func() { apiTokens = previous })
+	apiTokens = []apiToken{}
+	for name, s := range scopes {
+		tokens, err := loadTestAPITokens(t, "tokens:\n  - name: "+name+"\n    token_sha256: "+HashAPIToken(name)+"\n    scopes: ['"+strings.Join(s, "', '")+"']\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiTokens = append(apiTokens, tokens...)
+	}
+}
+
+func loadTestAPITokens(t *testing.T, contents string) ([]apiToken, error) {
+	path := filepath.Join(t.TempDir(), "tokens.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadAPITokens(path)
+}
+
+func TestLoadAPITokens(t *testing.T) {
+	hash := HashAPIToken("secret")
+	tests := []struct {
+		name     string
+		contents string
+		// Names and scopes of the loaded tokens
+		want    map[string][]string
+		wantErr string
+	}{
+		{"tokens", "tokens:\n  - name: ci\n    token_sha256: " + hash + "\n    scopes: [read, 'build:base']\n  - name: admin\n    token_sha256: " + hash + "\n    scopes: ['*']\n",
+			map[string][]string{"ci": {"read", "build:base"}, "admin": {"*"}}, ""},
+		{"upper case hash", "tokens:\n  - name: ci\n    token_sha256: " + strings.ToUpper(hash) + "\n", map[string][]string{"ci": nil}, ""},
+		{"no tokens", "tokens: []\n", nil, "No tokens defined in "},
+		{"invalid yaml", "tokens: [", nil, "yaml: "},
+		{"missing name", "tokens:\n  - token_sha256: " + hash + "\n", nil, "Token name is required"},
+		{"duplicate name", "tokens:\n  - name: ci\n    token_sha256: " + hash + "\n  - name: ci\n    token_sha256: " + hash + "\n", nil, "Duplicate token name: ci"},
+		{"plain token", "tokens:\n  - name: ci\n    token_sha256: secret\n", nil, "Invalid token_sha256 for token: ci"},
+		{"short hash", "tokens:\n  - name: ci\n    token_sha256: " + hash[:32] + "\n", nil, "Invalid token_sha256 for token: ci"},
+		{"unknown scope", "tokens:\n  - name: ci\n    token_sha256: " + hash + "\n    scopes: [write]\n", nil, "Unknown scope write for token: ci"},
+	}
+	for _, test := range tests {
+		tokens, err := loadTestAPITokens(t, test.contents)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: loadAPITokens() = %v, want an error containing %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := map[string][]string{}
+		for _, token := range tokens {
+			got[token.Name] = token.Scopes
+			if HashAPIToken("secret") != strings.ToLower(token.TokenSHA256) || len(token.hash) != 32 {
+				t.Errorf("%s: hash of %s was not decoded", test.name, token.Name)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: tokens = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{[]string{scopeRead}, scopeRead, true},
+		{[]string{scopeRead, scopeBuildBase}, scopeBuildBase, true},
+		{[]string{scopeRead}, scopeBuildBase, false},
+		{[]string{scopeAll}, scopeReadAudit, true},
+		{nil, scopeRead, false},
+	}
+	for _, test := range tests {
+		if got := hasScope(test.scopes, test.scope); got != test.want {
+			t.Errorf("hasScope(%v, %s) = %v, want %v", test.scopes, test.scope, got, test.want)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	previousEngine := ginEngine
+	t.Cleanup(func() { ginEngine = previousEngine })
+	gin.SetMode(gin.TestMode)
+	ginEngine = gin.New()
+	ginEngine.POST("/build", requireScope(scopeBuildBase), func(c *gin.Context) {
+		c.JSON(200, gin.H{"caller": getCaller(c), "scopes": getCallerScopes(c)})
+	})
+
+	tests := []struct {
+		name string
+		// Tokens are not loaded when nil, disabling authentication
+		tokens        map[string][]string
+		authorization string
+		wantStatus    int
+		wantCaller    string
+	}{
+		{"authentication disabled", nil, "", 200, anonymousCaller},
+		{"token with the scope", map[string][]string{"ci": {scopeRead, scopeBuildBase}}, "Bearer ci", 200, "ci"},
+		{"token with every scope", map[string][]string{"admin": {scopeAll}}, "Bearer admin", 200, "admin"},
+		{"surrounding spaces", map[string][]string{"ci": {scopeBuildBase}}, "Bearer  ci ", 200, "ci"},
+		{"token without the scope", map[string][]string{"viewer": {scopeRead}}, "Bearer viewer", 403, ""},
+		{"unknown token", map[string][]string{"ci": {scopeBuildBase}}, "Bearer other", 401, ""},
+		{"not a bearer token", map[string][]string{"ci": {scopeBuildBase}}, "Basic ci", 401, ""},
+		{"no token", map[string][]string{"ci": {scopeBuildBase}}, "", 401, ""},
+	}
+	for _, test := range tests {
+		if test.tokens == nil {
+			previous := apiTokens
+			apiTokens = nil
+			t.Cleanup(func() { apiTokens = previous })
+		} else {
+			setTestAPITokens(t, test.tokens)
+		}
+		r := httptest.NewRequest("POST", "/build", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		ginEngine.ServeHTTP(w, r)
+		if w.Code != test.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", test.name, w.Code, test.wantStatus, w.Body.String())
+			continue
+		}
+		if w.Code == 401 && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: unauthorized response has no WWW-Authenticate header", test.name)
+		}
+		if test.wantCaller != "" && !strings.Contains(w.Body.String(), `"caller":"`+test.wantCaller+`"`) {
+			t.Errorf("%s: response = %s, want caller %s", test.name, w.Body.String(), test.wantCaller)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package webserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+const (
+	// Directory created in each workspace directory to hold the lock files
+	buildLockDirectoryName = ".container-factory-locks"
+
+	buildLockConflictQueue  = "queue"
+	buildLockConflictReject = "reject"
+
+	defaultBuildLockLease = 30 * time.Second
+	minBuildLockLease     = 3 * time.Second
+	// Interval between attempts to take a lock held by another instance
+	buildLockRetryInterval = 5 * time.Second
+	// Attempts to take over an expired lock before giving up for this retry interval
+	maxBuildLockTakeovers = 3
+)
+
+var errBuildLockLost = errors.New("Build lock was taken over by another instance while the job ran")
+
+// buildLocksConfig makes server instances sharing a workspace directory build each tag one at a time
+type buildLocksConfig struct {
+	// Time a lock stays valid without being renewed, after which another instance may take it over, i.e. 30s
+	Lease string `json:"lease"`
+	// queue (the default) waits for the lock; reject fails the job
+	OnConflict string `json:"on_conflict"`
+
+	lease time.Duration
+}
+
+// buildLockInfo is the content of a lock file
+type buildLockInfo struct {
+	// Server instance holding the lock, as hostname-random
+	Instance   string    `json:"instance"`
+	JobID      string    `json:"job_id"`
+	Workspace  string    `json:"workspace,omitempty"`
+	Tag        string    `json:"tag"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Distinguishes this acquisition from earlier ones by the same instance and job
+	Token string `json:"token"`
+}
+
+// buildLockManager takes file locks with leases in the workspace directory, which may be shared with other instances over NFS
+type buildLockManager struct {
+	config *buildLocksConfig
+	// Identifies this server instance in lock files
+	instance string
+}
+
+var buildLocks = buildLockManager{}
+
+func validateBuildLocks(config *buildLocksConfig) error {
+	if config == nil {
+		return nil
+	}
+	config.lease = defaultBuildLockLease
+	if config.Lease != "" {
+		var err error
+		if config.lease, err = time.ParseDuration(config.Lease); err != nil || config.lease < minBuildLockLease {
+			return errors.New("Invalid lease for build_locks; it must be at least " + minBuildLockLease.String() + ": " + config.Lease)
+		}
+	}
+	switch config.OnConflict {
+	case "":
+		config.OnConflict = buildLockConflictQueue
+	case buildLockConflictQueue, buildLockConflictReject:
+	default:
+		return errors.New("Invalid on_conflict for build_locks; it must be queue or reject: " + config.OnConflict)
+	}
+	return nil
+}
+
+func (m *buildLockManager) configure(config *buildLocksConfig) {
+	if config == nil {
+		return
+	}
+	m.config = config
+	hostname, _ := os.Hostname()
+	m.instance = hostname + "-" + newLockToken()[:8]
+}
+
+// getBuildLockTag returns the tag a job pushes, which is the unit locked across instances
+func getBuildLockTag(parameters map[string]string) string {
+	if parameters["deployment_tag"] != "" {
+		return parameters["deployment_tag"]
+	}
+	return parameters["tag"]
+}
+
+// getBuildLockTags returns every tag a job pushes, including the extra tags of the images it builds
+func getBuildLockTags(parameters map[string]string) []string {
+	tags := []string{getBuildLockTag(parameters)}
+	if parameters["extra_tags"] != "" {
+		tags = append(tags, strings.Split(parameters["extra_tags"], ",")...)
+	}
+	return tags
+}
+
+// acquireTags takes the lock on each tag as acquire does, in sorted order so instances locking overlapping tags cannot deadlock
+// The returned context is cancelled if any lease is lost; release removes every lock
+func (m *buildLockManager) acquireTags(ctx context.Context, source buildSource, tags []string, jobID string, log io.Writer, waiting func()) (context.Context, func(), error) {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	releases := []func(){}
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	lockCtx := ctx
+	for i, tag := range sorted {
+		if i > 0 && tag == sorted[i-1] {
+			continue
+		}
+		var unlock func()
+		var err error
+		if lockCtx, unlock, err = m.acquire(lockCtx, source, tag, jobID, log, waiting); err != nil {
+			release()
+			return nil, nil, err
+		}
+		releases = append(releases, unlock)
+	}
+	return lockCtx, release, nil
+}
+
+// acquire takes the lock on tag in the workspace directory of source, waiting or failing per on_conflict while another instance holds it
+// waiting is called once if the job has to wait for the lock
+// The returned context is cancelled if the lease is lost; release stops renewing the lease and removes the lock
+func (m *buildLockManager) acquire(ctx context.Context, source buildSource, tag string, jobID string, log io.Writer, waiting func()) (context.Context, func(), error) {
+	if m.config == nil || source.baseDirectory == "" || tag == "" {
+		return ctx, func() {}, nil
+	}
+	directory := filepath.Join(source.baseDirectory, buildLockDirectoryName)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, nil, err
+	}
+	path := filepath.Join(directory, url.PathEscape(tag)+".lock")
+
+	fields := logrus.Fields{
+		"job_id":    jobID,
+		"workspace": source.workspace,
+		"tag":       tag,
+	}
+	isWaiting := false
+	for {
+		now := time.Now().UTC()
+		info := buildLockInfo{
+			Instance:   m.instance,
+			JobID:      jobID,
+			Workspace:  source.workspace,
+			Tag:        tag,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(m.config.lease),
+			Token:      newLockToken(),
+		}
+		holder, err := m.tryLock(path, info)
+		if err != nil {
+			return nil, nil, err
+		}
+		if holder == nil {
+			logger.WithFields(fields).Debug("Acquired build lock")
+			lockCtx, cancel := context.WithCancel(ctx)
+			stop := make(chan struct{})
+			stopped := make(chan struct{})
+			go m.renew(path, info, stop, stopped, cancel)
+			return lockCtx, func() {
+				close(stop)
+				<-stopped
+				cancel()
+				if current, err := readBuildLock(path); err == nil && current.Token == info.Token {
+					os.Remove(path)
+				}
+			}, nil
+		}
+
+		description := "tag " + tag + " is being built by " + holder.Instance + " in job " + holder.JobID
+		if m.config.OnConflict == buildLockConflictReject {
+			return nil, nil, errors.New("Build lock not available; " + description)
+		}
+		if !isWaiting {
+			isWaiting = true
+			waiting()
+			log.Write([]byte("Waiting for build lock; " + description + "\n"))
+			fields["holder"] = holder.Instance
+			logger.WithFields(fields).Info("Waiting for build lock")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, dockerbuild.ErrBuildCancelled
+		case <-time.After(buildLockRetryInterval):
+		}
+	}
+}
+
+// tryLock creates the lock file, taking it over if its lease has expired
+// Returns the current holder if another acquisition holds the lock
+// The lock is only held once it has been read back with the token of info, since an instance taking over the expired lock at the same time may have replaced it
+func (m *buildLockManager) tryLock(path string, info buildLockInfo) (*buildLockInfo, error) {
+	contents, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	// Linking a complete file into place is atomic on NFS, unlike O_EXCL, and never exposes a partially written lock
+	temp := path + ".tmp-" + info.Token
+	if err := ioutil.WriteFile(temp, contents, 0644); err != nil {
+		return nil, err
+	}
+	defer os.Remove(temp)
+
+	for attempt := 0; attempt < maxBuildLockTakeovers; attempt++ {
+		if err := os.Link(temp, path); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+
+		holder, err := readBuildLock(path)
+		if os.IsNotExist(err) {
+			// Released, or moved aside by an instance taking it over, since it was linked
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if holder.Token == info.Token {
+			return nil, nil
+		}
+		if time.Now().Before(holder.ExpiresAt) {
+			return &holder, nil
+		}
+		m.takeOver(path, holder, info.Token)
+	}
+	holder, err := readBuildLock(path)
+	if err != nil {
+		return nil, err
+	}
+	return &holder, nil
+}
+
+// takeOver removes an expired lock so it can be taken
+// The lock is moved aside first so only one instance removes it; if it was renewed or replaced in the meantime it is put back
+func (m *buildLockManager) takeOver(path string, expired buildLockInfo, token string) {
+	// Another instance may already have taken it over; moving its lock aside would leave the path free for a moment
+	if current, err := readBuildLock(path); err != nil || current.Token != expired.Token {
+		return
+	}
+	aside := path + ".expired-" + token
+	if err := os.Rename(path, aside); err != nil {
+		return
+	}
+	defer os.Remove(aside)
+	moved, err := readBuildLock(aside)
+	if err == nil && (moved.Token != expired.Token || time.Now().Before(moved.ExpiresAt)) {
+		os.Link(aside, path)
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"tag":        expired.Tag,
+		"workspace":  expired.Workspace,
+		"holder":     expired.Instance,
+		"job_id":     expired.JobID,
+		"expired_at": expired.ExpiresAt,
+	}).Warn("Took over expired build lock")
+}
+
+// renew extends the lease until stop is closed, cancelling the job if another instance took the lock
+// A lease that expired before it was renewed is not renewed, since another instance may have taken it over since
+func (m *buildLockManager) renew(path string, info buildLockInfo, stop <-chan struct{}, stopped chan<- struct{}, cancel context.CancelFunc) {
+	defer close(stopped)
+	ticker := time.NewTicker(m.config.lease / 3)
+	defer ticker.Stop()
+	fields := logrus.Fields{
+		"job_id":    info.JobID,
+		"workspace": info.Workspace,
+		"tag":       info.Tag,
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !time.Now().Before(info.ExpiresAt) {
+			logger.WithFields(fields).Error("Build lock lease expired before it was renewed; cancelling the job")
+			cancel()
+			return
+		}
+		current, err := readBuildLock(path)
+		if err == nil && current.Token != info.Token || os.IsNotExist(err) {
+			if err == nil {
+				fields["holder"] = current.Instance
+			}
+			logger.WithFields(fields).Error("Build lock lease was lost; cancelling the job")
+			cancel()
+			return
+		}
+		renewed := info
+		renewed.ExpiresAt = time.Now().UTC().Add(m.config.lease)
+		if err := writeBuildLock(path, renewed); err != nil {
+			fields["error"] = err
+			logger.WithFields(fields).Warn("Failed to renew build lock")
+			delete(fields, "error")
+			continue
+		}
+		info = renewed
+	}
+}
+
+func readBuildLock(path string) (buildLockInfo, error) {
+	var info buildLockInfo
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(contents, &info)
+	return info, err
+}
+
+// writeBuildLock replaces the lock file atomically
+func writeBuildLock(path string, info buildLockInfo) error {
+	contents, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp-" + info.Token
+	if err := ioutil.WriteFile(temp, contents, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+func newLockToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logger.Panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,294 @@
+package webserver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// configureTestBuildLocks enables build locks with the shortest lease for the duration of the test
+func configureTestBuildLocks(t *testing.T, onConflict string) {
+	previous := buildLocks
+	t.Cleanup(func() {
+		// Jobs still renew their locks until they return
+		jobs.running.Wait()
+		buildLocks = previous
+	})
+	buildLocks = buildLockManager{}
+	buildLocks.configure(&buildLocksConfig{OnConflict: onConflict, lease: minBuildLockLease})
+}
+
+// writeTestBuildLock writes a lock on tag held by another instance, expiring after expiresIn
+func writeTestBuildLock(t *testing.T, baseDirectory string, tag string, expiresIn time.Duration) string {
+	directory := filepath.Join(baseDirectory, buildLockDirectoryName)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(directory, tag+".lock")
+	now := time.Now().UTC()
+	if err := writeBuildLock(path, buildLockInfo{
+		Instance:   "other-host",
+		JobID:      "other-job",
+		Tag:        tag,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(expiresIn),
+		Token:      newLockToken(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// waitForJob polls the job until done returns true
+func waitForJob(t *testing.T, id string, timeout time.Duration, done func(j job) bool) job {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		j, _ := jobs.get(id)
+		if done(j) {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Job %s is still %s", id, j.Status)
+		}
+	}
+}
+
+func TestBuildLockAcquire(t *testing.T) {
+	tests := []struct {
+		name       string
+		onConflict string
+		// Lifetime of a lock held by another instance; none when 0
+		heldFor time.Duration
+		wantErr string
+	}{
+		{"free", buildLockConflictReject, 0, ""},
+		{"held", buildLockConflictReject, time.Minute, "Build lock not available; tag test is being built by other-host in job other-job"},
+		{"expired", buildLockConflictReject, -time.Second, ""},
+	}
+	for _, test := range tests {
+		configureTestBuildLocks(t, test.onConflict)
+		source := buildSource{baseDirectory: t.TempDir()}
+		if test.heldFor != 0 {
+			writeTestBuildLock(t, source.baseDirectory, "test", test.heldFor)
+		}
+		waited := false
+		_, release, err := buildLocks.acquire(context.Background(), source, "test", "job", ioutil.Discard, func() { waited = true })
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s: acquire returned %v, want %s", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: acquire: %v", test.name, err)
+			continue
+		}
+		path := filepath.Join(source.baseDirectory, buildLockDirectoryName, "test.lock")
+		if info, err := readBuildLock(path); err != nil || info.Instance != buildLocks.instance || info.JobID != "job" {
+			t.Errorf("%s: lock is %+v, %v", test.name, info, err)
+		}
+		release()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: lock was not removed on release", test.name)
+		}
+		if waited {
+			t.Errorf("%s: acquire waited for a free lock", test.name)
+		}
+	}
+}
+
+func TestBuildLockLostWhileHeld(t *testing.T) {
+	configureTestBuildLocks(t, buildLockConflictQueue)
+	source := buildSource{baseDirectory: t.TempDir()}
+	lockCtx, release, err := buildLocks.acquire(context.Background(), source, "test", "job", ioutil.Discard, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance took the lock over
+	path := writeTestBuildLock(t, source.baseDirectory, "test", time.Minute)
+
+	select {
+	case <-lockCtx.Done():
+	case <-time.After(2 * minBuildLockLease):
+		t.Fatal("Context was not cancelled after the lock was lost")
+	}
+	release()
+	if info, err := readBuildLock(path); err != nil || info.Instance != "other-host" {
+		t.Errorf("Release removed the lock of another instance: %+v, %v", info, err)
+	}
+}
+
+// TestBuildLockContendedTakeover checks that only one of two instances taking over the same expired lock holds it
+func TestBuildLockContendedTakeover(t *testing.T) {
+	managers := make([]*buildLockManager, 2)
+	for i := range managers {
+		managers[i] = &buildLockManager{}
+		managers[i].configure(&buildLocksConfig{OnConflict: buildLockConflictReject, lease: minBuildLockLease})
+	}
+	source := buildSource{baseDirectory: t.TempDir()}
+	for attempt := 0; attempt < 50; attempt++ {
+		path := writeTestBuildLock(t, source.baseDirectory, "test", -time.Second)
+		releases := make([]func(), len(managers))
+		errs := make([]error, len(managers))
+		var wg sync.WaitGroup
+		for i, m := range managers {
+			wg.Add(1)
+			go func(i int, m *buildLockManager) {
+				defer wg.Done()
+				_, releases[i], errs[i] = m.acquire(context.Background(), source, "test", "job", ioutil.Discard, func() {})
+			}(i, m)
+		}
+		wg.Wait()
+
+		winners := []int{}
+		for i, err := range errs {
+			if err == nil {
+				winners = append(winners, i)
+			} else if !strings.HasPrefix(err.Error(), "Build lock not available") {
+				t.Fatalf("Attempt %d: acquire: %v", attempt, err)
+			}
+		}
+		if len(winners) != 1 {
+			t.Fatalf("Attempt %d: %d instances acquired the lock", attempt, len(winners))
+		}
+		if info, err := readBuildLock(path); err != nil || info.Instance != managers[winners[0]].instance {
+			t.Fatalf("Attempt %d: lock is %+v, %v; want it held by %s", attempt, info, err, managers[winners[0]].instance)
+		}
+		releases[winners[0]]()
+	}
+}
+
+func TestBuildLockRenewAfterExpiry(t *testing.T) {
+	configureTestBuildLocks(t, buildLockConflictReject)
+	path := writeTestBuildLock(t, t.TempDir(), "test", time.Minute)
+	info, err := readBuildLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lease ran out before it was renewed, so another instance may have taken the lock over in the meantime
+	info.ExpiresAt = time.Now().UTC().Add(-time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go buildLocks.renew(path, info, stop, stopped, cancel)
+	select {
+	case <-ctx.Done():
+	case <-time.After(minBuildLockLease):
+		close(stop)
+		t.Fatal("Context was not cancelled after the lease expired")
+	}
+	<-stopped
+	if renewed, err := readBuildLock(path); err != nil || renewed.ExpiresAt.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expired lease was renewed: %+v, %v", renewed, err)
+	}
+}
+
+// TestJobsWaitForBuildLockWithoutASlot checks that a job waiting for a lock held by another instance does not take the only slot, and takes the lock over once it expires
+func TestJobsWaitForBuildLockWithoutASlot(t *testing.T) {
+	configureTestBuildLocks(t, buildLockConflictQueue)
+	jobs.setConcurrency(1)
+	defer jobs.setConcurrency(0)
+	source := buildSource{workspace: "default", baseDirectory: t.TempDir(), release: func() {}}
+	path := writeTestBuildLock(t, source.baseDirectory, "locked", minBuildLockLease)
+
+	succeed := func(ctx context.Context) error { return nil }
+	locked, err := jobs.start(context.Background(), jobTypeBaseImages, "ci", map[string]string{"tag": "locked"}, source, succeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, locked.ID, 5*time.Second, func(j job) bool { return j.Status == jobStatusWaitingForLock })
+
+	free, err := jobs.start(context.Background(), jobTypeBaseImages, "ci", map[string]string{"tag": "free"}, source, succeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := waitForJob(t, free.ID, 5*time.Second, func(j job) bool { return j.FinishedAt != nil }); j.Status != jobStatusSucceeded {
+		t.Errorf("Job for a free tag finished %s: %s", j.Status, j.Error)
+	}
+	if j, _ := jobs.get(locked.ID); j.Status != jobStatusWaitingForLock {
+		t.Errorf("Job for the locked tag is %s while the lock is held", j.Status)
+	}
+
+	j := waitForJob(t, locked.ID, minBuildLockLease+2*buildLockRetryInterval, func(j job) bool { return j.FinishedAt != nil })
+	if j.Status != jobStatusSucceeded {
+		t.Errorf("Job for the locked tag finished %s: %s", j.Status, j.Error)
+	}
+	if log, _, _, _ := j.log.readFrom(0); !strings.Contains(string(log), "Waiting for build lock; tag locked is being built by other-host in job other-job") {
+		t.Errorf("Job log does not name the lock holder: %s", log)
+	}
+	// The lock is released as the job goroutine returns, just after the job is marked finished
+	jobs.running.Wait()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Lock was not removed once the job finished")
+	}
+}
+
+func TestJobsFailWhenBuildLockIsRejected(t *testing.T) {
+	configureTestBuildLocks(t, buildLockConflictReject)
+	source := buildSource{baseDirectory: t.TempDir(), release: func() {}}
+	writeTestBuildLock(t, source.baseDirectory, "locked", time.Minute)
+
+	started, err := jobs.start(context.Background(), jobTypeBaseImages, "ci", map[string]string{"tag": "locked"}, source, func(ctx context.Context) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := waitForJob(t, started.ID, 5*time.Second, func(j job) bool { return j.FinishedAt != nil })
+	if j.Status != jobStatusFailed || !strings.HasPrefix(j.Error, "Build lock not available") {
+		t.Errorf("Job finished %s: %s", j.Status, j.Error)
+	}
+}
+
+func TestJobsLockExtraTags(t *testing.T) {
+	configureTestBuildLocks(t, buildLockConflictReject)
+	baseDirectory := t.TempDir()
+	for name, contents := range map[string]string{
+		"dockerfiles/root":       "FROM alpine:3\n",
+		"dockerfiles/child":      "FROM {{ local }}/root\n",
+		"dockerfiles/child.yaml": "extra_tags: [latest]\n",
+		"dockerfiles/other":      "FROM alpine:3\n",
+		"deployments/.keep":      "",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(baseDirectory, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(baseDirectory, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inventory, err := dockerbuild.LoadInventory(baseDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := buildSource{baseDirectory: baseDirectory, inventory: inventory, release: func() {}}
+	writeTestBuildLock(t, baseDirectory, "latest", time.Minute)
+
+	tests := []struct {
+		name          string
+		images        string
+		wantExtraTags string
+		wantStatus    string
+	}{
+		{"image with an extra tag", "root", "latest", jobStatusFailed},
+		{"image without extra tags", "other", "", jobStatusSucceeded},
+	}
+	for _, test := range tests {
+		started, err := jobs.start(context.Background(), jobTypeBaseImages, "ci", map[string]string{"tag": "dev", "images": test.images}, source, func(ctx context.Context) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if started.Parameters["extra_tags"] != test.wantExtraTags {
+			t.Errorf("%s: extra_tags = %q, want %q", test.name, started.Parameters["extra_tags"], test.wantExtraTags)
+		}
+		j := waitForJob(t, started.ID, 5*time.Second, func(j job) bool { return j.FinishedAt != nil })
+		if j.Status != test.wantStatus {
+			t.Errorf("%s: job finished %s, want %s: %s", test.name, j.Status, test.wantStatus, j.Error)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package webserver
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/container-factory/workspace"
+)
+
+const (
+	errorCodeRefNotFound          = "ref_not_found"
+	errorCodeWorkspaceUnavailable = "workspace_unavailable"
+)
+
+var errRefRequiresGitWorkspace = errors.New("A ref can only be given when the server builds from a git workspace")
+
+// gitWorkspaceConfig configures building from a git repository in the server config file
+type gitWorkspaceConfig struct {
+	URL string `json:"url"`
+	// Branch, tag or commit built when a request does not give a ref; also used for the inventory listings
+	DefaultRef string `json:"default_ref"`
+	// Directory of the repository holding dockerfiles/ and deployments/; the repository root when empty
+	PathPrefix string `json:"path_prefix"`
+}
+
+// buildSource is the inventory and registry a job builds with
+// release must be called once the job no longer needs the source
+type buildSource struct {
+	workspace string
+	// Workspace directory, which holds the build locks
+	baseDirectory    string
+	inventory        *dockerbuild.Inventory
+	registryBasePath string
+	ref              string
+	commit           string
+	// Profile of the workspace configuration the build uses, if any
+	profile          string
+	protectedProfile bool
+	buildArgs        map[string]string
+	release          func()
+}
+
+// applyBuildArgs adds build args given with the build request, which take precedence over those of the profile
+func (s *buildSource) applyBuildArgs(args map[string]string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := dockerbuild.ValidateBuildArgs(args); err != nil {
+		return err
+	}
+	s.buildArgs = dockerbuild.MergeBuildArgs(s.buildArgs, args)
+	return nil
+}
+
+// applyGitWorkspaceDefaults sets the values left out of a git workspace config when the server config is loaded
+func applyGitWorkspaceDefaults(config *gitWorkspaceConfig) {
+	if config == nil {
+		return
+	}
+	if config.DefaultRef == "" {
+		config.DefaultRef = "master"
+	}
+}
+
+func validateGitWorkspace(config *gitWorkspaceConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.URL == "" {
+		return errors.New("URL is required for git_workspace")
+	}
+	return nil
+}
+
+// renderBuildSourceError reports why the source for a build could not be prepared
+func renderBuildSourceError(c *gin.Context, err error) {
+	switch status := getBuildSourceErrorStatus(err); status {
+	case 400:
+		renderAPIError(c, status, errorCodeInvalidRequest, err.Error())
+	case 404:
+		renderAPIError(c, status, errorCodeRefNotFound, err.Error())
+	default:
+		renderAPIError(c, status, errorCodeWorkspaceUnavailable, "Could not prepare the workspace: "+err.Error())
+	}
+}
+
+// getBuildSourceErrorStatus maps errors from prepareBuildSource to a response status
+func getBuildSourceErrorStatus(err error) int {
+	switch err {
+	case errRefRequiresGitWorkspace:
+		return 400
+	case workspace.ErrUnknownRef:
+		return 404
+	}
+	logger.WithFields(logrus.Fields{
+		"error": err,
+	}).Error("Failed to prepare workspace")
+	return 503
+}
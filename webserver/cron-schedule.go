@@ -0,0 +1,175 @@
+package webserver
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression: minute, hour, day of month, month and day of week
+// Each field is a bitset of the values it matches
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// As in cron, a time matches when either day field matches if both are restricted
+	anyDay     bool
+	anyWeekday bool
+}
+
+// Runs more than this far apart are treated as never matching, i.e. 30 February
+const maxCronSearch = 5 * 366 * 24 * time.Hour
+
+// Hours field of a schedule running every hour
+const cronEveryHour = 1<<24 - 1
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronWeekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseCronSchedule(expression string) (*cronSchedule, error) {
+	if macro, exists := cronMacros[strings.ToLower(strings.TrimSpace(expression))]; exists {
+		expression = macro
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New("Cron expression must have five fields: " + expression)
+	}
+
+	s := &cronSchedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if s.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7
+	if s.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdayNames); err != nil {
+		return nil, err
+	}
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of *, values and ranges, each with an optional /step
+// names, when given, are accepted in place of the values starting at min
+func parseCronField(field string, min int, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, errors.New("Invalid step in cron field: " + field)
+			}
+			rangePart = part[:i]
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if start, err = parseCronValue(bounds[0], min, names); err != nil {
+				return 0, errors.New("Invalid value in cron field: " + field)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = parseCronValue(bounds[1], min, names); err != nil {
+					return 0, errors.New("Invalid value in cron field: " + field)
+				}
+			} else if step > 1 {
+				// A single value with a step runs from the value to the end of the range, i.e. 5/15
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, errors.New("Cron field out of range: " + field)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, min int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.ToLower(value) == name {
+			return min + i, nil
+		}
+	}
+	return strconv.Atoi(value)
+}
+
+// next returns the first time after t matching the schedule, in the location of t
+// As in cron, times skipped when daylight saving time starts never match, and times repeated when it ends only match once unless the schedule runs every hour
+// Returns the zero time if the schedule never matches
+func (s *cronSchedule) next(t time.Time) time.Time {
+	limit := t.Add(maxCronSearch)
+	location := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		switch {
+		case s.months&(1<<uint(t.Month())) == 0:
+			t = advanceCron(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location))
+		case !s.matchesDay(t):
+			t = advanceCron(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location))
+		case s.hours&(1<<uint(t.Hour())) == 0:
+			t = advanceCron(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location))
+		case s.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		case s.hours != cronEveryHour && isRepeatedWallTime(t):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// isRepeatedWallTime reports whether the wall clock already showed the time of t earlier, when daylight saving time ended
+func isRepeatedWallTime(t time.Time) bool {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location()).Before(t)
+}
+
+// advanceCron moves to candidate, or by a minute when daylight saving time folds candidate back to or before t
+func advanceCron(t time.Time, candidate time.Time) time.Time {
+	if candidate.After(t) {
+		return candidate
+	}
+	return t.Add(time.Minute)
+}
@@ -0,0 +1,166 @@
+package webserver
+
+import (
+	"testing"
+	"time"
+)
+
+func cronBits(values ...int) uint64 {
+	var bits uint64
+	for _, v := range values {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func cronBitRange(start int, end int, step int) uint64 {
+	var bits uint64
+	for v := start; v <= end; v += step {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       cronSchedule
+	}{
+		{"* * * * *", cronSchedule{cronBitRange(0, 59, 1), cronBitRange(0, 23, 1), cronBitRange(1, 31, 1), cronBitRange(1, 12, 1), cronBitRange(0, 7, 1), true, true}},
+		{"0-59 0-23 1-31 1-12 0-6", cronSchedule{cronBitRange(0, 59, 1), cronBitRange(0, 23, 1), cronBitRange(1, 31, 1), cronBitRange(1, 12, 1), cronBitRange(0, 6, 1), false, false}},
+		{"*/15 */6 */10 */3 */2", cronSchedule{cronBits(0, 15, 30, 45), cronBits(0, 6, 12, 18), cronBits(1, 11, 21, 31), cronBits(1, 4, 7, 10), cronBits(0, 2, 4, 6), false, false}},
+		{"5/20 1-10/3 3 1 1", cronSchedule{cronBits(5, 25, 45), cronBits(1, 4, 7, 10), cronBits(3), cronBits(1), cronBits(1), false, false}},
+		{"0,30 9,17 1,15 * *", cronSchedule{cronBits(0, 30), cronBits(9, 17), cronBits(1, 15), cronBitRange(1, 12, 1), cronBitRange(0, 7, 1), false, true}},
+		{"0 0 * jan-mar,Dec mon-fri", cronSchedule{cronBits(0), cronBits(0), cronBitRange(1, 31, 1), cronBits(1, 2, 3, 12), cronBitRange(1, 5, 1), true, false}},
+		{"0 0 * * SUN", cronSchedule{cronBits(0), cronBits(0), cronBitRange(1, 31, 1), cronBitRange(1, 12, 1), cronBits(0), true, false}},
+		{"0 0 * * 7", cronSchedule{cronBits(0), cronBits(0), cronBitRange(1, 31, 1), cronBitRange(1, 12, 1), cronBits(0, 7), true, false}},
+		{"@hourly", cronSchedule{cronBits(0), cronBitRange(0, 23, 1), cronBitRange(1, 31, 1), cronBitRange(1, 12, 1), cronBitRange(0, 7, 1), true, true}},
+		{" @Daily ", cronSchedule{cronBits(0), cronBits(0), cronBitRange(1, 31, 1), cronBitRange(1, 12, 1), cronBitRange(0, 7, 1), true, true}},
+		{"@weekly", cronSchedule{cronBits(0), cronBits(0), cronBitRange(1, 31, 1), cronBitRange(1, 12, 1), cronBits(0), true, false}},
+	}
+	for _, test := range tests {
+		got, err := parseCronSchedule(test.expression)
+		if err != nil {
+			t.Errorf("parseCronSchedule(%q): %v", test.expression, err)
+			continue
+		}
+		if *got != test.want {
+			t.Errorf("parseCronSchedule(%q) = %+v, want %+v", test.expression, *got, test.want)
+		}
+	}
+}
+
+func TestParseCronScheduleErrors(t *testing.T) {
+	expressions := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@reboot",
+		"60 * * * *",
+		"-1 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"30-10 * * * *",
+		"*/0 * * * *",
+		"*/-5 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"* * * * monday",
+		"0 0 * * fri-sun",
+		"1,,2 * * * *",
+	}
+	for _, expression := range expressions {
+		if _, err := parseCronSchedule(expression); err == nil {
+			t.Errorf("parseCronSchedule(%q) did not return an error", expression)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("Time zone data is not available: ", err)
+	}
+	tests := []struct {
+		name       string
+		expression string
+		from       time.Time
+		want       []time.Time
+	}{
+		{"every minute skips seconds", "* * * * *", time.Date(2026, 10, 19, 10, 7, 30, 0, time.UTC),
+			[]time.Time{time.Date(2026, 10, 19, 10, 8, 0, 0, time.UTC), time.Date(2026, 10, 19, 10, 9, 0, 0, time.UTC)}},
+		{"step", "*/15 * * * *", time.Date(2026, 10, 19, 10, 7, 0, 0, time.UTC),
+			[]time.Time{time.Date(2026, 10, 19, 10, 15, 0, 0, time.UTC), time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC)}},
+		{"strictly after a matching time", "0 12 * * mon", time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC),
+			[]time.Time{time.Date(2026, 10, 26, 12, 0, 0, 0, time.UTC)}},
+		{"year end", "0 0 1 1 *", time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC),
+			[]time.Time{time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{"31st skips shorter months", "0 0 31 * *", time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC),
+			[]time.Time{time.Date(2026, 5, 31, 0, 0, 0, 0, time.UTC), time.Date(2026, 7, 31, 0, 0, 0, 0, time.UTC)}},
+		{"leap day", "0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+			[]time.Time{time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2032, 2, 29, 0, 0, 0, 0, time.UTC)}},
+		{"never", "0 0 30 2 *", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), []time.Time{{}}},
+		{"either day field", "0 0 13 * fri", time.Date(2026, 11, 7, 0, 0, 0, 0, time.UTC),
+			[]time.Time{time.Date(2026, 11, 13, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 20, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 27, 0, 0, 0, 0, time.UTC), time.Date(2026, 12, 4, 0, 0, 0, 0, time.UTC)}},
+		{"either day field on a weekday", "0 0 20 * fri", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+			[]time.Time{time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC)}},
+		{"in the location of the time", "0 9 * * *", time.Date(2026, 10, 19, 12, 0, 0, 0, newYork),
+			[]time.Time{time.Date(2026, 10, 20, 9, 0, 0, 0, newYork)}},
+		{"time skipped when daylight saving time starts", "30 2 * * *", time.Date(2026, 3, 7, 3, 0, 0, 0, newYork),
+			[]time.Time{time.Date(2026, 3, 9, 2, 30, 0, 0, newYork)}},
+		{"daily across daylight saving time start", "0 3 * * *", time.Date(2026, 3, 7, 3, 0, 0, 0, newYork),
+			[]time.Time{time.Date(2026, 3, 8, 3, 0, 0, 0, newYork), time.Date(2026, 3, 9, 3, 0, 0, 0, newYork)}},
+		{"time repeated when daylight saving time ends", "30 1 * * *", time.Date(2026, 11, 1, 0, 0, 0, 0, newYork),
+			[]time.Time{time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), time.Date(2026, 11, 2, 6, 30, 0, 0, time.UTC)}},
+		{"second pass of the repeated hour", "30 1 * * *", time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC).In(newYork),
+			[]time.Time{time.Date(2026, 11, 2, 6, 30, 0, 0, time.UTC)}},
+		{"hourly through daylight saving time end", "0 * * * *", time.Date(2026, 11, 1, 0, 30, 0, 0, newYork),
+			[]time.Time{time.Date(2026, 11, 1, 5, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 7, 0, 0, 0, time.UTC)}},
+	}
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.expression)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		from := test.from
+		for _, want := range test.want {
+			got := schedule.next(from)
+			if !got.Equal(want) {
+				t.Errorf("%s: next(%s) = %s, want %s", test.name, from, got, want)
+				break
+			}
+			if !got.IsZero() && got.Location() != from.Location() {
+				t.Errorf("%s: next(%s) is in %s", test.name, from, got.Location())
+			}
+			from = got
+		}
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	cron, err := parseCronSchedule("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &scheduler{
+		schedules: map[string]*scheduledBuild{"test": {cron: cron}},
+		stopped:   make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		s.loop("test")
+		close(done)
+	}()
+	s.stop()
+	s.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("schedule loop did not stop")
+	}
+}
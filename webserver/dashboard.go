@@ -0,0 +1,350 @@
+package webserver
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+func addDashboardRoutes() {
+	ginEngine.GET("/", func(c *gin.Context) { c.Redirect(302, "/ui/") })
+	ginEngine.GET("/ui/", func(c *gin.Context) { renderDashboard(c) })
+}
+
+// renderDashboard serves the single page dashboard
+// The page itself holds no data; it calls the v2 API with the token the user enters, so no authentication is needed here
+func renderDashboard(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	c.Data(200, "text/html; charset=utf-8", []byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>container-factory</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0; color: #222; background: #f6f7f9; }
+header { background: #1f3a5f; color: #fff; padding: 0.75em 1.5em; display: flex; align-items: center; gap: 1em; flex-wrap: wrap; }
+header h1 { font-size: 1.2em; margin: 0; flex-grow: 1; }
+header input { width: 22em; }
+main { display: grid; grid-template-columns: minmax(20em, 1fr) minmax(28em, 2fr); gap: 1em; padding: 1em 1.5em; }
+section { background: #fff; border: 1px solid #dde1e6; border-radius: 4px; padding: 0.75em 1em; margin-bottom: 1em; }
+section h2 { font-size: 1em; margin: 0 0 0.5em 0; }
+ul.tree, ul.tree ul { list-style: none; padding-left: 1.1em; margin: 0; }
+ul.tree { padding-left: 0; }
+ul.tree li { margin: 0.15em 0; }
+.toggle { display: inline-block; width: 1em; cursor: pointer; user-select: none; color: #666; }
+.collapsed > ul { display: none; }
+button { font-size: 0.8em; margin-left: 0.5em; cursor: pointer; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+th, td { text-align: left; padding: 0.3em 0.5em; border-bottom: 1px solid #eee; }
+tr.job { cursor: pointer; }
+tr.job:hover, tr.selected { background: #eef3fa; }
+.status-pending_approval { color: #8e24aa; }
+.status-queued { color: #777; }
+.status-waiting_for_lock { color: #777; }
+.status-running { color: #1a6fc4; }
+.status-succeeded { color: #1d8a3a; }
+.status-failed { color: #c62828; }
+.status-cancelled { color: #a66b00; }
+.status-rejected { color: #a66b00; }
+pre#log { background: #111; color: #ddd; padding: 0.75em; height: 28em; overflow: auto; font-size: 0.8em; white-space: pre-wrap; margin: 0; }
+#message { color: #ffd54f; }
+.muted { color: #777; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<header>
+<h1>container-factory</h1>
+<span id="message"></span>
+<label>Tag <input id="tag" placeholder="build tag" style="width: 10em"></label>
+<label>Ref <input id="ref" placeholder="default" style="width: 8em"></label>
+<label>Token <input id="token" type="password" placeholder="API bearer token"></label>
+<button id="save-token">Save</button>
+<span id="caller" class="muted"></span>
+</header>
+<main>
+<div>
+<section>
+<h2>Base images</h2>
+<ul id="base-images" class="tree"></ul>
+</section>
+<section>
+<h2>Deployments</h2>
+<ul id="deployments" class="tree"></ul>
+</section>
+<section>
+<h2>Orphaned images</h2>
+<ul id="orphaned-images" class="tree"></ul>
+</section>
+</div>
+<div>
+<section>
+<h2>Jobs</h2>
+<table>
+<thead><tr><th>ID</th><th>Type</th><th>Parameters</th><th>Created by</th><th>Created</th><th>Status</th></tr></thead>
+<tbody id="jobs"></tbody>
+</table>
+</section>
+<section>
+<h2>Log <span id="log-job" class="muted"></span></h2>
+<pre id="log"></pre>
+</section>
+</div>
+</main>
+<script>
+(function () {
+	"use strict";
+
+	var scopes = [];
+	var caller = "";
+	var selectedJob = null;
+	var logAbort = null;
+
+	function el(tag, attributes, children) {
+		var e = document.createElement(tag);
+		Object.keys(attributes || {}).forEach(function (k) { e.setAttribute(k, attributes[k]); });
+		(children || []).forEach(function (c) {
+			e.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+		});
+		return e;
+	}
+
+	function message(text) {
+		document.getElementById("message").textContent = text || "";
+	}
+
+	function headers() {
+		var h = { "Content-Type": "application/json" };
+		var token = localStorage.getItem("container-factory-token");
+		if (token) {
+			h["Authorization"] = "Bearer " + token;
+		}
+		return h;
+	}
+
+	function api(method, path, body) {
+		return fetch("/api/v2" + path, {
+			method: method,
+			headers: headers(),
+			body: body ? JSON.stringify(body) : undefined
+		}).then(function (response) {
+			return response.json().then(function (data) {
+				if (!response.ok) {
+					throw new Error(data.error ? data.error.message : response.statusText);
+				}
+				return data;
+			});
+		});
+	}
+
+	function hasScope(scope) {
+		return scopes.indexOf("*") >= 0 || scopes.indexOf(scope) >= 0;
+	}
+
+	function buildButton(label, scope, request) {
+		if (!hasScope(scope)) {
+			return document.createTextNode("");
+		}
+		var button = el("button", {}, [label]);
+		button.addEventListener("click", function () {
+			var tag = document.getElementById("tag").value.trim();
+			if (!tag) {
+				message("A tag is required to start a build");
+				return;
+			}
+			var r = request();
+			r.body.tag = tag;
+			var ref = document.getElementById("ref").value.trim();
+			if (ref) {
+				r.body.ref = ref;
+			}
+			api("POST", r.path, r.body).then(function (data) {
+				message("");
+				refreshJobs().then(function () { selectJob(data.job.id); });
+			}).catch(function (err) { message(err.message); });
+		});
+		return button;
+	}
+
+	function renderImage(image) {
+		var hasChildren = image.children && image.children.length > 0;
+		var toggle = el("span", { "class": "toggle" }, [hasChildren ? "▾" : ""]);
+		var li = el("li", {}, [
+			toggle,
+			image.image_name,
+			buildButton(hasChildren ? "Build subtree" : "Build", "build:base", function () {
+				return { path: "/base-images/builds", body: { images: [image.image_name] } };
+			})
+		]);
+		if (hasChildren) {
+			toggle.addEventListener("click", function () {
+				li.classList.toggle("collapsed");
+				toggle.textContent = li.classList.contains("collapsed") ? "▸" : "▾";
+			});
+			li.appendChild(el("ul", {}, image.children.map(renderImage)));
+		}
+		return li;
+	}
+
+	function replaceChildren(id, children, empty) {
+		var container = document.getElementById(id);
+		container.innerHTML = "";
+		if (children.length === 0) {
+			container.appendChild(el("li", { "class": "muted" }, [empty]));
+		}
+		children.forEach(function (c) { container.appendChild(c); });
+	}
+
+	function refreshInventory() {
+		api("GET", "/base-images").then(function (data) {
+			var roots = (data.buildable_images || []).map(renderImage);
+			if (roots.length > 0) {
+				roots.unshift(el("li", {}, [
+					el("span", { "class": "toggle" }, []),
+					el("em", {}, ["All base images"]),
+					buildButton("Build all", "build:base", function () {
+						return { path: "/base-images/builds", body: {} };
+					})
+				]));
+			}
+			replaceChildren("base-images", roots, "No buildable images");
+			replaceChildren("orphaned-images", (data.orphaned_images || []).map(function (image) {
+				return el("li", {}, [image.image_name + " ", el("span", { "class": "muted" }, ["(parent " + image.parent_image_name + ")"])]);
+			}), "No orphaned images");
+		}).catch(function (err) { message(err.message); });
+
+		api("GET", "/deployments").then(function (data) {
+			replaceChildren("deployments", (data.deployments || []).map(function (name) {
+				return el("li", {}, [name, buildButton("Build", "build:deployment", function () {
+					return { path: "/deployments/builds", body: { name: name } };
+				})]);
+			}), "No deployments");
+		}).catch(function (err) { message(err.message); });
+	}
+
+	// approvalButtons lets approvers decide a job waiting to build a protected tag; callers cannot approve their own jobs
+	function approvalButtons(job) {
+		if (job.status !== "pending_approval" || !hasScope("approve:builds")) {
+			return [];
+		}
+		var buttons = [];
+		if (job.created_by !== caller) {
+			buttons.push(decisionButton(job, "Approve", "approve"));
+		}
+		buttons.push(decisionButton(job, "Reject", "reject"));
+		return buttons;
+	}
+
+	function decisionButton(job, label, action) {
+		var button = el("button", {}, [label]);
+		button.addEventListener("click", function (event) {
+			event.stopPropagation();
+			var comment = window.prompt(label + " build of protected tag " + job.approval.tag + "? Optional comment:", "");
+			if (comment === null) {
+				return;
+			}
+			api("POST", "/jobs/" + job.id + "/" + action, { comment: comment }).then(function () {
+				message("");
+				refreshJobs();
+			}).catch(function (err) { message(err.message); });
+		});
+		return button;
+	}
+
+	function formatParameters(parameters) {
+		return Object.keys(parameters || {}).sort().map(function (k) { return k + "=" + parameters[k]; }).join(" ");
+	}
+
+	function refreshJobs() {
+		return api("GET", "/jobs").then(function (data) {
+			var rows = (data.jobs || []).map(function (job) {
+				var row = el("tr", { "class": "job" + (job.id === selectedJob ? " selected" : "") }, [
+					el("td", {}, [job.id.substring(0, 8)]),
+					el("td", {}, [job.type]),
+					el("td", {}, [formatParameters(job.parameters)]),
+					el("td", {}, [job.created_by]),
+					el("td", {}, [new Date(job.created_at).toLocaleString()]),
+					el("td", { "class": "status-" + job.status, title: job.error || "" }, [job.status.replace("_", " ")].concat(approvalButtons(job)))
+				]);
+				row.addEventListener("click", function () { selectJob(job.id); });
+				return row;
+			});
+			var tbody = document.getElementById("jobs");
+			tbody.innerHTML = "";
+			rows.forEach(function (r) { tbody.appendChild(r); });
+		}).catch(function (err) { message(err.message); });
+	}
+
+	// selectJob streams the log of a job until it finishes or another job is selected
+	function selectJob(id) {
+		if (logAbort) {
+			logAbort.abort();
+		}
+		selectedJob = id;
+		logAbort = new AbortController();
+		var log = document.getElementById("log");
+		log.textContent = "";
+		document.getElementById("log-job").textContent = id;
+		refreshJobs();
+
+		fetch("/api/v2/jobs/" + id + "/logs?follow=true", { headers: headers(), signal: logAbort.signal }).then(function (response) {
+			if (!response.ok) {
+				throw new Error("Could not load log: " + response.statusText);
+			}
+			var reader = response.body.getReader();
+			var decoder = new TextDecoder();
+			function read() {
+				return reader.read().then(function (result) {
+					if (result.done) {
+						refreshJobs();
+						return;
+					}
+					var follow = log.scrollTop + log.clientHeight >= log.scrollHeight - 5;
+					log.textContent += decoder.decode(result.value, { stream: true });
+					if (follow) {
+						log.scrollTop = log.scrollHeight;
+					}
+					return read();
+				});
+			}
+			return read();
+		}).catch(function (err) {
+			if (err.name !== "AbortError") {
+				message(err.message);
+			}
+		});
+	}
+
+	function refresh() {
+		api("GET", "/whoami").then(function (data) {
+			scopes = data.scopes || [];
+			caller = data.caller;
+			document.getElementById("caller").textContent = data.caller;
+			message("");
+			refreshInventory();
+			refreshJobs();
+		}).catch(function (err) {
+			scopes = [];
+			caller = "";
+			document.getElementById("caller").textContent = "";
+			message(err.message);
+		});
+	}
+
+	document.getElementById("token").value = localStorage.getItem("container-factory-token") || "";
+	document.getElementById("save-token").addEventListener("click", function () {
+		localStorage.setItem("container-factory-token", document.getElementById("token").value.trim());
+		refresh();
+	});
+
+	refresh();
+	setInterval(refreshJobs, 5000);
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package webserver
+
+import (
+	"errors"
+)
+
+// directoryWatcher is only implemented with inotify; use POST /api/v1/inventory/reload on other platforms
+type directoryWatcher struct {
+	changes chan struct{}
+}
+
+func newDirectoryWatcher(baseDirectory string, subdirectories []string) (*directoryWatcher, error) {
+	return nil, errors.New("Watching for inventory changes is only supported on linux")
+}
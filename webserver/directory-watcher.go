@@ -0,0 +1,164 @@
+//go:build linux
+// +build linux
+
+package webserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const watchedEvents = unix.IN_CREATE | unix.IN_DELETE | unix.IN_CLOSE_WRITE | unix.IN_MODIFY |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// directoryWatcher signals changes to the files under a set of subdirectories of a base directory using inotify
+// Subdirectories created after the watcher starts, including the watched subdirectories themselves, are watched as they appear
+type directoryWatcher struct {
+	fd             int
+	baseDirectory  string
+	subdirectories []string
+	changes        chan struct{}
+
+	mutex   sync.Mutex
+	watches map[int]string
+}
+
+// newDirectoryWatcher starts watching the subdirectories of baseDirectory; changes is signalled after every batch of events
+func newDirectoryWatcher(baseDirectory string, subdirectories []string) (*directoryWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &directoryWatcher{
+		fd:             fd,
+		baseDirectory:  filepath.Clean(baseDirectory),
+		subdirectories: subdirectories,
+		changes:        make(chan struct{}, 1),
+		watches:        map[int]string{},
+	}
+	// The base directory is watched on its own so subdirectories created later are picked up
+	if err := w.addWatch(w.baseDirectory, unix.IN_CREATE|unix.IN_MOVED_TO|unix.IN_ONLYDIR); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	for _, s := range subdirectories {
+		w.addTree(filepath.Join(w.baseDirectory, s))
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+func (w *directoryWatcher) addWatch(path string, mask uint32) error {
+	wd, err := unix.InotifyAddWatch(w.fd, path, mask)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	w.watches[wd] = path
+	w.mutex.Unlock()
+	return nil
+}
+
+// addTree watches a directory and every directory below it, except hidden ones
+func (w *directoryWatcher) addTree(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if isHiddenName(info.Name()) {
+			return filepath.SkipDir
+		}
+		if err := w.addWatch(path, watchedEvents); err != nil {
+			logger.WithFields(logrus.Fields{
+				"path":  path,
+				"error": err,
+			}).Warn("Failed to watch directory")
+		}
+		return nil
+	})
+}
+
+// isHiddenName reports whether a file or directory is left out of the inventory, like the .tmp- directories builds create
+// Changes to them do not change the inventory, so they are not watched
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+func (w *directoryWatcher) isWatchedSubdirectory(name string) bool {
+	for _, s := range w.subdirectories {
+		if filepath.Clean(s) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *directoryWatcher) readEvents() {
+	buffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(w.fd, buffer)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"directory": w.baseDirectory,
+				"error":     err,
+			}).Error("Stopped watching for inventory changes")
+			return
+		}
+
+		changed := false
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+
+			w.mutex.Lock()
+			directory, exists := w.watches[int(event.Wd)]
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(w.watches, int(event.Wd))
+			}
+			w.mutex.Unlock()
+			if !exists {
+				continue
+			}
+
+			if directory == w.baseDirectory {
+				// Only the watched subdirectories matter at the top of the base directory
+				if !w.isWatchedSubdirectory(name) {
+					continue
+				}
+				w.addTree(filepath.Join(directory, name))
+				changed = true
+				continue
+			}
+			if isHiddenName(name) {
+				continue
+			}
+			if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				w.addTree(filepath.Join(directory, name))
+			}
+			if event.Mask&unix.IN_IGNORED == 0 {
+				changed = true
+			}
+		}
+
+		if changed {
+			select {
+			case w.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
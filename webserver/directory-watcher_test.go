@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package webserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Longest a test waits for the watcher to signal a change
+const watcherTestTimeout = 500 * time.Millisecond
+
+func TestDirectoryWatcher(t *testing.T) {
+	baseDirectory := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(baseDirectory, "dockerfiles", ".tmp-existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := newDirectoryWatcher(baseDirectory, []string{"dockerfiles", "deployments"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkdir := func(path string) func() error {
+		return func() error { return os.Mkdir(filepath.Join(baseDirectory, path), 0755) }
+	}
+	write := func(path string) func() error {
+		return func() error {
+			return ioutil.WriteFile(filepath.Join(baseDirectory, path), []byte("FROM alpine:3\n"), 0644)
+		}
+	}
+	tests := []struct {
+		name        string
+		change      func() error
+		wantChanged bool
+	}{
+		{"dockerfile written", write("dockerfiles/base"), true},
+		{"hidden file written", write("dockerfiles/.base.swp"), false},
+		{"file in hidden directory from before the watcher started", write("dockerfiles/.tmp-existing/Dockerfile"), false},
+		{"hidden directory created", mkdir("dockerfiles/.tmp-build"), false},
+		{"file in created hidden directory", write("dockerfiles/.tmp-build/Dockerfile"), false},
+		{"hidden directory removed", func() error { return os.RemoveAll(filepath.Join(baseDirectory, "dockerfiles", ".tmp-build")) }, false},
+		{"directory created", mkdir("dockerfiles/nested"), true},
+		{"file in created directory", write("dockerfiles/nested/tools"), true},
+		{"unwatched directory created", mkdir("other"), false},
+		{"watched directory created", mkdir("deployments"), true},
+		{"deployment written", write("deployments/app"), true},
+	}
+	for _, test := range tests {
+		if err := test.change(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		changed := false
+		select {
+		case <-watcher.changes:
+			changed = true
+		case <-time.After(watcherTestTimeout):
+		}
+		if changed != test.wantChanged {
+			t.Errorf("%s: changed = %v, want %v", test.name, changed, test.wantChanged)
+		}
+		// Drain signals for events of the change that arrived in a later batch
+		for drained := false; !drained; {
+			select {
+			case <-watcher.changes:
+			case <-time.After(50 * time.Millisecond):
+				drained = true
+			}
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package webserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+const (
+	gitProviderGitHub = "github"
+	gitProviderGitLab = "gitlab"
+	gitProviderGitea  = "gitea"
+
+	jobTypeGitPush = "git-push"
+
+	errorCodeInvalidSignature = "invalid_signature"
+
+	// Push payloads from GitHub are capped at 25 MiB
+	maxGitHookPayloadBytes = 25 * 1024 * 1024
+)
+
+// Characters in branch names that are not allowed in docker tags
+var invalidTagCharactersRegex = regexp.MustCompile("[^\\w.-]+")
+
+// gitHooksConfig configures the git push receiver in the server config file
+type gitHooksConfig struct {
+	// Shared secret used to verify GitHub and Gitea signatures and compared to the GitLab token
+	Secret string `json:"secret"`
+	// Directory of the repository holding dockerfiles/ and deployments/; the repository root when empty
+	PathPrefix string `json:"path_prefix"`
+	// Branches are matched against rules in order; pushes to branches without a matching rule are ignored
+	BranchTags []branchTagRule `json:"branch_tags"`
+}
+
+// branchTagRule maps branches matching a glob pattern to a tag
+// {branch} in the tag is replaced with the branch name, with characters not allowed in tags replaced by dashes
+type branchTagRule struct {
+	Branch string `json:"branch"`
+	Tag    string `json:"tag"`
+}
+
+// gitPushPayload holds the fields shared by GitHub, GitLab and Gitea push events
+type gitPushPayload struct {
+	Ref               string `json:"ref"`
+	Before            string `json:"before"`
+	After             string `json:"after"`
+	TotalCommitsCount *int   `json:"total_commits_count"`
+	Commits           []struct {
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
+	Pusher struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+	UserUsername string `json:"user_username"`
+}
+
+// Populated from the server config; the receiver is disabled when nil
+var gitHooks *gitHooksConfig
+
+func validateGitHooks(config *gitHooksConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.Secret == "" {
+		return errors.New("Secret is required for git_hooks")
+	}
+	if len(config.BranchTags) == 0 {
+		return errors.New("At least one branch_tags rule is required for git_hooks")
+	}
+	for _, r := range config.BranchTags {
+		if _, err := path.Match(r.Branch, ""); err != nil || r.Branch == "" {
+			return errors.New("Invalid branch pattern in git_hooks: " + r.Branch)
+		}
+		if r.Tag == "" {
+			return errors.New("Tag is required for git_hooks branch: " + r.Branch)
+		}
+	}
+	return nil
+}
+
+func addGitHookRoutes() {
+	if gitHooks == nil {
+		return
+	}
+	ginEngine.POST("/api/v1/hooks/git", audit("git.push"), func(c *gin.Context) { receiveGitPush(c) })
+}
+
+// receiveGitPush queues builds for the images and deployments changed by a push
+func receiveGitPush(c *gin.Context) {
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxGitHookPayloadBytes))
+	if err != nil {
+		renderAPIError(c, 400, errorCodeInvalidRequest, "Could not read request body")
+		return
+	}
+
+	provider, event, err := verifyGitHook(c, body)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"client_ip": c.ClientIP(),
+			"error":     err,
+		}).Warn("Rejected git hook")
+		renderAPIError(c, 401, errorCodeInvalidSignature, err.Error())
+		return
+	}
+	if event != "push" {
+		c.JSON(200, gin.H{
+			"status": "ignored",
+			"reason": "Event is not a push: " + event,
+		})
+		return
+	}
+
+	var payload gitPushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		renderAPIError(c, 400, errorCodeInvalidRequest, "Request body must be a valid push event")
+		return
+	}
+	caller := "git:" + provider
+	if pusher := payload.getPusher(); pusher != "" {
+		caller += ":" + pusher
+	}
+	// Identifies the pusher in the audit log, including for ignored pushes
+	c.Set(callerContextKey, caller)
+	if !strings.HasPrefix(payload.Ref, "refs/heads/") || strings.Trim(payload.After, "0") == "" {
+		c.JSON(200, gin.H{
+			"status": "ignored",
+			"reason": "Push is not to an existing branch",
+		})
+		return
+	}
+	branch := strings.TrimPrefix(payload.Ref, "refs/heads/")
+	tag, matched := getBranchTag(gitHooks.BranchTags, branch)
+	if !matched {
+		c.JSON(200, gin.H{
+			"status": "ignored",
+			"reason": "No tag rule matches branch: " + branch,
+		})
+		return
+	}
+	if !dockerTagRegex.MatchString(tag) {
+		renderAPIError(c, 422, errorCodeValidationFailed, "Branch "+branch+" maps to an invalid tag: "+tag)
+		return
+	}
+
+	// Build the pushed commit when serving from a git workspace
+	ref := ""
+	if defaultWorkspace.repository != nil {
+		ref = payload.After
+	}
+	source, err := defaultWorkspace.prepareBuildSource(c.Request.Context(), ref)
+	if err != nil {
+		renderBuildSourceError(c, err)
+		return
+	}
+
+	var images, deployments []string
+	if payload.TotalCommitsCount != nil && *payload.TotalCommitsCount > len(payload.Commits) {
+		// GitLab truncates the commit list on large pushes, so the changed paths are unknown and everything is rebuilt
+		buildableImages, _ := source.inventory.GetBaseImageHeirarchy()
+		for _, i := range buildableImages {
+			images = append(images, i.Name)
+		}
+		deployments = source.inventory.GetDeployments()
+	} else {
+		paths := payload.getChangedPaths(gitHooks.PathPrefix)
+		previous := getPreviousSource(c.Request.Context(), payload, paths)
+		images, deployments = source.inventory.GetAffectedBuilds(paths, previous.inventory, source.profile)
+		previous.release()
+		if len(images) == 0 && len(deployments) == 0 {
+			source.release()
+			c.JSON(200, gin.H{
+				"status": "ignored",
+				"reason": "Push does not change any base images or deployments",
+			})
+			return
+		}
+	}
+
+	j, err := startGitPushJob(c.Request.Context(), caller, source, payload.Ref, payload.After, tag, images, deployments)
+	if err != nil {
+		renderAPIError(c, 503, errorCodeShuttingDown, err.Error())
+		return
+	}
+	renderJobAccepted(c, j)
+}
+
+// verifyGitHook identifies the provider from its headers and checks the request was sent with the shared secret
+// Returns the provider and event name
+func verifyGitHook(c *gin.Context, body []byte) (string, string, error) {
+	switch {
+	// Gitea also sends GitHub headers, so it is checked first
+	case c.GetHeader("X-Gitea-Event") != "":
+		if !isValidHMAC(body, strings.TrimPrefix(c.GetHeader("X-Gitea-Signature"), "sha256=")) {
+			return "", "", errors.New("Invalid Gitea signature")
+		}
+		return gitProviderGitea, c.GetHeader("X-Gitea-Event"), nil
+	case c.GetHeader("X-GitHub-Event") != "":
+		signature := c.GetHeader("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") || !isValidHMAC(body, strings.TrimPrefix(signature, "sha256=")) {
+			return "", "", errors.New("Invalid GitHub signature")
+		}
+		return gitProviderGitHub, c.GetHeader("X-GitHub-Event"), nil
+	case c.GetHeader("X-Gitlab-Event") != "":
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Gitlab-Token")), []byte(gitHooks.Secret)) != 1 {
+			return "", "", errors.New("Invalid GitLab token")
+		}
+		event := c.GetHeader("X-Gitlab-Event")
+		if event == "Push Hook" {
+			event = "push"
+		}
+		return gitProviderGitLab, event, nil
+	}
+	return "", "", errors.New("Request is not from a supported git provider")
+}
+
+func isValidHMAC(body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(gitHooks.Secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// getBranchTag returns the tag for the first rule matching branch
+func getBranchTag(rules []branchTagRule, branch string) (string, bool) {
+	for _, r := range rules {
+		if matched, _ := path.Match(r.Branch, branch); matched {
+			return strings.Replace(r.Tag, "{branch}", invalidTagCharactersRegex.ReplaceAllString(branch, "-"), -1), true
+		}
+	}
+	return "", false
+}
+
+// getChangedPaths returns the paths changed by every commit, relative to the docker base directory
+func (p gitPushPayload) getChangedPaths(pathPrefix string) []string {
+	prefix := strings.Trim(pathPrefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	paths := []string{}
+	for _, commit := range p.Commits {
+		for _, files := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, f := range files {
+				if strings.HasPrefix(f, prefix) {
+					paths = append(paths, strings.TrimPrefix(f, prefix))
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// getPreviousSource checks out the commit before a push that changed the workspace configuration, so builds whose build args changed are detected
+// The source has no inventory when serving from a directory, the configuration did not change or the commit can not be checked out
+func getPreviousSource(ctx context.Context, payload gitPushPayload, paths []string) buildSource {
+	none := buildSource{release: func() {}}
+	if defaultWorkspace.repository == nil || strings.Trim(payload.Before, "0") == "" {
+		return none
+	}
+	for _, p := range paths {
+		if strings.TrimPrefix(p, "/") != dockerbuild.ProjectConfigFilename {
+			continue
+		}
+		previous, err := defaultWorkspace.prepareBuildSource(ctx, payload.Before)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"commit": payload.Before,
+				"error":  err,
+			}).Warn("Failed to load the inventory before the push; every build is affected if the workspace configuration has build args")
+			return none
+		}
+		return previous
+	}
+	return none
+}
+
+func (p gitPushPayload) getPusher() string {
+	if p.Pusher.Name != "" {
+		return p.Pusher.Name
+	}
+	return p.UserUsername
+}
+
+// startGitPushJob builds the changed base image subtrees, then the affected deployments
+func startGitPushJob(parent context.Context, caller string, source buildSource, ref string, commit string, tag string, images []string, deployments []string) (job, error) {
+	parameters := map[string]string{
+		"ref":    ref,
+		"commit": commit,
+		"tag":    tag,
+	}
+	if len(images) > 0 {
+		parameters["images"] = strings.Join(images, ",")
+	}
+	if len(deployments) > 0 {
+		parameters["deployments"] = strings.Join(deployments, ",")
+	}
+	return jobs.start(parent, jobTypeGitPush, caller, parameters, source, func(ctx context.Context) error {
+		return buildSubtreesThenDeployments(ctx, source, tag, images, false, deployments)
+	})
+}
@@ -0,0 +1,189 @@
+package webserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testGitHookSecret = "hook-secret"
+
+// configureTestGitHooks serves the git push receiver from a directory workspace for the duration of the test
+func configureTestGitHooks(t *testing.T) {
+	previousEngine, previousWorkspace, previousGitHooks := ginEngine, defaultWorkspace, gitHooks
+	t.Cleanup(func() {
+		jobs.running.Wait()
+		ginEngine, defaultWorkspace, gitHooks = previousEngine, previousWorkspace, previousGitHooks
+	})
+	installFakeDocker(t, "0")
+
+	gitHooks = &gitHooksConfig{
+		Secret:     testGitHookSecret,
+		PathPrefix: "docker/",
+		BranchTags: []branchTagRule{
+			{Branch: "main", Tag: "latest"},
+			{Branch: "release/*", Tag: "release-{branch}"},
+		},
+	}
+	defaultWorkspace = &serverWorkspace{}
+	defaultWorkspace.config.RegistryBasePath = "registry.test/base"
+	defaultWorkspace.inventory = loadTestWorkspaceInventory(t, map[string]string{
+		"dockerfiles/root":  "FROM alpine:3\n",
+		"dockerfiles/child": "FROM {{ local }}/root\n",
+		"dockerfiles/other": "FROM alpine:3\n",
+		"deployments/app":   "FROM {{ local }}/child\n",
+		"deployments/api":   "FROM alpine:3\n",
+	})
+	gin.SetMode(gin.TestMode)
+	ginEngine = gin.New()
+	addGitHookRoutes()
+}
+
+func signTestGitHook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(testGitHookSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestGetBranchTag(t *testing.T) {
+	rules := []branchTagRule{
+		{Branch: "main", Tag: "latest"},
+		{Branch: "release/*", Tag: "release-{branch}"},
+		{Branch: "*", Tag: "branch-{branch}"},
+	}
+	tests := []struct {
+		branch      string
+		wantTag     string
+		wantMatched bool
+	}{
+		{"main", "latest", true},
+		{"release/1.2", "release-release-1.2", true},
+		{"feature_x", "branch-feature_x", true},
+		// * does not match across slashes
+		{"feature/new login", "", false},
+	}
+	for _, test := range tests {
+		tag, matched := getBranchTag(rules, test.branch)
+		if tag != test.wantTag || matched != test.wantMatched {
+			t.Errorf("getBranchTag(%q) = %q, %v; want %q, %v", test.branch, tag, matched, test.wantTag, test.wantMatched)
+		}
+	}
+	if tag, _ := getBranchTag([]branchTagRule{{Branch: "feature/*", Tag: "{branch}"}}, "feature/new login"); tag != "feature-new-login" {
+		t.Errorf("Characters not allowed in tags were not replaced: %q", tag)
+	}
+}
+
+func TestGetChangedPaths(t *testing.T) {
+	var payload gitPushPayload
+	if err := json.Unmarshal([]byte(`{"commits": [
+		{"added": ["docker/dockerfiles/new"], "modified": ["readme.md"]},
+		{"modified": ["docker/deployments/app"], "removed": ["docker/dockerfiles/old"]}
+	]}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pathPrefix string
+		want       []string
+	}{
+		{"", []string{"docker/dockerfiles/new", "readme.md", "docker/deployments/app", "docker/dockerfiles/old"}},
+		{"docker", []string{"dockerfiles/new", "deployments/app", "dockerfiles/old"}},
+		{"/docker/", []string{"dockerfiles/new", "deployments/app", "dockerfiles/old"}},
+		{"other/", []string{}},
+	}
+	for _, test := range tests {
+		if got := payload.getChangedPaths(test.pathPrefix); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getChangedPaths(%q) = %v, want %v", test.pathPrefix, got, test.want)
+		}
+	}
+}
+
+func TestReceiveGitPush(t *testing.T) {
+	configureTestGitHooks(t)
+	push := func(ref string, after string, changed ...string) []byte {
+		body, _ := json.Marshal(map[string]interface{}{
+			"ref":    ref,
+			"before": strings.Repeat("1", 40),
+			"after":  after,
+			"commits": []interface{}{
+				map[string]interface{}{"modified": changed},
+			},
+			"pusher": map[string]interface{}{"name": "developer"},
+		})
+		return body
+	}
+	commit := strings.Repeat("2", 40)
+	childPush := push("refs/heads/main", commit, "docker/dockerfiles/child")
+	truncatedPush := []byte(`{"ref": "refs/heads/release/2", "after": "` + commit + `", "total_commits_count": 30, "commits": [], "user_username": "developer"}`)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    []byte
+		// Status and ignore reason of the response
+		wantStatus int
+		wantReason string
+		// Parameters of the job started for an accepted push
+		wantParameters map[string]string
+		wantCaller     string
+	}{
+		{"invalid GitHub signature", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": signTestGitHook([]byte("other"))}, childPush, 401, "", nil, ""},
+		{"invalid GitLab token", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}, childPush, 401, "", nil, ""},
+		{"unknown provider", nil, childPush, 401, "", nil, ""},
+		{"not a push", map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": signTestGitHook([]byte("{}"))}, []byte("{}"), 200, "Event is not a push: ping", nil, ""},
+		{"deleted branch", map[string]string{"X-GitHub-Event": "push"}, push("refs/heads/main", strings.Repeat("0", 40), "docker/dockerfiles/child"), 200, "Push is not to an existing branch", nil, ""},
+		{"tag", map[string]string{"X-GitHub-Event": "push"}, push("refs/tags/v1", commit, "docker/dockerfiles/child"), 200, "Push is not to an existing branch", nil, ""},
+		{"unmatched branch", map[string]string{"X-GitHub-Event": "push"}, push("refs/heads/feature", commit, "docker/dockerfiles/child"), 200, "No tag rule matches branch: feature", nil, ""},
+		{"no builds changed", map[string]string{"X-GitHub-Event": "push"}, push("refs/heads/main", commit, "readme.md", "dockerfiles/child"), 200, "Push does not change any base images or deployments", nil, ""},
+		{"GitHub", map[string]string{"X-GitHub-Event": "push"}, childPush, 202, "",
+			map[string]string{"ref": "refs/heads/main", "commit": commit, "tag": "latest", "images": "child", "deployments": "app"}, "git:github:developer"},
+		// Gitea also sends the GitHub event header
+		{"Gitea", map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push", "X-Gitea-Signature": strings.TrimPrefix(signTestGitHook(childPush), "sha256=")}, childPush, 202, "",
+			map[string]string{"ref": "refs/heads/main", "commit": commit, "tag": "latest", "images": "child", "deployments": "app"}, "git:gitea:developer"},
+		// Every subtree is built from its root
+		{"truncated GitLab push", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": testGitHookSecret}, truncatedPush, 202, "",
+			map[string]string{"ref": "refs/heads/release/2", "commit": commit, "tag": "release-release-2", "images": "other,root", "deployments": "api,app"}, "git:gitlab:developer"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/api/v1/hooks/git", strings.NewReader(string(test.body)))
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		if test.headers["X-GitHub-Event"] != "" && request.Header.Get("X-Hub-Signature-256") == "" {
+			request.Header.Set("X-Hub-Signature-256", signTestGitHook(test.body))
+		}
+		w := httptest.NewRecorder()
+		ginEngine.ServeHTTP(w, request)
+		if w.Code != test.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", test.name, w.Code, test.wantStatus, w.Body.String())
+			continue
+		}
+
+		var response struct {
+			Reason string `json:"reason"`
+			Job    job    `json:"job"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if response.Reason != test.wantReason {
+			t.Errorf("%s: reason = %q, want %q", test.name, response.Reason, test.wantReason)
+		}
+		if test.wantParameters == nil {
+			continue
+		}
+		if !reflect.DeepEqual(response.Job.Parameters, test.wantParameters) || response.Job.CreatedBy != test.wantCaller {
+			t.Errorf("%s: job was started by %s with %v; want %s with %v", test.name, response.Job.CreatedBy, response.Job.Parameters, test.wantCaller, test.wantParameters)
+		}
+		if j := waitForJob(t, response.Job.ID, 10*time.Second, func(j job) bool { return j.FinishedAt != nil }); j.Status != jobStatusSucceeded {
+			t.Errorf("%s: job finished %s: %s", test.name, j.Status, j.Error)
+		}
+	}
+}
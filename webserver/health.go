@@ -0,0 +1,100 @@
+package webserver
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+const (
+	// Docker daemon checks are cached so frequent probes do not spawn a process per request
+	builderCheckInterval = 10 * time.Second
+	builderCheckTimeout  = 5 * time.Second
+)
+
+var serverVersion = "dev"
+
+type builderCheck struct {
+	mutex     sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+var lastBuilderCheck builderCheck
+
+func addHealthRoutes() {
+	ginEngine.GET("/healthz", func(c *gin.Context) { renderHealth(c) })
+	ginEngine.GET("/readyz", func(c *gin.Context) { renderReadiness(c) })
+	ginEngine.GET("/version", func(c *gin.Context) { renderVersion(c) })
+}
+
+// renderHealth reports that the process is up and serving requests
+func renderHealth(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+// renderReadiness reports whether the server can accept build jobs
+func renderReadiness(c *gin.Context) {
+	checks := map[string]string{
+		"inventory": "ok",
+		"builder":   "ok",
+		"jobs":      "ok",
+	}
+	ready := true
+
+	if !dockerbuild.InventoryLoaded() {
+		checks["inventory"] = "not loaded"
+		ready = false
+	}
+	if buildAgents.enabled() {
+		// Agents register through this server, so it stays ready without them; jobs wait until one connects
+		agents, _ := buildAgents.list()
+		checks["builder"] = strconv.Itoa(len(agents)) + " build agents connected"
+	} else if err := checkBuilder(); err != nil {
+		checks["builder"] = "unreachable: " + err.Error()
+		ready = false
+	}
+	if jobs.isDraining() {
+		checks["jobs"] = "shutting down"
+		ready = false
+	}
+
+	status := 200
+	if !ready {
+		status = 503
+	}
+	c.JSON(status, gin.H{
+		"ready":  ready,
+		"checks": checks,
+	})
+}
+
+func renderVersion(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"version":    serverVersion,
+		"go_version": runtime.Version(),
+	})
+}
+
+// checkBuilder returns the result of the most recent docker daemon check, refreshing it when stale
+func checkBuilder() error {
+	lastBuilderCheck.mutex.Lock()
+	defer lastBuilderCheck.mutex.Unlock()
+
+	if time.Since(lastBuilderCheck.checkedAt) < builderCheckInterval {
+		return lastBuilderCheck.err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), builderCheckTimeout)
+	defer cancel()
+	lastBuilderCheck.err = dockerbuild.CheckDockerDaemon(ctx)
+	lastBuilderCheck.checkedAt = time.Now()
+	return lastBuilderCheck.err
+}
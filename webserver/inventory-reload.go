@@ -0,0 +1,92 @@
+package webserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+const errorCodeInventoryReloadFailed = "inventory_reload_failed"
+
+// Time without filesystem events before the inventory is reloaded, so editors and copies can finish writing
+const inventoryReloadDelay = 500 * time.Millisecond
+
+// reloadInventory loads the inventory of the workspace again, replacing it only once the new inventory has loaded
+// Running jobs keep the inventory they started with
+func (ws *serverWorkspace) reloadInventory(ctx context.Context) error {
+	ws.reloadMutex.Lock()
+	defer ws.reloadMutex.Unlock()
+
+	if ws.repository != nil {
+		if err := ws.fetch(ctx); err != nil {
+			return err
+		}
+		return ws.refreshDefaultCheckout(ctx)
+	}
+
+	inventory, err := dockerbuild.LoadInventory(ws.config.BaseDirectory)
+	if err != nil {
+		return err
+	}
+	ws.setInventory(inventory)
+	logger.WithFields(logrus.Fields{
+		"workspace": ws.config.Name,
+		"directory": inventory.BaseDirectory(),
+	}).Info("Reloaded inventory")
+	return nil
+}
+
+// watchInventory reloads the inventory of a directory workspace whenever files under dockerfiles/ or deployments/ change
+// Git workspaces follow their default ref instead
+func (ws *serverWorkspace) watchInventory() error {
+	if ws.repository != nil {
+		return nil
+	}
+	watcher, err := newDirectoryWatcher(ws.getInventory().BaseDirectory(), []string{"dockerfiles", "deployments"})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range watcher.changes {
+			timer := time.NewTimer(inventoryReloadDelay)
+			for settled := false; !settled; {
+				select {
+				case <-watcher.changes:
+					timer.Reset(inventoryReloadDelay)
+				case <-timer.C:
+					settled = true
+				}
+			}
+			if err := ws.reloadInventory(context.Background()); err != nil {
+				logger.WithFields(logrus.Fields{
+					"workspace": ws.config.Name,
+					"error":     err,
+				}).Error("Failed to reload inventory; keeping the previous inventory")
+			}
+		}
+	}()
+	logger.WithFields(logrus.Fields{
+		"workspace": ws.config.Name,
+	}).Debug("Watching for inventory changes")
+	return nil
+}
+
+func reloadInventory(c *gin.Context) {
+	ws := getWorkspace(c)
+	if err := ws.reloadInventory(c.Request.Context()); err != nil {
+		renderAPIError(c, 500, errorCodeInventoryReloadFailed, "Could not reload the inventory: "+err.Error())
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"workspace": ws.config.Name,
+		"caller":    getCaller(c),
+	}).Info("Inventory reload requested")
+	c.JSON(200, gin.H{
+		"status":      "reloaded",
+		"deployments": len(ws.getInventory().GetDeployments()),
+	})
+}
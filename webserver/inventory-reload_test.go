@@ -0,0 +1,44 @@
+package webserver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadInventoryKeepsPreviousInventoryOnError(t *testing.T) {
+	baseDirectory := t.TempDir()
+	for name, contents := range map[string]string{
+		"dockerfiles/root": "FROM alpine:3\n",
+		"deployments/app":  "FROM {{ local }}/root\n",
+	} {
+		path := filepath.Join(baseDirectory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws, err := openWorkspace(workspaceConfig{Name: "test", BaseDirectory: baseDirectory}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := ws.getInventory()
+
+	// A dockerfile saved mid-edit, before its FROM line is written
+	if err := ioutil.WriteFile(filepath.Join(baseDirectory, "dockerfiles", "child"), []byte("RUN true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.reloadInventory(context.Background()); err == nil {
+		t.Error("reloadInventory() did not return an error for a dockerfile without FROM")
+	}
+	if ws.getInventory() != previous {
+		t.Error("reloadInventory() replaced the inventory after failing")
+	}
+	if got := getBaseImageNames(ws.getInventory()); got != "root" {
+		t.Errorf("base images = %s, want root", got)
+	}
+}
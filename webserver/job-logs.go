@@ -0,0 +1,113 @@
+package webserver
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logs beyond this size have their oldest output dropped
+const maxJobLogBytes = 4 * 1024 * 1024
+
+// jobLog holds the output of a job and wakes followers as output is appended
+type jobLog struct {
+	mutex sync.Mutex
+	data  []byte
+	// Number of bytes dropped from the start of the log to stay under maxJobLogBytes
+	dropped int
+	closed  bool
+	updated chan struct{}
+}
+
+func newJobLog() *jobLog {
+	return &jobLog{
+		updated: make(chan struct{}),
+	}
+}
+
+// Write appends to the log; it is safe for concurrent use
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return len(p), nil
+	}
+	l.data = append(l.data, p...)
+	if excess := len(l.data) - maxJobLogBytes; excess > 0 {
+		l.data = append([]byte{}, l.data[excess:]...)
+		l.dropped += excess
+	}
+	close(l.updated)
+	l.updated = make(chan struct{})
+	return len(p), nil
+}
+
+// close marks the log complete and releases any followers
+func (l *jobLog) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.updated)
+}
+
+// readFrom returns output after the absolute offset along with the offset to continue from
+// updated is closed when more output is written or the log is closed
+func (l *jobLog) readFrom(offset int) (chunk []byte, next int, closed bool, updated <-chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if offset < l.dropped {
+		offset = l.dropped
+	}
+	start := offset - l.dropped
+	if start > len(l.data) {
+		start = len(l.data)
+	}
+	chunk = append([]byte{}, l.data[start:]...)
+	return chunk, l.dropped + len(l.data), l.closed, l.updated
+}
+
+// renderJobLogs writes the job log as plain text
+// With follow=true the response streams new output until the job finishes or the client disconnects
+func renderJobLogs(c *gin.Context, j job) {
+	follow, _ := strconv.ParseBool(c.Query("follow"))
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	offset := 0
+	if !follow {
+		chunk, _, _, _ := j.log.readFrom(offset)
+		c.Data(200, "text/plain; charset=utf-8", chunk)
+		return
+	}
+
+	// Keep proxies from buffering the stream and periodically send nothing to detect closed clients
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		chunk, next, closed, updated := j.log.readFrom(offset)
+		offset = next
+		if len(chunk) > 0 {
+			w.Write(chunk)
+			return true
+		}
+		if closed {
+			return false
+		}
+		select {
+		case <-updated:
+		case <-keepalive.C:
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
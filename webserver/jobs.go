@@ -0,0 +1,436 @@
+package webserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/container-factory/tracing"
+)
+
+const (
+	jobStatusPendingApproval = "pending_approval"
+	jobStatusQueued          = "queued"
+	jobStatusWaitingForLock  = "waiting_for_lock"
+	jobStatusRunning         = "running"
+	jobStatusSucceeded       = "succeeded"
+	jobStatusFailed          = "failed"
+	jobStatusCancelled       = "cancelled"
+	jobStatusRejected        = "rejected"
+
+	jobTypeBaseImages = "base-images"
+	jobTypeDeployment = "deployment"
+
+	// Finished jobs beyond this count are dropped from the registry, oldest first
+	maxRetainedJobs = 1000
+)
+
+var (
+	errShuttingDown = errors.New("Server is shutting down and not accepting new jobs")
+	errJobNotFound  = errors.New("Job does not exist")
+)
+
+type jobIDContextKey struct{}
+
+// job tracks a build process started through the web API
+type job struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Status     string            `json:"status"`
+	CreatedBy  string            `json:"created_by"`
+	Parameters map[string]string `json:"parameters"`
+	// Results of each image as it finishes building and pushing
+	Images []dockerbuild.ImageResult `json:"images,omitempty"`
+	// Set for jobs building a protected tag
+	Approval   *jobApproval `json:"approval,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	StartedAt  *time.Time   `json:"started_at,omitempty"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	log        *jobLog
+	// Closed once a job waiting for approval is approved or rejected
+	decided chan struct{}
+}
+
+type jobRegistry struct {
+	mutex    sync.RWMutex
+	jobs     map[string]*job
+	order    []string
+	cancels  map[string]context.CancelFunc
+	running  sync.WaitGroup
+	draining bool
+	// Buffered to the maximum number of concurrently running jobs; nil allows unlimited jobs
+	slots chan struct{}
+}
+
+var jobs = jobRegistry{
+	jobs:    map[string]*job{},
+	cancels: map[string]context.CancelFunc{},
+}
+
+// setConcurrency limits the number of jobs running at once; jobs beyond the limit are queued
+// A limit of 0 runs every job immediately
+func (jr *jobRegistry) setConcurrency(limit int) {
+	jr.mutex.Lock()
+	defer jr.mutex.Unlock()
+	if limit > 0 {
+		jr.slots = make(chan struct{}, limit)
+	} else {
+		jr.slots = nil
+	}
+}
+
+// start registers a new job and runs it in the background once a slot is available
+// Jobs building a protected tag wait for approval, and jobs whose tag is locked by another instance wait for the lock, before taking a slot
+// The job builds from source and releases it when finished; it continues the trace in parent but is not cancelled with it
+// Returns errShuttingDown once the registry has started draining
+func (jr *jobRegistry) start(parent context.Context, jobType string, caller string, parameters map[string]string, source buildSource, run func(ctx context.Context) error) (job, error) {
+	// Only the names of build args are recorded, since their values may be credentials
+	buildArgs := []string{}
+	for name := range source.buildArgs {
+		buildArgs = append(buildArgs, name)
+	}
+	sort.Strings(buildArgs)
+	// Extra tags are pushed along with the tag, so they are protected and locked the same way
+	extraTags := []string{}
+	if source.inventory != nil && (jobType == jobTypeBaseImages || parameters["images"] != "") {
+		var images []string
+		if parameters["images"] != "" {
+			images = strings.Split(parameters["images"], ",")
+		}
+		extraTags = source.inventory.GetExtraTags(images)
+	}
+	for name, value := range map[string]string{"workspace": source.workspace, "ref": source.ref, "commit": source.commit, "profile": source.profile, "build_args": strings.Join(buildArgs, ","), "extra_tags": strings.Join(extraTags, ",")} {
+		if _, exists := parameters[name]; !exists && value != "" {
+			parameters[name] = value
+		}
+	}
+	j := &job{
+		ID:         newJobID(),
+		Type:       jobType,
+		Status:     jobStatusQueued,
+		CreatedBy:  caller,
+		Parameters: parameters,
+		Approval:   getRequiredApproval(caller, parameters, source),
+		CreatedAt:  time.Now().UTC(),
+		log:        newJobLog(),
+	}
+	if j.Approval != nil {
+		j.Status = jobStatusPendingApproval
+		j.decided = make(chan struct{})
+	}
+	ctx, cancel := context.WithCancel(tracing.ContextWithSpanContext(context.Background(), tracing.SpanContextFromContext(parent)))
+
+	jr.mutex.Lock()
+	if jr.draining {
+		jr.mutex.Unlock()
+		cancel()
+		source.release()
+		return job{}, errShuttingDown
+	}
+	jr.jobs[j.ID] = j
+	jr.order = append(jr.order, j.ID)
+	jr.cancels[j.ID] = cancel
+	jr.running.Add(1)
+	jr.prune()
+	snapshot := *j
+	slots := jr.slots
+	jr.mutex.Unlock()
+	recordAuditJob(parent, snapshot)
+
+	if j.Approval != nil {
+		if j.Approval.Profile != "" && j.Approval.Pattern != "" {
+			j.log.Write([]byte("Waiting for approval to build protected tag " + j.Approval.Tag + " with protected profile " + j.Approval.Profile + "\n"))
+		} else if j.Approval.Profile != "" {
+			j.log.Write([]byte("Waiting for approval to build with protected profile " + j.Approval.Profile + "\n"))
+		} else {
+			j.log.Write([]byte("Waiting for approval to build protected tag " + j.Approval.Tag + "\n"))
+		}
+		webhooks.notify(webhookEventJobPendingApproval, snapshot, nil)
+		logger.WithFields(logrus.Fields{
+			"job_id":   j.ID,
+			"job_type": jobType,
+			"caller":   caller,
+			"tag":      j.Approval.Tag,
+		}).Info("Job waiting for approval")
+	} else {
+		logger.WithFields(logrus.Fields{
+			"job_id":   j.ID,
+			"job_type": jobType,
+			"caller":   caller,
+		}).Info("Job queued")
+	}
+
+	go func() {
+		defer jr.running.Done()
+		defer source.release()
+
+		err := jr.awaitApproval(ctx, j)
+		// The lock is taken before the slot so a job waiting on another instance does not keep others on this one from running
+		lockCtx := ctx
+		if err == nil {
+			waiting := func() { jr.setStatus(j, jobStatusWaitingForLock) }
+			var locked context.Context
+			var unlock func()
+			if locked, unlock, err = buildLocks.acquireTags(ctx, source, getBuildLockTags(j.Parameters), j.ID, j.log, waiting); err == nil {
+				defer unlock()
+				lockCtx = locked
+				jr.setStatus(j, jobStatusQueued)
+			}
+		}
+		if err == nil {
+			if jr.acquireSlot(lockCtx, slots) {
+				defer jr.releaseSlot(slots)
+			} else {
+				err = dockerbuild.ErrBuildCancelled
+			}
+		}
+		if err == nil {
+			jr.mutex.Lock()
+			started := time.Now().UTC()
+			j.Status = jobStatusRunning
+			j.StartedAt = &started
+			current := *j
+			jr.mutex.Unlock()
+			webhooks.notify(webhookEventJobStarted, current, nil)
+			logger.WithFields(logrus.Fields{
+				"job_id":   j.ID,
+				"job_type": jobType,
+				"caller":   caller,
+			}).Info("Job started")
+
+			runCtx, span := tracing.Start(lockCtx, "job",
+				tracing.String("job.id", j.ID),
+				tracing.String("job.type", jobType),
+				tracing.String("caller", caller),
+			)
+			runCtx = context.WithValue(runCtx, jobIDContextKey{}, j.ID)
+			runCtx = dockerbuild.WithInventory(runCtx, source.inventory)
+			runCtx = dockerbuild.WithLogOutput(runCtx, j.log)
+			if len(source.buildArgs) > 0 {
+				runCtx = dockerbuild.WithBuildArgs(runCtx, source.buildArgs)
+			}
+			runCtx = dockerbuild.WithImageResultHandler(runCtx, func(result dockerbuild.ImageResult) {
+				jr.mutex.Lock()
+				j.Images = append(j.Images, result)
+				current := *j
+				jr.mutex.Unlock()
+				if result.Status == dockerbuild.ImageStatusFailed {
+					webhooks.notify(webhookEventImageFailed, current, &result)
+				}
+			})
+			err = run(runCtx)
+			if lockCtx.Err() != nil && ctx.Err() == nil {
+				err = errBuildLockLost
+			}
+			span.End(err)
+		} else if lockCtx.Err() != nil && ctx.Err() == nil {
+			// Lost while waiting for a slot
+			err = errBuildLockLost
+		}
+
+		jr.mutex.Lock()
+		finished := time.Now().UTC()
+		j.FinishedAt = &finished
+		switch {
+		case err == errJobRejected:
+			j.Status = jobStatusRejected
+		case err == dockerbuild.ErrBuildCancelled:
+			j.Status = jobStatusCancelled
+			j.Error = err.Error()
+		case err != nil:
+			j.Status = jobStatusFailed
+			j.Error = err.Error()
+		default:
+			j.Status = jobStatusSucceeded
+		}
+		delete(jr.cancels, j.ID)
+		jobsTotal.Inc(jobType, j.Status)
+		if j.StartedAt != nil {
+			jobDuration.Observe(finished.Sub(*j.StartedAt).Seconds(), jobType, j.Status)
+		}
+		current := *j
+		jr.mutex.Unlock()
+		cancel()
+		j.log.close()
+		webhooks.notify(webhookEventJobFinished, current, nil)
+		recordAuditJobFinished(current)
+
+		logger.WithFields(logrus.Fields{
+			"job_id":     j.ID,
+			"job_type":   jobType,
+			"job_status": current.Status,
+			"caller":     caller,
+		}).Info("Job finished")
+	}()
+
+	return snapshot, nil
+}
+
+// getJobID returns the ID of the job running with ctx
+func getJobID(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDContextKey{}).(string)
+	return id
+}
+
+// awaitApproval waits until a job building a protected tag is approved
+// Returns errJobRejected if it is rejected, or ErrBuildCancelled if it is cancelled first
+func (jr *jobRegistry) awaitApproval(ctx context.Context, j *job) error {
+	if j.decided == nil {
+		return nil
+	}
+	select {
+	case <-j.decided:
+	case <-ctx.Done():
+		return dockerbuild.ErrBuildCancelled
+	}
+	jr.mutex.RLock()
+	defer jr.mutex.RUnlock()
+	if j.Approval.Status == approvalStatusRejected {
+		return errJobRejected
+	}
+	return nil
+}
+
+// setStatus updates the status of a job that has not started running
+func (jr *jobRegistry) setStatus(j *job, status string) {
+	jr.mutex.Lock()
+	defer jr.mutex.Unlock()
+	j.Status = status
+}
+
+// acquireSlot waits for a free slot; returns false if the job is cancelled while queued
+func (jr *jobRegistry) acquireSlot(ctx context.Context, slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (jr *jobRegistry) releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// countByStatus returns the number of retained jobs with the given status
+func (jr *jobRegistry) countByStatus(status string) int {
+	jr.mutex.RLock()
+	defer jr.mutex.RUnlock()
+	count := 0
+	for _, j := range jr.jobs {
+		if j.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// drain stops accepting new jobs and waits up to timeout for running jobs to finish
+// Jobs waiting for approval are cancelled immediately; jobs still running after the timeout are cancelled and waited on until they stop
+func (jr *jobRegistry) drain(timeout time.Duration) {
+	jr.mutex.Lock()
+	jr.draining = true
+	for id, j := range jr.jobs {
+		if j.Status == jobStatusPendingApproval {
+			jr.cancels[id]()
+		}
+	}
+	running := len(jr.cancels)
+	jr.mutex.Unlock()
+
+	logger.WithFields(logrus.Fields{
+		"running_jobs": running,
+		"timeout":      timeout.String(),
+	}).Info("Waiting for running jobs to finish")
+
+	finished := make(chan struct{})
+	go func() {
+		jr.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return
+	case <-time.After(timeout):
+	}
+
+	jr.mutex.Lock()
+	for id, cancel := range jr.cancels {
+		logger.WithFields(logrus.Fields{
+			"job_id": id,
+		}).Warn("Cancelling job")
+		cancel()
+	}
+	jr.mutex.Unlock()
+	<-finished
+}
+
+// isDraining reports whether the registry has stopped accepting jobs
+func (jr *jobRegistry) isDraining() bool {
+	jr.mutex.RLock()
+	defer jr.mutex.RUnlock()
+	return jr.draining
+}
+
+// get returns a copy of the job with the given ID
+func (jr *jobRegistry) get(id string) (job, bool) {
+	jr.mutex.RLock()
+	defer jr.mutex.RUnlock()
+	j, exists := jr.jobs[id]
+	if !exists {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// list returns copies of all retained jobs, newest first
+func (jr *jobRegistry) list() []job {
+	jr.mutex.RLock()
+	defer jr.mutex.RUnlock()
+	l := make([]job, 0, len(jr.order))
+	for i := len(jr.order) - 1; i >= 0; i-- {
+		l = append(l, *jr.jobs[jr.order[i]])
+	}
+	return l
+}
+
+// prune drops the oldest finished jobs once the registry grows too large; the caller must hold the lock
+func (jr *jobRegistry) prune() {
+	excess := len(jr.order) - maxRetainedJobs
+	if excess <= 0 {
+		return
+	}
+	retained := jr.order[:0]
+	for _, id := range jr.order {
+		if excess > 0 && jr.jobs[id].FinishedAt != nil {
+			delete(jr.jobs, id)
+			excess--
+			continue
+		}
+		retained = append(retained, id)
+	}
+	jr.order = retained
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logger.Panic(err)
+	}
+	return hex.EncodeToString(b)
+}
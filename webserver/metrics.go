@@ -0,0 +1,79 @@
+package webserver
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/container-factory/metrics"
+)
+
+var jobsTotal = metrics.NewCounterVec(
+	"container_factory_jobs_total",
+	"Jobs finished by the web server by type and final status",
+	"type", "status",
+)
+
+var jobDuration = metrics.NewHistogramVec(
+	"container_factory_job_duration_seconds",
+	"Time jobs spent running, excluding time queued",
+	metrics.DurationBuckets,
+	"type", "status",
+)
+
+func init() {
+	metrics.NewGaugeFunc(
+		"container_factory_jobs_queued",
+		"Jobs waiting for a free slot",
+		func() float64 { return float64(jobs.countByStatus(jobStatusQueued)) },
+	)
+	metrics.NewGaugeFunc(
+		"container_factory_jobs_waiting_for_lock",
+		"Jobs waiting for the build lock of their tag held by another instance",
+		func() float64 { return float64(jobs.countByStatus(jobStatusWaitingForLock)) },
+	)
+	metrics.NewGaugeFunc(
+		"container_factory_jobs_pending_approval",
+		"Jobs building a protected tag waiting for approval",
+		func() float64 { return float64(jobs.countByStatus(jobStatusPendingApproval)) },
+	)
+	metrics.NewGaugeFunc(
+		"container_factory_jobs_running",
+		"Jobs currently running",
+		func() float64 { return float64(jobs.countByStatus(jobStatusRunning)) },
+	)
+	metrics.NewGaugeFunc(
+		"container_factory_inventory_base_images",
+		"Buildable base images in the inventory",
+		func() float64 {
+			buildableImages, _ := dockerbuild.GetBaseImageHeirarchy()
+			return float64(countImages(buildableImages))
+		},
+	)
+	metrics.NewGaugeFunc(
+		"container_factory_inventory_orphaned_images",
+		"Base images whose parent is not in the inventory",
+		func() float64 {
+			_, orphanedImages := dockerbuild.GetBaseImageHeirarchy()
+			return float64(len(orphanedImages))
+		},
+	)
+	metrics.NewGaugeFunc(
+		"container_factory_inventory_deployments",
+		"Deployments in the inventory",
+		func() float64 { return float64(len(dockerbuild.GetDeployments())) },
+	)
+}
+
+func addMetricsRoutes() {
+	handler := metrics.Handler()
+	ginEngine.GET("/metrics", requireScope(scopeRead), func(c *gin.Context) { handler.ServeHTTP(c.Writer, c.Request) })
+}
+
+// countImages returns the number of images in the heirarchy, including all descendants
+func countImages(images []dockerbuild.DockerBuildableImage) int {
+	count := len(images)
+	for _, i := range images {
+		count += countImages(i.Children)
+	}
+	return count
+}
@@ -0,0 +1,628 @@
+package webserver
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"go.mikenewswanger.com/container-factory/agent"
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+// openAPIObject is a node of the OpenAPI document
+type openAPIObject map[string]interface{}
+
+func addOpenAPIRoutes() {
+	ginEngine.GET("/api/openapi.json", func(c *gin.Context) { renderOpenAPI(c) })
+}
+
+// renderOpenAPI serves the OpenAPI 3 description of every route; it describes no data, so no authentication is needed
+func renderOpenAPI(c *gin.Context) {
+	c.JSON(200, getOpenAPIDocument())
+}
+
+func getOpenAPIDocument() openAPIObject {
+	paths := openAPIObject{
+		"/healthz": openAPIObject{
+			"get": apiOperation("getHealth", "Report that the process is up", "", nil, nil, openAPIObject{
+				"200": apiJSON("The process is up", apiObject(openAPIObject{"status": apiString("")})),
+			}),
+		},
+		"/readyz": openAPIObject{
+			"get": apiOperation("getReadiness", "Report whether the server can accept build jobs", "", nil, nil, openAPIObject{
+				"200": apiJSON("Ready", apiSchema("Readiness")),
+				"503": apiJSON("Not ready", apiSchema("Readiness")),
+			}),
+		},
+		"/version": openAPIObject{
+			"get": apiOperation("getVersion", "Report the version of the server", "", nil, nil, openAPIObject{
+				"200": apiJSON("Version", apiObject(openAPIObject{"version": apiString(""), "go_version": apiString("")})),
+			}),
+		},
+		"/metrics": openAPIObject{
+			"get": apiOperation("getMetrics", "Prometheus metrics", scopeRead, nil, nil, openAPIObject{
+				"200": apiText("Metrics in the Prometheus text format"),
+			}),
+		},
+		"/api/openapi.json": openAPIObject{
+			"get": apiOperation("getOpenAPI", "This document", "", nil, nil, openAPIObject{
+				"200": apiJSON("OpenAPI document", openAPIObject{"type": "object"}),
+			}),
+		},
+
+		"/api/v2/base-images": openAPIObject{
+			"get": apiOperation("listBaseImages", "List the base image hierarchy", scopeRead, nil, nil, openAPIObject{
+				"200": apiJSON("Base images", apiSchema("BaseImageHierarchy")),
+			}),
+		},
+		"/api/v2/base-images/builds": openAPIObject{
+			"post": apiOperation("buildBaseImages", "Start a job building base images", scopeBuildBase, nil, apiRequestBody(apiSchema("BaseImagesBuildRequest")), openAPIObject{
+				"202": apiJobAccepted(),
+				"400": apiJSON("The profile cannot be built by the server", apiSchema("Error")),
+				"404": apiJSON("An image, ref or profile does not exist", apiSchema("Error")),
+				"422": apiJSON("The request failed validation", apiSchema("Error")),
+				"503": apiJSON("The server is shutting down or the workspace is unavailable", apiSchema("Error")),
+			}),
+		},
+		"/api/v2/deployments": openAPIObject{
+			"get": apiOperation("listDeployments", "List deployments", scopeRead, nil, nil, openAPIObject{
+				"200": apiJSON("Deployments", apiObject(openAPIObject{"deployments": apiArray(apiString(""))})),
+			}),
+		},
+		"/api/v2/deployments/builds": openAPIObject{
+			"post": apiOperation("buildDeployment", "Start a job building a deployment", scopeBuildDeployment, nil, apiRequestBody(apiSchema("DeploymentBuildRequest")), openAPIObject{
+				"202": apiJobAccepted(),
+				"400": apiJSON("The profile cannot be built by the server", apiSchema("Error")),
+				"404": apiJSON("The deployment, ref or profile does not exist", apiSchema("Error")),
+				"422": apiJSON("The request failed validation", apiSchema("Error")),
+				"503": apiJSON("The server is shutting down or the workspace is unavailable", apiSchema("Error")),
+			}),
+		},
+		"/api/v2/jobs": openAPIObject{
+			"get": apiOperation("listJobs", "List recent jobs of the workspaces the caller may read, newest first", scopeRead, nil, nil, openAPIObject{
+				"200": apiJSON("Jobs", apiObject(openAPIObject{"jobs": apiArray(apiSchema("Job"))})),
+			}),
+		},
+		"/api/v2/jobs/{id}": openAPIObject{
+			"get": apiOperation("getJob", "Get a job", scopeRead, []openAPIObject{apiPathParameter("id", "Job ID")}, nil, openAPIObject{
+				"200": apiJSON("The job", apiObject(openAPIObject{"job": apiSchema("Job")})),
+				"404": apiJSON("The job does not exist or belongs to a workspace the caller may not read", apiSchema("Error")),
+			}),
+		},
+		"/api/v2/jobs/{id}/logs": openAPIObject{
+			"get": apiOperation("getJobLogs", "Get the output of a job", scopeRead, []openAPIObject{
+				apiPathParameter("id", "Job ID"),
+				apiQueryParameter("follow", "Stream the output until the job finishes", apiBoolean()),
+			}, nil, openAPIObject{
+				"200": apiText("Output of the job"),
+				"404": apiJSON("The job does not exist or belongs to a workspace the caller may not read", apiSchema("Error")),
+			}),
+		},
+		"/api/v2/jobs/{id}/approve": openAPIObject{
+			"post": apiOperation("approveJob", "Approve a job building a protected tag so it runs", scopeApproveBuilds, []openAPIObject{apiPathParameter("id", "Job ID")}, apiApprovalRequestBody(), apiApprovalResponses()),
+		},
+		"/api/v2/jobs/{id}/reject": openAPIObject{
+			"post": apiOperation("rejectJob", "Reject a job building a protected tag", scopeApproveBuilds, []openAPIObject{apiPathParameter("id", "Job ID")}, apiApprovalRequestBody(), apiApprovalResponses()),
+		},
+		"/api/v2/webhooks/deliveries": openAPIObject{
+			"get": apiOperation("listWebhookDeliveries", "List recent webhook deliveries", scopeRead, []openAPIObject{
+				apiQueryParameter("job_id", "Only deliveries for this job", apiString("")),
+			}, nil, openAPIObject{
+				"200": apiJSON("Deliveries", apiObject(openAPIObject{"deliveries": apiArray(apiSchema("WebhookDelivery"))})),
+			}),
+		},
+		"/api/v2/whoami": openAPIObject{
+			"get": apiOperation("whoAmI", "Identify the caller and its scopes", scopeRead, nil, nil, openAPIObject{
+				"200": apiJSON("The caller", apiObject(openAPIObject{
+					"caller":                 apiString(""),
+					"scopes":                 apiArray(apiString("")),
+					"authentication_enabled": apiBoolean(),
+				})),
+			}),
+		},
+
+		"/api/v1/hooks/git": openAPIObject{
+			"post": apiOperation("receiveGitPush", "Receive a push webhook from GitHub, GitLab or Gitea", "", nil, apiRequestBody(openAPIObject{"type": "object"}), openAPIObject{
+				"200": apiJSON("The push was ignored", apiObject(openAPIObject{"status": apiString(""), "reason": apiString("")})),
+				"202": apiJobAccepted(),
+				"400": apiJSON("The body is not a push event", apiSchema("Error")),
+				"401": apiJSON("The signature or token is invalid", apiSchema("Error")),
+				"422": apiJSON("The branch maps to an invalid tag", apiSchema("Error")),
+				"503": apiJSON("The server is shutting down", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/workspaces": openAPIObject{
+			"get": apiOperation("listWorkspaces", "List named workspaces", scopeRead, nil, nil, openAPIObject{
+				"200": apiJSON("Workspace names", apiObject(openAPIObject{"workspaces": apiArray(apiString(""))})),
+			}),
+		},
+		"/api/v1/schedules": openAPIObject{
+			"get": apiOperation("listSchedules", "List schedules", scopeRead, nil, nil, openAPIObject{
+				"200": apiJSON("Schedules", apiObject(openAPIObject{"schedules": apiArray(apiSchema("Schedule"))})),
+			}),
+		},
+		"/api/v1/schedules/{name}": openAPIObject{
+			"get": apiOperation("getSchedule", "Get a schedule", scopeRead, []openAPIObject{apiPathParameter("name", "Schedule name")}, nil, apiScheduleResponses()),
+		},
+		"/api/v1/schedules/{name}/pause": openAPIObject{
+			"post": apiOperation("pauseSchedule", "Stop starting scheduled runs", scopeManageSchedules, []openAPIObject{apiPathParameter("name", "Schedule name")}, nil, apiScheduleResponses()),
+		},
+		"/api/v1/schedules/{name}/resume": openAPIObject{
+			"post": apiOperation("resumeSchedule", "Start scheduled runs again", scopeManageSchedules, []openAPIObject{apiPathParameter("name", "Schedule name")}, nil, apiScheduleResponses()),
+		},
+		"/api/v1/schedules/{name}/run": openAPIObject{
+			"post": apiOperation("runSchedule", "Start the build of a schedule now", scopeManageSchedules, []openAPIObject{apiPathParameter("name", "Schedule name")}, nil, openAPIObject{
+				"202": apiJobAccepted(),
+				"404": apiJSON("The schedule does not exist", apiSchema("Error")),
+				"422": apiJSON("A deployment of the schedule does not exist", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/upstream-images": openAPIObject{
+			"get": apiOperation("listUpstreamImages", "List the digests recorded for external images", scopeRead, nil, nil, openAPIObject{
+				"200": apiJSON("Upstream images", apiObject(openAPIObject{"upstream_images": apiArray(apiSchema("UpstreamImage"))})),
+			}),
+		},
+		"/api/v1/upstream-images/poll": openAPIObject{
+			"post": apiOperation("pollUpstreamImages", "Poll external images now", scopeBuildBase, nil, nil, openAPIObject{
+				"200": apiJSON("No image changed", apiObject(openAPIObject{"upstream_images": apiArray(apiSchema("UpstreamImage"))})),
+				"202": apiJobAccepted(),
+			}),
+		},
+		"/api/v1/audit": openAPIObject{
+			"get": apiOperation("listAuditEntries", "List audit log entries, newest first", scopeReadAudit, []openAPIObject{
+				apiQueryParameter("since", "Only entries at or after this time", apiDateTime()),
+				apiQueryParameter("until", "Only entries before this time", apiDateTime()),
+				apiQueryParameter("caller", "Only entries of this caller", apiString("")),
+				apiQueryParameter("action", "Only entries of this action, i.e. base-images.build", apiString("")),
+				apiQueryParameter("job_id", "Only entries of this job", apiString("")),
+				apiQueryParameter("limit", "Maximum number of entries; 100 by default, at most 1000", openAPIObject{"type": "integer"}),
+			}, nil, openAPIObject{
+				"200": apiJSON("Audit entries", apiObject(openAPIObject{"entries": apiArray(apiSchema("AuditEntry"))})),
+				"400": apiJSON("A filter is invalid", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/agents": openAPIObject{
+			"get": apiOperation("listAgents", "List connected build agents and the number of tasks waiting for one", scopeRead, nil, nil, openAPIObject{
+				"200": apiJSON("Build agents", apiObject(openAPIObject{
+					"agents":       apiArray(apiSchema("BuildAgent")),
+					"queued_tasks": openAPIObject{"type": "integer"},
+				})),
+			}),
+			"post": apiOperation("registerAgent", "Register a build agent", scopeAgent, nil, apiRequestBody(apiSchema("AgentRegistration")), openAPIObject{
+				"201": apiJSON("The registered agent", apiObject(openAPIObject{
+					"agent":              apiSchema("BuildAgent"),
+					"heartbeat_interval": apiString("Interval between heartbeats, i.e. 10s"),
+				})),
+				"400": apiJSON("The body is not a registration", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/agents/{id}": openAPIObject{
+			"delete": apiOperation("deregisterAgent", "Remove a stopping build agent and reassign its tasks", scopeAgent, []openAPIObject{apiPathParameter("id", "Agent ID")}, nil, openAPIObject{
+				"204": openAPIObject{"description": "The agent was removed"},
+				"404": apiJSON("The agent is not registered", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/agents/{id}/heartbeat": openAPIObject{
+			"post": apiOperation("sendAgentHeartbeat", "Report a build agent alive with the tasks it is running", scopeAgent, []openAPIObject{apiPathParameter("id", "Agent ID")}, apiRequestBody(apiObject(openAPIObject{"running": apiArray(apiString("Task ID"))})), openAPIObject{
+				"200": apiJSON("Running tasks the agent should stop", apiObject(openAPIObject{"cancel": apiArray(apiString("Task ID"))})),
+				"404": apiJSON("The agent is not registered", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/agents/{id}/poll": openAPIObject{
+			"post": apiOperation("pollAgentTasks", "Wait for a task to be assigned to a build agent", scopeAgent, []openAPIObject{apiPathParameter("id", "Agent ID")}, nil, openAPIObject{
+				"200": apiJSON("The assigned task", apiObject(openAPIObject{"task": apiSchema("AgentTask")})),
+				"204": openAPIObject{"description": "No task was assigned before the poll timed out"},
+				"404": apiJSON("The agent is not registered", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/agents/{id}/tasks/{task}/source": openAPIObject{
+			"get": apiOperation("getAgentTaskSource", "Download the build assets of a task", scopeAgent, []openAPIObject{apiPathParameter("id", "Agent ID"), apiPathParameter("task", "Task ID")}, nil, openAPIObject{
+				"200": openAPIObject{
+					"description": "Gzipped tarball of the build assets",
+					"content":     openAPIObject{"application/gzip": openAPIObject{"schema": openAPIObject{"type": "string", "format": "binary"}}},
+				},
+				"404": apiJSON("The agent or task does not exist", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/agents/{id}/tasks/{task}/logs": openAPIObject{
+			"post": apiOperation("sendAgentTaskLogs", "Stream the build output of a task into the job log", scopeAgent, []openAPIObject{apiPathParameter("id", "Agent ID"), apiPathParameter("task", "Task ID")}, openAPIObject{
+				"content": openAPIObject{"text/plain": openAPIObject{"schema": apiString("")}},
+			}, openAPIObject{
+				"204": openAPIObject{"description": "The stream ended"},
+				"404": apiJSON("The agent or task does not exist", apiSchema("Error")),
+			}),
+		},
+		"/api/v1/agents/{id}/tasks/{task}/result": openAPIObject{
+			"post": apiOperation("sendAgentTaskResult", "Report the outcome of a task", scopeAgent, []openAPIObject{apiPathParameter("id", "Agent ID"), apiPathParameter("task", "Task ID")}, apiRequestBody(apiObject(openAPIObject{
+				"status": openAPIObject{"type": "string", "enum": []string{agent.TaskStatusSucceeded, agent.TaskStatusFailed}},
+				"image":  apiSchema("ImageResult"),
+				"error":  apiString(""),
+			}, "status")), openAPIObject{
+				"204": openAPIObject{"description": "The result was recorded"},
+				"400": apiJSON("The body is not a task result", apiSchema("Error")),
+				"404": apiJSON("The agent or task does not exist", apiSchema("Error")),
+			}),
+		},
+	}
+	addV1InventoryPaths(paths, "/api/v1", "", nil)
+	addV1InventoryPaths(paths, "/api/v1/workspaces/{workspace}", "Workspace", []openAPIObject{apiPathParameter("workspace", "Workspace name")})
+
+	return openAPIObject{
+		"openapi": "3.0.3",
+		"info": openAPIObject{
+			"title":       "container-factory",
+			"description": "Builds base image hierarchies and deployments with docker.  Operations list the scope their token needs in x-required-scope.",
+			"version":     serverVersion,
+		},
+		"paths": paths,
+		"components": openAPIObject{
+			"securitySchemes": openAPIObject{
+				"bearerAuth": openAPIObject{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+			"schemas": getOpenAPISchemas(),
+		},
+	}
+}
+
+// addV1InventoryPaths describes the v1 inventory routes served under prefix
+func addV1InventoryPaths(paths openAPIObject, prefix string, idSuffix string, parameters []openAPIObject) {
+	withParameters := func(p ...openAPIObject) []openAPIObject {
+		return append(append([]openAPIObject{}, parameters...), p...)
+	}
+	listResponses := func(description string, schema openAPIObject) openAPIObject {
+		return openAPIObject{
+			"200": openAPIObject{
+				"description": description,
+				"content": openAPIObject{
+					"text/plain":         openAPIObject{"schema": apiString("")},
+					"application/json":   openAPIObject{"schema": schema},
+					"application/x-yaml": openAPIObject{"schema": schema},
+				},
+			},
+		}
+	}
+	buildResponses := openAPIObject{
+		"200": apiText("The build started"),
+		"400": apiText("The tag is missing"),
+		"404": apiText("The deployment or ref does not exist"),
+		"503": apiText("The server is shutting down or the workspace is unavailable"),
+	}
+	format := apiQueryParameter("format", "Response format; plain text when omitted", openAPIObject{"type": "string", "enum": []string{"json", "yaml"}})
+	tag := apiQueryParameter("tag", "Tag to build; required unless the workspace has a default tag", apiString(""))
+	ref := apiQueryParameter("ref", "Branch, tag or commit to build from a git workspace", apiString(""))
+
+	paths[prefix+"/base-images/build"] = openAPIObject{
+		"get": apiOperation("buildBaseImagesV1"+idSuffix, "Start a job building every base image", scopeBuildBase, withParameters(
+			tag, ref, apiQueryParameter("force-rebuild", "Rebuild without the docker cache when set", apiString("")),
+		), nil, buildResponses),
+	}
+	paths[prefix+"/base-images/list"] = openAPIObject{
+		"get": apiOperation("listBaseImagesV1"+idSuffix, "List the base image hierarchy", scopeRead, withParameters(format), nil, listResponses("Base images", apiSchema("BaseImageHierarchy"))),
+	}
+	paths[prefix+"/deployments/build"] = openAPIObject{
+		"get": apiOperation("buildDeploymentV1"+idSuffix, "Start a job building a deployment", scopeBuildDeployment, withParameters(
+			apiQueryParameter("name", "Deployment to build", apiString("")),
+			tag, ref,
+			apiQueryParameter("deployment-tag", "Tag of the deployment image", apiString("")),
+		), nil, buildResponses),
+	}
+	paths[prefix+"/deployments/list"] = openAPIObject{
+		"get": apiOperation("listDeploymentsV1"+idSuffix, "List deployments", scopeRead, withParameters(format), nil, listResponses("Deployments", apiObject(openAPIObject{"deployments": apiArray(apiString(""))}))),
+	}
+	paths[prefix+"/inventory/reload"] = openAPIObject{
+		"post": apiOperation("reloadInventory"+idSuffix, "Reload the inventory from the build assets", scopeBuildBase, withParameters(), nil, openAPIObject{
+			"200": apiJSON("The inventory was reloaded", apiObject(openAPIObject{"status": apiString(""), "deployments": openAPIObject{"type": "integer"}})),
+			"500": apiJSON("The inventory could not be loaded; the previous inventory is kept", apiSchema("Error")),
+		}),
+	}
+}
+
+func getOpenAPISchemas() openAPIObject {
+	return openAPIObject{
+		"Error": apiObject(openAPIObject{
+			"error": apiObject(openAPIObject{
+				"code":    apiString("Machine readable error code, i.e. validation_failed"),
+				"message": apiString(""),
+				"fields":  openAPIObject{"type": "object", "additionalProperties": apiString("")},
+			}),
+		}),
+		"Readiness": apiObject(openAPIObject{
+			"ready":  apiBoolean(),
+			"checks": openAPIObject{"type": "object", "additionalProperties": apiString("")},
+		}),
+		"BaseImage": apiObject(openAPIObject{
+			"image_name": apiString(""),
+			"children":   apiArray(apiSchema("BaseImage")),
+			"metadata":   apiSchema("ImageMetadata"),
+		}),
+		"ImageMetadata": apiObject(openAPIObject{
+			"description":          apiString(""),
+			"owners":               apiArray(apiString("")),
+			"build_args":           openAPIObject{"type": "object", "additionalProperties": apiString("")},
+			"propagate_build_args": apiArray(apiString("Build arg also passed to every descendant of the image")),
+			"labels":               openAPIObject{"type": "object", "additionalProperties": apiString("")},
+			"extra_tags":           apiArray(apiString("Tag the image is also pushed as")),
+			"platforms":            apiArray(apiString("i.e. linux/amd64; at most one")),
+			"timeout":              apiString("Longest the build of the image may run, i.e. 20m"),
+			"cache_policy":         openAPIObject{"type": "string", "enum": []string{dockerbuild.CachePolicyDefault, dockerbuild.CachePolicyNoCache, dockerbuild.CachePolicyPull}},
+			"disabled":             apiBoolean(),
+		}),
+		"OrphanedImage": apiObject(openAPIObject{
+			"image_name":        apiString(""),
+			"parent_image_name": apiString("Parent image that does not exist"),
+		}),
+		"BaseImageHierarchy": apiObject(openAPIObject{
+			"buildable_images": apiArray(apiSchema("BaseImage")),
+			"orphaned_images":  apiArray(apiSchema("OrphanedImage")),
+		}),
+		"BaseImagesBuildRequest": apiObject(openAPIObject{
+			"tag":           apiString("Required unless the profile has a tag template"),
+			"force_rebuild": apiBoolean(),
+			"images":        apiArray(apiString("Builds only these images and their descendants; every base image is built when empty")),
+			"ref":           apiString("Branch, tag or commit to build from a git workspace"),
+			"profile":       apiString("Profile of the workspace configuration to build with; its tag template is used when tag is not given"),
+			"build_args":    openAPIObject{"type": "object", "additionalProperties": apiString(""), "description": "Passed to every image as --build-arg, taking precedence over the build args of the profile"},
+		}),
+		"DeploymentBuildRequest": apiObject(openAPIObject{
+			"name":           apiString(""),
+			"tag":            apiString("Tag of the base images to build from; required unless the profile has a tag template"),
+			"deployment_tag": apiString(""),
+			"ref":            apiString("Branch, tag or commit to build from a git workspace"),
+			"profile":        apiString("Profile of the workspace configuration to build with"),
+			"build_args":     openAPIObject{"type": "object", "additionalProperties": apiString(""), "description": "Passed to the build as --build-arg, taking precedence over the build args of the profile"},
+		}, "name"),
+		"ImageResult": apiObject(openAPIObject{
+			"image_name":  apiString(""),
+			"reference":   apiString(""),
+			"status":      openAPIObject{"type": "string", "enum": []string{"succeeded", "failed"}},
+			"failed_step": apiString(""),
+			"digest":      apiString("Registry digest of the pushed image"),
+			"error":       apiString(""),
+		}),
+		"Job": apiObject(openAPIObject{
+			"id":          apiString(""),
+			"type":        apiString(""),
+			"status":      openAPIObject{"type": "string", "enum": []string{jobStatusPendingApproval, jobStatusQueued, jobStatusWaitingForLock, jobStatusRunning, jobStatusSucceeded, jobStatusFailed, jobStatusCancelled, jobStatusRejected}},
+			"created_by":  apiString(""),
+			"parameters":  openAPIObject{"type": "object", "additionalProperties": apiString("")},
+			"images":      apiArray(apiSchema("ImageResult")),
+			"approval":    apiSchema("JobApproval"),
+			"error":       apiString(""),
+			"created_at":  apiDateTime(),
+			"started_at":  apiDateTime(),
+			"finished_at": apiDateTime(),
+		}),
+		"JobApproval": apiObject(openAPIObject{
+			"tag":        apiString("Tag the job builds"),
+			"pattern":    apiString("Protected tag pattern matching the tag"),
+			"profile":    apiString("Protected profile the job builds with"),
+			"status":     openAPIObject{"type": "string", "enum": []string{approvalStatusPending, approvalStatusApproved, approvalStatusRejected}},
+			"decided_by": apiString(""),
+			"decided_at": apiDateTime(),
+			"comment":    apiString(""),
+		}),
+		"ApprovalRequest": apiObject(openAPIObject{
+			"comment": apiString(""),
+		}),
+		"WebhookDelivery": apiObject(openAPIObject{
+			"id":              apiString(""),
+			"webhook":         apiString(""),
+			"event":           apiString(""),
+			"job_id":          apiString(""),
+			"status":          apiString(""),
+			"attempts":        openAPIObject{"type": "integer"},
+			"response_status": openAPIObject{"type": "integer"},
+			"error":           apiString(""),
+			"created_at":      apiDateTime(),
+			"finished_at":     apiDateTime(),
+		}),
+		"Schedule": apiObject(openAPIObject{
+			"name":          apiString(""),
+			"cron":          apiString(""),
+			"workspace":     apiString(""),
+			"tag":           apiString(""),
+			"base_images":   apiBoolean(),
+			"images":        apiArray(apiString("")),
+			"deployments":   apiArray(apiString("")),
+			"force_rebuild": apiBoolean(),
+			"missed_runs":   openAPIObject{"type": "string", "enum": []string{missedRunsRunOnce, missedRunsSkip}},
+			"paused":        apiBoolean(),
+			"last_run":      apiDateTime(),
+			"last_job_id":   apiString(""),
+			"checked_at":    apiDateTime(),
+			"next_run":      apiDateTime(),
+		}),
+		"UpstreamImage": apiObject(openAPIObject{
+			"reference":      apiString(""),
+			"digest":         apiString("Digest the images were last built from"),
+			"pending_digest": apiString("New digest a rebuild was started for"),
+			"pending_job_id": apiString(""),
+			"checked_at":     apiDateTime(),
+			"changed_at":     apiDateTime(),
+			"images":         apiArray(apiString("Root images built FROM the reference")),
+			"error":          apiString(""),
+		}),
+		"AuditEntry": apiObject(openAPIObject{
+			"time":           apiDateTime(),
+			"action":         apiString("Route or event recorded, i.e. base-images.build or job.finished"),
+			"caller":         apiString(""),
+			"source_ip":      apiString(""),
+			"method":         apiString(""),
+			"path":           apiString(""),
+			"status":         openAPIObject{"type": "integer", "description": "HTTP status of the response; unset for job events"},
+			"workspace":      apiString(""),
+			"tag":            apiString(""),
+			"deployment_tag": apiString(""),
+			"selection":      apiArray(apiString("Image or deployment the build was limited to")),
+			"job_id":         apiString(""),
+			"pushed":         apiArray(apiString("Image pushed by a finished job, as reference@digest")),
+			"outcome":        apiString("succeeded, failed or denied for API calls; the job status for job events"),
+			"error":          apiString(""),
+		}),
+		"AgentRegistration": apiObject(openAPIObject{
+			"name":     apiString("Defaults to the caller"),
+			"platform": apiString("Platform the agent builds for, i.e. linux/amd64"),
+			"capacity": openAPIObject{"type": "integer"},
+			"version":  apiString(""),
+		}),
+		"BuildAgent": apiObject(openAPIObject{
+			"id":            apiString(""),
+			"name":          apiString(""),
+			"platform":      apiString(""),
+			"capacity":      openAPIObject{"type": "integer"},
+			"version":       apiString(""),
+			"registered_at": apiDateTime(),
+			"last_seen":     apiDateTime(),
+			"tasks":         apiArray(apiString("IDs of the tasks assigned to the agent")),
+		}),
+		"AgentTask": apiObject(openAPIObject{
+			"id":                 apiString(""),
+			"job_id":             apiString("Tasks of the same job share a build source"),
+			"type":               openAPIObject{"type": "string", "enum": []string{agent.TaskTypeBaseImage, agent.TaskTypeDeployment}},
+			"image":              apiString("Base image or deployment name"),
+			"tag":                apiString(""),
+			"deployment_tag":     apiString(""),
+			"registry_base_path": apiString(""),
+			"force_rebuild":      apiBoolean(),
+			"pull_base_images":   apiBoolean(),
+			"build_args":         openAPIObject{"type": "object", "additionalProperties": apiString("")},
+			"attempt":            openAPIObject{"type": "integer"},
+		}),
+	}
+}
+
+// apiOperation describes an operation; scope is empty for operations that never require a token
+func apiOperation(id string, summary string, scope string, parameters []openAPIObject, requestBody openAPIObject, responses openAPIObject) openAPIObject {
+	o := openAPIObject{
+		"operationId": id,
+		"summary":     summary,
+		"responses":   responses,
+	}
+	if len(parameters) > 0 {
+		o["parameters"] = parameters
+	}
+	if requestBody != nil {
+		o["requestBody"] = requestBody
+	}
+	if scope != "" {
+		o["security"] = []openAPIObject{{"bearerAuth": []string{}}}
+		o["x-required-scope"] = scope
+		responses["401"] = apiJSON("Authentication is enabled and the token is missing or invalid", apiSchema("Error"))
+		responses["403"] = apiJSON("The token is missing the required scope", apiSchema("Error"))
+	}
+	return o
+}
+
+func apiScheduleResponses() openAPIObject {
+	return openAPIObject{
+		"200": apiJSON("The schedule", apiObject(openAPIObject{"schedule": apiSchema("Schedule")})),
+		"404": apiJSON("The schedule does not exist", apiSchema("Error")),
+	}
+}
+
+// apiApprovalRequestBody describes the optional comment recorded with an approval or rejection
+func apiApprovalRequestBody() openAPIObject {
+	body := apiRequestBody(apiSchema("ApprovalRequest"))
+	body["required"] = false
+	return body
+}
+
+func apiApprovalResponses() openAPIObject {
+	return openAPIObject{
+		"200": apiJSON("The decided job", apiObject(openAPIObject{"job": apiSchema("Job")})),
+		"404": apiJSON("The job does not exist or belongs to a workspace where the caller may not approve builds", apiSchema("Error")),
+		"409": apiJSON("The job is not waiting for approval", apiSchema("Error")),
+	}
+}
+
+func apiJobAccepted() openAPIObject {
+	response := apiJSON("The job was started", apiObject(openAPIObject{
+		"job":      apiSchema("Job"),
+		"location": apiString("Path of the job"),
+	}))
+	response["headers"] = openAPIObject{
+		"Location": openAPIObject{"schema": apiString("Path of the job")},
+	}
+	return response
+}
+
+func apiRequestBody(schema openAPIObject) openAPIObject {
+	return openAPIObject{
+		"required": true,
+		"content": openAPIObject{
+			"application/json": openAPIObject{"schema": schema},
+		},
+	}
+}
+
+func apiJSON(description string, schema openAPIObject) openAPIObject {
+	return openAPIObject{
+		"description": description,
+		"content": openAPIObject{
+			"application/json": openAPIObject{"schema": schema},
+		},
+	}
+}
+
+func apiText(description string) openAPIObject {
+	return openAPIObject{
+		"description": description,
+		"content": openAPIObject{
+			"text/plain": openAPIObject{"schema": apiString("")},
+		},
+	}
+}
+
+func apiPathParameter(name string, description string) openAPIObject {
+	return openAPIObject{
+		"name":        name,
+		"in":          "path",
+		"required":    true,
+		"description": description,
+		"schema":      apiString(""),
+	}
+}
+
+func apiQueryParameter(name string, description string, schema openAPIObject) openAPIObject {
+	return openAPIObject{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      schema,
+	}
+}
+
+func apiSchema(name string) openAPIObject {
+	return openAPIObject{"$ref": "#/components/schemas/" + name}
+}
+
+func apiObject(properties openAPIObject, required ...string) openAPIObject {
+	o := openAPIObject{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		o["required"] = required
+	}
+	return o
+}
+
+func apiArray(items openAPIObject) openAPIObject {
+	return openAPIObject{"type": "array", "items": items}
+}
+
+func apiString(description string) openAPIObject {
+	if description == "" {
+		return openAPIObject{"type": "string"}
+	}
+	return openAPIObject{"type": "string", "description": description}
+}
+
+func apiBoolean() openAPIObject {
+	return openAPIObject{"type": "boolean"}
+}
+
+func apiDateTime() openAPIObject {
+	return openAPIObject{"type": "string", "format": "date-time"}
+}
@@ -0,0 +1,69 @@
+package webserver
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Routes serving the dashboard page rather than the API
+var undocumentedRoutes = map[string]bool{
+	"GET /":    true,
+	"GET /ui/": true,
+}
+
+var ginPathParameterRegex = regexp.MustCompile(":(\\w+)")
+
+// TestOpenAPIPathsMatchRoutes checks that every route is described by the OpenAPI document and every described operation is routed
+func TestOpenAPIPathsMatchRoutes(t *testing.T) {
+	// Optional features only add their routes when configured
+	previousEngine, previousGitHooks, previousAuditLog := ginEngine, gitHooks, auditLog
+	previousAgents, previousUpstream := buildAgents.config, upstreamImages.config
+	defer func() {
+		ginEngine, gitHooks, auditLog = previousEngine, previousGitHooks, previousAuditLog
+		buildAgents.config, upstreamImages.config = previousAgents, previousUpstream
+	}()
+	gin.SetMode(gin.TestMode)
+	ginEngine = gin.New()
+	gitHooks = &gitHooksConfig{}
+	auditLog = &auditLogFile{}
+	buildAgents.config = &agentsConfig{}
+	upstreamImages.config = &upstreamPollingConfig{}
+	addRoutes()
+
+	routed := map[string]bool{}
+	for _, route := range ginEngine.Routes() {
+		operation := route.Method + " " + ginPathParameterRegex.ReplaceAllString(route.Path, "{$1}")
+		if !undocumentedRoutes[operation] {
+			routed[operation] = true
+		}
+	}
+	documented := map[string]bool{}
+	for path, item := range getOpenAPIDocument()["paths"].(openAPIObject) {
+		for method := range item.(openAPIObject) {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	for _, operation := range getMissingOperations(routed, documented) {
+		t.Errorf("Route is not in the OpenAPI document: %s", operation)
+	}
+	for _, operation := range getMissingOperations(documented, routed) {
+		t.Errorf("OpenAPI operation has no route: %s", operation)
+	}
+}
+
+// getMissingOperations returns the operations in a that are not in b, sorted
+func getMissingOperations(a map[string]bool, b map[string]bool) []string {
+	missing := []string{}
+	for operation := range a {
+		if !b[operation] {
+			missing = append(missing, operation)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,69 @@
+package webserver
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+const (
+	errorCodeProfileNotFound = "profile_not_found"
+	errorCodeInvalidProfile  = "invalid_profile"
+)
+
+var (
+	errProfileDoesNotPush          = errors.New("Profile does not push its images; the server always pushes the images it builds")
+	errProtectedProfileWithoutAuth = errors.New("Profile is protected, which requires the server to authenticate callers with --auth-tokens-file")
+)
+
+// applyProfile selects a profile of the workspace configuration for the build and returns the tag to build
+// The profile's registry base path and build args replace those of the source; its tag template is used when tag is empty
+func (s *buildSource) applyProfile(name string, tag string) (string, error) {
+	if name == "" {
+		return tag, nil
+	}
+	profile, err := s.inventory.ProjectConfig().GetProfile(name)
+	if err != nil {
+		return "", err
+	}
+	if !profile.ShouldPush() {
+		return "", errProfileDoesNotPush
+	}
+	if profile.Protected && apiTokens == nil {
+		return "", errProtectedProfileWithoutAuth
+	}
+	if tag == "" {
+		if tag, err = profile.RenderTag(name, s.inventory.BaseDirectory()); err != nil {
+			return "", err
+		}
+		if tag != "" && !dockerTagRegex.MatchString(tag) {
+			return "", errors.New("Tag template of profile " + name + " gave an invalid tag: " + tag)
+		}
+	}
+	s.profile = name
+	s.protectedProfile = profile.Protected
+	s.buildArgs = profile.BuildArgs
+	if profile.RegistryBasePath != "" {
+		s.registryBasePath = profile.RegistryBasePath
+	}
+	return tag, nil
+}
+
+// renderProfileError reports why the profile of a build could not be applied
+func renderProfileError(c *gin.Context, name string, err error) {
+	if err == dockerbuild.ErrProfileNotFound {
+		renderAPIError(c, 404, errorCodeProfileNotFound, "Profile does not exist: "+name)
+		return
+	}
+	renderAPIError(c, 400, errorCodeInvalidProfile, err.Error())
+}
+
+// getProfileErrorStatus returns the HTTP status of an error applying a profile for the v1 API
+func getProfileErrorStatus(err error) int {
+	if err == dockerbuild.ErrProfileNotFound {
+		return 404
+	}
+	return 400
+}
@@ -7,37 +7,88 @@ import (
 )
 
 func addRoutes() {
-	ginEngine.GET("/api/v1/base-images/build", func(c *gin.Context) { buildBaseImages(c) })
-	ginEngine.GET("/api/v1/base-images/list", func(c *gin.Context) { renderBaseImagesList(c) })
-	ginEngine.GET("/api/v1/deployments/build", func(c *gin.Context) { buildDeployment(c) })
-	ginEngine.GET("/api/v1/deployments/list", func(c *gin.Context) { renderDeploymentsList(c) })
+	ginEngine.GET("/api/v1/base-images/build", audit("base-images.build"), requireScope(scopeBuildBase), func(c *gin.Context) { buildBaseImages(c) })
+	ginEngine.GET("/api/v1/base-images/list", requireScope(scopeRead), func(c *gin.Context) { renderBaseImagesList(c) })
+	ginEngine.GET("/api/v1/deployments/build", audit("deployment.build"), requireScope(scopeBuildDeployment), func(c *gin.Context) { buildDeployment(c) })
+	ginEngine.GET("/api/v1/deployments/list", requireScope(scopeRead), func(c *gin.Context) { renderDeploymentsList(c) })
+	ginEngine.POST("/api/v1/inventory/reload", audit("inventory.reload"), requireScope(scopeBuildBase), func(c *gin.Context) { reloadInventory(c) })
+
+	addHealthRoutes()
+	addMetricsRoutes()
+	addV2Routes()
+	addDashboardRoutes()
+	addGitHookRoutes()
+	addWorkspaceRoutes()
+	addScheduleRoutes()
+	addUpstreamImageRoutes()
+	addAgentRoutes()
+	addAuditRoutes()
+	addOpenAPIRoutes()
 }
 
 func buildBaseImages(c *gin.Context) {
+	ws := getWorkspace(c)
 	tag := c.Query("tag")
+	source, err := ws.prepareBuildSource(c.Request.Context(), c.Query("ref"))
+	if err != nil {
+		c.String(getBuildSourceErrorStatus(err), err.Error())
+		return
+	}
+	if tag, err = source.applyProfile(c.Query("profile"), tag); err != nil {
+		source.release()
+		c.String(getProfileErrorStatus(err), err.Error())
+		return
+	}
 	if tag == "" {
+		tag = ws.getDefaultTag(c.Query("ref"))
+	}
+	if tag == "" {
+		source.release()
 		c.String(400, "Tag is required for Web API calls")
 		return
 	}
+	if _, err := startBaseImagesJob(c.Request.Context(), getCaller(c), source, tag, nil, c.Query("force-rebuild") != ""); err != nil {
+		c.String(503, err.Error())
+		return
+	}
 	c.String(200, "Build process started")
-	go func(tag string, forceRebuild bool) {
-		dockerbuild.BuildBaseImages(registryBasePath, tag, forceRebuild, true)
-	}(tag, c.Query("force-rebuild") != "")
 }
 
 func buildDeployment(c *gin.Context) {
+	ws := getWorkspace(c)
 	tag := c.Query("tag")
+	source, err := ws.prepareBuildSource(c.Request.Context(), c.Query("ref"))
+	if err != nil {
+		c.String(getBuildSourceErrorStatus(err), err.Error())
+		return
+	}
+	if tag, err = source.applyProfile(c.Query("profile"), tag); err != nil {
+		source.release()
+		c.String(getProfileErrorStatus(err), err.Error())
+		return
+	}
+	if tag == "" {
+		tag = ws.getDefaultTag(c.Query("ref"))
+	}
 	if tag == "" {
+		source.release()
 		c.String(400, "Tag is required for Web API calls")
+		return
+	}
+	if !source.inventory.DeploymentExists(c.Query("name")) {
+		source.release()
+		c.String(404, "Deployment does not exist")
+		return
+	}
+	if _, err := startDeploymentJob(c.Request.Context(), getCaller(c), source, c.Query("name"), tag, c.Query("deployment-tag")); err != nil {
+		c.String(503, err.Error())
+		return
 	}
 	c.String(200, "Build process started")
-	go func(deploymentName string, tag string, deploymentTag string) {
-		dockerbuild.BuildDeployment(registryBasePath, deploymentName, tag, deploymentTag, true)
-	}(c.Query("name"), tag, c.Query("deployment-tag"))
 }
 
 func renderBaseImagesList(c *gin.Context) {
-	buildableImages, orphanedImages := dockerbuild.GetBaseImageHeirarchy()
+	buildableImages, orphanedImages := getWorkspace(c).getInventory().GetBaseImageHeirarchy()
 
 	switch c.Query("format") {
 	case "json":
@@ -65,7 +116,7 @@ func renderBaseImagesList(c *gin.Context) {
 }
 
 func renderDeploymentsList(c *gin.Context) {
-	deployments := dockerbuild.GetDeployments()
+	deployments := getWorkspace(c).getInventory().GetDeployments()
 
 	switch c.Query("format") {
 	case "json":
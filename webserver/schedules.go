@@ -0,0 +1,453 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	errorCodeScheduleNotFound = "schedule_not_found"
+
+	jobTypeSchedule = "schedule"
+	// Scheduled runs are created by the schedule name with this prefix
+	scheduleCallerPrefix = "schedule:"
+
+	missedRunsRunOnce = "run_once"
+	missedRunsSkip    = "skip"
+
+	schedulesStateFilename = "schedules.json"
+)
+
+// scheduleConfig describes a recurring build in the server config file
+type scheduleConfig struct {
+	Name string `json:"name"`
+	// Five field cron expression in the server's local time, or a macro such as @daily
+	Cron      string `json:"cron"`
+	Workspace string `json:"workspace"`
+	Tag       string `json:"tag"`
+	// Builds every base image; images limits the build to the subtrees of the listed images
+	BaseImages   bool     `json:"base_images"`
+	Images       []string `json:"images"`
+	Deployments  []string `json:"deployments"`
+	ForceRebuild bool     `json:"force_rebuild"`
+	// What to do when runs were missed while the server was down: run_once or skip
+	MissedRuns string `json:"missed_runs"`
+}
+
+// scheduleState is persisted in the state directory so pauses and missed runs survive restarts
+type scheduleState struct {
+	Paused    bool       `json:"paused"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastJobID string     `json:"last_job_id,omitempty"`
+	// Every run scheduled up to this time has been started or skipped
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// scheduleStatus is a schedule as reported by the API
+type scheduleStatus struct {
+	scheduleConfig
+	scheduleState
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+type scheduledBuild struct {
+	config  scheduleConfig
+	cron    *cronSchedule
+	state   scheduleState
+	nextRun time.Time
+}
+
+// missingDeploymentError is returned when a schedule lists a deployment that is not in the inventory
+type missingDeploymentError string
+
+func (e missingDeploymentError) Error() string {
+	return "Deployment does not exist: " + string(e)
+}
+
+type scheduler struct {
+	mutex     sync.Mutex
+	stateFile string
+	schedules map[string]*scheduledBuild
+	order     []string
+	// Closed by stop to end the schedule loops
+	stopped chan struct{}
+}
+
+var schedules = scheduler{
+	schedules: map[string]*scheduledBuild{},
+	stopped:   make(chan struct{}),
+}
+
+func validateSchedules(configs []scheduleConfig, workspaces []workspaceConfig) error {
+	names := map[string]bool{}
+	for i, s := range configs {
+		if s.Name == "" {
+			return errors.New("Schedule name is required")
+		}
+		if names[s.Name] {
+			return errors.New("Duplicate schedule name: " + s.Name)
+		}
+		names[s.Name] = true
+
+		if _, err := parseCronSchedule(s.Cron); err != nil {
+			return errors.New(err.Error() + " for schedule: " + s.Name)
+		}
+		if !dockerTagRegex.MatchString(s.Tag) {
+			return errors.New("Invalid tag for schedule: " + s.Name)
+		}
+		if !s.BaseImages && len(s.Images) == 0 && len(s.Deployments) == 0 {
+			return errors.New("Schedule builds nothing; set base_images, images or deployments for schedule: " + s.Name)
+		}
+		if s.Workspace != "" && !hasWorkspaceConfig(workspaces, s.Workspace) {
+			return errors.New("Unknown workspace " + s.Workspace + " for schedule: " + s.Name)
+		}
+		switch s.MissedRuns {
+		case "":
+			configs[i].MissedRuns = missedRunsRunOnce
+		case missedRunsRunOnce, missedRunsSkip:
+		default:
+			return errors.New("missed_runs must be run_once or skip for schedule: " + s.Name)
+		}
+	}
+	return nil
+}
+
+func hasWorkspaceConfig(workspaces []workspaceConfig, name string) bool {
+	for _, w := range workspaces {
+		if w.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// configure sets up the schedules, restoring their state from stateDirectory when it is given
+// Without a state directory pauses are forgotten on restart and missed runs are not detected
+func (s *scheduler) configure(configs []scheduleConfig, stateDirectory string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	states := map[string]scheduleState{}
+	if stateDirectory != "" {
+		s.stateFile = filepath.Join(stateDirectory, schedulesStateFilename)
+		contents, err := ioutil.ReadFile(s.stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(contents, &states); err != nil {
+				return errors.New("Could not read schedule state from " + s.stateFile + ": " + err.Error())
+			}
+		}
+	} else if len(configs) > 0 {
+		logger.Warn("No state_directory configured; schedule pauses are not kept and missed runs are not detected across restarts")
+	}
+
+	for _, c := range configs {
+		cron, _ := parseCronSchedule(c.Cron)
+		s.schedules[c.Name] = &scheduledBuild{
+			config: c,
+			cron:   cron,
+			state:  states[c.Name],
+		}
+		s.order = append(s.order, c.Name)
+	}
+	return nil
+}
+
+// start runs every schedule in the background, first handling runs missed while the server was down
+func (s *scheduler) start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for _, name := range s.order {
+		sb := s.schedules[name]
+		if !sb.state.CheckedAt.IsZero() {
+			if missed := sb.cron.next(sb.state.CheckedAt.In(time.Local)); !missed.IsZero() && !missed.After(now) {
+				logger.WithFields(logrus.Fields{
+					"schedule":    name,
+					"missed_run":  missed,
+					"missed_runs": sb.config.MissedRuns,
+				}).Warn("Scheduled build was missed while the server was down")
+				if sb.config.MissedRuns == missedRunsRunOnce && !sb.state.Paused {
+					go s.runScheduled(name, missed)
+				}
+			}
+		}
+		sb.state.CheckedAt = now
+		go s.loop(name)
+	}
+	s.save()
+}
+
+// loop starts a build every time the schedule fires
+func (s *scheduler) loop(name string) {
+	for {
+		s.mutex.Lock()
+		sb := s.schedules[name]
+		next := sb.cron.next(time.Now())
+		sb.nextRun = next
+		s.mutex.Unlock()
+		if next.IsZero() {
+			logger.WithFields(logrus.Fields{
+				"schedule": name,
+			}).Warn("Schedule never fires")
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.stopped:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.runScheduled(name, next)
+	}
+}
+
+// stop ends every schedule loop; runs already started are not affected
+func (s *scheduler) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.stopped:
+	default:
+		close(s.stopped)
+	}
+}
+
+// runScheduled starts the build for a scheduled time unless the schedule is paused or its previous job is still active
+func (s *scheduler) runScheduled(name string, scheduledAt time.Time) {
+	s.mutex.Lock()
+	sb := s.schedules[name]
+	if scheduledAt.After(sb.state.CheckedAt) {
+		sb.state.CheckedAt = scheduledAt
+	}
+	paused := sb.state.Paused
+	lastJobID := sb.state.LastJobID
+	s.save()
+	s.mutex.Unlock()
+
+	fields := logrus.Fields{
+		"schedule":     name,
+		"scheduled_at": scheduledAt,
+	}
+	if paused {
+		logger.WithFields(fields).Info("Skipping scheduled build; schedule is paused")
+		return
+	}
+	if j, exists := jobs.get(lastJobID); exists && j.FinishedAt == nil {
+		fields["job_id"] = j.ID
+		logger.WithFields(fields).Warn("Skipping scheduled build; previous job has not finished")
+		return
+	}
+	if _, err := s.run(context.Background(), name, scheduleCallerPrefix+name); err != nil {
+		fields["error"] = err
+		logger.WithFields(fields).Error("Failed to start scheduled build")
+	}
+}
+
+// run starts a job building everything the schedule lists
+func (s *scheduler) run(parent context.Context, name string, caller string) (job, error) {
+	s.mutex.Lock()
+	config := s.schedules[name].config
+	s.mutex.Unlock()
+
+	ws := defaultWorkspace
+	if config.Workspace != "" {
+		ws = namedWorkspaces[config.Workspace]
+	}
+	source, err := ws.prepareBuildSource(parent, "")
+	if err != nil {
+		return job{}, err
+	}
+
+	images := config.Images
+	if config.BaseImages && len(images) == 0 {
+		buildableImages, _ := source.inventory.GetBaseImageHeirarchy()
+		for _, i := range buildableImages {
+			images = append(images, i.Name)
+		}
+	}
+	for _, d := range config.Deployments {
+		if !source.inventory.DeploymentExists(d) {
+			source.release()
+			return job{}, missingDeploymentError(d)
+		}
+	}
+
+	parameters := map[string]string{
+		"schedule": name,
+		"tag":      config.Tag,
+	}
+	if len(config.Images) > 0 {
+		parameters["images"] = strings.Join(config.Images, ",")
+	}
+	if len(config.Deployments) > 0 {
+		parameters["deployments"] = strings.Join(config.Deployments, ",")
+	}
+	if config.ForceRebuild {
+		parameters["force_rebuild"] = "true"
+	}
+	j, err := jobs.start(parent, jobTypeSchedule, caller, parameters, source, func(ctx context.Context) error {
+		return buildSubtreesThenDeployments(ctx, source, config.Tag, images, config.ForceRebuild, config.Deployments)
+	})
+	if err != nil {
+		return j, err
+	}
+
+	s.mutex.Lock()
+	sb := s.schedules[name]
+	sb.state.LastRun = &j.CreatedAt
+	sb.state.LastJobID = j.ID
+	s.save()
+	s.mutex.Unlock()
+	return j, nil
+}
+
+// setPaused pauses or resumes a schedule; returns false if it does not exist
+func (s *scheduler) setPaused(name string, paused bool) (scheduleStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sb, exists := s.schedules[name]
+	if !exists {
+		return scheduleStatus{}, false
+	}
+	sb.state.Paused = paused
+	s.save()
+	return sb.status(), true
+}
+
+func (s *scheduler) get(name string) (scheduleStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sb, exists := s.schedules[name]
+	if !exists {
+		return scheduleStatus{}, false
+	}
+	return sb.status(), true
+}
+
+func (s *scheduler) list() []scheduleStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l := make([]scheduleStatus, 0, len(s.order))
+	for _, name := range s.order {
+		l = append(l, s.schedules[name].status())
+	}
+	return l
+}
+
+func (sb *scheduledBuild) status() scheduleStatus {
+	status := scheduleStatus{
+		scheduleConfig: sb.config,
+		scheduleState:  sb.state,
+	}
+	if !sb.nextRun.IsZero() {
+		next := sb.nextRun
+		status.NextRun = &next
+	}
+	return status
+}
+
+// save writes the state of every schedule to the state file; the caller must hold the lock
+func (s *scheduler) save() {
+	if s.stateFile == "" {
+		return
+	}
+	states := map[string]scheduleState{}
+	for name, sb := range s.schedules {
+		states[name] = sb.state
+	}
+	if err := writeStateFile(s.stateFile, states); err != nil {
+		logger.WithFields(logrus.Fields{
+			"state_file": s.stateFile,
+			"error":      err,
+		}).Error("Failed to save schedule state")
+	}
+}
+
+// writeStateFile replaces path with the JSON encoding of v, so readers never see a partially written file
+func writeStateFile(path string, v interface{}) error {
+	contents, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := ioutil.WriteFile(temporary, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+func addScheduleRoutes() {
+	ginEngine.GET("/api/v1/schedules", requireScope(scopeRead), func(c *gin.Context) { renderSchedulesList(c) })
+	ginEngine.GET("/api/v1/schedules/:name", requireScope(scopeRead), func(c *gin.Context) { renderSchedule(c) })
+	ginEngine.POST("/api/v1/schedules/:name/pause", audit("schedule.pause"), requireScope(scopeManageSchedules), func(c *gin.Context) { setSchedulePaused(c, true) })
+	ginEngine.POST("/api/v1/schedules/:name/resume", audit("schedule.resume"), requireScope(scopeManageSchedules), func(c *gin.Context) { setSchedulePaused(c, false) })
+	ginEngine.POST("/api/v1/schedules/:name/run", audit("schedule.run"), requireScope(scopeManageSchedules), func(c *gin.Context) { runSchedule(c) })
+}
+
+func renderSchedulesList(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"schedules": schedules.list(),
+	})
+}
+
+func renderSchedule(c *gin.Context) {
+	status, exists := schedules.get(c.Param("name"))
+	if !exists {
+		renderAPIError(c, 404, errorCodeScheduleNotFound, "Schedule does not exist: "+c.Param("name"))
+		return
+	}
+	c.JSON(200, gin.H{
+		"schedule": status,
+	})
+}
+
+func setSchedulePaused(c *gin.Context, paused bool) {
+	status, exists := schedules.setPaused(c.Param("name"), paused)
+	if !exists {
+		renderAPIError(c, 404, errorCodeScheduleNotFound, "Schedule does not exist: "+c.Param("name"))
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"schedule": status.Name,
+		"paused":   paused,
+		"caller":   getCaller(c),
+	}).Info("Schedule updated")
+	c.JSON(200, gin.H{
+		"schedule": status,
+	})
+}
+
+// runSchedule starts the build of a schedule immediately, whether or not it is paused
+func runSchedule(c *gin.Context) {
+	if _, exists := schedules.get(c.Param("name")); !exists {
+		renderAPIError(c, 404, errorCodeScheduleNotFound, "Schedule does not exist: "+c.Param("name"))
+		return
+	}
+	j, err := schedules.run(c.Request.Context(), c.Param("name"), getCaller(c))
+	if _, missing := err.(missingDeploymentError); missing {
+		renderAPIError(c, 422, errorCodeDeploymentNotFound, err.Error())
+		return
+	} else if err == errShuttingDown {
+		renderAPIError(c, 503, errorCodeShuttingDown, err.Error())
+		return
+	} else if err != nil {
+		renderBuildSourceError(c, err)
+		return
+	}
+	renderJobAccepted(c, j)
+}
@@ -0,0 +1,78 @@
+package webserver
+
+import (
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+)
+
+// serverConfig holds the settings read from the file given by --server-config
+type serverConfig struct {
+	Webhooks []webhookConfig `json:"webhooks"`
+	GitHooks *gitHooksConfig `json:"git_hooks"`
+	// Builds from a git repository instead of the docker base directory when set
+	GitWorkspace *gitWorkspaceConfig `json:"git_workspace"`
+	// Additional workspaces served under /api/v1/workspaces/:workspace
+	Workspaces []workspaceConfig `json:"workspaces"`
+	Schedules  []scheduleConfig  `json:"schedules"`
+	// Rebuilds subtrees when an external image they are built FROM changes
+	UpstreamPolling *upstreamPollingConfig `json:"upstream_polling"`
+	// Tags that may only be built once another caller approves the job
+	ProtectedTags []protectedTagConfig `json:"protected_tags"`
+	// Records mutating API calls and finished jobs when set
+	AuditLog *auditLogConfig `json:"audit_log"`
+	// Builds each tag on one instance at a time when several servers share a workspace directory
+	BuildLocks *buildLocksConfig `json:"build_locks"`
+	// Dispatches builds to agents instead of the local docker daemon when set
+	Agents *agentsConfig `json:"agents"`
+	// Directory the server keeps state in across restarts, such as schedule pauses and last runs
+	StateDirectory string `json:"state_directory"`
+}
+
+// loadServerConfig reads and validates the server configuration file
+func loadServerConfig(path string) (serverConfig, error) {
+	var config serverConfig
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(contents, &config); err != nil {
+		return config, err
+	}
+	applyGitWorkspaceDefaults(config.GitWorkspace)
+	for _, w := range config.Workspaces {
+		applyGitWorkspaceDefaults(w.Git)
+	}
+
+	if err := validateWebhooks(config.Webhooks); err != nil {
+		return config, err
+	}
+	if err := validateGitHooks(config.GitHooks); err != nil {
+		return config, err
+	}
+	if err := validateGitWorkspace(config.GitWorkspace); err != nil {
+		return config, err
+	}
+	if err := validateWorkspaces(config.Workspaces); err != nil {
+		return config, err
+	}
+	if err := validateSchedules(config.Schedules, config.Workspaces); err != nil {
+		return config, err
+	}
+	if err := validateUpstreamPolling(config.UpstreamPolling, config.Workspaces); err != nil {
+		return config, err
+	}
+	if err := validateProtectedTags(config.ProtectedTags); err != nil {
+		return config, err
+	}
+	if err := validateAuditLog(config.AuditLog, config.StateDirectory); err != nil {
+		return config, err
+	}
+	if err := validateBuildLocks(config.BuildLocks); err != nil {
+		return config, err
+	}
+	if err := validateAgents(config.Agents); err != nil {
+		return config, err
+	}
+	return config, nil
+}
@@ -0,0 +1,107 @@
+package webserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certificateReloader serves the current TLS certificate and client CA pool, reloading both from disk on SIGHUP
+type certificateReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+func newCertificateReloader(certFile string, keyFile string, clientCAFile string) (*certificateReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("Both a TLS certificate and key must be specified")
+	}
+	cr := &certificateReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the certificate, key and client CA bundle; the previous values are kept if any of them fail to load
+func (cr *certificateReloader) reload() error {
+	certificate, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if cr.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(cr.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in client CA file: " + cr.clientCAFile)
+		}
+	}
+
+	cr.mutex.Lock()
+	cr.certificate = &certificate
+	cr.clientCAs = clientCAs
+	cr.mutex.Unlock()
+
+	logger.WithFields(logrus.Fields{
+		"tls_cert":  cr.certFile,
+		"client_ca": cr.clientCAFile,
+	}).Info("Loaded TLS certificates")
+	return nil
+}
+
+// watchSignals reloads certificates whenever the process receives SIGHUP
+func (cr *certificateReloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := cr.reload(); err != nil {
+				logger.WithFields(logrus.Fields{
+					"error": err,
+				}).Error("Failed to reload TLS certificates; continuing with the previous certificates")
+			}
+		}
+	}()
+}
+
+// tlsConfig builds a server configuration that always uses the most recently loaded certificates
+func (cr *certificateReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mutex.RLock()
+			defer cr.mutex.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cr.certificate},
+			}
+			if cr.clientCAs != nil {
+				config.ClientCAs = cr.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
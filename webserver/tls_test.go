@@ -0,0 +1,191 @@
+package webserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeTestCertificate writes a self-signed certificate for commonName and its key to directory, returning their paths
+func writeTestCertificate(t *testing.T, directory string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(directory, commonName+".crt")
+	keyFile := filepath.Join(directory, commonName+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encodedKey}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// getTestServerConfig returns the configuration the server uses for a new connection
+func getTestServerConfig(t *testing.T, cr *certificateReloader) *tls.Config {
+	config, err := cr.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestNewCertificateReloader(t *testing.T) {
+	directory := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, directory, "server")
+	caFile, _ := writeTestCertificate(t, directory, "client-ca")
+	emptyFile := filepath.Join(directory, "empty.pem")
+	if err := ioutil.WriteFile(emptyFile, []byte("not a certificate\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		certFile     string
+		keyFile      string
+		clientCAFile string
+		wantErr      string
+		// Whether clients must present a certificate
+		wantClientAuth bool
+	}{
+		{"certificate and key", certFile, keyFile, "", "", false},
+		{"client CA", certFile, keyFile, caFile, "", true},
+		{"missing key", certFile, "", "", "Both a TLS certificate and key must be specified", false},
+		{"client CA only", "", "", caFile, "Both a TLS certificate and key must be specified", false},
+		{"unreadable certificate", filepath.Join(directory, "missing.crt"), keyFile, "", "open " + filepath.Join(directory, "missing.crt") + ": no such file or directory", false},
+		{"mismatched key", caFile, keyFile, "", "tls: private key does not match public key", false},
+		{"client CA without certificates", certFile, keyFile, emptyFile, "No certificates found in client CA file: " + emptyFile, false},
+	}
+	for _, test := range tests {
+		cr, err := newCertificateReloader(test.certFile, test.keyFile, test.clientCAFile)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s: newCertificateReloader() = %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		config := getTestServerConfig(t, cr)
+		if len(config.Certificates) != 1 || config.MinVersion != tls.VersionTLS12 {
+			t.Errorf("%s: config has %d certificates and minimum version %x", test.name, len(config.Certificates), config.MinVersion)
+		}
+		if clientAuth := config.ClientAuth == tls.RequireAndVerifyClientCert && config.ClientCAs != nil; clientAuth != test.wantClientAuth {
+			t.Errorf("%s: client certificates required = %v, want %v", test.name, clientAuth, test.wantClientAuth)
+		}
+	}
+}
+
+func TestCertificateReloaderKeepsPreviousCertificatesOnError(t *testing.T) {
+	directory := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, directory, "server")
+	cr, err := newCertificateReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := getTestServerConfig(t, cr).Certificates[0].Certificate[0]
+
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.reload(); err == nil {
+		t.Error("reload() of an invalid certificate succeeded")
+	}
+	if current := getTestServerConfig(t, cr).Certificates[0].Certificate[0]; string(current) != string(previous) {
+		t.Error("Certificate was replaced by one that failed to load")
+	}
+
+	// A renewed certificate is served to new connections once reloaded
+	writeTestCertificate(t, directory, "server")
+	if err := cr.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if current := getTestServerConfig(t, cr).Certificates[0].Certificate[0]; string(current) == string(previous) {
+		t.Error("Renewed certificate was not loaded")
+	}
+}
+
+func TestClientCertificateCaller(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "build-agent")
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+
+	tests := []struct {
+		name string
+		// Tokens are not loaded when nil, disabling authentication
+		tokens        map[string][]string
+		tls           *tls.ConnectionState
+		authorization string
+		wantStatus    int
+		wantCaller    string
+	}{
+		{"plain HTTP", nil, nil, "", 200, anonymousCaller},
+		{"no client certificate", nil, &tls.ConnectionState{}, "", 200, anonymousCaller},
+		{"client certificate", nil, verified, "", 200, "cert:build-agent"},
+		// Tokens take precedence over client certificates when both are configured
+		{"client certificate without a token", map[string][]string{"ci": {scopeAll}}, verified, "", 401, ""},
+		{"client certificate and token", map[string][]string{"ci": {scopeAll}}, verified, "Bearer ci", 200, "ci"},
+	}
+	previousEngine, previousTokens := ginEngine, apiTokens
+	t.Cleanup(func() { ginEngine, apiTokens = previousEngine, previousTokens })
+	gin.SetMode(gin.TestMode)
+	ginEngine = gin.New()
+	ginEngine.GET("/whoami", requireScope(scopeRead), func(c *gin.Context) {
+		c.String(200, getCaller(c))
+	})
+	for _, test := range tests {
+		apiTokens = nil
+		if test.tokens != nil {
+			setTestAPITokens(t, test.tokens)
+		}
+		r := httptest.NewRequest("GET", "/whoami", nil)
+		r.TLS = test.tls
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		ginEngine.ServeHTTP(w, r)
+		if w.Code != test.wantStatus || (test.wantCaller != "" && w.Body.String() != test.wantCaller) {
+			t.Errorf("%s: response is %d %s, want %d %s", test.name, w.Code, w.Body.String(), test.wantStatus, test.wantCaller)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package webserver
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go.mikenewswanger.com/container-factory/tracing"
+)
+
+// traceRequests continues traces from incoming traceparent headers and records a span per API request
+// Health and metrics probes are not traced
+func traceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if !tracing.Enabled() || !strings.HasPrefix(path, "/api/") {
+			c.Next()
+			return
+		}
+
+		ctx := tracing.Extract(c.Request.Context(), c.Request.Header)
+		ctx, span := tracing.StartWithKind(ctx, c.Request.Method+" "+path, tracing.KindServer,
+			tracing.String("http.method", c.Request.Method),
+			tracing.String("http.target", path),
+			tracing.String("http.client_ip", c.ClientIP()),
+		)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		span.SetAttributes(
+			tracing.Int("http.status_code", c.Writer.Status()),
+			tracing.String("caller", getCaller(c)),
+		)
+		var err error
+		if c.Writer.Status() >= 500 {
+			err = &httpStatusError{status: c.Writer.Status()}
+		}
+		span.End(err)
+	}
+}
+
+type httpStatusError struct {
+	status int
+}
+
+func (e *httpStatusError) Error() string {
+	return "HTTP " + strconv.Itoa(e.status)
+}
@@ -0,0 +1,375 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/container-factory/registry"
+)
+
+const (
+	jobTypeUpstreamUpdate = "upstream-update"
+
+	upstreamPollerCaller        = "upstream-poller"
+	upstreamDigestsFilename     = "upstream-digests.json"
+	defaultUpstreamPollInterval = time.Hour
+)
+
+// upstreamPollingConfig configures watching the external images that root images are built FROM for new digests
+type upstreamPollingConfig struct {
+	// Time between polls, i.e. 30m; defaults to 1h
+	Interval  string `json:"interval"`
+	Tag       string `json:"tag"`
+	Workspace string `json:"workspace"`
+	// Registries reached over plain HTTP, i.e. localhost:5000
+	InsecureRegistries []string `json:"insecure_registries"`
+
+	interval time.Duration
+}
+
+// upstreamImage is the last digest built for an external image
+type upstreamImage struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest,omitempty"`
+	// New digest being rebuilt for; Digest only changes to it once the rebuild succeeds, so the next poll retries a failed rebuild
+	PendingDigest string     `json:"pending_digest,omitempty"`
+	PendingJobID  string     `json:"pending_job_id,omitempty"`
+	CheckedAt     *time.Time `json:"checked_at,omitempty"`
+	ChangedAt     *time.Time `json:"changed_at,omitempty"`
+	// Root images built FROM the reference, as of the last poll
+	Images []string `json:"images"`
+	Error  string   `json:"error,omitempty"`
+}
+
+type upstreamPoller struct {
+	config    *upstreamPollingConfig
+	client    *registry.Client
+	stateFile string
+
+	// Serializes polls so a change is only acted on once
+	pollMutex sync.Mutex
+	mutex     sync.Mutex
+	images    map[string]*upstreamImage
+
+	// Stops the polling loop; stopped is closed once it returns
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+var upstreamImages = upstreamPoller{
+	images: map[string]*upstreamImage{},
+}
+
+func validateUpstreamPolling(config *upstreamPollingConfig, workspaces []workspaceConfig) error {
+	if config == nil {
+		return nil
+	}
+	config.interval = defaultUpstreamPollInterval
+	if config.Interval != "" {
+		var err error
+		if config.interval, err = time.ParseDuration(config.Interval); err != nil || config.interval <= 0 {
+			return errors.New("Invalid interval for upstream_polling: " + config.Interval)
+		}
+	}
+	if !dockerTagRegex.MatchString(config.Tag) {
+		return errors.New("Invalid tag for upstream_polling: " + config.Tag)
+	}
+	if config.Workspace != "" && !hasWorkspaceConfig(workspaces, config.Workspace) {
+		return errors.New("Unknown workspace for upstream_polling: " + config.Workspace)
+	}
+	return nil
+}
+
+// configure sets up polling, restoring the digests seen before a restart from stateDirectory when it is given
+// Without recorded digests, the first poll only records them
+func (p *upstreamPoller) configure(config *upstreamPollingConfig, stateDirectory string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.config = config
+	if config == nil {
+		return nil
+	}
+	p.client = registry.NewClient(config.InsecureRegistries)
+	if stateDirectory == "" {
+		return nil
+	}
+
+	p.stateFile = filepath.Join(stateDirectory, upstreamDigestsFilename)
+	contents, err := ioutil.ReadFile(p.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(contents, &p.images); err != nil {
+		return errors.New("Could not read upstream digests from " + p.stateFile + ": " + err.Error())
+	}
+	return nil
+}
+
+// start polls immediately and then at the configured interval until stop is called
+func (p *upstreamPoller) start() {
+	if p.config == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.stopped = make(chan struct{})
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(p.config.interval)
+		defer ticker.Stop()
+		for {
+			p.poll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stop ends polling, waiting for a poll in progress so no rebuild starts once it returns
+func (p *upstreamPoller) stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.stopped
+}
+
+func (p *upstreamPoller) getWorkspace() *serverWorkspace {
+	if p.config.Workspace != "" {
+		return namedWorkspaces[p.config.Workspace]
+	}
+	return defaultWorkspace
+}
+
+// poll resolves the digest of every external image and starts a rebuild of the subtrees built FROM images whose digest changed
+// Images whose rebuild for the same digest is still running are left to it
+// Returns the job started, if any
+func (p *upstreamPoller) poll(ctx context.Context) (*job, error) {
+	p.pollMutex.Lock()
+	defer p.pollMutex.Unlock()
+
+	ws := p.getWorkspace()
+	inventory := ws.getInventory()
+	if inventory == nil {
+		// The workspace has not loaded an inventory yet
+		logger.WithFields(logrus.Fields{
+			"workspace": ws.config.Name,
+		}).Warn("Skipping upstream image poll until the workspace inventory is loaded")
+		return nil, nil
+	}
+	externalImages := inventory.GetExternalBaseImages()
+	changed := map[string]string{}
+	rebuild := []string{}
+	for reference, images := range externalImages {
+		// Pinned references never change
+		if strings.Contains(reference, "@") {
+			continue
+		}
+		digest, err := p.client.ResolveDigest(ctx, reference)
+		if ctx.Err() != nil {
+			// Stopped while resolving; nothing is recorded or rebuilt
+			return nil, ctx.Err()
+		}
+		now := time.Now().UTC()
+
+		p.mutex.Lock()
+		image, exists := p.images[reference]
+		if !exists {
+			image = &upstreamImage{
+				Reference: reference,
+			}
+			p.images[reference] = image
+		}
+		image.Images = images
+		image.CheckedAt = &now
+		if err != nil {
+			image.Error = err.Error()
+			p.mutex.Unlock()
+			logger.WithFields(logrus.Fields{
+				"reference": reference,
+				"error":     err,
+			}).Warn("Failed to resolve upstream image digest")
+			continue
+		}
+		image.Error = ""
+		fields := logrus.Fields{
+			"reference":       reference,
+			"previous_digest": image.Digest,
+			"digest":          digest,
+		}
+		switch {
+		case image.Digest == "":
+			image.Digest = digest
+		case image.Digest == digest:
+			image.PendingDigest = ""
+			image.PendingJobID = ""
+		case image.PendingDigest != digest:
+			image.ChangedAt = &now
+			// Recorded before the rebuild starts, since it may finish before poll returns
+			image.PendingDigest = digest
+			image.PendingJobID = ""
+			changed[reference] = digest
+			rebuild = append(rebuild, images...)
+			logger.WithFields(fields).Info("Upstream image changed")
+		case !isJobActive(image.PendingJobID):
+			changed[reference] = digest
+			rebuild = append(rebuild, images...)
+			fields["job_id"] = image.PendingJobID
+			logger.WithFields(fields).Warn("Retrying rebuild for changed upstream image")
+		}
+		p.mutex.Unlock()
+	}
+
+	p.mutex.Lock()
+	for reference := range p.images {
+		if _, exists := externalImages[reference]; !exists {
+			delete(p.images, reference)
+		}
+	}
+	p.save()
+	p.mutex.Unlock()
+
+	if len(rebuild) == 0 {
+		return nil, nil
+	}
+	references := make([]string, 0, len(changed))
+	for reference := range changed {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+	sort.Strings(rebuild)
+	j, err := p.startRebuild(ctx, ws, changed, references, rebuild)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"upstream_images": references,
+			"error":           err,
+		}).Error("Failed to start rebuild for changed upstream images")
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	for reference, digest := range changed {
+		if image, exists := p.images[reference]; exists && image.PendingDigest == digest {
+			image.PendingJobID = j.ID
+		}
+	}
+	p.save()
+	p.mutex.Unlock()
+	return &j, nil
+}
+
+// startRebuild builds the subtrees of images, pulling the changed external images rather than using the copies cached by docker
+// The digests of the changed references are recorded once the build succeeds
+func (p *upstreamPoller) startRebuild(ctx context.Context, ws *serverWorkspace, changed map[string]string, references []string, images []string) (job, error) {
+	source, err := ws.prepareBuildSource(ctx, "")
+	if err != nil {
+		return job{}, err
+	}
+	tag := p.config.Tag
+	parameters := map[string]string{
+		"tag":      tag,
+		"images":   strings.Join(images, ","),
+		"upstream": strings.Join(references, ","),
+	}
+	return jobs.start(ctx, jobTypeUpstreamUpdate, upstreamPollerCaller, parameters, source, func(ctx context.Context) error {
+		if err := runBaseImagesBuild(dockerbuild.WithPullBaseImages(ctx), source, tag, images, false); err != nil {
+			return err
+		}
+		p.recordRebuilt(changed)
+		return nil
+	})
+}
+
+// recordRebuilt records the digests a rebuild succeeded for, unless a newer digest is already pending
+func (p *upstreamPoller) recordRebuilt(digests map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for reference, digest := range digests {
+		if image, exists := p.images[reference]; exists && image.PendingDigest == digest {
+			image.Digest = digest
+			image.PendingDigest = ""
+			image.PendingJobID = ""
+		}
+	}
+	p.save()
+}
+
+// isJobActive reports whether a job is still waiting or running
+func isJobActive(id string) bool {
+	j, exists := jobs.get(id)
+	return exists && j.FinishedAt == nil
+}
+
+func (p *upstreamPoller) list() []upstreamImage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	l := make([]upstreamImage, 0, len(p.images))
+	for _, image := range p.images {
+		l = append(l, *image)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Reference < l[j].Reference })
+	return l
+}
+
+// save writes the recorded digests to the state file; the caller must hold the lock
+func (p *upstreamPoller) save() {
+	if p.stateFile == "" {
+		return
+	}
+	if err := writeStateFile(p.stateFile, p.images); err != nil {
+		logger.WithFields(logrus.Fields{
+			"state_file": p.stateFile,
+			"error":      err,
+		}).Error("Failed to save upstream digests")
+	}
+}
+
+func addUpstreamImageRoutes() {
+	if upstreamImages.config == nil {
+		return
+	}
+	ginEngine.GET("/api/v1/upstream-images", requireScope(scopeRead), func(c *gin.Context) { renderUpstreamImages(c) })
+	ginEngine.POST("/api/v1/upstream-images/poll", audit("upstream-images.poll"), requireScope(scopeBuildBase), func(c *gin.Context) { pollUpstreamImages(c) })
+}
+
+func renderUpstreamImages(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"upstream_images": upstreamImages.list(),
+	})
+}
+
+// pollUpstreamImages polls immediately instead of waiting for the interval
+func pollUpstreamImages(c *gin.Context) {
+	j, err := upstreamImages.poll(c.Request.Context())
+	if err == errShuttingDown {
+		renderAPIError(c, 503, errorCodeShuttingDown, err.Error())
+		return
+	} else if err != nil {
+		renderBuildSourceError(c, err)
+		return
+	}
+	if j != nil {
+		renderJobAccepted(c, *j)
+		return
+	}
+	c.JSON(200, gin.H{
+		"upstream_images": upstreamImages.list(),
+	})
+}
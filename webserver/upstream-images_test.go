@@ -0,0 +1,88 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestUpstreamPoller polls the external images of a default workspace whose root image is built FROM the registry of handler
+func newTestUpstreamPoller(t *testing.T, interval time.Duration, handler http.HandlerFunc) *upstreamPoller {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	previousWorkspace := defaultWorkspace
+	t.Cleanup(func() { defaultWorkspace = previousWorkspace })
+	defaultWorkspace = &serverWorkspace{config: workspaceConfig{Name: "test"}}
+	defaultWorkspace.inventory = loadTestWorkspaceInventory(t, map[string]string{
+		"dockerfiles/root": "FROM " + host + "/base:1\n",
+	})
+
+	p := &upstreamPoller{images: map[string]*upstreamImage{}}
+	if err := p.configure(&upstreamPollingConfig{Tag: "latest", InsecureRegistries: []string{host}, interval: interval}, ""); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestUpstreamPollerStopsPolling(t *testing.T) {
+	var requests int32
+	p := newTestUpstreamPoller(t, 10*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(404)
+	})
+	p.start()
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&requests) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the poller to poll twice")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	p.stop()
+
+	polled := atomic.LoadInt32(&requests)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&requests); got != polled {
+		t.Errorf("Poller made %d requests after it was stopped", got-polled)
+	}
+}
+
+func TestUpstreamPollerStopCancelsPoll(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	p := newTestUpstreamPoller(t, time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-r.Context().Done()
+	})
+	p.start()
+	<-requested
+
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop() did not return while a poll was resolving a digest")
+	}
+	// The poll is abandoned without recording the cancellation as a registry error
+	if images := p.list(); len(images) != 0 {
+		t.Errorf("Stopped poll recorded %+v", images)
+	}
+}
+
+func TestUpstreamPollerSkipsWorkspaceWithoutInventory(t *testing.T) {
+	p := newTestUpstreamPoller(t, time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Poll without an inventory reached the registry")
+	})
+	defaultWorkspace.inventory = nil
+	if j, err := p.poll(context.Background()); j != nil || err != nil {
+		t.Errorf("poll() = %v, %v; want no job and no error", j, err)
+	}
+}
@@ -1,32 +1,215 @@
 package webserver
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/sirupsen/logrus"
 
 	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/container-factory/tracing"
 )
 
+// ServerOptions configures the web server
+type ServerOptions struct {
+	DockerBaseDirectory    string
+	DockerRegistryBasePath string
+	ListenPort             uint16
+	// Path to a YAML file of hashed API tokens; authentication is disabled when empty
+	AuthTokensFile string
+	// TLS is enabled when a certificate and key are given; client certificates are required when a CA is also given
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	// Maximum number of jobs running at once; additional jobs are queued.  0 is unlimited
+	MaxConcurrentJobs int
+	// Time running jobs are given to finish on SIGTERM or SIGINT before they are cancelled
+	ShutdownTimeout time.Duration
+	// Reported by the /version endpoint
+	Version string
+	// Path to a YAML file of additional server settings such as webhooks
+	ConfigFile string
+}
+
+// Time given to in-flight HTTP requests once all jobs have stopped
+const httpShutdownTimeout = 10 * time.Second
+
 var ginEngine *gin.Engine
 var logger = logrus.New()
 var verbosity = uint8(0)
-var registryBasePath string
 
 // Serve starts up a webserver
-func Serve(dockerBaseDirectory string, dockerRegistryBasePath string, listenPort uint16, l *logrus.Logger, v uint8) {
+func Serve(options ServerOptions, l *logrus.Logger, v uint8) {
 	logger = l
 	verbosity = v
 	ginEngine = gin.Default()
-	registryBasePath = dockerRegistryBasePath
+	ginEngine.Use(traceRequests())
+	jobs.setConcurrency(options.MaxConcurrentJobs)
+	if options.Version != "" {
+		serverVersion = options.Version
+	}
+	if err := binding.Validator.RegisterValidation("docker_tag", validateDockerTag); err != nil {
+		logger.Fatal(err)
+	}
+
+	if options.AuthTokensFile != "" {
+		var err error
+		if apiTokens, err = loadAPITokens(options.AuthTokensFile); err != nil {
+			logger.Fatal(err)
+		}
+		logger.WithFields(logrus.Fields{
+			"tokens": len(apiTokens),
+		}).Info("API token authentication enabled")
+	} else {
+		logger.Warn("No API tokens file specified; the web API is open to anyone who can reach it")
+	}
+
+	var config serverConfig
+	if options.ConfigFile != "" {
+		var err error
+		config, err = loadServerConfig(options.ConfigFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if len(config.ProtectedTags) > 0 && apiTokens == nil {
+			logger.Fatal("Protected tags require --auth-tokens-file so approvers can be told apart from the callers starting builds")
+		}
+		webhooks.configure(config.Webhooks)
+		buildAgents.configure(config.Agents)
+		buildLocks.configure(config.BuildLocks)
+		gitHooks = config.GitHooks
+		protectedTags = config.ProtectedTags
+		logger.WithFields(logrus.Fields{
+			"config_file":    options.ConfigFile,
+			"webhooks":       len(config.Webhooks),
+			"git_hooks":      gitHooks != nil,
+			"workspaces":     len(config.Workspaces),
+			"schedules":      len(config.Schedules),
+			"protected_tags": len(config.ProtectedTags),
+			"audit_log":      config.AuditLog != nil,
+			"build_locks":    config.BuildLocks != nil,
+			"agents":         config.Agents != nil,
+		}).Info("Loaded server configuration")
+	}
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(int(options.ListenPort)),
+		Handler: ginEngine,
+	}
+	if options.TLSCertFile != "" || options.TLSKeyFile != "" || options.TLSClientCAFile != "" {
+		certificates, err := newCertificateReloader(options.TLSCertFile, options.TLSKeyFile, options.TLSClientCAFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		certificates.watchSignals()
+		server.TLSConfig = certificates.tlsConfig()
+	} else {
+		logger.Warn("TLS is not configured; the web API is served over plain HTTP")
+	}
 
 	dockerbuild.SetLogger(logger)
 	dockerbuild.SetVerbosity(verbosity)
-	dockerbuild.SetDockerBaseDirectory(dockerBaseDirectory)
+	// With a git workspace the docker base directory holds the clone and worktrees of the repository instead of build assets
+	var err error
+	if defaultWorkspace, err = openWorkspace(workspaceConfig{
+		Name:             "default",
+		BaseDirectory:    options.DockerBaseDirectory,
+		Git:              config.GitWorkspace,
+		RegistryBasePath: options.DockerRegistryBasePath,
+	}, true); err != nil {
+		logger.Fatal(err)
+	}
+	servedWorkspaces := []*serverWorkspace{defaultWorkspace}
+	for _, w := range config.Workspaces {
+		ws, err := openWorkspace(w, false)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"workspace": w.Name,
+			}).Fatal(err)
+		}
+		namedWorkspaces[w.Name] = ws
+		servedWorkspaces = append(servedWorkspaces, ws)
+	}
+	for _, ws := range servedWorkspaces {
+		ws.startRefreshing()
+		if err := ws.watchInventory(); err != nil {
+			logger.WithFields(logrus.Fields{
+				"workspace": ws.config.Name,
+				"error":     err,
+			}).Warn("Not watching for inventory changes; use POST /api/v1/inventory/reload after changing build assets")
+		}
+	}
+	if config.StateDirectory != "" {
+		if err := os.MkdirAll(config.StateDirectory, 0755); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if auditLog, err = openAuditLog(config.AuditLog, config.StateDirectory); err != nil {
+		logger.Fatal(err)
+	}
+	if err := schedules.configure(config.Schedules, config.StateDirectory); err != nil {
+		logger.Fatal(err)
+	}
+	if err := upstreamImages.configure(config.UpstreamPolling, config.StateDirectory); err != nil {
+		logger.Fatal(err)
+	}
 	logger.WithFields(logrus.Fields{
-		"port": listenPort,
+		"port": options.ListenPort,
+		"tls":  server.TLSConfig != nil,
 	}).Info("Starting web server")
 	addRoutes()
-	ginEngine.Run(":" + strconv.Itoa(int(listenPort)))
+	schedules.start()
+	upstreamImages.start()
+	buildAgents.start()
+
+	shutdownComplete := make(chan struct{})
+	go shutdownOnSignal(server, options.ShutdownTimeout, shutdownComplete)
+
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logger.Fatal(err)
+	}
+	<-shutdownComplete
+	logger.Info("Web server stopped")
+}
+
+// shutdownOnSignal drains running jobs and stops the server on SIGTERM or SIGINT
+// The web API keeps serving status requests while jobs drain; new jobs are rejected
+func shutdownOnSignal(server *http.Server, timeout time.Duration, complete chan struct{}) {
+	defer close(complete)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+	logger.WithFields(logrus.Fields{
+		"signal": sig.String(),
+	}).Warn("Shutting down")
+
+	schedules.stop()
+	upstreamImages.stop()
+	jobs.drain(timeout)
+	webhooks.wait(httpShutdownTimeout)
+	defaultWorkspace.stopRefreshing()
+	for _, ws := range namedWorkspaces {
+		ws.stopRefreshing()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error(err)
+	}
+	tracing.Shutdown(ctx)
 }
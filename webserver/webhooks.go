@@ -0,0 +1,346 @@
+package webserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+)
+
+const (
+	webhookEventJobPendingApproval = "job.pending_approval"
+	webhookEventJobStarted         = "job.started"
+	webhookEventImageFailed        = "image.failed"
+	webhookEventJobFinished        = "job.finished"
+
+	webhookDeliveryPending   = "pending"
+	webhookDeliverySucceeded = "succeeded"
+	webhookDeliveryFailed    = "failed"
+
+	// Failed deliveries are retried with exponential backoff starting at webhookInitialBackoff
+	webhookMaxAttempts     = 5
+	webhookInitialBackoff  = 2 * time.Second
+	webhookRequestTimeout  = 10 * time.Second
+	maxRetainedDeliveries  = 1000
+	webhookSignatureHeader = "X-Container-Factory-Signature"
+)
+
+var knownWebhookEvents = []string{webhookEventJobPendingApproval, webhookEventJobStarted, webhookEventImageFailed, webhookEventJobFinished}
+
+// webhookConfig describes a single subscriber in the server config file
+type webhookConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Key used to sign payloads with HMAC-SHA256
+	Secret string `json:"secret"`
+	// Events sent to the subscriber; every event is sent when empty
+	Events []string `json:"events"`
+}
+
+// webhookPayload is the JSON body posted to subscribers
+type webhookPayload struct {
+	Event      string `json:"event"`
+	DeliveryID string `json:"delivery_id"`
+	// Increases with every event sent by this server process, so subscribers can discard events older than one already handled
+	Sequence  uint64                   `json:"sequence"`
+	Timestamp time.Time                `json:"timestamp"`
+	Tag       string                   `json:"tag"`
+	Job       job                      `json:"job"`
+	Image     *dockerbuild.ImageResult `json:"image,omitempty"`
+}
+
+// webhookDelivery records the attempts made to deliver one event to one subscriber
+type webhookDelivery struct {
+	ID             string     `json:"id"`
+	Webhook        string     `json:"webhook"`
+	Event          string     `json:"event"`
+	JobID          string     `json:"job_id"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+// webhookQueue holds the deliveries waiting for one subscriber, which are sent one at a time in the order of their events
+type webhookQueue struct {
+	deliveries []queuedWebhookDelivery
+	// Whether a goroutine is sending the queued deliveries
+	draining bool
+}
+
+type queuedWebhookDelivery struct {
+	webhook  webhookConfig
+	delivery *webhookDelivery
+	body     []byte
+}
+
+type webhookDispatcher struct {
+	mutex      sync.RWMutex
+	webhooks   []webhookConfig
+	deliveries []*webhookDelivery
+	// Queued deliveries by webhook name
+	queues   map[string]*webhookQueue
+	sequence uint64
+	pending  sync.WaitGroup
+	client   *http.Client
+}
+
+var webhooks = webhookDispatcher{
+	client: &http.Client{
+		Timeout: webhookRequestTimeout,
+	},
+}
+
+func validateWebhooks(hooks []webhookConfig) error {
+	names := map[string]bool{}
+	for _, h := range hooks {
+		if h.Name == "" {
+			return errors.New("Webhook name is required")
+		}
+		if names[h.Name] {
+			return errors.New("Duplicate webhook name: " + h.Name)
+		}
+		names[h.Name] = true
+
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Invalid url for webhook: " + h.Name)
+		}
+		if h.Secret == "" {
+			return errors.New("Secret is required for webhook: " + h.Name)
+		}
+		for _, e := range h.Events {
+			if !isKnownWebhookEvent(e) {
+				return errors.New("Unknown event " + e + " for webhook: " + h.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func isKnownWebhookEvent(event string) bool {
+	for _, e := range knownWebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (h webhookConfig) subscribesTo(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// configure replaces the set of subscribers
+func (wd *webhookDispatcher) configure(hooks []webhookConfig) {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	wd.webhooks = hooks
+}
+
+// notify sends an event about j to every subscriber in the background
+// Each subscriber receives events in the order they were notified, including while earlier events are retried
+// image is only set for image events
+func (wd *webhookDispatcher) notify(event string, j job, image *dockerbuild.ImageResult) {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	wd.sequence++
+	for _, h := range wd.webhooks {
+		if !h.subscribesTo(event) {
+			continue
+		}
+
+		d := &webhookDelivery{
+			ID:        newJobID(),
+			Webhook:   h.Name,
+			Event:     event,
+			JobID:     j.ID,
+			Status:    webhookDeliveryPending,
+			CreatedAt: time.Now().UTC(),
+		}
+		body, err := json.Marshal(webhookPayload{
+			Event:      event,
+			DeliveryID: d.ID,
+			Sequence:   wd.sequence,
+			Timestamp:  d.CreatedAt,
+			Tag:        j.Parameters["tag"],
+			Job:        j,
+			Image:      image,
+		})
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		wd.deliveries = append(wd.deliveries, d)
+		if excess := len(wd.deliveries) - maxRetainedDeliveries; excess > 0 {
+			wd.deliveries = append([]*webhookDelivery{}, wd.deliveries[excess:]...)
+		}
+		wd.pending.Add(1)
+		wd.enqueue(queuedWebhookDelivery{webhook: h, delivery: d, body: body})
+	}
+}
+
+// enqueue adds a delivery to the queue of its subscriber, starting a goroutine to send it unless one is already running
+// The caller must hold the mutex
+func (wd *webhookDispatcher) enqueue(q queuedWebhookDelivery) {
+	if wd.queues == nil {
+		wd.queues = map[string]*webhookQueue{}
+	}
+	queue := wd.queues[q.webhook.Name]
+	if queue == nil {
+		queue = &webhookQueue{}
+		wd.queues[q.webhook.Name] = queue
+	}
+	queue.deliveries = append(queue.deliveries, q)
+	if !queue.draining {
+		queue.draining = true
+		go wd.drain(queue)
+	}
+}
+
+// drain sends the queued deliveries one at a time until the queue is empty
+func (wd *webhookDispatcher) drain(queue *webhookQueue) {
+	for {
+		wd.mutex.Lock()
+		if len(queue.deliveries) == 0 {
+			queue.draining = false
+			wd.mutex.Unlock()
+			return
+		}
+		q := queue.deliveries[0]
+		queue.deliveries = queue.deliveries[1:]
+		wd.mutex.Unlock()
+
+		wd.deliver(q.webhook, q.delivery, q.body)
+	}
+}
+
+// deliver posts body to the subscriber, retrying until it responds with a 2xx status or attempts run out
+func (wd *webhookDispatcher) deliver(h webhookConfig, d *webhookDelivery, body []byte) {
+	defer wd.pending.Done()
+
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := webhookInitialBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		status, err := wd.post(h.URL, d, signature, body)
+
+		wd.mutex.Lock()
+		d.Attempts = attempt
+		d.ResponseStatus = status
+		d.Error = ""
+		if err != nil {
+			d.Error = err.Error()
+		}
+		if err == nil || attempt == webhookMaxAttempts {
+			finished := time.Now().UTC()
+			d.FinishedAt = &finished
+			d.Status = webhookDeliverySucceeded
+			if err != nil {
+				d.Status = webhookDeliveryFailed
+			}
+		}
+		wd.mutex.Unlock()
+
+		if err == nil {
+			logger.WithFields(logrus.Fields{
+				"webhook":     h.Name,
+				"event":       d.Event,
+				"delivery_id": d.ID,
+			}).Debug("Delivered webhook")
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"webhook":            h.Name,
+			"event":              d.Event,
+			"delivery_id":        d.ID,
+			"attempt":            attempt,
+			"attempts_remaining": webhookMaxAttempts - attempt,
+			"error":              err,
+		}).Warn("Failed to deliver webhook")
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (wd *webhookDispatcher) post(target string, d *webhookDelivery, signature string, body []byte) (int, error) {
+	request, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "container-factory/"+serverVersion)
+	request.Header.Set("X-Container-Factory-Event", d.Event)
+	request.Header.Set("X-Container-Factory-Delivery", d.ID)
+	request.Header.Set(webhookSignatureHeader, signature)
+
+	response, err := wd.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, errors.New("Unexpected response status " + strconv.Itoa(response.StatusCode))
+	}
+	return response.StatusCode, nil
+}
+
+// list returns copies of the retained deliveries, newest first, optionally limited to one job
+func (wd *webhookDispatcher) list(jobID string) []webhookDelivery {
+	wd.mutex.RLock()
+	defer wd.mutex.RUnlock()
+	l := []webhookDelivery{}
+	for i := len(wd.deliveries) - 1; i >= 0; i-- {
+		if jobID == "" || wd.deliveries[i].JobID == jobID {
+			l = append(l, *wd.deliveries[i])
+		}
+	}
+	return l
+}
+
+// wait blocks until pending deliveries finish or timeout passes
+func (wd *webhookDispatcher) wait(timeout time.Duration) {
+	finished := make(chan struct{})
+	go func() {
+		wd.pending.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		logger.Warn("Abandoning undelivered webhooks")
+	}
+}
+
+func renderWebhookDeliveriesV2(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"deliveries": webhooks.list(c.Query("job_id")),
+	})
+}
@@ -0,0 +1,56 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWebhookDeliveriesKeepEventOrder checks that a retried event is received before the events notified after it
+func TestWebhookDeliveriesKeepEventOrder(t *testing.T) {
+	var mutex sync.Mutex
+	received := []webhookPayload{}
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, payload)
+		// Only the first attempt fails, so job.started is retried after job.finished was notified
+		if len(received) == 1 {
+			w.WriteHeader(500)
+		}
+	}))
+	defer subscriber.Close()
+
+	wd := &webhookDispatcher{client: subscriber.Client()}
+	wd.configure([]webhookConfig{{Name: "orchestrator", URL: subscriber.URL, Secret: "secret"}})
+	j := job{ID: "job-1", Parameters: map[string]string{"tag": "v1"}}
+	wd.notify(webhookEventJobStarted, j, nil)
+	wd.notify(webhookEventJobFinished, j, nil)
+	wd.wait(webhookInitialBackoff + 5*time.Second)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	events := []string{}
+	for _, p := range received {
+		events = append(events, p.Event)
+	}
+	want := []string{webhookEventJobStarted, webhookEventJobStarted, webhookEventJobFinished}
+	if len(events) != len(want) || events[0] != want[0] || events[1] != want[1] || events[2] != want[2] {
+		t.Fatalf("Received events %v, want %v", events, want)
+	}
+	if received[1].Sequence >= received[2].Sequence || received[0].Sequence != received[1].Sequence {
+		t.Errorf("Sequences are %d, %d, %d; want the retry to keep its sequence and job.finished to follow it", received[0].Sequence, received[1].Sequence, received[2].Sequence)
+	}
+
+	deliveries := wd.list("job-1")
+	if len(deliveries) != 2 || deliveries[0].Status != webhookDeliverySucceeded || deliveries[1].Status != webhookDeliverySucceeded || deliveries[1].Attempts != 2 {
+		t.Errorf("Deliveries are %+v", deliveries)
+	}
+}
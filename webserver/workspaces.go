@@ -0,0 +1,446 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/container-factory/workspace"
+)
+
+const (
+	errorCodeWorkspaceNotFound = "workspace_not_found"
+
+	// Key used to store the workspace of a request on the gin context
+	workspaceContextKey = "workspace"
+)
+
+const (
+	// Longest a fetch of a git workspace may take before the request waiting on it fails
+	gitFetchTimeout = 2 * time.Minute
+	// Interval at which git workspaces are fetched to follow the default ref between requests
+	gitRefreshInterval = time.Minute
+)
+
+// workspaceConfig describes a named workspace in the server config file
+type workspaceConfig struct {
+	Name string `json:"name"`
+	// Holds the build assets, or the clone of the repository when git is set
+	BaseDirectory    string              `json:"base_directory"`
+	Git              *gitWorkspaceConfig `json:"git"`
+	RegistryBasePath string              `json:"registry_base_path"`
+	// Tag used when a build request does not give one; branch_tags are checked first for git workspaces
+	DefaultTag string          `json:"default_tag"`
+	BranchTags []branchTagRule `json:"branch_tags"`
+	// Scopes granted to each caller in this workspace; callers keep their token scopes when empty
+	Permissions map[string][]string `json:"permissions"`
+}
+
+// serverWorkspace is a set of build assets and the registry its images are pushed to
+// Each workspace has its own inventory; the default workspace also backs the dockerbuild default inventory
+type serverWorkspace struct {
+	config     workspaceConfig
+	isDefault  bool
+	repository *workspace.Repository
+
+	// Worktree of the default ref backing the inventory of git workspaces
+	checkoutMutex  sync.Mutex
+	checkoutCommit string
+	checkoutPath   string
+
+	// Serializes fetches so requests arriving together share one fetch
+	fetchMutex sync.Mutex
+	// When the last successful fetch started
+	lastFetch time.Time
+	// Asks the background refresh to check out the default ref again; stop ends it
+	refresh chan struct{}
+	stop    chan struct{}
+
+	inventoryMutex sync.RWMutex
+	inventory      *dockerbuild.Inventory
+	// Serializes reloads so an older inventory never replaces a newer one
+	reloadMutex sync.Mutex
+}
+
+// Set up by Serve; named workspaces are served under /api/v1/workspaces/:workspace
+var defaultWorkspace *serverWorkspace
+var namedWorkspaces = map[string]*serverWorkspace{}
+
+func validateWorkspaces(configs []workspaceConfig) error {
+	names := map[string]bool{}
+	for i, w := range configs {
+		if w.Name == "" {
+			return errors.New("Workspace name is required")
+		}
+		if names[w.Name] {
+			return errors.New("Duplicate workspace name: " + w.Name)
+		}
+		names[w.Name] = true
+
+		if w.BaseDirectory == "" {
+			return errors.New("Base directory is required for workspace: " + w.Name)
+		}
+		if err := validateGitWorkspace(configs[i].Git); err != nil {
+			return errors.New(err.Error() + " for workspace: " + w.Name)
+		}
+		if w.RegistryBasePath == "" {
+			return errors.New("Registry base path is required for workspace: " + w.Name)
+		}
+		if w.DefaultTag != "" && !dockerTagRegex.MatchString(w.DefaultTag) {
+			return errors.New("Invalid default tag for workspace: " + w.Name)
+		}
+		if err := validateBranchTags(w.BranchTags); err != nil {
+			return errors.New(err.Error() + " for workspace: " + w.Name)
+		}
+		for caller, scopes := range w.Permissions {
+			for _, s := range scopes {
+				if !isKnownScope(s) {
+					return errors.New("Unknown scope " + s + " for " + caller + " in workspace: " + w.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// openWorkspace loads the inventory of a workspace, cloning its repository into the base directory for git workspaces
+func openWorkspace(config workspaceConfig, isDefault bool) (*serverWorkspace, error) {
+	ws := &serverWorkspace{
+		config:    config,
+		isDefault: isDefault,
+		refresh:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	if config.BaseDirectory == "" {
+		return nil, errors.New("Docker base directory must be specified")
+	}
+	if config.Git == nil {
+		inventory, err := dockerbuild.LoadInventory(config.BaseDirectory)
+		if err != nil {
+			return nil, err
+		}
+		ws.setInventory(inventory)
+		return ws, nil
+	}
+
+	workspace.SetLogger(logger)
+	logger.WithFields(logrus.Fields{
+		"workspace":   config.Name,
+		"git_url":     config.Git.URL,
+		"default_ref": config.Git.DefaultRef,
+		"directory":   config.BaseDirectory,
+	}).Info("Building from git workspace")
+	var err error
+	if ws.repository, err = workspace.Open(context.Background(), config.Git.URL, config.BaseDirectory); err != nil {
+		return nil, err
+	}
+	return ws, ws.refreshDefaultCheckout(context.Background())
+}
+
+// startRefreshing fetches a git workspace periodically and checks out its default ref again when it moved
+// Requests only nudge the refresh, so they never wait for the inventory to load
+func (ws *serverWorkspace) startRefreshing() {
+	if ws.repository == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(gitRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ws.stop:
+				return
+			case <-ticker.C:
+				if err := ws.fetch(context.Background()); err != nil {
+					logger.WithFields(logrus.Fields{
+						"workspace": ws.config.Name,
+						"error":     err,
+					}).Warn("Failed to fetch git workspace")
+					continue
+				}
+			case <-ws.refresh:
+			}
+			if err := ws.refreshDefaultCheckout(context.Background()); err != nil {
+				logger.WithFields(logrus.Fields{
+					"workspace": ws.config.Name,
+					"ref":       ws.config.Git.DefaultRef,
+					"error":     err,
+				}).Error("Failed to update the workspace inventory")
+			}
+		}
+	}()
+}
+
+// stopRefreshing ends the background refresh started by startRefreshing
+func (ws *serverWorkspace) stopRefreshing() {
+	select {
+	case <-ws.stop:
+	default:
+		close(ws.stop)
+	}
+}
+
+// requestRefresh asks the background refresh to check out the default ref again without waiting for it
+func (ws *serverWorkspace) requestRefresh() {
+	select {
+	case ws.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// fetch updates the repository of a git workspace unless a fetch started since fetch was called
+// Callers waiting while a fetch runs share the next one; a fetch is cancelled after gitFetchTimeout
+func (ws *serverWorkspace) fetch(ctx context.Context) error {
+	requested := time.Now()
+	ws.fetchMutex.Lock()
+	defer ws.fetchMutex.Unlock()
+	if ws.lastFetch.After(requested) {
+		return nil
+	}
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, gitFetchTimeout)
+	defer cancel()
+	if err := ws.repository.Fetch(ctx); err != nil {
+		return err
+	}
+	ws.lastFetch = started
+	return nil
+}
+
+// resolveCommit returns the commit to build for ref, fetching the repository first unless ref is a commit already in it
+func (ws *serverWorkspace) resolveCommit(ctx context.Context, ref string) (string, error) {
+	// Commits never change, so one already fetched needs no fetch
+	if commit, err := ws.repository.ResolveCommit(ctx, ref); err == nil && commit == ref {
+		return commit, nil
+	}
+	if err := ws.fetch(ctx); err != nil {
+		return "", err
+	}
+	ws.requestRefresh()
+	return ws.repository.ResolveCommit(ctx, ref)
+}
+
+// name identifies the workspace in job parameters; the default workspace has no name
+func (ws *serverWorkspace) name() string {
+	if ws.isDefault {
+		return ""
+	}
+	return ws.config.Name
+}
+
+func (ws *serverWorkspace) getInventory() *dockerbuild.Inventory {
+	ws.inventoryMutex.RLock()
+	defer ws.inventoryMutex.RUnlock()
+	return ws.inventory
+}
+
+func (ws *serverWorkspace) setInventory(inventory *dockerbuild.Inventory) {
+	ws.inventoryMutex.Lock()
+	ws.inventory = inventory
+	ws.inventoryMutex.Unlock()
+	if ws.isDefault {
+		dockerbuild.SetDefaultInventory(inventory)
+	}
+}
+
+// prepareBuildSource returns the inventory to build ref from
+// For git workspaces the repository is fetched if needed and ref is checked out into a worktree for the job; the default ref is used when ref is empty
+func (ws *serverWorkspace) prepareBuildSource(ctx context.Context, ref string) (buildSource, error) {
+	source := buildSource{
+		workspace:        ws.name(),
+		baseDirectory:    ws.config.BaseDirectory,
+		registryBasePath: ws.config.RegistryBasePath,
+		release:          func() {},
+	}
+	if ws.repository == nil {
+		if ref != "" {
+			return buildSource{}, errRefRequiresGitWorkspace
+		}
+		if source.inventory = ws.getInventory(); source.inventory == nil {
+			return buildSource{}, dockerbuild.ErrInventoryNotLoaded
+		}
+		return source, nil
+	}
+
+	if ref == "" {
+		ref = ws.config.Git.DefaultRef
+	}
+	commit, err := ws.resolveCommit(ctx, ref)
+	if err != nil {
+		return buildSource{}, err
+	}
+	worktree, err := ws.repository.AddWorktree(ctx, newJobID(), commit)
+	if err != nil {
+		return buildSource{}, err
+	}
+	source.release = func() { ws.removeWorktree(worktree) }
+	if source.inventory, err = dockerbuild.LoadInventory(filepath.Join(worktree, ws.config.Git.PathPrefix)); err != nil {
+		source.release()
+		return buildSource{}, err
+	}
+	source.ref = ref
+	source.commit = commit
+	return source, nil
+}
+
+// refreshDefaultCheckout checks out the default ref again if it moved and makes it the workspace inventory
+func (ws *serverWorkspace) refreshDefaultCheckout(ctx context.Context) error {
+	ws.checkoutMutex.Lock()
+	defer ws.checkoutMutex.Unlock()
+
+	commit, err := ws.repository.ResolveCommit(ctx, ws.config.Git.DefaultRef)
+	if err != nil {
+		return err
+	}
+	if commit == ws.checkoutCommit {
+		return nil
+	}
+
+	worktree, err := ws.repository.AddWorktree(ctx, "default-"+commit, commit)
+	if err != nil {
+		return err
+	}
+	inventory, err := dockerbuild.LoadInventory(filepath.Join(worktree, ws.config.Git.PathPrefix))
+	if err != nil {
+		ws.removeWorktree(worktree)
+		return err
+	}
+	ws.setInventory(inventory)
+
+	if ws.checkoutPath != "" {
+		ws.removeWorktree(ws.checkoutPath)
+	}
+	ws.checkoutCommit = commit
+	ws.checkoutPath = worktree
+	logger.WithFields(logrus.Fields{
+		"workspace": ws.config.Name,
+		"ref":       ws.config.Git.DefaultRef,
+		"commit":    commit,
+	}).Info("Loaded inventory from git workspace")
+	return nil
+}
+
+// removeWorktree removes a worktree of the workspace, logging failures since the worktree is no longer used either way
+func (ws *serverWorkspace) removeWorktree(path string) {
+	if err := ws.repository.RemoveWorktree(path); err != nil {
+		logger.WithFields(logrus.Fields{
+			"workspace": ws.config.Name,
+			"path":      path,
+			"error":     err,
+		}).Warn("Failed to remove worktree")
+	}
+}
+
+// getDefaultTag returns the tag to build when a request does not give one
+// Returns an empty string if the workspace has no rule for ref
+func (ws *serverWorkspace) getDefaultTag(ref string) string {
+	if ws.config.Git != nil {
+		if ref == "" {
+			ref = ws.config.Git.DefaultRef
+		}
+		if tag, matched := getBranchTag(ws.config.BranchTags, ref); matched {
+			return tag
+		}
+	}
+	return ws.config.DefaultTag
+}
+
+func validateBranchTags(rules []branchTagRule) error {
+	for _, r := range rules {
+		if _, err := path.Match(r.Branch, ""); err != nil || r.Branch == "" {
+			return errors.New("Invalid branch pattern: " + r.Branch)
+		}
+		if r.Tag == "" {
+			return errors.New("Tag is required for branch: " + r.Branch)
+		}
+	}
+	return nil
+}
+
+// getWorkspace returns the workspace of the request, set by requireWorkspaceScope
+func getWorkspace(c *gin.Context) *serverWorkspace {
+	if ws, exists := c.Get(workspaceContextKey); exists {
+		return ws.(*serverWorkspace)
+	}
+	return defaultWorkspace
+}
+
+// requireWorkspaceScope builds middleware rejecting callers without the given scope in the workspace named in the path
+// Workspaces with permissions grant scopes per caller instead of using the scopes of the caller's token
+func requireWorkspaceScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller, scopes, authenticated := authenticateCaller(c)
+		if !authenticated {
+			return
+		}
+		c.Set(callerContextKey, caller)
+		ws, exists := namedWorkspaces[c.Param("workspace")]
+		if !exists {
+			renderAPIError(c, 404, errorCodeWorkspaceNotFound, "Workspace does not exist: "+c.Param("workspace"))
+			return
+		}
+		scopes = ws.getCallerScopes(caller, scopes)
+		if !hasScope(scopes, scope) {
+			logger.WithFields(logrus.Fields{
+				"caller":    caller,
+				"scope":     scope,
+				"workspace": ws.config.Name,
+				"path":      c.Request.URL.Path,
+			}).Warn("Rejected request with insufficient scope")
+			renderAPIError(c, 403, errorCodeForbidden, "Caller is missing the required scope in workspace "+ws.config.Name+": "+scope)
+			return
+		}
+
+		c.Set(callerScopesContextKey, scopes)
+		c.Set(workspaceContextKey, ws)
+	}
+}
+
+// getCallerScopes returns the scopes of a caller in the workspace, given the scopes of its token
+func (ws *serverWorkspace) getCallerScopes(caller string, tokenScopes []string) []string {
+	if ws.config.Permissions != nil {
+		return ws.config.Permissions[caller]
+	}
+	return tokenScopes
+}
+
+// canAccessJob reports whether the caller of a request has scope in the workspace the job builds from
+// Jobs of the default workspace are covered by the scope check of the route
+func canAccessJob(c *gin.Context, j job, scope string) bool {
+	name := j.Parameters["workspace"]
+	if name == "" {
+		return true
+	}
+	ws, exists := namedWorkspaces[name]
+	return exists && hasScope(ws.getCallerScopes(getCaller(c), getCallerScopes(c)), scope)
+}
+
+func addWorkspaceRoutes() {
+	ginEngine.GET("/api/v1/workspaces", requireScope(scopeRead), func(c *gin.Context) { renderWorkspacesList(c) })
+
+	w := ginEngine.Group("/api/v1/workspaces/:workspace")
+	w.GET("/base-images/build", audit("base-images.build"), requireWorkspaceScope(scopeBuildBase), func(c *gin.Context) { buildBaseImages(c) })
+	w.GET("/base-images/list", requireWorkspaceScope(scopeRead), func(c *gin.Context) { renderBaseImagesList(c) })
+	w.GET("/deployments/build", audit("deployment.build"), requireWorkspaceScope(scopeBuildDeployment), func(c *gin.Context) { buildDeployment(c) })
+	w.GET("/deployments/list", requireWorkspaceScope(scopeRead), func(c *gin.Context) { renderDeploymentsList(c) })
+	w.POST("/inventory/reload", audit("inventory.reload"), requireWorkspaceScope(scopeBuildBase), func(c *gin.Context) { reloadInventory(c) })
+}
+
+func renderWorkspacesList(c *gin.Context) {
+	names := []string{}
+	for name := range namedWorkspaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c.JSON(200, gin.H{
+		"workspaces": names,
+	})
+}
@@ -0,0 +1,179 @@
+package webserver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mikenewswanger.com/container-factory/dockerbuild"
+	"go.mikenewswanger.com/container-factory/workspace"
+)
+
+// testRepository is a git repository pushed to a local bare repository, which git workspaces clone from
+type testRepository struct {
+	t         *testing.T
+	directory string
+	url       string
+}
+
+func newTestRepository(t *testing.T) *testRepository {
+	r := &testRepository{
+		t:         t,
+		directory: filepath.Join(t.TempDir(), "source"),
+		url:       filepath.Join(t.TempDir(), "origin.git"),
+	}
+	r.git("", "init", "--quiet", "--bare", r.url)
+	r.git("", "init", "--quiet", r.directory)
+	r.git(r.directory, "remote", "add", "origin", r.url)
+	return r
+}
+
+// commit writes files relative to the repository root, commits them and pushes the commit to branch main
+func (r *testRepository) commit(files map[string]string) string {
+	for name, contents := range files {
+		path := filepath.Join(r.directory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	r.git(r.directory, "add", "-A")
+	r.git(r.directory, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "Update")
+	r.git(r.directory, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+	return strings.TrimSpace(r.git(r.directory, "rev-parse", "HEAD"))
+}
+
+func (r *testRepository) git(directory string, arguments ...string) string {
+	cmd := exec.Command("git", arguments...)
+	cmd.Dir = directory
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v: %s", strings.Join(arguments, " "), err, output)
+	}
+	return string(output)
+}
+
+func openTestGitWorkspace(t *testing.T, url string) *serverWorkspace {
+	config := workspaceConfig{
+		Name:          "test",
+		BaseDirectory: filepath.Join(t.TempDir(), "workspace"),
+		Git:           &gitWorkspaceConfig{URL: url},
+	}
+	applyGitWorkspaceDefaults(config.Git)
+	config.Git.DefaultRef = "main"
+	ws, err := openWorkspace(config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ws.stopRefreshing)
+	return ws
+}
+
+func getBaseImageNames(inventory *dockerbuild.Inventory) string {
+	names := []string{}
+	images, _ := inventory.GetBaseImageHeirarchy()
+	for _, image := range images {
+		names = append(names, image.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestPrepareBuildSourceFromGitWorkspace(t *testing.T) {
+	repository := newTestRepository(t)
+	first := repository.commit(map[string]string{"dockerfiles/base": "FROM alpine:3\n", "deployments/.keep": ""})
+	ws := openTestGitWorkspace(t, repository.url)
+	second := repository.commit(map[string]string{"dockerfiles/tools": "FROM base\n"})
+
+	tests := []struct {
+		ref        string
+		wantCommit string
+		wantImages string
+	}{
+		{"", second, "base,tools"},
+		{"main", second, "base,tools"},
+		{first, first, "base"},
+		{second, second, "base,tools"},
+	}
+	for _, test := range tests {
+		source, err := ws.prepareBuildSource(context.Background(), test.ref)
+		if err != nil {
+			t.Fatalf("prepareBuildSource(%q): %v", test.ref, err)
+		}
+		if source.commit != test.wantCommit {
+			t.Errorf("prepareBuildSource(%q) commit = %s, want %s", test.ref, source.commit, test.wantCommit)
+		}
+		if got := getBaseImageNames(source.inventory); got != test.wantImages {
+			t.Errorf("prepareBuildSource(%q) images = %s, want %s", test.ref, got, test.wantImages)
+		}
+		worktree := source.inventory.BaseDirectory()
+		source.release()
+		if _, err := os.Stat(worktree); !os.IsNotExist(err) {
+			t.Errorf("prepareBuildSource(%q) worktree %s still exists after release", test.ref, worktree)
+		}
+	}
+
+	if _, err := ws.prepareBuildSource(context.Background(), "no-such-branch"); err != workspace.ErrUnknownRef {
+		t.Errorf("prepareBuildSource(no-such-branch) error = %v, want %v", err, workspace.ErrUnknownRef)
+	}
+}
+
+func TestGitWorkspaceRefreshesDefaultCheckoutInBackground(t *testing.T) {
+	repository := newTestRepository(t)
+	repository.commit(map[string]string{"dockerfiles/base": "FROM alpine:3\n", "deployments/.keep": ""})
+	ws := openTestGitWorkspace(t, repository.url)
+	ws.startRefreshing()
+	head := repository.commit(map[string]string{"dockerfiles/tools": "FROM base\n"})
+
+	// Building the default ref fetches the new commit and leaves the inventory update to the background refresh
+	source, err := ws.prepareBuildSource(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.release()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		ws.checkoutMutex.Lock()
+		commit := ws.checkoutCommit
+		ws.checkoutMutex.Unlock()
+		if commit == head {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("default checkout is at %s, want %s", commit, head)
+		}
+	}
+	if got := getBaseImageNames(ws.getInventory()); got != "base,tools" {
+		t.Errorf("inventory images = %s, want base,tools", got)
+	}
+}
+
+func TestApplyGitWorkspaceDefaults(t *testing.T) {
+	tests := []struct {
+		config gitWorkspaceConfig
+		want   string
+	}{
+		{gitWorkspaceConfig{URL: "repo"}, "master"},
+		{gitWorkspaceConfig{URL: "repo", DefaultRef: "main"}, "main"},
+	}
+	for _, test := range tests {
+		config := test.config
+		if err := validateGitWorkspace(&config); err != nil {
+			t.Fatal(err)
+		}
+		if config != test.config {
+			t.Errorf("validateGitWorkspace changed %+v to %+v", test.config, config)
+		}
+		applyGitWorkspaceDefaults(&config)
+		if config.DefaultRef != test.want {
+			t.Errorf("applyGitWorkspaceDefaults(%+v) default ref = %s, want %s", test.config, config.DefaultRef, test.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"go.mikenewswanger.com/utilities/filesystem"
+)
+
+// ErrUnknownRef is returned when a ref does not resolve to a commit in the repository
+var ErrUnknownRef = errors.New("Ref does not exist")
+
+var logger = logrus.New()
+
+// SetLogger allows overriding the default logger
+func SetLogger(l *logrus.Logger) {
+	logger = l
+}
+
+// Repository is a bare clone of a git repository that builds check out isolated worktrees from
+type Repository struct {
+	url       string
+	directory string
+	// Serializes operations that update refs or worktree metadata in the clone
+	mutex sync.Mutex
+}
+
+// Open clones url into directory, or reuses an existing clone of it
+func Open(ctx context.Context, url string, directory string) (*Repository, error) {
+	directory, err := filesystem.BuildAbsolutePathFromHome(directory)
+	if err != nil {
+		return nil, err
+	}
+	if directory, err = filepath.Abs(directory); err != nil {
+		return nil, err
+	}
+	r := &Repository{
+		url:       url,
+		directory: directory,
+	}
+
+	if _, err := os.Stat(r.gitDirectory()); os.IsNotExist(err) {
+		logger.WithFields(logrus.Fields{
+			"git_url":   url,
+			"directory": r.gitDirectory(),
+		}).Info("Cloning repository")
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return nil, err
+		}
+		if _, err := runGit(ctx, "", "clone", "--bare", "--quiet", url, r.gitDirectory()); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if _, err := r.git(ctx, "remote", "set-url", "origin", url); err != nil {
+		return nil, err
+	}
+
+	// Worktrees left behind by a previous run are no longer in use
+	os.RemoveAll(r.worktreesDirectory())
+	r.git(ctx, "worktree", "prune")
+	return r, r.Fetch(ctx)
+}
+
+// Fetch updates every branch and tag from the remote
+func (r *Repository) Fetch(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	logger.WithFields(logrus.Fields{
+		"git_url": r.url,
+	}).Debug("Fetching repository")
+	_, err := r.git(ctx, "fetch", "--quiet", "--prune", "--force", "origin", "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	return err
+}
+
+// ResolveCommit returns the commit a branch, tag or commit hash refers to
+func (r *Repository) ResolveCommit(ctx context.Context, ref string) (string, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return "", ErrUnknownRef
+	}
+	commit, err := r.git(ctx, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", ErrUnknownRef
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+// AddWorktree checks out commit into a new worktree named name and returns its path
+// The worktree must be removed with RemoveWorktree once it is no longer needed
+func (r *Repository) AddWorktree(ctx context.Context, name string, commit string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	path := filepath.Join(r.worktreesDirectory(), name)
+	if err := os.MkdirAll(r.worktreesDirectory(), 0755); err != nil {
+		return "", err
+	}
+	if _, err := r.git(ctx, "worktree", "add", "--quiet", "--detach", "--force", path, commit); err != nil {
+		return "", err
+	}
+	logger.WithFields(logrus.Fields{
+		"path":   path,
+		"commit": commit,
+	}).Debug("Added worktree")
+	return path, nil
+}
+
+// RemoveWorktree deletes a worktree created by AddWorktree
+func (r *Repository) RemoveWorktree(path string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, err := r.git(context.Background(), "worktree", "remove", "--force", path); err != nil {
+		os.RemoveAll(path)
+		_, err = r.git(context.Background(), "worktree", "prune")
+		return err
+	}
+	logger.WithFields(logrus.Fields{
+		"path": path,
+	}).Debug("Removed worktree")
+	return nil
+}
+
+func (r *Repository) gitDirectory() string {
+	return filepath.Join(r.directory, "repository.git")
+}
+
+func (r *Repository) worktreesDirectory() string {
+	return filepath.Join(r.directory, "worktrees")
+}
+
+func (r *Repository) git(ctx context.Context, arguments ...string) (string, error) {
+	return runGit(ctx, r.gitDirectory(), arguments...)
+}
+
+// runGit runs a git command and returns its output; errors include the output of git on stderr
+func runGit(ctx context.Context, gitDirectory string, arguments ...string) (string, error) {
+	command := arguments[0]
+	if gitDirectory != "" {
+		arguments = append([]string{"--git-dir", gitDirectory}, arguments...)
+	}
+	logger.WithFields(logrus.Fields{
+		"git_dir": gitDirectory,
+	}).Debugf("Command: git %s", strings.Join(arguments, " "))
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", arguments...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Never prompt for credentials; the server has no terminal to answer them
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", errors.New("git " + command + " failed: " + message)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}